@@ -0,0 +1,308 @@
+package artifact
+
+import (
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Artifact
+// @dev A compiled contract found in a local Foundry/Hardhat/Truffle project
+type Artifact struct {
+	Name             string          // contract name, or the deployment name for Hardhat-deploy
+	Path             string          // the artifact file
+	ABI              json.RawMessage // the whole ABI of the contract
+	DeployedBytecode []byte          // runtime bytecode
+	Deployments      []Deployment    // where the contract is deployed
+}
+
+// Deployment
+// @dev An address the artifact is deployed at
+type Deployment struct {
+	ChainID int
+	Address common.Address
+}
+
+// foundryArtifact
+// @dev out/<Source>.sol/<Contract>.json
+type foundryArtifact struct {
+	ABI              json.RawMessage `json:"abi"`
+	DeployedBytecode struct {
+		Object string `json:"object"`
+	} `json:"deployedBytecode"`
+}
+
+// foundryBroadcast
+// @dev broadcast/<Script>.s.sol/<chainID>/run-latest.json
+type foundryBroadcast struct {
+	Transactions []struct {
+		TransactionType string `json:"transactionType"`
+		ContractName    string `json:"contractName"`
+		ContractAddress string `json:"contractAddress"`
+	} `json:"transactions"`
+}
+
+// hardhatArtifact
+// @dev artifacts/**/<Contract>.json, build/contracts/<Contract>.json(Truffle) and deployments/<network>/<Name>.json(Hardhat-deploy)
+type hardhatArtifact struct {
+	ContractName     string          `json:"contractName"`
+	Address          string          `json:"address"` // Hardhat-deploy only
+	ABI              json.RawMessage `json:"abi"`
+	DeployedBytecode string          `json:"deployedBytecode"`
+	Networks         map[string]struct {
+		Address string `json:"address"`
+	} `json:"networks"` // Truffle only, keyed by network ID
+}
+
+var log = logrus.New()
+
+// Load
+// @dev Walk a project directory and collect the artifacts of Foundry(out/), Hardhat(artifacts/),
+// Hardhat-deploy(deployments/) and Truffle(build/contracts/)
+// Notice: the deployments in Foundry broadcast logs are bound to the artifacts by contract name
+func Load(dir string) ([]*Artifact, error) {
+	var artifacts []*Artifact
+
+	foundry, err := loadFoundry(dir)
+	if err != nil {
+		return nil, err
+	}
+	artifacts = append(artifacts, foundry...)
+
+	hardhat, err := loadHardhat(dir)
+	if err != nil {
+		return nil, err
+	}
+	artifacts = append(artifacts, hardhat...)
+
+	hardhatDeploy, err := loadHardhatDeploy(dir)
+	if err != nil {
+		return nil, err
+	}
+	artifacts = append(artifacts, hardhatDeploy...)
+
+	truffle, err := loadTruffle(dir)
+	if err != nil {
+		return nil, err
+	}
+	artifacts = append(artifacts, truffle...)
+
+	return artifacts, nil
+}
+
+// @dev Foundry: out/**/*.json, and the deployments from broadcast/**/run-latest.json
+func loadFoundry(dir string) ([]*Artifact, error) {
+	byName := make(map[string]*Artifact)
+	var artifacts []*Artifact
+
+	err := walkJSON(filepath.Join(dir, "out"), func(path string) error {
+		if strings.Contains(path, string(filepath.Separator)+"build-info"+string(filepath.Separator)) {
+			return nil
+		}
+		var data foundryArtifact
+		if err := readJSON(path, &data); err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		artifact := newArtifact(name, path, data.ABI, data.DeployedBytecode.Object)
+		if artifact == nil {
+			return nil
+		}
+		artifacts = append(artifacts, artifact)
+		byName[name] = artifact
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = walkJSON(filepath.Join(dir, "broadcast"), func(path string) error {
+		if filepath.Base(path) != "run-latest.json" {
+			return nil
+		}
+		chainID, err := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+		if err != nil {
+			log.Warning("Not found the chainID of the broadcast log:", path)
+			return nil
+		}
+		var data foundryBroadcast
+		if err := readJSON(path, &data); err != nil {
+			return err
+		}
+		for _, tx := range data.Transactions {
+			if tx.TransactionType != "CREATE" && tx.TransactionType != "CREATE2" {
+				continue
+			}
+			artifact, found := byName[tx.ContractName]
+			if !found || !common.IsHexAddress(tx.ContractAddress) {
+				log.Warning("Not found the artifact of the broadcast contract:", tx.ContractName, " path:", path)
+				continue
+			}
+			artifact.addDeployment(chainID, common.HexToAddress(tx.ContractAddress))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return artifacts, nil
+}
+
+// @dev Hardhat: artifacts/**/*.json, without the debug files and build-info
+func loadHardhat(dir string) ([]*Artifact, error) {
+	var artifacts []*Artifact
+	err := walkJSON(filepath.Join(dir, "artifacts"), func(path string) error {
+		if strings.HasSuffix(path, ".dbg.json") ||
+			strings.Contains(path, string(filepath.Separator)+"build-info"+string(filepath.Separator)) {
+			return nil
+		}
+		var data hardhatArtifact
+		if err := readJSON(path, &data); err != nil {
+			return err
+		}
+		if artifact := newArtifact(data.ContractName, path, data.ABI, data.DeployedBytecode); artifact != nil {
+			artifacts = append(artifacts, artifact)
+		}
+		return nil
+	})
+	return artifacts, err
+}
+
+// @dev Hardhat-deploy: deployments/<network>/<Name>.json, the chainID is in deployments/<network>/.chainId
+func loadHardhatDeploy(dir string) ([]*Artifact, error) {
+	var artifacts []*Artifact
+	err := walkJSON(filepath.Join(dir, "deployments"), func(path string) error {
+		network := filepath.Dir(path)
+		content, err := os.ReadFile(filepath.Join(network, ".chainId"))
+		if err != nil { // solcInputs/ and the networks without .chainId
+			return nil
+		}
+		chainID, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			log.Warning("Invalid chainID in ", filepath.Join(network, ".chainId"))
+			return nil
+		}
+
+		var data hardhatArtifact
+		if err := readJSON(path, &data); err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		artifact := newArtifact(name, path, data.ABI, data.DeployedBytecode)
+		if artifact == nil {
+			return nil
+		}
+		if common.IsHexAddress(data.Address) {
+			artifact.addDeployment(chainID, common.HexToAddress(data.Address))
+		}
+		artifacts = append(artifacts, artifact)
+		return nil
+	})
+	return artifacts, err
+}
+
+// @dev Truffle: build/contracts/*.json, the deployments are in the networks field
+// Notice: Truffle keys the networks by network ID, which is the chainID for the public networks
+func loadTruffle(dir string) ([]*Artifact, error) {
+	var artifacts []*Artifact
+	err := walkJSON(filepath.Join(dir, "build", "contracts"), func(path string) error {
+		var data hardhatArtifact
+		if err := readJSON(path, &data); err != nil {
+			return err
+		}
+		artifact := newArtifact(data.ContractName, path, data.ABI, data.DeployedBytecode)
+		if artifact == nil {
+			return nil
+		}
+
+		networkIDs := make([]string, 0, len(data.Networks))
+		for networkID := range data.Networks {
+			networkIDs = append(networkIDs, networkID)
+		}
+		sort.Strings(networkIDs)
+		for _, networkID := range networkIDs {
+			chainID, err := strconv.Atoi(networkID)
+			address := data.Networks[networkID].Address
+			if err != nil || !common.IsHexAddress(address) {
+				continue
+			}
+			artifact.addDeployment(chainID, common.HexToAddress(address))
+		}
+		artifacts = append(artifacts, artifact)
+		return nil
+	})
+	return artifacts, err
+}
+
+// @dev Build an artifact, return nil if it can not be deployed(interfaces, abstract contracts) or has no ABI
+func newArtifact(name string, path string, contractABI json.RawMessage, deployedBytecode string) *Artifact {
+	if name == "" || len(contractABI) == 0 || string(contractABI) == "[]" {
+		return nil
+	}
+	bytecode, err := hexutil.Decode(deployedBytecode)
+	if err != nil {
+		// unlinked libraries leave placeholders like __$...$__ in the bytecode
+		if deployedBytecode != "" && deployedBytecode != "0x" {
+			log.Warning("Fail to decode the deployed bytecode, skip it. path:", path)
+		}
+		return nil
+	}
+	if len(bytecode) == 0 {
+		return nil
+	}
+	return &Artifact{
+		Name:             name,
+		Path:             path,
+		ABI:              contractABI,
+		DeployedBytecode: bytecode,
+	}
+}
+
+// @dev Add a deployment, ignore duplicates
+func (a *Artifact) addDeployment(chainID int, address common.Address) {
+	for _, deployment := range a.Deployments {
+		if deployment.ChainID == chainID && deployment.Address == address {
+			return
+		}
+	}
+	a.Deployments = append(a.Deployments, Deployment{ChainID: chainID, Address: address})
+}
+
+// @dev Call fn for every .json file under root, do nothing if root does not exist
+func walkJSON(root string, fn func(path string) error) error {
+	if _, err := os.Stat(root); err != nil {
+		return nil
+	}
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// @dev Read and unmarshal a JSON file
+func readJSON(path string, v interface{}) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Error("Fail to read the artifact:", path)
+		return errors.Wrap(err, "Read fail")
+	}
+	if err = json.Unmarshal(content, v); err != nil {
+		log.Error("Fail to parse the artifact:", path)
+		return errors.Wrap(err, "Parse fail: "+path)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package artifact
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Prepare some data that may be used
+var (
+	tokenABI     = `[{"inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"name":"transfer","outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable","type":"function"}]`
+	tokenAddress = common.HexToAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3")
+)
+
+// @dev Write a file under dir, create the parent directories
+func writeFile(t *testing.T, dir string, path string, content string) {
+	path = filepath.Join(dir, path)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
+
+func TestLoadFoundry(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "out/Token.sol/Token.json", `{"abi":`+tokenABI+`,"deployedBytecode":{"object":"0x6080604052"}}`)
+	writeFile(t, dir, "out/IToken.sol/IToken.json", `{"abi":`+tokenABI+`,"deployedBytecode":{"object":"0x"}}`) // interface
+	writeFile(t, dir, "out/build-info/1234.json", `{"id":"1234"}`)
+	writeFile(t, dir, "broadcast/Deploy.s.sol/31337/run-latest.json",
+		`{"transactions":[{"transactionType":"CREATE","contractName":"Token","contractAddress":"`+tokenAddress.Hex()+`"},{"transactionType":"CALL","contractName":"Token"}]}`)
+	writeFile(t, dir, "broadcast/Deploy.s.sol/31337/run-1700000000.json", `{"transactions":[]}`)
+
+	artifacts, err := Load(dir)
+	assert.NoError(t, err)
+	assert.Len(t, artifacts, 1)
+	assert.Equal(t, "Token", artifacts[0].Name)
+	assert.JSONEq(t, tokenABI, string(artifacts[0].ABI))
+	assert.Equal(t, []byte{0x60, 0x80, 0x60, 0x40, 0x52}, artifacts[0].DeployedBytecode)
+	assert.Equal(t, []Deployment{{ChainID: 31337, Address: tokenAddress}}, artifacts[0].Deployments)
+}
+
+func TestLoadHardhat(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "artifacts/contracts/Token.sol/Token.json",
+		`{"_format":"hh-sol-artifact-1","contractName":"Token","abi":`+tokenABI+`,"deployedBytecode":"0x6080604052"}`)
+	writeFile(t, dir, "artifacts/contracts/Token.sol/Token.dbg.json", `{"_format":"hh-sol-dbg-1"}`)
+	writeFile(t, dir, "deployments/sepolia/.chainId", "11155111\n")
+	writeFile(t, dir, "deployments/sepolia/Token_Proxy.json",
+		`{"address":"`+tokenAddress.Hex()+`","abi":`+tokenABI+`,"deployedBytecode":"0x6080604052"}`)
+	writeFile(t, dir, "deployments/sepolia/solcInputs/abcd.json", `{"language":"Solidity"}`)
+
+	artifacts, err := Load(dir)
+	assert.NoError(t, err)
+	assert.Len(t, artifacts, 2)
+
+	assert.Equal(t, "Token", artifacts[0].Name)
+	assert.Empty(t, artifacts[0].Deployments)
+
+	assert.Equal(t, "Token_Proxy", artifacts[1].Name)
+	assert.Equal(t, []Deployment{{ChainID: 11155111, Address: tokenAddress}}, artifacts[1].Deployments)
+}
+
+func TestLoadTruffle(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "build/contracts/Token.json",
+		`{"contractName":"Token","abi":`+tokenABI+`,"deployedBytecode":"0x6080604052","networks":{"5777":{"address":"`+tokenAddress.Hex()+`"},"1":{"address":"`+tokenAddress.Hex()+`"}}}`)
+	writeFile(t, dir, "build/contracts/Library.json",
+		`{"contractName":"Library","abi":`+tokenABI+`,"deployedBytecode":"0x73__$1234$__6080","networks":{}}`) // unlinked
+
+	artifacts, err := Load(dir)
+	assert.NoError(t, err)
+	assert.Len(t, artifacts, 1)
+	assert.Equal(t, []Deployment{{ChainID: 1, Address: tokenAddress}, {ChainID: 5777, Address: tokenAddress}}, artifacts[0].Deployments)
+}
+
+func TestLoadInvalidArtifact(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "out/Token.sol/Token.json", `{"abi":`)
+
+	_, err := Load(dir)
+	assert.Error(t, err)
+
+	// an empty project
+	artifacts, err := Load(t.TempDir())
+	assert.NoError(t, err)
+	assert.Empty(t, artifacts)
+}
@@ -2,11 +2,40 @@ package cache
 
 import (
 	"container/list"
-	"fmt"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
-	"math/big"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The kinds of the cache items, a part of Key
+const (
+	KindFunction    = iota // the functionABI of a selector
+	KindContract           // the whole contractABI
+	KindNegative           // no ABI for the address
+	KindDeployments        // the first blocks of the deployments of the address
+)
+
+// Key
+// @dev The structured key of a cache item: chainID + 20 bytes address + 4 bytes selector + the deployment
+// Notice: compared field by field rather than hashed, so two items never share a key
+type Key struct {
+	ChainID         int            `json:"chainID"`
+	ContractAddress common.Address `json:"contractAddress"`
+	Selector        [4]byte        `json:"selector"` // only for KindFunction
+	Kind            int            `json:"kind"`
+	FromBlock       int64          `json:"fromBlock,omitempty"` // the first block of the deployment, E.g. of a proxy upgrade. 0: since the creation
+}
+
+// The default size of ABICache
+const (
+	DefaultCapacity    = 1000
+	DefaultShards      = 16
+	DefaultMaxBytes    = 64 << 20         // 64 MiB of parsed ABIs
+	DefaultNegativeTTL = 10 * time.Minute // then the negative result is read from DB again
 )
 
 // CacheItem
@@ -17,23 +46,177 @@ type CacheItem struct {
 	Signature       string      // E.g. transfer(address,uint256) => we store 0xa9059cbb
 	FunctionABI     *abi.Method // the ABI of the Signature.
 	ContractABI     *abi.ABI    // The whole ABI of the contract
+	FromBlock       int64       // the first block of the deployment of the ABIs
+	Deployments     []int64     // the first blocks of the deployments in ascending order, only for KindDeployments
+	Negative        error       // why there is no ABI, only for the negative entries
+	RecheckAt       time.Time   // the negative result is invalid after it, only for the negative entries
+	ExpireAt        time.Time   // the item is removed after it, zero: never
+	Size            int64       // the approximate bytes, see ItemSize
+	key             Key
+	accessedAt      time.Time // set or found at, guarded by the lock of the shard
+	requests        uint64    // found since the previous snapshot, guarded by the lock of the shard
+}
+
+// SnapshotEntry
+// @dev A key of the hot set, see Snapshot
+type SnapshotEntry struct {
+	Key        Key       `json:"key"`
+	AccessedAt time.Time `json:"accessedAt"` // when it is found or set the last time
+	Requests   uint64    `json:"requests"`   // how many times it is found since the previous snapshot
 }
 
 // ABICache
 // @dev contain the cache strategy
+// Notice: safe for concurrent use. The keys are spread over shards, each shard is an LRU with its own lock,
+// so the least recently used item is evicted per shard rather than globally.
+// Both the number of items and their approximate bytes are bounded
 type ABICache struct {
+	shards      []*shard
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+	rejections  atomic.Uint64
+}
+
+// shard
+// @dev An LRU: the map finds the element, the list orders them by recency
+type shard struct {
+	mu       sync.Mutex
 	capacity int
-	cache    map[int64]*list.Element
+	maxBytes int64
+	bytes    int64
+	cache    map[Key]*list.Element
 	list     *list.List
 }
 
+// Stats
+// @dev The counters and the usage of an ABICache, E.g. for the dashboards
+type Stats struct {
+	Hits        uint64 `json:"hits"`        // Get/GetNegative found the item
+	Misses      uint64 `json:"misses"`      // Get/GetNegative did not find the item, or it expired
+	Evictions   uint64 `json:"evictions"`   // the items removed because a shard is full
+	Expirations uint64 `json:"expirations"` // the items removed because of the TTL
+	Rejections  uint64 `json:"rejections"`  // the items larger than the byte budget of a shard, not cached
+	Entries     int    `json:"entries"`     // the items in the cache now
+	Capacity    int    `json:"capacity"`    // the max number of items
+	Bytes       int64  `json:"bytes"`       // the approximate bytes of the items now
+	MaxBytes    int64  `json:"maxBytes"`    // the byte budget
+}
+
+// Option
+// @dev Configure an ABICache, see NewABICache
+type Option func(*config)
+
+type config struct {
+	capacity    int
+	shards      int
+	maxBytes    int64
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+}
+
+// WithCapacity
+// @dev The max number of items, default: 1000
+func WithCapacity(capacity int) Option {
+	return func(c *config) {
+		c.capacity = capacity
+	}
+}
+
+// WithShards
+// @dev The number of shards, default: 16. More shards mean less lock contention and a less exact LRU
+func WithShards(shards int) Option {
+	return func(c *config) {
+		c.shards = shards
+	}
+}
+
+// WithMaxBytes
+// @dev The byte budget of the parsed ABIs, default: 64 MiB. An item larger than the budget of its shard is not cached
+func WithMaxBytes(maxBytes int64) Option {
+	return func(c *config) {
+		c.maxBytes = maxBytes
+	}
+}
+
+// WithTTL
+// @dev How long Set keeps an item, default: 0, until it is evicted
+func WithTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.ttl = ttl
+	}
+}
+
+// WithNegativeTTL
+// @dev How long SetNegative keeps an item at most, default: 10 minutes, 0: until the re-check time
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.negativeTTL = ttl
+	}
+}
+
+// WithClock
+// @dev The current time for the TTL, default: time.Now
+func WithClock(now func() time.Time) Option {
+	return func(c *config) {
+		c.now = now
+	}
+}
+
 // NewABICache
-// @dev Create a new ABICache with the given capacity
-func NewABICache() *ABICache {
+// @dev Create a new ABICache, 1000 entries and 64 MiB in 16 shards by default
+func NewABICache(options ...Option) *ABICache {
+	cfg := config{
+		capacity:    DefaultCapacity,
+		shards:      DefaultShards,
+		maxBytes:    DefaultMaxBytes,
+		negativeTTL: DefaultNegativeTTL,
+		now:         time.Now,
+	}
+	for _, option := range options {
+		option(&cfg)
+	}
+	if cfg.capacity < 1 {
+		cfg.capacity = 1
+	}
+	if cfg.shards < 1 {
+		cfg.shards = 1
+	}
+	if cfg.shards > cfg.capacity {
+		cfg.shards = cfg.capacity
+	}
+	if cfg.maxBytes < 1 {
+		cfg.maxBytes = 1
+	}
+
 	cache := &ABICache{
-		capacity: 1000, // Fixed capacity of 1000 entries
-		cache:    make(map[int64]*list.Element),
-		list:     list.New(),
+		shards:      make([]*shard, cfg.shards),
+		ttl:         cfg.ttl,
+		negativeTTL: cfg.negativeTTL,
+		now:         cfg.now,
+	}
+	shards := int64(cfg.shards)
+	for i := range cache.shards {
+		// spread the capacity and the budget, the first shards take the remainder
+		capacity := cfg.capacity / cfg.shards
+		if i < cfg.capacity%cfg.shards {
+			capacity++
+		}
+		maxBytes := cfg.maxBytes / shards
+		if int64(i) < cfg.maxBytes%shards {
+			maxBytes++
+		}
+		cache.shards[i] = &shard{
+			capacity: capacity,
+			maxBytes: maxBytes,
+			cache:    make(map[Key]*list.Element),
+			list:     list.New(),
+		}
 	}
 	return cache
 }
@@ -41,76 +224,354 @@ func NewABICache() *ABICache {
 // Get
 // @dev Retrieve an item from the cache
 // @return FunctionABI, ContractABI, isFound
-// Notice: chainID+contractAddress+signature => return functionABI
-// Notice: chainID+contractAddress+"Search for contractABI" => return contractABI
+// Notice: chainID+contractAddress+signature => return functionABI, the text signature, E.g. transfer(address,uint256)
+// Notice: chainID+contractAddress+"" => return contractABI
 func (c *ABICache) Get(chainID int, contractAddress common.Address, signature string) (functionABI *abi.Method, contractABI *abi.ABI, isFound bool) {
-	key := CacheKey(chainID, contractAddress, signature)
-	if element, found := c.cache[key]; found {
-		c.list.MoveToFront(element)
-		return element.Value.(*CacheItem).FunctionABI, element.Value.(*CacheItem).ContractABI, true
+	return c.GetAt(SignatureKey(chainID, contractAddress, signature))
+}
+
+// GetAt
+// @dev Retrieve the item of the key, E.g. SelectorKey(chainID, contractAddress, sig).At(fromBlock), see Get
+func (c *ABICache) GetAt(key Key) (functionABI *abi.Method, contractABI *abi.ABI, isFound bool) {
+	if item, found := c.get(key); found {
+		return item.FunctionABI, item.ContractABI, true
 	}
 	return nil, nil, false
 }
 
 // Set
-// @dev Add an item to the cache
+// @dev Add an item to the cache, it is kept until evicted, or for the TTL of WithTTL
 func (c *ABICache) Set(chainID int, contractAddress common.Address, functionABI *abi.Method, contractABI *abi.ABI, signature string) {
-	key := CacheKey(chainID, contractAddress, signature)
+	c.SetWithTTL(chainID, contractAddress, functionABI, contractABI, signature, c.ttl)
+}
+
+// SetAt
+// @dev Add the item of the key, E.g. ContractKey(chainID, contractAddress).At(fromBlock), see Set
+func (c *ABICache) SetAt(key Key, functionABI *abi.Method, contractABI *abi.ABI) {
+	c.setAt(key, "", functionABI, contractABI, c.ttl)
+}
+
+// SetAtWithTTL
+// @dev Add the item of the key for ttl, 0: until evicted, see SetWithTTL
+func (c *ABICache) SetAtWithTTL(key Key, functionABI *abi.Method, contractABI *abi.ABI, ttl time.Duration) {
+	c.setAt(key, "", functionABI, contractABI, ttl)
+}
+
+// SetWithTTL
+// @dev Add an item to the cache for ttl, 0: until evicted
+// Notice: use a short ttl for the results which may change, E.g. the ABI found through a proxy's implementation
+func (c *ABICache) SetWithTTL(chainID int, contractAddress common.Address, functionABI *abi.Method, contractABI *abi.ABI, signature string, ttl time.Duration) {
+	c.setAt(SignatureKey(chainID, contractAddress, signature), signature, functionABI, contractABI, ttl)
+}
+
+// GetDeployments
+// @dev Retrieve the first blocks of the deployments of chainID+contractAddress in ascending order
+func (c *ABICache) GetDeployments(chainID int, contractAddress common.Address) (fromBlocks []int64, isFound bool) {
+	if item, found := c.get(DeploymentsKey(chainID, contractAddress)); found {
+		return item.Deployments, true
+	}
+	return nil, false
+}
 
+// SetDeployments
+// @dev Remember the first blocks of the deployments of chainID+contractAddress, so a lookup at a block finds the items
+// of its deployment without the store. Removed with the other items of the address by DeleteAddress
+func (c *ABICache) SetDeployments(chainID int, contractAddress common.Address, fromBlocks []int64) {
 	newItem := &CacheItem{
 		ChainID:         chainID,
 		ContractAddress: contractAddress,
+		Deployments:     fromBlocks,
+		key:             DeploymentsKey(chainID, contractAddress),
+	}
+	if c.ttl > 0 {
+		newItem.ExpireAt = c.now().Add(c.ttl)
+	}
+	c.set(newItem)
+}
+
+// @dev Add the item of the key for ttl, 0: until evicted
+// @param signature: the text signature of the item, "" for the raw selectors and the contractABIs
+func (c *ABICache) setAt(key Key, signature string, functionABI *abi.Method, contractABI *abi.ABI, ttl time.Duration) {
+	newItem := &CacheItem{
+		ChainID:         key.ChainID,
+		ContractAddress: key.ContractAddress,
 		Signature:       signature,
+		FromBlock:       key.FromBlock,
 		FunctionABI:     functionABI,
 		ContractABI:     contractABI,
+		key:             key,
+	}
+	if ttl > 0 {
+		newItem.ExpireAt = c.now().Add(ttl)
+	}
+	c.set(newItem)
+}
+
+// SetNegative
+// @dev Remember that chainID+contractAddress has no ABI until expireAt
+// @param reason: the classified error, E.g. not verified, no code
+// Notice: the item is kept for the negative TTL at most, then the caller reads the result from its store again
+func (c *ABICache) SetNegative(chainID int, contractAddress common.Address, reason error, expireAt time.Time) {
+	newItem := &CacheItem{
+		ChainID:         chainID,
+		ContractAddress: contractAddress,
+		Negative:        reason,
+		RecheckAt:       expireAt,
+		ExpireAt:        expireAt,
+		key:             NegativeKey(chainID, contractAddress),
+	}
+	if c.negativeTTL > 0 {
+		if deadline := c.now().Add(c.negativeTTL); deadline.Before(expireAt) {
+			newItem.ExpireAt = deadline
+		}
+	}
+	c.set(newItem)
+}
+
+// GetNegative
+// @dev Retrieve the negative entry of chainID+contractAddress
+// @return the reason why there is no ABI, when it expires, isFound
+func (c *ABICache) GetNegative(chainID int, contractAddress common.Address) (reason error, expireAt time.Time, isFound bool) {
+	if item, found := c.get(NegativeKey(chainID, contractAddress)); found {
+		return item.Negative, item.RecheckAt, true
+	}
+	return nil, time.Time{}, false
+}
+
+// DeleteNegative
+// @dev Remove the negative entry of chainID+contractAddress, E.g. after the ABI is found
+func (c *ABICache) DeleteNegative(chainID int, contractAddress common.Address) {
+	key := NegativeKey(chainID, contractAddress)
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, found := s.cache[key]; found {
+		s.remove(element)
+	}
+}
+
+// DeleteAddress
+// @dev Remove all the items of chainID+contractAddress, E.g. after an override or a new crawl result
+// @return the number of items removed
+// Notice: every shard is scanned, the items of an address are spread by their selectors
+func (c *ABICache) DeleteAddress(chainID int, contractAddress common.Address) int {
+	removed := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for element := s.list.Front(); element != nil; {
+			next := element.Next()
+			key := element.Value.(*CacheItem).key
+			if key.ChainID == chainID && key.ContractAddress == contractAddress {
+				s.remove(element)
+				removed++
+			}
+			element = next
+		}
+		s.mu.Unlock()
+	}
+	return removed
+}
+
+// Len
+// @dev The number of items in the cache
+func (c *ABICache) Len() int {
+	length := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		length += s.list.Len()
+		s.mu.Unlock()
+	}
+	return length
+}
+
+// Stats
+// @dev The counters since the cache is created, and the current usage
+func (c *ABICache) Stats() Stats {
+	stats := Stats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+		Rejections:  c.rejections.Load(),
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Entries += s.list.Len()
+		stats.Bytes += s.bytes
+		s.mu.Unlock()
+		stats.Capacity += s.capacity
+		stats.MaxBytes += s.maxBytes
+	}
+	return stats
+}
+
+// Snapshot
+// @dev The keys of the ABIs in the cache, the most recently used first, E.g. to prewarm another cache
+// Notice: the negative, deployment and expired items are skipped. The request counters restart from 0 after it
+func (c *ABICache) Snapshot() []SnapshotEntry {
+	entries := make([]SnapshotEntry, 0)
+	now := c.now()
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for element := s.list.Front(); element != nil; element = element.Next() {
+			item := element.Value.(*CacheItem)
+			if item.key.Kind == KindNegative || item.key.Kind == KindDeployments || (!item.ExpireAt.IsZero() && !now.Before(item.ExpireAt)) {
+				continue
+			}
+			entries = append(entries, SnapshotEntry{Key: item.key, AccessedAt: item.accessedAt, Requests: item.requests})
+			item.requests = 0
+		}
+		s.mu.Unlock()
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].AccessedAt.After(entries[j].AccessedAt)
+	})
+	return entries
+}
+
+// @dev Find the item of the key, remove it if it expires
+// Notice: only the recency of the items is modified after set, so the caller can read the ABIs without the lock
+func (c *ABICache) get(key Key) (*CacheItem, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, found := s.cache[key]
+	if !found {
+		c.misses.Add(1)
+		return nil, false
+	}
+	item := element.Value.(*CacheItem)
+	if !item.ExpireAt.IsZero() && !c.now().Before(item.ExpireAt) { // expired, search it again
+		s.remove(element)
+		c.expirations.Add(1)
+		c.misses.Add(1)
+		return nil, false
 	}
-	element := c.list.PushFront(newItem)
-	c.cache[key] = element
+	s.list.MoveToFront(element)
+	item.accessedAt = c.now()
+	item.requests++
+	c.hits.Add(1)
+	return item, true
+}
+
+// @dev Insert or replace an item
+func (c *ABICache) set(newItem *CacheItem) {
+	newItem.Size = ItemSize(newItem)
+	s := c.shard(newItem.key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, found := s.cache[newItem.key]; found {
+		s.remove(element)
+	}
+	if newItem.Size > s.maxBytes { // E.g. a huge ABI in a small cache, it would evict everything else
+		c.rejections.Add(1)
+		return
+	}
+	newItem.accessedAt = c.now()
+	element := s.list.PushFront(newItem)
+	s.cache[newItem.key] = element
+	s.bytes += newItem.Size
 
 	// Check capacity and remove the oldest items as necessary: LRU
-	if c.list.Len() > c.capacity {
-		c.evict()
+	for s.list.Len() > s.capacity || s.bytes > s.maxBytes {
+		s.evict()
+		c.evictions.Add(1)
 	}
+}
 
+// @dev The shard of the key
+func (c *ABICache) shard(key Key) *shard {
+	return c.shards[key.hash()%uint64(len(c.shards))]
 }
 
 // evict LRU
-func (c *ABICache) evict() {
-	if element := c.list.Back(); element != nil {
-		c.list.Remove(element)
-		item := element.Value.(*CacheItem)
-		delete(c.cache, CacheKey(item.ChainID, item.ContractAddress, item.Signature))
+func (s *shard) evict() {
+	if element := s.list.Back(); element != nil {
+		s.remove(element)
 	}
 }
 
-// cacheKey
-// @dev Generate key for cache mapping
-// To find functionABI: signature => signature
-// To find contractABI: signature => ""
-func CacheKey(chainID int, address common.Address, signature string) int64 {
+// @dev Remove an item from the list and the map
+func (s *shard) remove(element *list.Element) {
+	s.list.Remove(element)
+	item := element.Value.(*CacheItem)
+	s.bytes -= item.Size
+	delete(s.cache, item.key)
+}
+
+// ContractKey
+// @dev The key of the contractABI of chainID+contractAddress
+func ContractKey(chainID int, address common.Address) Key {
+	return Key{ChainID: chainID, ContractAddress: address, Kind: KindContract}
+}
 
-	input := fmt.Sprintf("%d-%s-%s", chainID, address.Hex(), signature)
+// SelectorKey
+// @dev The key of the functionABI of the 4 bytes selector, E.g. 0xa9059cbb
+func SelectorKey(chainID int, address common.Address, selector [4]byte) Key {
+	return Key{ChainID: chainID, ContractAddress: address, Selector: selector, Kind: KindFunction}
+}
 
-	hash := crypto.Keccak256([]byte(input))
+// SignatureKey
+// @dev The key of the functionABI of the text signature, E.g. transfer(address,uint256) => the key of 0xa9059cbb
+// Notice: "" => the key of the contractABI, see Get
+func SignatureKey(chainID int, address common.Address, signature string) Key {
+	if signature == "" {
+		return ContractKey(chainID, address)
+	}
+	return SelectorKey(chainID, address, Get4bytesSig(signature))
+}
+
+// NegativeKey
+// @dev The key of the negative entry of chainID+contractAddress: it has no ABI
+func NegativeKey(chainID int, address common.Address) Key {
+	return Key{ChainID: chainID, ContractAddress: address, Kind: KindNegative}
+}
 
-	// high 8 bytes
-	high8Bytes := hash[len(hash)-8:]
+// DeploymentsKey
+// @dev The key of the first blocks of the deployments of chainID+contractAddress
+func DeploymentsKey(chainID int, address common.Address) Key {
+	return Key{ChainID: chainID, ContractAddress: address, Kind: KindDeployments}
+}
 
-	// bytes => big.Int => int64
-	high8BigInt := new(big.Int).SetBytes(high8Bytes)
-	high8Int64 := high8BigInt.Int64()
+// At
+// @dev The key of the item of the deployment from fromBlock, the functionABIs and the contractABIs only
+func (k Key) At(fromBlock int64) Key {
+	if k.Kind == KindFunction || k.Kind == KindContract {
+		k.FromBlock = fromBlock
+	}
+	return k
+}
 
-	return high8Int64
+// @dev FNV-1a of the key, only to pick the shard
+func (k Key) hash() uint64 {
+	const prime = 1099511628211
+	hash := uint64(14695981039346656037)
+	for i := 0; i < 8; i++ {
+		hash = (hash ^ uint64(byte(k.ChainID>>(8*i)))) * prime
+	}
+	for _, b := range k.ContractAddress {
+		hash = (hash ^ uint64(b)) * prime
+	}
+	for _, b := range k.Selector {
+		hash = (hash ^ uint64(b)) * prime
+	}
+	for i := 0; i < 8; i++ {
+		hash = (hash ^ uint64(byte(k.FromBlock>>(8*i)))) * prime
+	}
+	return (hash ^ uint64(k.Kind)) * prime
 }
 
 // Get4bytesSig
-// @dev signature => 4 bytes signature
+// @dev signature => 4 bytes signature, E.g. transfer(address,uint256) => 0xa9059cbb
 func Get4bytesSig(signature string) [4]byte {
 	hash := crypto.Keccak256([]byte(signature))
 
 	// high 4 bytes
 	var result [4]byte
-	copy(result[:], hash[len(hash)-4:])
+	copy(result[:], hash[:4])
 
 	return result
 }
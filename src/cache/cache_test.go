@@ -1,10 +1,15 @@
 package cache
 
 import (
+	"fmt"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // Prepare some data that may be used
@@ -18,9 +23,18 @@ var (
 func TestNewABICache(t *testing.T) {
 	cache := NewABICache()
 	assert.NotNil(t, cache)
-	assert.Equal(t, 1000, cache.capacity)
-	assert.NotNil(t, cache.list)
-	assert.NotNil(t, cache.cache)
+	assert.Equal(t, 1000, cache.Stats().Capacity)
+	assert.Len(t, cache.shards, DefaultShards)
+	for _, s := range cache.shards {
+		assert.NotNil(t, s.list)
+		assert.NotNil(t, s.cache)
+	}
+
+	cache = NewABICache(WithCapacity(10), WithShards(4))
+	assert.Equal(t, 10, cache.Stats().Capacity)
+	assert.Len(t, cache.shards, 4)
+	cache = NewABICache(WithCapacity(3))
+	assert.Len(t, cache.shards, 3) // at least one item per shard
 }
 
 func TestSetAndGetCacheItem(t *testing.T) {
@@ -34,12 +48,12 @@ func TestSetAndGetCacheItem(t *testing.T) {
 	assert.Equal(t, contractABI, fetchedAbi)
 
 	// Is the test item at the forefront of the cache
-	assert.Equal(t, cache.list.Front().Value.(*CacheItem).Signature, signature)
+	s := cache.shard(SignatureKey(1, contractAddress, signature))
+	assert.Equal(t, s.list.Front().Value.(*CacheItem).Signature, signature)
 }
 
 func TestCacheEviction(t *testing.T) {
-	cache := NewABICache()
-	cache.capacity = 3 // Set small capacity for easy testing
+	cache := NewABICache(WithCapacity(3), WithShards(1)) // Set small capacity for easy testing
 
 	// Fill cache
 	cache.Set(1, contractAddress, functionABI, contractABI, signature)
@@ -51,12 +65,228 @@ func TestCacheEviction(t *testing.T) {
 	// Add the forth item to trigger evict()
 	cache.Set(4, contractAddress, functionABI, contractABI, "function4")
 
-	_, _, found := cache.Get(1, contractAddress, signature)
-	assert.False(t, found) // the second Item will be the RLU
+	_, _, found := cache.Get(2, contractAddress, "function2")
+	assert.False(t, found) // the second Item is evicted
 
-	_, _, found = cache.Get(2, contractAddress, "function2")
+	_, _, found = cache.Get(1, contractAddress, signature)
 	assert.True(t, found) // the first item is still exist
 
 	_, _, found = cache.Get(3, contractAddress, "function3")
 	assert.True(t, found) // the third item is still exist
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, 3, stats.Entries)
+}
+
+func TestCacheKey(t *testing.T) {
+	selector := Get4bytesSig(signature)
+	assert.Equal(t, [4]byte{0xa9, 0x05, 0x9c, 0xbb}, selector)
+
+	// the text signature and its selector are the same key
+	key := SignatureKey(1, contractAddress, signature)
+	assert.Equal(t, key, SelectorKey(1, contractAddress, selector))
+	assert.Equal(t, Key{ChainID: 1, ContractAddress: contractAddress, Selector: selector, Kind: KindFunction}, key)
+
+	// every part of the key counts
+	assert.NotEqual(t, key, SignatureKey(2, contractAddress, signature))
+	assert.NotEqual(t, key, SignatureKey(1, common.HexToAddress("0x01"), signature))
+	assert.NotEqual(t, key, SignatureKey(1, contractAddress, "approve(address,uint256)"))
+	assert.NotEqual(t, key, key.At(100))
+	assert.NotEqual(t, ContractKey(1, contractAddress), NegativeKey(1, contractAddress))
+	assert.NotEqual(t, ContractKey(1, contractAddress), SelectorKey(1, contractAddress, [4]byte{}))
+	assert.Equal(t, NegativeKey(1, contractAddress), NegativeKey(1, contractAddress).At(100))
+
+	// a text signature of 4 bytes or "negative" is hashed like the others, not taken as a selector or a negative key
+	assert.Equal(t, SelectorKey(1, contractAddress, Get4bytesSig("ab()")), SignatureKey(1, contractAddress, "ab()"))
+	assert.NotEqual(t, SelectorKey(1, contractAddress, [4]byte{'a', 'b', '(', ')'}), SignatureKey(1, contractAddress, "ab()"))
+	assert.NotEqual(t, NegativeKey(1, contractAddress), SignatureKey(1, contractAddress, "negative"))
+
+	// the contractABI and the functionABI of the same address are separate items
+	cache := NewABICache()
+	cache.Set(1, contractAddress, functionABI, nil, signature)
+	_, _, found := cache.Get(1, contractAddress, "")
+	assert.False(t, found)
+}
+
+// @dev A contract ABI with n functions of 2 inputs
+func bigABI(t *testing.T, n int) *abi.ABI {
+	var items []string
+	for i := 0; i < n; i++ {
+		items = append(items, fmt.Sprintf(`{"type":"function","name":"function%d","inputs":[{"name":"to","type":"address"},{"name":"amounts","type":"uint256[]"}],"outputs":[]}`, i))
+	}
+	parsed, err := abi.JSON(strings.NewReader("[" + strings.Join(items, ",") + "]"))
+	assert.NoError(t, err)
+	return &parsed
+}
+
+func TestItemSize(t *testing.T) {
+	small := ItemSize(&CacheItem{ContractABI: bigABI(t, 1)})
+	large := ItemSize(&CacheItem{ContractABI: bigABI(t, 100)})
+	assert.Greater(t, small, int64(0))
+	assert.Greater(t, large, 20*small)
+
+	// the function item also holds the contractABI
+	assert.Greater(t, ItemSize(&CacheItem{FunctionABI: functionABI, ContractABI: bigABI(t, 100)}), large)
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	big := bigABI(t, 100)
+	budget := 3 * ItemSize(&CacheItem{ContractABI: big})
+	cache := NewABICache(WithShards(1), WithMaxBytes(budget))
+
+	// only 3 big ABIs fit, although the capacity is 1000
+	for i := 1; i <= 5; i++ {
+		cache.Set(i, contractAddress, nil, big, "")
+	}
+	stats := cache.Stats()
+	assert.Equal(t, 3, stats.Entries)
+	assert.Equal(t, uint64(2), stats.Evictions)
+	assert.LessOrEqual(t, stats.Bytes, budget)
+	assert.Equal(t, budget, stats.MaxBytes)
+	_, _, found := cache.Get(1, contractAddress, "")
+	assert.False(t, found)
+	_, _, found = cache.Get(5, contractAddress, "")
+	assert.True(t, found)
+
+	// the small items fit in the same budget
+	for i := 0; i < 100; i++ {
+		cache.Set(i, contractAddress, functionABI, nil, signature)
+	}
+	for i := 0; i < 100; i++ {
+		_, _, found = cache.Get(i, contractAddress, signature)
+		assert.True(t, found)
+	}
+
+	// an ABI larger than the budget is not cached
+	cache = NewABICache(WithShards(1), WithMaxBytes(budget/2))
+	cache.Set(1, contractAddress, functionABI, nil, signature)
+	cache.Set(1, contractAddress, nil, bigABI(t, 200), "")
+	_, _, found = cache.Get(1, contractAddress, "")
+	assert.False(t, found)
+	_, _, found = cache.Get(1, contractAddress, signature)
+	assert.True(t, found) // nothing is evicted for it
+	assert.Equal(t, uint64(1), cache.Stats().Rejections)
+
+	// replacing an item releases its bytes
+	cache = NewABICache()
+	cache.Set(1, contractAddress, nil, big, "")
+	cache.Set(1, contractAddress, nil, bigABI(t, 1), "")
+	assert.Equal(t, ItemSize(&CacheItem{ContractABI: bigABI(t, 1)}), cache.Stats().Bytes)
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Now()
+	cache := NewABICache(WithTTL(time.Hour), WithNegativeTTL(time.Minute), WithClock(func() time.Time { return now }))
+
+	cache.Set(1, contractAddress, functionABI, contractABI, signature)
+	cache.SetWithTTL(1, contractAddress, nil, contractABI, "", time.Minute) // E.g. found through a proxy
+	cache.SetNegative(2, contractAddress, errors.New("not verified"), now.Add(48*time.Hour))
+	cache.SetNegative(3, contractAddress, errors.New("rate limited"), now.Add(30*time.Second))
+
+	now = now.Add(40 * time.Second)
+	_, _, found := cache.Get(1, contractAddress, "")
+	assert.True(t, found)
+	reason, expireAt, found := cache.GetNegative(2, contractAddress)
+	assert.True(t, found)
+	assert.EqualError(t, reason, "not verified")
+	assert.Equal(t, now.Add(-40*time.Second).Add(48*time.Hour), expireAt) // the re-check time, not the TTL
+	_, _, found = cache.GetNegative(3, contractAddress)
+	assert.False(t, found) // the re-check time is before the TTL
+
+	now = now.Add(time.Minute)
+	_, _, found = cache.Get(1, contractAddress, "")
+	assert.False(t, found)
+	_, _, found = cache.GetNegative(2, contractAddress)
+	assert.False(t, found) // the negative TTL is shorter than the re-check time
+	_, _, found = cache.Get(1, contractAddress, signature)
+	assert.True(t, found)
+
+	now = now.Add(time.Hour)
+	_, _, found = cache.Get(1, contractAddress, signature)
+	assert.False(t, found)
+	stats := cache.Stats()
+	assert.Equal(t, uint64(4), stats.Expirations)
+	assert.Equal(t, 0, stats.Entries)
+	assert.Equal(t, int64(0), stats.Bytes)
+}
+
+func TestSnapshot(t *testing.T) {
+	now := time.Now()
+	cache := NewABICache(WithClock(func() time.Time { return now }))
+	cache.Set(1, contractAddress, nil, contractABI, "")
+	now = now.Add(time.Second)
+	cache.Set(1, contractAddress, functionABI, contractABI, signature)
+	cache.SetNegative(2, contractAddress, errors.New("not verified"), now.Add(time.Hour))
+	now = now.Add(time.Second)
+	_, _, _ = cache.Get(1, contractAddress, "")
+	_, _, _ = cache.Get(1, contractAddress, "")
+
+	entries := cache.Snapshot()
+	if assert.Len(t, entries, 2) { // the negative item is skipped
+		assert.Equal(t, ContractKey(1, contractAddress), entries[0].Key) // the most recently used first
+		assert.Equal(t, uint64(2), entries[0].Requests)
+		assert.Equal(t, now, entries[0].AccessedAt)
+		assert.Equal(t, SignatureKey(1, contractAddress, signature), entries[1].Key)
+		assert.Equal(t, uint64(0), entries[1].Requests)
+	}
+	assert.Equal(t, uint64(0), cache.Snapshot()[0].Requests) // restart from 0
+}
+
+// Run with -race: many goroutines read and write the same keys
+func TestConcurrentAccess(t *testing.T) {
+	cache := NewABICache(WithCapacity(64), WithShards(4))
+	reason := errors.New("not verified")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				chainID := (i + j) % 100
+				cache.Set(chainID, contractAddress, functionABI, contractABI, signature)
+				if fetched, _, found := cache.Get(chainID, contractAddress, signature); found {
+					assert.Equal(t, functionABI, fetched)
+				}
+				cache.SetNegative(chainID, contractAddress, reason, time.Now().Add(time.Minute))
+				_, _, _ = cache.GetNegative(chainID, contractAddress)
+				cache.DeleteNegative(chainID, contractAddress)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := cache.Stats()
+	assert.LessOrEqual(t, stats.Entries, 64)
+	assert.Equal(t, uint64(32*500*2), stats.Hits+stats.Misses)
+	assert.Greater(t, stats.Evictions, uint64(0))
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	cache := NewABICache()
+	for i := 0; i < 1000; i++ {
+		cache.Set(1, contractAddress, functionABI, contractABI, fmt.Sprint(i))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			_, _, _ = cache.Get(1, contractAddress, fmt.Sprint(i%1000))
+			i++
+		}
+	})
+}
+
+func BenchmarkCacheSet(b *testing.B) {
+	cache := NewABICache()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.Set(1, contractAddress, functionABI, contractABI, fmt.Sprint(i%2000))
+			i++
+		}
+	})
 }
@@ -0,0 +1,410 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The default settings of RedisCache
+const (
+	DefaultRedisPrefix  = "abi:"
+	DefaultRedisChannel = "abi:invalidate"
+	DefaultRedisTTL     = 24 * time.Hour
+	DefaultRedisTimeout = time.Second
+)
+
+var log = logrus.New()
+
+// RedisCache
+// @dev The second tier shared by the replicas: the serialized ABIs in a server speaking the Redis protocol(RESP),
+// E.g. Redis, Valkey, KeyDB. The ABIs of an address are the fields of one hash, so an address is invalidated by one DEL
+// Notice: safe for concurrent use, the connections are pooled
+type RedisCache struct {
+	addr     string
+	password string
+	prefix   string
+	channel  string
+	ttl      time.Duration
+	timeout  time.Duration
+	pool     chan *redisConn
+}
+
+// RedisOption
+// @dev Configure a RedisCache, see NewRedisCache
+type RedisOption func(*RedisCache)
+
+// WithRedisPassword
+// @dev AUTH with the password after connecting
+func WithRedisPassword(password string) RedisOption {
+	return func(r *RedisCache) {
+		r.password = password
+	}
+}
+
+// WithRedisPrefix
+// @dev The prefix of the keys and the invalidation channel, default: "abi:"
+func WithRedisPrefix(prefix string) RedisOption {
+	return func(r *RedisCache) {
+		r.prefix = prefix
+		r.channel = prefix + "invalidate"
+	}
+}
+
+// WithRedisTTL
+// @dev How long the ABIs of an address are kept after the last Set, default: 24 hours
+func WithRedisTTL(ttl time.Duration) RedisOption {
+	return func(r *RedisCache) {
+		r.ttl = ttl
+	}
+}
+
+// WithRedisTimeout
+// @dev The timeout of a command if the context has no deadline, default: 1 second
+func WithRedisTimeout(timeout time.Duration) RedisOption {
+	return func(r *RedisCache) {
+		r.timeout = timeout
+	}
+}
+
+// NewRedisCache
+// @dev Create a RedisCache of the server at addr, E.g. "127.0.0.1:6379". It connects at the first command
+func NewRedisCache(addr string, options ...RedisOption) *RedisCache {
+	r := &RedisCache{
+		addr:    addr,
+		prefix:  DefaultRedisPrefix,
+		channel: DefaultRedisChannel,
+		ttl:     DefaultRedisTTL,
+		timeout: DefaultRedisTimeout,
+		pool:    make(chan *redisConn, 16),
+	}
+	for _, option := range options {
+		option(r)
+	}
+	return r
+}
+
+// Get
+// @dev Retrieve the serialized ABI of the key
+// @return the value, isFound
+func (r *RedisCache) Get(ctx context.Context, key Key) ([]byte, bool, error) {
+	reply, err := r.do(ctx, "HGET", r.hashKey(key.ChainID, key.ContractAddress), field(key))
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	return value, ok, nil
+}
+
+// Set
+// @dev Store the serialized ABI of the key, the ABIs of the address expire ttl after it, 0: the TTL of WithRedisTTL
+func (r *RedisCache) Set(ctx context.Context, key Key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = r.ttl
+	}
+	hashKey := r.hashKey(key.ChainID, key.ContractAddress)
+	_, err := r.pipeline(ctx,
+		[]string{"HSET", hashKey, field(key), string(value)},
+		[]string{"PEXPIRE", hashKey, strconv.FormatInt(ttl.Milliseconds(), 10)},
+	)
+	return err
+}
+
+// Invalidate
+// @dev Remove the ABIs of chainID+contractAddress, and tell the subscribers to drop their copies
+func (r *RedisCache) Invalidate(ctx context.Context, chainID int, contractAddress common.Address) error {
+	_, err := r.pipeline(ctx,
+		[]string{"DEL", r.hashKey(chainID, contractAddress)},
+		[]string{"PUBLISH", r.channel, fmt.Sprintf("%d:%s", chainID, contractAddress.Hex())},
+	)
+	return err
+}
+
+// Subscribe
+// @dev Call handler for every invalidation until the context is done, reconnect if the connection breaks
+// Notice: the invalidations published while reconnecting are lost, so keep the TTL of the memory tier short enough
+func (r *RedisCache) Subscribe(ctx context.Context, handler func(chainID int, contractAddress common.Address)) error {
+	for {
+		err := r.subscribe(ctx, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Warning("The invalidation subscription breaks, reconnect. Err:", err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Close
+// @dev Close the pooled connections
+func (r *RedisCache) Close() {
+	for {
+		select {
+		case conn := <-r.pool:
+			_ = conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// @dev One subscription until the connection breaks or the context is done
+func (r *RedisCache) subscribe(ctx context.Context, handler func(chainID int, contractAddress common.Address)) error {
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// unblock the receive when the context is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(r.timeout))
+	if err = conn.send([]string{"SUBSCRIBE", r.channel}); err != nil {
+		return err
+	}
+	if _, err = conn.receive(); err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{}) // wait for the messages
+
+	for {
+		reply, err := conn.receive()
+		if err != nil {
+			return err
+		}
+		// ["message", channel, "chainID:contractAddress"]
+		message, ok := reply.([]interface{})
+		if !ok || len(message) != 3 || string(asBytes(message[0])) != "message" {
+			continue
+		}
+		parts := strings.SplitN(string(asBytes(message[2])), ":", 2)
+		if len(parts) != 2 || !common.IsHexAddress(parts[1]) {
+			continue
+		}
+		chainID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		handler(chainID, common.HexToAddress(parts[1]))
+	}
+}
+
+// @dev The hash of the ABIs of an address, E.g. abi:1:0xdAC17F958D2ee523a2206206994597C13D831ec7
+func (r *RedisCache) hashKey(chainID int, contractAddress common.Address) string {
+	return fmt.Sprintf("%s%d:%s", r.prefix, chainID, contractAddress.Hex())
+}
+
+// @dev The field of the key in the hash: "contract", or the selector in hex, then @ the first block of a later deployment
+func field(key Key) string {
+	name := fmt.Sprintf("%x", key.Selector)
+	switch key.Kind {
+	case KindContract:
+		name = "contract"
+	case KindDeployments:
+		name = "deployments"
+	}
+	if key.FromBlock != 0 {
+		name += fmt.Sprintf("@%d", key.FromBlock)
+	}
+	return name
+}
+
+// @dev Send one command, see pipeline
+func (r *RedisCache) do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := r.pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// @dev Send the commands at once then read their replies, the connection is returned to the pool if nothing breaks
+// Notice: a pooled connection may be closed by the server meanwhile, E.g. a restart, so the commands are retried once on a new one
+func (r *RedisCache) pipeline(ctx context.Context, commands ...[]string) ([]interface{}, error) {
+	conn, pooled, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := r.roundTrip(ctx, conn, commands)
+	var serverErr redisError
+	if err != nil && pooled && !errors.As(err, &serverErr) {
+		if conn, err = r.dial(ctx); err != nil {
+			return nil, err
+		}
+		replies, err = r.roundTrip(ctx, conn, commands)
+	}
+	return replies, err
+}
+
+// @dev Send the commands on the connection then read their replies, the connection is closed if it breaks
+func (r *RedisCache) roundTrip(ctx context.Context, conn *redisConn, commands [][]string) ([]interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(r.timeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	for _, command := range commands {
+		if err := conn.send(command); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	replies := make([]interface{}, len(commands))
+	var replyErr error
+	for i := range commands {
+		var err error
+		if replies[i], err = conn.receive(); err != nil {
+			var serverErr redisError
+			if !errors.As(err, &serverErr) {
+				_ = conn.Close()
+				return nil, err
+			}
+			replyErr = err // the connection is still fine
+		}
+	}
+	r.release(conn)
+	return replies, replyErr
+}
+
+// @dev A pooled connection, or a new one
+// @return the connection, isPooled
+func (r *RedisCache) conn(ctx context.Context) (*redisConn, bool, error) {
+	select {
+	case conn := <-r.pool:
+		return conn, true, nil
+	default:
+		conn, err := r.dial(ctx)
+		return conn, false, err
+	}
+}
+
+// @dev Return the connection to the pool, close it if the pool is full
+func (r *RedisCache) release(conn *redisConn) {
+	select {
+	case r.pool <- conn:
+	default:
+		_ = conn.Close()
+	}
+}
+
+// @dev Connect to the server, AUTH if there is a password
+func (r *RedisCache) dial(ctx context.Context) (*redisConn, error) {
+	dialer := net.Dialer{Timeout: r.timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to connect to redis")
+	}
+	conn := &redisConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	if r.password != "" {
+		_ = conn.SetDeadline(time.Now().Add(r.timeout))
+		err = conn.send([]string{"AUTH", r.password})
+		if err == nil {
+			_, err = conn.receive()
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, errors.Wrap(err, "Fail to AUTH")
+		}
+	}
+	return conn, nil
+}
+
+// redisConn
+// @dev A connection speaking RESP
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// redisError
+// @dev An error reply of the server, E.g. "WRONGTYPE Operation against a key holding the wrong kind of value"
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// @dev Write a command as an array of bulk strings
+func (c *redisConn) send(args []string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(c.Conn, b.String())
+	return errors.Wrap(err, "Fail to send the command")
+}
+
+// @dev Read a reply: string, redisError, int64, []byte(nil if not found) or []interface{}
+func (c *redisConn) receive() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to read the reply")
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("Empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		data := make([]byte, length+2) // with \r\n
+		if _, err = io.ReadFull(c.reader, data); err != nil {
+			return nil, errors.Wrap(err, "Fail to read the reply")
+		}
+		return data[:length], nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, length)
+		for i := range items {
+			if items[i], err = c.receive(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errors.New("Invalid reply: " + line)
+}
+
+// @dev A bulk or simple string reply => bytes
+func asBytes(reply interface{}) []byte {
+	switch value := reply.(type) {
+	case []byte:
+		return value
+	case string:
+		return []byte(value)
+	}
+	return nil
+}
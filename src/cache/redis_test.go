@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"code/src/cache/redistest"
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test storing, expiring and invalidating the serialized ABIs
+func TestRedisCache(t *testing.T) {
+	server := redistest.NewServer()
+	defer server.Close()
+	redis := NewRedisCache(server.Addr)
+	defer redis.Close()
+	ctx := context.Background()
+
+	functionKey := SignatureKey(1, contractAddress, signature)
+	contractKey := ContractKey(1, contractAddress)
+	_, isFound, err := redis.Get(ctx, functionKey)
+	assert.NoError(t, err)
+	assert.False(t, isFound)
+
+	assert.NoError(t, redis.Set(ctx, functionKey, []byte(`[{"type":"function"}]`), 0))
+	assert.NoError(t, redis.Set(ctx, contractKey, []byte(`[]`), 0))
+	value, isFound, err := redis.Get(ctx, functionKey)
+	assert.NoError(t, err)
+	assert.True(t, isFound)
+	assert.Equal(t, `[{"type":"function"}]`, string(value))
+	_, isFound, _ = redis.Get(ctx, ContractKey(2, contractAddress)) // another chain
+	assert.False(t, isFound)
+
+	// The connection closed by the server is replaced
+	server.CloseClients()
+	value, isFound, err = redis.Get(ctx, contractKey)
+	assert.NoError(t, err)
+	assert.True(t, isFound)
+	assert.Equal(t, `[]`, string(value))
+
+	// Invalidate drops all the ABIs of the address
+	assert.NoError(t, redis.Invalidate(ctx, 1, contractAddress))
+	_, isFound, _ = redis.Get(ctx, functionKey)
+	assert.False(t, isFound)
+	_, isFound, _ = redis.Get(ctx, contractKey)
+	assert.False(t, isFound)
+
+	// TTL
+	assert.NoError(t, redis.Set(ctx, contractKey, []byte(`[]`), 50*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+	_, isFound, _ = redis.Get(ctx, contractKey)
+	assert.False(t, isFound)
+
+	// AUTH
+	server.Password = "secret"
+	server.CloseClients()
+	_, _, err = NewRedisCache(server.Addr).Get(ctx, contractKey)
+	assert.Error(t, err)
+	_, _, err = NewRedisCache(server.Addr, WithRedisPassword("secret")).Get(ctx, contractKey)
+	assert.NoError(t, err)
+
+	// Unreachable
+	_, _, err = NewRedisCache("127.0.0.1:1", WithRedisTimeout(100*time.Millisecond)).Get(ctx, contractKey)
+	assert.Error(t, err)
+}
+
+// Test the invalidations received by the subscribers
+func TestRedisSubscribe(t *testing.T) {
+	server := redistest.NewServer()
+	defer server.Close()
+	publisher, subscriber := NewRedisCache(server.Addr), NewRedisCache(server.Addr)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var mu sync.Mutex
+	var received []common.Address
+	done := make(chan struct{})
+	go func() {
+		err := subscriber.Subscribe(ctx, func(chainID int, address common.Address) {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, 1, chainID)
+			received = append(received, address)
+		})
+		assert.NoError(t, err)
+		close(done)
+	}()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received)
+	}
+
+	assert.Eventually(t, func() bool { return server.Subscribers(DefaultRedisChannel) == 1 }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, publisher.Invalidate(ctx, 1, contractAddress))
+	assert.Eventually(t, func() bool { return count() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, contractAddress, received[0])
+
+	// Another prefix is another channel
+	assert.NoError(t, NewRedisCache(server.Addr, WithRedisPrefix("other:")).Invalidate(ctx, 1, contractAddress))
+
+	// Resubscribe after the connection breaks
+	server.CloseClients()
+	assert.Eventually(t, func() bool { return server.Subscribers(DefaultRedisChannel) == 1 }, 3*time.Second, 10*time.Millisecond)
+	assert.NoError(t, publisher.Invalidate(ctx, 1, contractAddress))
+	assert.Eventually(t, func() bool { return count() == 2 }, time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe does not return after the context is done")
+	}
+}
+
+// Test dropping all the items of an address from memory
+func TestDeleteAddress(t *testing.T) {
+	cache := NewABICache(WithShards(4))
+	other := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	cache.Set(1, contractAddress, functionABI, contractABI, signature)
+	cache.Set(1, contractAddress, functionABI, contractABI, "approve(address,uint256)")
+	cache.Set(1, contractAddress, nil, contractABI, "")
+	cache.Set(2, contractAddress, nil, contractABI, "")
+	cache.Set(1, other, nil, contractABI, "")
+
+	assert.Equal(t, 3, cache.DeleteAddress(1, contractAddress))
+	_, _, isFound := cache.Get(1, contractAddress, signature)
+	assert.False(t, isFound)
+	_, _, isFound = cache.Get(2, contractAddress, "")
+	assert.True(t, isFound)
+	_, _, isFound = cache.Get(1, other, "")
+	assert.True(t, isFound)
+	assert.Equal(t, 2, cache.Len())
+	assert.Equal(t, 0, cache.DeleteAddress(1, contractAddress))
+}
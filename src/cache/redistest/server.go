@@ -0,0 +1,264 @@
+// Package redistest
+// @dev An in-process server speaking the Redis protocol for the tests, like net/http/httptest
+// Notice: only the commands of cache.RedisCache: PING, AUTH, HGET, HSET, DEL, PEXPIRE, PTTL, PUBLISH, SUBSCRIBE, FLUSHALL
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server
+// @dev The keys are hashes of strings, the expired ones are removed at the next access
+type Server struct {
+	Addr     string // E.g. 127.0.0.1:51234
+	Password string // AUTH is required if it is set before the first connection
+
+	listener    net.Listener
+	mu          sync.Mutex
+	hashes      map[string]map[string]string
+	expireAt    map[string]time.Time
+	subscribers map[string][]*client // channel => subscribers
+	clients     map[*client]bool
+	commands    int
+}
+
+// client
+// @dev A connection to the server
+type client struct {
+	conn   net.Conn
+	mu     sync.Mutex // the replies and the published messages are written by different goroutines
+	authed bool
+}
+
+// NewServer
+// @dev Start a server on a random local port, call Close when done
+func NewServer() *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("redistest: fail to listen: " + err.Error())
+	}
+	s := &Server{
+		Addr:        listener.Addr().String(),
+		listener:    listener,
+		hashes:      make(map[string]map[string]string),
+		expireAt:    make(map[string]time.Time),
+		subscribers: make(map[string][]*client),
+		clients:     make(map[*client]bool),
+	}
+	go s.serve()
+	return s
+}
+
+// Close
+// @dev Stop the server and close the connections
+func (s *Server) Close() {
+	_ = s.listener.Close()
+	s.CloseClients()
+}
+
+// CloseClients
+// @dev Close the connections but keep the data, E.g. to test reconnecting
+func (s *Server) CloseClients() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		_ = c.conn.Close()
+	}
+	s.clients = make(map[*client]bool)
+	s.subscribers = make(map[string][]*client)
+}
+
+// Commands
+// @dev The number of commands served
+func (s *Server) Commands() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands
+}
+
+// Subscribers
+// @dev The number of subscribers of the channel
+func (s *Server) Subscribers(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers[channel])
+}
+
+// @dev Accept the connections until closed
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{conn: conn}
+		s.mu.Lock()
+		s.clients[c] = true
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+// @dev Serve the commands of a connection
+func (s *Server) handle(c *client) {
+	defer c.conn.Close()
+	reader := bufio.NewReader(c.conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		c.write(s.execute(c, args))
+	}
+}
+
+// @dev Run a command, return the RESP reply
+func (s *Server) execute(c *client, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands++
+
+	command := strings.ToUpper(args[0])
+	if s.Password != "" && !c.authed && command != "AUTH" {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+	switch {
+	case command == "PING":
+		return "+PONG\r\n"
+	case command == "AUTH" && len(args) == 2:
+		if args[1] != s.Password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		c.authed = true
+		return "+OK\r\n"
+	case command == "HGET" && len(args) == 3:
+		value, found := s.hash(args[1])[args[2]]
+		if !found {
+			return "$-1\r\n"
+		}
+		return bulk(value)
+	case command == "HSET" && len(args) >= 4 && len(args)%2 == 0:
+		hash := s.hash(args[1])
+		if hash == nil {
+			hash = make(map[string]string)
+			s.hashes[args[1]] = hash
+		}
+		added := 0
+		for i := 2; i < len(args); i += 2 {
+			if _, found := hash[args[i]]; !found {
+				added++
+			}
+			hash[args[i]] = args[i+1]
+		}
+		return fmt.Sprintf(":%d\r\n", added)
+	case command == "DEL" && len(args) >= 2:
+		deleted := 0
+		for _, key := range args[1:] {
+			if s.hash(key) != nil {
+				deleted++
+			}
+			delete(s.hashes, key)
+			delete(s.expireAt, key)
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	case command == "PEXPIRE" && len(args) == 3:
+		milliseconds, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if s.hash(args[1]) == nil {
+			return ":0\r\n"
+		}
+		s.expireAt[args[1]] = time.Now().Add(time.Duration(milliseconds) * time.Millisecond)
+		return ":1\r\n"
+	case command == "PTTL" && len(args) == 2:
+		if s.hash(args[1]) == nil {
+			return ":-2\r\n"
+		}
+		expireAt, found := s.expireAt[args[1]]
+		if !found {
+			return ":-1\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", time.Until(expireAt).Milliseconds())
+	case command == "PUBLISH" && len(args) == 3:
+		subscribers := s.subscribers[args[1]]
+		message := "*3\r\n" + bulk("message") + bulk(args[1]) + bulk(args[2])
+		for _, subscriber := range subscribers {
+			go subscriber.write(message)
+		}
+		return fmt.Sprintf(":%d\r\n", len(subscribers))
+	case command == "SUBSCRIBE" && len(args) >= 2:
+		var reply strings.Builder
+		for i, channel := range args[1:] {
+			s.subscribers[channel] = append(s.subscribers[channel], c)
+			reply.WriteString("*3\r\n" + bulk("subscribe") + bulk(channel) + fmt.Sprintf(":%d\r\n", i+1))
+		}
+		return reply.String()
+	case command == "FLUSHALL":
+		s.hashes = make(map[string]map[string]string)
+		s.expireAt = make(map[string]time.Time)
+		return "+OK\r\n"
+	}
+	return "-ERR unknown command or wrong number of arguments for '" + args[0] + "'\r\n"
+}
+
+// @dev The hash of the key, nil if it does not exist or expires
+func (s *Server) hash(key string) map[string]string {
+	if expireAt, found := s.expireAt[key]; found && !time.Now().Before(expireAt) {
+		delete(s.hashes, key)
+		delete(s.expireAt, key)
+	}
+	return s.hashes[key]
+}
+
+// @dev Write a reply
+func (c *client) write(reply string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, _ = io.WriteString(c.conn, reply)
+}
+
+// @dev Read a command: an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil // inline command, E.g. from telnet
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid command: %s", line)
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid bulk string: %s", line)
+		}
+		data := make([]byte, length+2)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+// @dev A RESP bulk string
+func bulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"github.com/ethereum/go-ethereum/accounts/abi"
+)
+
+// The approximate bytes of the structs behind the strings and slices, measured on 64-bit Go
+const (
+	itemOverhead     = 256 // CacheItem + list.Element + the map entry
+	abiOverhead      = 192 // abi.ABI and its maps
+	methodOverhead   = 320 // abi.Method, also the map entry of abi.ABI.Methods
+	eventOverhead    = 160 // abi.Event
+	errorOverhead    = 128 // abi.Error
+	argumentOverhead = 48  // abi.Argument
+	typeOverhead     = 176 // abi.Type
+)
+
+// ItemSize
+// @dev The approximate memory of the parsed ABIs held by an item, used for the byte budget
+// Notice: a contractABI shared with the other items is counted by every item, so the budget is an upper bound
+func ItemSize(item *CacheItem) int64 {
+	size := int64(itemOverhead + len(item.Signature) + 8*len(item.Deployments))
+	if item.FunctionABI != nil {
+		size += methodSize(item.FunctionABI)
+	}
+	if item.ContractABI != nil {
+		size += abiSize(item.ContractABI)
+	}
+	if item.Negative != nil {
+		size += int64(len(item.Negative.Error()))
+	}
+	return size
+}
+
+// @dev The approximate bytes of a parsed contract ABI
+func abiSize(contractABI *abi.ABI) int64 {
+	size := int64(abiOverhead)
+	size += methodSize(&contractABI.Constructor) + methodSize(&contractABI.Fallback) + methodSize(&contractABI.Receive)
+	for name, method := range contractABI.Methods {
+		size += int64(len(name)) + methodSize(&method)
+	}
+	for name, event := range contractABI.Events {
+		size += int64(len(name)+eventOverhead+len(event.Name)+len(event.RawName)+len(event.Sig)) + argumentsSize(event.Inputs)
+	}
+	for name, abiError := range contractABI.Errors {
+		size += int64(len(name)+errorOverhead+len(abiError.Name)+len(abiError.Sig)) + argumentsSize(abiError.Inputs)
+	}
+	return size
+}
+
+// @dev The approximate bytes of a parsed function
+func methodSize(method *abi.Method) int64 {
+	size := int64(methodOverhead + len(method.Name) + len(method.RawName) + len(method.Sig) + len(method.StateMutability) + len(method.ID))
+	return size + argumentsSize(method.Inputs) + argumentsSize(method.Outputs)
+}
+
+// @dev The approximate bytes of the parsed inputs or outputs
+func argumentsSize(arguments abi.Arguments) int64 {
+	var size int64
+	for _, argument := range arguments {
+		size += int64(argumentOverhead+len(argument.Name)) + typeSize(&argument.Type)
+	}
+	return size
+}
+
+// @dev The approximate bytes of a parsed type, the tuples and arrays are counted recursively
+func typeSize(t *abi.Type) int64 {
+	size := int64(typeOverhead + len(t.TupleRawName))
+	if t.Elem != nil {
+		size += typeSize(t.Elem)
+	}
+	for i, elem := range t.TupleElems {
+		size += typeSize(elem)
+		if i < len(t.TupleRawNames) {
+			size += int64(len(t.TupleRawNames[i]))
+		}
+	}
+	return size
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+)
+
+// The kinds of [ABIEntry]
+const (
+	KindFunction    = "function"
+	KindEvent       = "event"
+	KindError       = "error"
+	KindConstructor = "constructor"
+	KindFallback    = "fallback"
+	KindReceive     = "receive"
+)
+
+// The namespace of the [ABIEntry] IDs derived from their fragments
+var abiEntryNamespace = uuid.MustParse("5d0f8a6c-2b1e-4f3a-8c7d-9e4b6a2f1c08")
+
+// NewABIEntries
+// @dev Split a JSON ABI into [ABIEntry] items, the same item of two ABIs has the same ID
+// @param contractABI: the JSON ABI, E.g. the ContractABI of [ContractBytecode]
+// Notice: the fragment is the item with sorted keys, no spaces and the type, so the formatting of the sources does not matter
+func NewABIEntries(contractABI string) ([]ABIEntry, error) {
+	var rawMessages []json.RawMessage
+	if err := json.Unmarshal([]byte(contractABI), &rawMessages); err != nil {
+		return nil, errors.Wrap(err, "Invalid ABI")
+	}
+
+	var entries []ABIEntry
+	isAdded := make(map[uuid.UUID]bool)
+	for _, raw := range rawMessages {
+		var item map[string]interface{}
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return nil, errors.Wrap(err, "Invalid ABI item")
+		}
+		if _, isFound := item["type"]; !isFound {
+			item["type"] = KindFunction // the default type of the ABI specification
+		}
+		fragment, err := json.Marshal(item) // the keys of a map are sorted
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid ABI item")
+		}
+		theABI, err := abi.JSON(strings.NewReader("[" + string(fragment) + "]"))
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid ABI item")
+		}
+
+		entry := ABIEntry{ID: uuid.NewSHA1(abiEntryNamespace, fragment), Fragment: string(fragment)}
+		if isAdded[entry.ID] {
+			continue
+		}
+		entry.Kind, _ = item["type"].(string)
+		switch entry.Kind {
+		case KindFunction:
+			for _, method := range theABI.Methods {
+				entry.Name, entry.Signature, entry.Selector, entry.StateMutability = method.RawName, method.Sig, method.ID, method.StateMutability
+			}
+		case KindEvent:
+			for _, event := range theABI.Events {
+				entry.Name, entry.Signature, entry.Selector = event.RawName, event.Sig, event.ID.Bytes()
+			}
+		case KindError:
+			for _, abiError := range theABI.Errors {
+				entry.Name, entry.Signature, entry.Selector = abiError.Name, abiError.Sig, abiError.ID.Bytes()[:4]
+			}
+		case KindConstructor:
+			entry.Signature, entry.StateMutability = "constructor"+arguments(theABI.Constructor.Inputs), theABI.Constructor.StateMutability
+		case KindFallback:
+			entry.Signature, entry.StateMutability = "fallback()", theABI.Fallback.StateMutability
+		case KindReceive:
+			entry.Signature, entry.StateMutability = "receive()", theABI.Receive.StateMutability
+		default:
+			return nil, errors.New("Unknown ABI item: " + string(fragment))
+		}
+		isAdded[entry.ID] = true
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// StoreABIEntries
+// @dev Store the items of the ABI of a bytecode: [ABIEntry] unless they exist, and [BytecodeABIEntry]
+// Notice: upserts, storing the same ABI again does nothing
+func StoreABIEntries(tx *gorm.DB, contractBytecodeID uuid.UUID, entries []ABIEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&entries).Error; err != nil {
+		return errors.Wrap(err, "Fail to create the ABIEntry items")
+	}
+	links := make([]BytecodeABIEntry, 0, len(entries))
+	for _, entry := range entries {
+		links = append(links, BytecodeABIEntry{ContractBytecodeID: contractBytecodeID, ABIEntryID: entry.ID})
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&links).Error; err != nil {
+		return errors.Wrap(err, "Fail to create the BytecodeABIEntry items")
+	}
+	return nil
+}
+
+// FindABIEntries
+// @dev The [ABIEntry] items by kind, name and selector, E.g. every function whose selector is 0xa9059cbb
+// @param kind, name, selector: "" or nil matches any
+func FindABIEntries(db *gorm.DB, kind string, name string, selector []byte) ([]ABIEntry, error) {
+	query := db.Model(&ABIEntry{})
+	if kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	if name != "" {
+		query = query.Where("name = ?", name)
+	}
+	if len(selector) > 0 {
+		query = query.Where("selector = ?", selector)
+	}
+	var entries []ABIEntry
+	if err := query.Order("signature ASC").Find(&entries).Error; err != nil {
+		return nil, errors.Wrap(err, "Fail to find the ABIEntry items")
+	}
+	return entries, nil
+}
+
+// @dev The types of the arguments, E.g. (address,uint256)
+func arguments(inputs abi.Arguments) string {
+	types := make([]string, 0, len(inputs))
+	for _, input := range inputs {
+		types = append(types, input.Type.String())
+	}
+	return fmt.Sprintf("(%s)", strings.Join(types, ","))
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Test splitting an ABI into the items, the same item of two ABIs is the same
+func TestNewABIEntries(t *testing.T) {
+	contractABI := `[
+		{"type":"constructor","inputs":[{"name":"owner","type":"address"}],"stateMutability":"nonpayable"},
+		{"name":"transfer","inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable"},
+		{"type":"event","name":"Transfer","anonymous":false,"inputs":[{"indexed":true,"name":"from","type":"address"},{"indexed":true,"name":"to","type":"address"},{"indexed":false,"name":"value","type":"uint256"}]},
+		{"type":"error","name":"InsufficientBalance","inputs":[{"name":"available","type":"uint256"}]},
+		{"type":"fallback","stateMutability":"payable"},
+		{"type":"receive","stateMutability":"payable"},
+		{"name":"transfer","inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable"}
+	]`
+	entries, err := NewABIEntries(contractABI)
+	assert.NoError(t, err)
+	if !assert.Len(t, entries, 6) { // the repeated transfer is stored once
+		return
+	}
+	assert.Equal(t, ABIEntry{ID: entries[0].ID, Kind: KindConstructor, Signature: "constructor(address)", StateMutability: "nonpayable", Fragment: entries[0].Fragment}, entries[0])
+	assert.Equal(t, KindFunction, entries[1].Kind)
+	assert.Equal(t, "transfer", entries[1].Name)
+	assert.Equal(t, "transfer(address,uint256)", entries[1].Signature)
+	assert.Equal(t, []byte{0xa9, 0x05, 0x9c, 0xbb}, entries[1].Selector)
+	assert.Equal(t, "nonpayable", entries[1].StateMutability)
+	assert.Equal(t, KindEvent, entries[2].Kind)
+	assert.Equal(t, "Transfer(address,address,uint256)", entries[2].Signature)
+	assert.Len(t, entries[2].Selector, 32)
+	assert.Equal(t, KindError, entries[3].Kind)
+	assert.Len(t, entries[3].Selector, 4)
+	assert.Equal(t, "fallback()", entries[4].Signature)
+	assert.Equal(t, KindReceive, entries[5].Kind)
+
+	// the formatting does not matter
+	same, err := NewABIEntries(`[{"stateMutability":"nonpayable","outputs":[{"type":"bool","name":""}],"name":"transfer","inputs":[{"type":"address","name":"to"},{"type":"uint256","name":"value"}]}]`)
+	assert.NoError(t, err)
+	if assert.Len(t, same, 1) {
+		assert.Equal(t, entries[1].ID, same[0].ID)
+		assert.Equal(t, entries[1].Fragment, same[0].Fragment)
+	}
+
+	_, err = NewABIEntries(`[{"type":"unknown"}]`)
+	assert.Error(t, err)
+	_, err = NewABIEntries(`{}`)
+	assert.Error(t, err)
+}
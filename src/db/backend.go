@@ -0,0 +1,110 @@
+package db
+
+import (
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// backend
+// @dev A kind of database: how to open it and its default settings
+type backend struct {
+	open   func(dsn string) gorm.Dialector
+	config config
+}
+
+// config
+// @dev The settings of Open. The connection pool, 0: the default of database/sql
+type config struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	manualMigrate   bool // true: refuse an outdated schema rather than migrating it
+	skipSchema      bool // true: neither migrate nor check the schema
+}
+
+// The built-in backends by the scheme of the DSN, postgres.go adds "postgres" with the postgres build tag
+var backends = map[string]*backend{
+	"sqlite": {open: sqlite.Open},
+}
+
+// password=... of a key-value DSN
+var passwordPattern = regexp.MustCompile(`password=\S*`)
+
+// Option
+// @dev Configure Open
+type Option func(*config)
+
+// WithMaxOpenConns
+// @dev The max number of open connections, default: 20 for Postgres, unlimited for SQLite3
+func WithMaxOpenConns(n int) Option {
+	return func(c *config) {
+		c.maxOpenConns = n
+	}
+}
+
+// WithMaxIdleConns
+// @dev The max number of idle connections, default: 10 for Postgres, 2 for SQLite3
+func WithMaxIdleConns(n int) Option {
+	return func(c *config) {
+		c.maxIdleConns = n
+	}
+}
+
+// WithConnMaxLifetime
+// @dev How long a connection is reused, E.g. shorter than the timeout of a proxy, default: 30 minutes for Postgres
+func WithConnMaxLifetime(d time.Duration) Option {
+	return func(c *config) {
+		c.connMaxLifetime = d
+	}
+}
+
+// WithAutoMigrate
+// @dev Apply the migrations of this binary when opening, default: true. false: refuse an outdated schema, E.g. when
+// several replicas share a database and `db migrate` is run at deploy time
+func WithAutoMigrate(enabled bool) Option {
+	return func(c *config) {
+		c.manualMigrate = !enabled
+	}
+}
+
+// WithoutSchemaCheck
+// @dev Open the database whatever its schema, E.g. for `db dedup` which repairs what a migration refuses
+// Notice: the caller has to run Migrate before using the models
+func WithoutSchemaCheck() Option {
+	return func(c *config) {
+		c.skipSchema = true
+	}
+}
+
+// Backend
+// @dev The name of the backend of the DSN: "sqlite" or "postgres"
+func Backend(dsn string) string {
+	name, _ := parseDSN(dsn)
+	return name
+}
+
+// @dev The DSN => the backend and the DSN for its driver
+// postgres://..., postgresql://... and "host=... dbname=..." are Postgres, sqlite://path and the other paths are SQLite3
+func parseDSN(dsn string) (string, string) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return "postgres", dsn
+	case strings.Contains(dsn, "dbname=") || strings.HasPrefix(dsn, "host="):
+		return "postgres", dsn
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return "sqlite", strings.TrimPrefix(dsn, "sqlite://")
+	}
+	return "sqlite", dsn
+}
+
+// @dev Hide the password of a DSN for the logs
+func redact(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return passwordPattern.ReplaceAllString(dsn, "password=xxxxx")
+}
@@ -71,13 +71,23 @@ func TestFunctionSignature(t *testing.T) {
 	db.Create(&cb)
 
 	fs := FunctionSignature{
-		ID:                 123456789,
+		ChainID:            1,
+		ContractAddress:    []byte{0x00, 0x1a, 0x2b, 0x3c, 0x4d},
 		ContractBytecodeID: cb.ID,
 		Signature:          []byte{0x1a, 0x2b, 0x3c, 0x4d},
-		FunctionABI:        "{\"inputs\": [], \"name\": \"testFunc\", \"type\": \"function\"}",
+		ABIEntryID:         uuid.New(),
 	}
 	result := db.Create(&fs)
 	assert.Nil(t, result.Error)
+
+	// the same chainID + contractAddress + signature + bytecode is the same item
+	fs.ABIEntryID = uuid.New()
+	assert.Error(t, db.Create(&fs).Error)
+	fs.ChainID = 56
+	assert.Nil(t, db.Create(&fs).Error)
+	// the function of another deployment at the address
+	fs.ContractBytecodeID = uuid.New()
+	assert.Nil(t, db.Create(&fs).Error)
 }
 
 func TestContractDeployment(t *testing.T) {
@@ -101,3 +111,35 @@ func TestContractDeployment(t *testing.T) {
 	result := db.Create(&cd)
 	assert.Nil(t, result.Error)
 }
+
+// Test rebuilding the FunctionSignature items keyed by a hash
+func TestMigrateFunctionSignatures(t *testing.T) {
+	legacy := OpenDatabase(t.TempDir() + "/legacy.db")
+	assert.NoError(t, legacy.Migrator().DropTable(&FunctionSignature{}))
+	assert.NoError(t, legacy.Exec("CREATE TABLE function_signatures (id bigint PRIMARY KEY, contract_bytecode_id uuid, signature blob, function_abi text)").Error)
+	assert.NoError(t, legacy.Exec("INSERT INTO function_signatures VALUES (1, 'x', x'8e58a796', '[]')").Error)
+
+	cb := ContractBytecode{
+		ID:          uuid.New(),
+		ContractABI: `[{"inputs":[],"name":"name","outputs":[{"name":"","type":"string"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"Transfer","type":"event"}]`,
+	}
+	assert.NoError(t, legacy.Create(&cb).Error)
+	address := []byte{0xda, 0xc1, 0x7f, 0x95, 0x8d, 0x2e, 0xe5, 0x23, 0xa2, 0x20, 0x62, 0x06, 0x99, 0x45, 0x97, 0xc1, 0x3d, 0x83, 0x1e, 0xc7}
+	// the older versions allowed duplicate deployments
+	assert.NoError(t, legacy.Migrator().DropTable(&ContractDeployment{}))
+	assert.NoError(t, legacy.Exec("CREATE TABLE contract_deployments (chain_id int, contract_address blob, contract_bytecode_id uuid)").Error)
+	assert.NoError(t, legacy.Exec("INSERT INTO contract_deployments VALUES (1, ?, ?), (1, ?, ?)", address, cb.ID, address, cb.ID).Error)
+
+	assert.NoError(t, migrateFunctionSignatures(legacy))
+	assert.False(t, legacy.Migrator().HasColumn(&FunctionSignature{}, "id"))
+	var functionSignatures []FunctionSignature
+	assert.NoError(t, legacy.Find(&functionSignatures).Error)
+	if assert.Len(t, functionSignatures, 1) {
+		assert.Equal(t, []byte{0x06, 0xfd, 0xde, 0x03}, functionSignatures[0].Signature) // name()
+		assert.Equal(t, address, functionSignatures[0].ContractAddress)
+		assert.Equal(t, cb.ID, functionSignatures[0].ContractBytecodeID)
+	}
+
+	// nothing to do the second time
+	assert.NoError(t, migrateFunctionSignatures(legacy))
+}
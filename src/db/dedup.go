@@ -0,0 +1,137 @@
+package db
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"strings"
+)
+
+// DedupReport
+// @dev What Dedup found, the number of rows removed by table
+type DedupReport struct {
+	Deployments     int64 // duplicate keys of contract_deployments
+	DeploymentsRows int64 // rows removed from contract_deployments
+	Searches        int64 // duplicate keys of search_etherscans
+	SearchesRows    int64 // rows removed from search_etherscans
+}
+
+// String
+// @dev The report for the command line
+func (r DedupReport) String() string {
+	return fmt.Sprintf("contract_deployments: %d duplicate keys, %d rows removed\nsearch_etherscans: %d duplicate keys, %d rows removed",
+		r.Deployments, r.DeploymentsRows, r.Searches, r.SearchesRows)
+}
+
+// Dedup
+// @dev Merge the rows with the same key, which migration 6 refuses. One-off repair of the databases of the older versions
+// @param dryRun true: only count them
+// Notice: a ContractDeployment keeps the bytecode which has an ABI, a SearchEtherscan is searched unless one of its
+// rows has been, at its first time. The database has to be at version 5 unless dryRun, Migrate stops there on ErrDuplicates
+func Dedup(db *gorm.DB, dryRun bool) (DedupReport, error) {
+	var report DedupReport
+	if !dryRun {
+		current, err := CurrentVersion(db)
+		if err != nil {
+			return report, err
+		}
+		if current < 5 {
+			return report, errors.Wrap(ErrSchemaOutdated, fmt.Sprintf("version %d, dedup needs 5", current))
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// ContractDeployment: chainID + contractAddress[ + fromBlock]
+		key := []string{"chain_id", "contract_address"}
+		if tx.Migrator().HasColumn(&ContractDeployment{}, "from_block") {
+			key = append(key, "from_block")
+		}
+		var deploymentKeys []ContractDeployment
+		if err := findDuplicates(tx, "contract_deployments", key, &deploymentKeys); err != nil {
+			return err
+		}
+		report.Deployments = int64(len(deploymentKeys))
+		for _, deploymentKey := range deploymentKeys {
+			deploymentKey := deploymentKey
+			query := func() *gorm.DB {
+				if len(key) == 3 {
+					return tx.Where("chain_id = ? AND contract_address = ? AND from_block = ?", deploymentKey.ChainID, deploymentKey.ContractAddress, deploymentKey.FromBlock)
+				}
+				return tx.Where("chain_id = ? AND contract_address = ?", deploymentKey.ChainID, deploymentKey.ContractAddress)
+			}
+			var rows []ContractDeployment
+			if err := query().Find(&rows).Error; err != nil {
+				return errors.Wrap(err, "Fail to read the deployments")
+			}
+			report.DeploymentsRows += int64(len(rows) - 1)
+			if dryRun {
+				continue
+			}
+
+			kept := rows[0]
+			for _, row := range rows {
+				var count int64
+				if err := tx.Model(&ContractBytecode{}).Where("id = ? AND contract_abi <> ''", row.ContractBytecodeID).Count(&count).Error; err != nil {
+					return errors.Wrap(err, "Fail to read the bytecode")
+				}
+				if count > 0 {
+					kept = row
+					break
+				}
+			}
+			if err := query().Delete(&ContractDeployment{}).Error; err != nil {
+				return errors.Wrap(err, "Fail to delete the deployments")
+			}
+			if err := tx.Create(&kept).Error; err != nil {
+				return errors.Wrap(err, "Fail to store the deployment")
+			}
+		}
+
+		// SearchEtherscan: chainID + contractAddress
+		var searchKeys []SearchEtherscan
+		if err := findDuplicates(tx, "search_etherscans", []string{"chain_id", "contract_address"}, &searchKeys); err != nil {
+			return err
+		}
+		report.Searches = int64(len(searchKeys))
+		for _, searchKey := range searchKeys {
+			searchKey := searchKey
+			query := func() *gorm.DB {
+				return tx.Where("chain_id = ? AND contract_address = ?", searchKey.ChainID, searchKey.ContractAddress)
+			}
+			var rows []SearchEtherscan
+			if err := query().Find(&rows).Error; err != nil {
+				return errors.Wrap(err, "Fail to read the searches")
+			}
+			report.SearchesRows += int64(len(rows) - 1)
+			if dryRun {
+				continue
+			}
+
+			merged := rows[0]
+			for _, row := range rows[1:] {
+				merged.ShouldSearch = merged.ShouldSearch && row.ShouldSearch
+				if row.Time < merged.Time {
+					merged.Time = row.Time
+				}
+			}
+			if err := query().Delete(&SearchEtherscan{}).Error; err != nil {
+				return errors.Wrap(err, "Fail to delete the searches")
+			}
+			if err := tx.Create(&merged).Error; err != nil {
+				return errors.Wrap(err, "Fail to store the search")
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+// @dev The keys which have several rows in the table, into the models
+func findDuplicates(tx *gorm.DB, table string, key []string, dest interface{}) error {
+	columns := strings.Join(key, ", ")
+	err := tx.Raw(fmt.Sprintf("SELECT %s FROM %s GROUP BY %s HAVING COUNT(*) > 1", columns, table, columns)).Scan(dest).Error
+	if err != nil {
+		return errors.Wrap(err, "Fail to find the duplicates of "+table)
+	}
+	return nil
+}
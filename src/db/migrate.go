@@ -0,0 +1,91 @@
+package db
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// NewFunctionSignatures
+// @dev The [FunctionSignature] items of a deployment, one per function of its ABI
+// @param entries: the items of the ABI, see NewABIEntries
+func NewFunctionSignatures(chainID int, contractAddress []byte, contractBytecodeID uuid.UUID, entries []ABIEntry) []FunctionSignature {
+	var functionSignatures []FunctionSignature
+	for _, entry := range entries {
+		if entry.Kind != KindFunction {
+			continue
+		}
+		functionSignatures = append(functionSignatures, FunctionSignature{
+			ChainID:            chainID,
+			ContractAddress:    contractAddress,
+			Signature:          entry.Selector, // the first 4 bytes of keccak256(transfer(address,uint256))
+			ContractBytecodeID: contractBytecodeID,
+			ABIEntryID:         entry.ID,
+		})
+	}
+	return functionSignatures
+}
+
+// The namespace of the [ContractBytecode] IDs derived from their content
+var contractBytecodeNamespace = uuid.MustParse("1b6f3a4e-6c1d-4d8e-9a57-0c2f4e8b7d31")
+
+// NewContractBytecodeID
+// @dev The ID of a crawled [ContractBytecode], derived from the bytecode and the ABI
+// Notice: a retried crawl stores the same item rather than a new one
+func NewContractBytecodeID(bytecode []byte, contractABI string) uuid.UUID {
+	data := make([]byte, 0, len(bytecode)+len(contractABI))
+	data = append(data, bytecode...)
+	data = append(data, contractABI...)
+	return uuid.NewSHA1(contractBytecodeNamespace, data)
+}
+
+// @dev The old [FunctionSignature] items are keyed by 8 bytes of a hash, which may collide, and store the last 4 bytes of
+// keccak256 as the signature. Rebuild them with the composite keys from the ABIs of [ContractDeployment]
+func migrateFunctionSignatures(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&FunctionSignature{}, "id") {
+		return nil
+	}
+	log.Warning("Rebuild the FunctionSignature items with the composite keys")
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Migrator().DropTable(&FunctionSignature{}); err != nil {
+			return errors.Wrap(err, "Fail to drop the old table")
+		}
+		if err := tx.Migrator().CreateTable(&FunctionSignature{}); err != nil {
+			return errors.Wrap(err, "Fail to create the table")
+		}
+
+		var deployments []ContractDeployment
+		if err := tx.Find(&deployments).Error; err != nil {
+			return errors.Wrap(err, "Fail to read the ContractDeployment items")
+		}
+		migrated := make(map[string]bool) // chainID-contractAddress, a contract may be stored more than once
+		for _, deployment := range deployments {
+			key := fmt.Sprintf("%d-%x", deployment.ChainID, deployment.ContractAddress)
+			if migrated[key] {
+				continue
+			}
+			migrated[key] = true
+
+			var contractBytecode ContractBytecode
+			if tx.Where("id = ?", deployment.ContractBytecodeID).First(&contractBytecode).Error != nil || contractBytecode.ContractABI == "" {
+				log.Warning("No ABI for the deployment, skip it. ChainID:", deployment.ChainID, " contractAddress:", deployment.ContractAddress)
+				continue
+			}
+			entries, err := NewABIEntries(contractBytecode.ContractABI)
+			if err != nil {
+				log.Warning("Fail to parse the ABI of the deployment, skip it. ChainID:", deployment.ChainID, " Err:", err)
+				continue
+			}
+			functionSignatures := NewFunctionSignatures(deployment.ChainID, deployment.ContractAddress, deployment.ContractBytecodeID, entries)
+			if len(functionSignatures) == 0 {
+				continue
+			}
+			if err = tx.Create(&functionSignatures).Error; err != nil {
+				return errors.Wrap(err, "Fail to create the FunctionSignature items")
+			}
+		}
+		return nil
+	})
+}
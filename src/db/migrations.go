@@ -0,0 +1,504 @@
+package db
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrSchemaTooNew
+// @dev The database is migrated by a newer binary, this one may corrupt it
+var ErrSchemaTooNew = errors.New("The schema of the database is newer than this binary")
+
+// ErrSchemaOutdated
+// @dev The database needs the migrations of this binary, E.g. run `db migrate` when the automatic migration is off
+var ErrSchemaOutdated = errors.New("The schema of the database is outdated, run db migrate")
+
+// ErrDuplicates
+// @dev The table has several rows with the same key, the older versions did not prevent them. Run `db dedup` to merge them
+var ErrDuplicates = errors.New("The table has duplicate keys, run db dedup")
+
+// SchemaVersion
+// @dev Table 8: the migrations applied to the database
+type SchemaVersion struct {
+	Version     int    `gorm:"type:int;primaryKey;autoIncrement:false"` // the version of the migration
+	Description string `gorm:"type:text"`                               // what the migration does
+	AppliedAt   int    `gorm:"type:int"`                                // UNIX timestamp
+}
+
+// TableName
+// @dev The table is schema_version
+func (SchemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// Migration
+// @dev One step of the schema, applied once in a transaction with its SchemaVersion
+// Notice: never edit a released migration, add a new one with the next version. Up has to skip what exists,
+// since migration 1 creates the tables from the current models: a new database already has the later columns
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *gorm.DB) error
+}
+
+// The models of the tables, in the order they are created
+var models = []interface{}{&ContractBytecode{}, &FunctionSignature{}, &ContractDeployment{}, &SearchEtherscan{}, &ABIOverride{}, &AddressStatus{}, &LookupStat{}, &ABIEntry{}, &BytecodeABIEntry{}, &ABIVersion{}, &WatchedProxy{}, &ProxyUpgrade{}, &ChainCursor{}, &CrawlAttempt{}}
+
+// jsonbColumns
+// @dev The ABI columns migration 5 turns into jsonb in Postgres, they always hold a valid JSON ABI
+// Notice: contract_bytecodes.contract_abi stays text, a bytecode may be stored before its ABI is known.
+// function_signatures.function_abi is replaced by abi_entries.fragment in migration 7
+var jsonbColumns = []struct {
+	model  interface{}
+	column string
+}{
+	{&FunctionSignature{}, "function_abi"},
+	{&ABIOverride{}, "contract_abi"},
+}
+
+// migrations
+// @dev The schema, in order of Version. The first ones also bring the databases created before the versions up to date
+var migrations = []Migration{
+	{Version: 1, Description: "Create the tables", Up: createTables},
+	{Version: 2, Description: "Key FunctionSignature by chainID + contractAddress + selector", Up: migrateFunctionSignatures},
+	{Version: 3, Description: "Add the columns missing in the tables created by the older versions", Up: addMissingColumns},
+	{Version: 4, Description: "Create the indexes of the lookups", Up: createIndexes},
+	{Version: 5, Description: "Store the ABIs as jsonb in Postgres", Up: useJSONB},
+	{Version: 6, Description: "Key ContractDeployment and SearchEtherscan", Up: addPrimaryKeys},
+	{Version: 7, Description: "Store the ABI items once in ABIEntry", Up: normaliseABIEntries},
+	{Version: 8, Description: "Record the ABIs seen at the addresses in ABIVersion", Up: recordABIVersions},
+	{Version: 9, Description: "Create the tables of the upgrade watcher", Up: createTables},
+	{Version: 10, Description: "Keep the FunctionSignature items of every deployment", Up: keySignaturesByBytecode},
+	{Version: 11, Description: "Delay the search of the contracts found by the block follower", Up: followBlocks},
+	{Version: 12, Description: "Search the queued addresses by priority", Up: prioritiseSearches},
+	{Version: 13, Description: "Record the requests of the queued addresses", Up: addMissingColumns},
+	{Version: 14, Description: "Back off the re-checks of the addresses without ABI", Up: addMissingColumns},
+	{Version: 15, Description: "Record the crawl attempts and dead-letter the failing addresses", Up: deadLetterSearches},
+}
+
+// keyedTables
+// @dev The tables migration 6 gives a primary key, with the indexes the older versions created on them
+var keyedTables = []struct {
+	model   interface{}
+	key     []string
+	indexes []string
+}{
+	{&ContractDeployment{}, []string{"chain_id", "contract_address", "from_block"}, []string{"idx_contract_deployment"}},
+	{&SearchEtherscan{}, []string{"chain_id", "contract_address"}, []string{"idx_search_etherscan", "idx_search_etherscans_chain_id", "idx_search_etherscans_should_search"}},
+}
+
+// searchIndexes
+// @dev The indexes of SearchEtherscan, created by name in the migrations which add their columns. Not tagged in the
+// model: migrations 1, 3 and 4 would create them on the unkeyed tables of the older versions, and migration 6 would
+// fail on their global names
+var searchIndexes = []string{
+	"CREATE INDEX IF NOT EXISTS idx_search_etherscans_priority ON search_etherscans (priority)",
+	"CREATE INDEX IF NOT EXISTS idx_search_etherscans_dead_lettered_at ON search_etherscans (dead_lettered_at)",
+}
+
+// LatestVersion
+// @dev The version of the schema this binary understands
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// CurrentVersion
+// @dev The version of the schema of the database, 0: no migration applied, E.g. a new database or one created before the versions
+func CurrentVersion(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&SchemaVersion{}) {
+		return 0, nil
+	}
+	var version int
+	if err := db.Model(&SchemaVersion{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error; err != nil {
+		return 0, errors.Wrap(err, "Fail to read the schema version")
+	}
+	return version, nil
+}
+
+// Migrate
+// @dev Apply the migrations newer than the schema of the database, in order
+// @return the number of migrations applied
+// Notice: refuses a database migrated by a newer binary. In Postgres the replicas starting together wait for each other
+func Migrate(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&SchemaVersion{}) {
+		if err := db.Migrator().CreateTable(&SchemaVersion{}); err != nil {
+			return 0, errors.Wrap(err, "Fail to create the schema_version table")
+		}
+	}
+	current, err := CurrentVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if current > LatestVersion() {
+		return 0, errors.Wrap(ErrSchemaTooNew, fmt.Sprintf("version %d, this binary understands %d", current, LatestVersion()))
+	}
+
+	applied := 0
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+		isApplied := false
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if tx.Dialector.Name() == "postgres" {
+				// serialize the replicas, then check whether another one has applied it meanwhile
+				if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLock).Error; err != nil {
+					return errors.Wrap(err, "Fail to lock the migrations")
+				}
+				var count int64
+				if err := tx.Model(&SchemaVersion{}).Where("version = ?", migration.Version).Count(&count).Error; err != nil || count > 0 {
+					return err
+				}
+			}
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+			isApplied = true
+			return tx.Create(&SchemaVersion{Version: migration.Version, Description: migration.Description, AppliedAt: int(time.Now().Unix())}).Error
+		})
+		if err != nil {
+			return applied, errors.Wrap(err, fmt.Sprintf("Fail to apply the migration %d: %s", migration.Version, migration.Description))
+		}
+		if isApplied {
+			log.Info("Apply the migration ", migration.Version, ": ", migration.Description)
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+// CheckVersion
+// @dev Make sure the schema of the database is the one of this binary, without migrating it
+func CheckVersion(db *gorm.DB) error {
+	current, err := CurrentVersion(db)
+	if err != nil {
+		return err
+	}
+	switch {
+	case current > LatestVersion():
+		return errors.Wrap(ErrSchemaTooNew, fmt.Sprintf("version %d, this binary understands %d", current, LatestVersion()))
+	case current < LatestVersion():
+		return errors.Wrap(ErrSchemaOutdated, fmt.Sprintf("version %d, this binary needs %d", current, LatestVersion()))
+	}
+	return nil
+}
+
+// The key of the Postgres advisory lock of the migrations
+const migrationLock = 0x616269 // "abi"
+
+// @dev Migration 1: create the tables which do not exist
+func createTables(tx *gorm.DB) error {
+	for _, model := range models {
+		if tx.Migrator().HasTable(model) {
+			continue
+		}
+		if err := tx.Migrator().CreateTable(model); err != nil {
+			return errors.Wrap(err, "Fail to create the table")
+		}
+	}
+	return nil
+}
+
+// @dev Migration 3: add the columns of the models which the tables do not have, E.g. ContractBytecode.MetadataHash
+func addMissingColumns(tx *gorm.DB) error {
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(model); err != nil {
+			return errors.Wrap(err, "Fail to parse the model")
+		}
+		for _, name := range stmt.Schema.DBNames {
+			if tx.Migrator().HasColumn(model, name) {
+				continue
+			}
+			if err := tx.Migrator().AddColumn(model, name); err != nil {
+				return errors.Wrap(err, "Fail to add the column "+stmt.Schema.Table+"."+name)
+			}
+		}
+	}
+	return nil
+}
+
+// @dev Migration 4: create the indexes of the models which do not exist
+func createIndexes(tx *gorm.DB) error {
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(model); err != nil {
+			return errors.Wrap(err, "Fail to parse the model")
+		}
+		var names []string
+		for name := range stmt.Schema.ParseIndexes() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if tx.Migrator().HasIndex(model, name) {
+				continue
+			}
+			if err := tx.Migrator().CreateIndex(model, name); err != nil {
+				return errors.Wrap(err, "Fail to create the index "+name)
+			}
+		}
+	}
+	return nil
+}
+
+// @dev Create the indexes of searchIndexes which do not exist
+func createSearchIndexes(tx *gorm.DB) error {
+	for _, statement := range searchIndexes {
+		if err := tx.Exec(statement).Error; err != nil {
+			return errors.Wrap(err, "Fail to create the index: "+statement)
+		}
+	}
+	return nil
+}
+
+// @dev Migration 5: turn the ABI columns into jsonb in Postgres, nothing in SQLite3
+func useJSONB(tx *gorm.DB) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	for _, item := range jsonbColumns {
+		if !tx.Migrator().HasColumn(item.model, item.column) { // removed by a later migration
+			continue
+		}
+		if err := toJSONB(tx, item.model, item.column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// @dev Turn the column into jsonb, in Postgres only
+func toJSONB(tx *gorm.DB, model interface{}, column string) error {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return errors.Wrap(err, "Fail to parse the model")
+	}
+	table := stmt.Schema.Table
+	err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE jsonb USING %s::jsonb", table, column, column)).Error
+	if err != nil {
+		return errors.Wrap(err, "Fail to turn "+table+"."+column+" into jsonb")
+	}
+	return nil
+}
+
+// @dev Migration 6: rebuild ContractDeployment and SearchEtherscan with their primary key, unless they have it
+// Notice: refuses the tables with duplicate keys, see Dedup
+func addPrimaryKeys(tx *gorm.DB) error {
+	for _, item := range keyedTables {
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(item.model); err != nil {
+			return errors.Wrap(err, "Fail to parse the model")
+		}
+		table := stmt.Schema.Table
+		isKeyed, err := hasPrimaryKey(tx, item.model, item.key[0])
+		if err != nil {
+			return err
+		}
+		if isKeyed {
+			continue
+		}
+		duplicates, err := countDuplicates(tx, table, item.key)
+		if err != nil {
+			return err
+		}
+		if duplicates > 0 {
+			return errors.Wrap(ErrDuplicates, fmt.Sprintf("%d keys of %s", duplicates, table))
+		}
+
+		// the index names are global, drop them before creating the new table
+		for _, index := range item.indexes {
+			if tx.Migrator().HasIndex(item.model, index) {
+				if err := tx.Migrator().DropIndex(item.model, index); err != nil {
+					return errors.Wrap(err, "Fail to drop the index "+index)
+				}
+			}
+		}
+		if err := tx.Migrator().RenameTable(table, table+"_old"); err != nil {
+			return errors.Wrap(err, "Fail to rename the table "+table)
+		}
+		if err := tx.Migrator().CreateTable(item.model); err != nil {
+			return errors.Wrap(err, "Fail to create the table "+table)
+		}
+		columns := strings.Join(stmt.Schema.DBNames, ", ")
+		if err := tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s_old", table, columns, columns, table)).Error; err != nil {
+			return errors.Wrap(err, "Fail to copy the rows of "+table)
+		}
+		if err := tx.Migrator().DropTable(table + "_old"); err != nil {
+			return errors.Wrap(err, "Fail to drop the table "+table+"_old")
+		}
+	}
+	return nil
+}
+
+// @dev Whether the column is part of the primary key of the table
+func hasPrimaryKey(tx *gorm.DB, model interface{}, column string) (bool, error) {
+	columnTypes, err := tx.Migrator().ColumnTypes(model)
+	if err != nil {
+		return false, errors.Wrap(err, "Fail to read the columns")
+	}
+	for _, columnType := range columnTypes {
+		if columnType.Name() == column {
+			isPrimaryKey, _ := columnType.PrimaryKey()
+			return isPrimaryKey, nil
+		}
+	}
+	return false, nil
+}
+
+// @dev The number of keys which have several rows in the table
+func countDuplicates(tx *gorm.DB, table string, key []string) (int64, error) {
+	var count int64
+	columns := strings.Join(key, ", ")
+	err := tx.Raw(fmt.Sprintf("SELECT COUNT(*) FROM (SELECT %s FROM %s GROUP BY %s HAVING COUNT(*) > 1) AS duplicates", columns, table, columns)).Scan(&count).Error
+	if err != nil {
+		return 0, errors.Wrap(err, "Fail to count the duplicates of "+table)
+	}
+	return count, nil
+}
+
+// @dev Migration 7: split the ABIs of the bytecodes into [ABIEntry], point [FunctionSignature] at them instead of
+// function_abi, the JSON of its function, then drop function_abi
+// Notice: also the bytecodes whose FunctionSignature items migration 2 rebuilt, their abi_entry_id has no item yet
+func normaliseABIEntries(tx *gorm.DB) error {
+	if err := createTables(tx); err != nil {
+		return err
+	}
+	if !tx.Migrator().HasColumn(&FunctionSignature{}, "abi_entry_id") {
+		if err := tx.Migrator().AddColumn(&FunctionSignature{}, "abi_entry_id"); err != nil {
+			return errors.Wrap(err, "Fail to add the column function_signatures.abi_entry_id")
+		}
+	}
+
+	var contractBytecodes []ContractBytecode
+	err := tx.Where("contract_abi <> '' AND id NOT IN (?)", tx.Model(&BytecodeABIEntry{}).Select("contract_bytecode_id")).
+		FindInBatches(&contractBytecodes, 100, func(batch *gorm.DB, _ int) error {
+			for _, contractBytecode := range contractBytecodes {
+				entries, err := NewABIEntries(contractBytecode.ContractABI)
+				if err != nil {
+					log.Warning("Fail to parse the ABI of the bytecode, skip it. contractBytecodeID:", contractBytecode.ID, " Err:", err)
+					continue
+				}
+				if err = StoreABIEntries(tx, contractBytecode.ID, entries); err != nil {
+					return err
+				}
+				for _, entry := range entries {
+					if entry.Kind != KindFunction {
+						continue
+					}
+					err = tx.Model(&FunctionSignature{}).
+						Where("contract_bytecode_id = ? AND signature = ?", contractBytecode.ID, entry.Selector).
+						Update("abi_entry_id", entry.ID).Error
+					if err != nil {
+						return errors.Wrap(err, "Fail to update the FunctionSignature items")
+					}
+				}
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return errors.Wrap(err, "Fail to split the ABIs")
+	}
+	if tx.Migrator().HasColumn(&FunctionSignature{}, "function_abi") {
+		// SQLite3 >= 3.35 and Postgres, the Migrator of SQLite3 rebuilds the table and misses the unquoted columns
+		if err := tx.Exec("ALTER TABLE function_signatures DROP COLUMN function_abi").Error; err != nil {
+			return errors.Wrap(err, "Fail to drop the column function_signatures.function_abi")
+		}
+	}
+
+	if err := createIndexes(tx); err != nil {
+		return err
+	}
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	return toJSONB(tx, &ABIEntry{}, "fragment")
+}
+
+// @dev Migration 8: create [ABIVersion], the current deployments are the first versions, seen at an unknown block
+func recordABIVersions(tx *gorm.DB) error {
+	if err := createTables(tx); err != nil {
+		return err
+	}
+	var count int64
+	if err := tx.Model(&ABIVersion{}).Count(&count).Error; err != nil || count > 0 {
+		return err
+	}
+	err := tx.Exec("INSERT INTO abi_versions (chain_id, contract_address, version, contract_bytecode_id, block_number, seen_at) "+
+		"SELECT chain_id, contract_address, 1, contract_bytecode_id, 0, ? FROM contract_deployments WHERE from_block = 0", time.Now().Unix()).Error
+	if err != nil {
+		return errors.Wrap(err, "Fail to record the deployments as the first versions")
+	}
+	return nil
+}
+
+// @dev Migration 10: rebuild FunctionSignature with contractBytecodeID in its primary key, unless it has it, so the
+// functions of the earlier deployments of an address are kept for the lookups at their blocks
+func keySignaturesByBytecode(tx *gorm.DB) error {
+	isKeyed, err := hasPrimaryKey(tx, &FunctionSignature{}, "contract_bytecode_id")
+	if err != nil || isKeyed {
+		return err
+	}
+
+	// the index names are global, drop them before creating the new table
+	for _, index := range []string{"idx_function_signatures_contract_bytecode_id", "idx_function_signatures_abi_entry_id"} {
+		if tx.Migrator().HasIndex(&FunctionSignature{}, index) {
+			if err := tx.Migrator().DropIndex(&FunctionSignature{}, index); err != nil {
+				return errors.Wrap(err, "Fail to drop the index "+index)
+			}
+		}
+	}
+	if err := tx.Migrator().RenameTable("function_signatures", "function_signatures_old"); err != nil {
+		return errors.Wrap(err, "Fail to rename the table function_signatures")
+	}
+	if err := tx.Migrator().CreateTable(&FunctionSignature{}); err != nil {
+		return errors.Wrap(err, "Fail to create the table function_signatures")
+	}
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(&FunctionSignature{}); err != nil {
+		return errors.Wrap(err, "Fail to parse the model")
+	}
+	columns := strings.Join(stmt.Schema.DBNames, ", ")
+	err = tx.Exec(fmt.Sprintf("INSERT INTO function_signatures (%s) SELECT %s FROM function_signatures_old", columns, columns)).Error
+	if err != nil {
+		return errors.Wrap(err, "Fail to copy the rows of function_signatures")
+	}
+	if err := tx.Migrator().DropTable("function_signatures_old"); err != nil {
+		return errors.Wrap(err, "Fail to drop the table function_signatures_old")
+	}
+	return nil
+}
+
+// @dev Migration 11: SearchEtherscan.NotBefore and the table of the block follower
+func followBlocks(tx *gorm.DB) error {
+	if err := createTables(tx); err != nil {
+		return err
+	}
+	return addMissingColumns(tx)
+}
+
+// @dev Migration 12: SearchEtherscan.Priority and its index
+func prioritiseSearches(tx *gorm.DB) error {
+	if err := addMissingColumns(tx); err != nil {
+		return err
+	}
+	return createSearchIndexes(tx)
+}
+
+// @dev Migration 15: the table of the crawl attempts, and SearchEtherscan.Failures, LastError, DeadLetteredAt with its index
+func deadLetterSearches(tx *gorm.DB) error {
+	if err := createTables(tx); err != nil {
+		return err
+	}
+	if err := addMissingColumns(tx); err != nil {
+		return err
+	}
+	if err := createIndexes(tx); err != nil {
+		return err
+	}
+	return createSearchIndexes(tx)
+}
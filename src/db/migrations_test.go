@@ -0,0 +1,243 @@
+package db
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+// Test migrating a new database, and refusing the schemas this binary does not match
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ABIs.db")
+
+	// automatic migration off: a new database is outdated
+	_, err := Open(path, WithAutoMigrate(false))
+	assert.ErrorIs(t, err, ErrSchemaOutdated)
+
+	db, err := Open(path)
+	assert.NoError(t, err)
+	version, err := CurrentVersion(db)
+	assert.NoError(t, err)
+	assert.Equal(t, LatestVersion(), version)
+	var versions []SchemaVersion
+	assert.NoError(t, db.Order("version ASC").Find(&versions).Error)
+	assert.Len(t, versions, len(migrations))
+	for i, migration := range migrations {
+		assert.Equal(t, migration.Version, versions[i].Version)
+		assert.Equal(t, migration.Description, versions[i].Description)
+	}
+
+	// nothing to do the second time
+	applied, err := Migrate(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, applied)
+	_, err = Open(path, WithAutoMigrate(false))
+	assert.NoError(t, err)
+
+	// migrated by a newer binary
+	assert.NoError(t, db.Create(&SchemaVersion{Version: LatestVersion() + 1, Description: "from the future"}).Error)
+	_, err = Migrate(db)
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+	_, err = Open(path)
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+	_, err = Open(path, WithAutoMigrate(false))
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+}
+
+// Test bringing a database created before the versions up to date
+func TestMigrateLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ABIs.db")
+	legacy, err := Open(path)
+	assert.NoError(t, err)
+	// the schema of an old ABIs.db: no versions, no metadata columns, no indexes, FunctionSignature keyed by a hash
+	for _, table := range []string{"schema_version", "contract_bytecodes", "function_signatures", "contract_deployments", "search_etherscans", "lookup_stats"} {
+		assert.NoError(t, legacy.Exec("DROP TABLE "+table).Error)
+	}
+	for _, statement := range []string{
+		"CREATE TABLE contract_bytecodes (id uuid PRIMARY KEY, bytecode blob, source_code text, compile_time_params text, contract_abi text)",
+		"CREATE TABLE function_signatures (id bigint PRIMARY KEY, contract_bytecode_id uuid, signature blob, function_abi text)",
+		"CREATE TABLE contract_deployments (chain_id int, contract_address blob, contract_bytecode_id uuid)",
+		"CREATE TABLE search_etherscans (chain_id int, contract_address blob, time int, should_search boolean)",
+	} {
+		assert.NoError(t, legacy.Exec(statement).Error)
+	}
+	id := uuid.New()
+	address := []byte{0xda, 0xc1, 0x7f, 0x95, 0x8d, 0x2e, 0xe5, 0x23, 0xa2, 0x20, 0x62, 0x06, 0x99, 0x45, 0x97, 0xc1, 0x3d, 0x83, 0x1e, 0xc7}
+	assert.NoError(t, legacy.Exec("INSERT INTO contract_bytecodes (id, contract_abi) VALUES (?, ?)", id,
+		`[{"inputs":[],"name":"name","outputs":[{"name":"","type":"string"}],"stateMutability":"view","type":"function"}]`).Error)
+	assert.NoError(t, legacy.Exec("INSERT INTO contract_deployments VALUES (1, ?, ?)", address, id).Error)
+	sqlDB, _ := legacy.DB()
+	assert.NoError(t, sqlDB.Close())
+
+	db, err := Open(path)
+	assert.NoError(t, err)
+	version, err := CurrentVersion(db)
+	assert.NoError(t, err)
+	assert.Equal(t, LatestVersion(), version)
+	assert.True(t, db.Migrator().HasColumn(&ContractBytecode{}, "metadata_hash"))
+	assert.True(t, db.Migrator().HasColumn(&ContractBytecode{}, "compiler_version"))
+	assert.True(t, db.Migrator().HasTable(&LookupStat{}))
+	isPrimaryKey, err := hasPrimaryKey(db, &ContractDeployment{}, "chain_id")
+	assert.NoError(t, err)
+	assert.True(t, isPrimaryKey)
+	assert.True(t, db.Migrator().HasIndex(&ContractBytecode{}, "idx_contract_bytecodes_metadata_hash"))
+	assert.True(t, db.Migrator().HasIndex(&SearchEtherscan{}, "idx_search_etherscans_priority"))
+	assert.True(t, db.Migrator().HasIndex(&SearchEtherscan{}, "idx_search_etherscans_dead_lettered_at"))
+
+	var functionSignatures []FunctionSignature
+	assert.NoError(t, db.Find(&functionSignatures).Error)
+	if assert.Len(t, functionSignatures, 1) {
+		assert.Equal(t, []byte{0x06, 0xfd, 0xde, 0x03}, functionSignatures[0].Signature) // name()
+		assert.Equal(t, address, functionSignatures[0].ContractAddress)
+		// the ABI items are stored by migration 7
+		var entry ABIEntry
+		assert.NoError(t, db.Where("id = ?", functionSignatures[0].ABIEntryID).First(&entry).Error)
+		assert.Equal(t, "name()", entry.Signature)
+	}
+	var contractBytecode ContractBytecode
+	assert.NoError(t, db.Where("id = ?", id).First(&contractBytecode).Error)
+	assert.Contains(t, contractBytecode.ContractABI, `"name"`)
+
+	// the deployment is the first version of the address
+	var versions []ABIVersion
+	assert.NoError(t, db.Find(&versions).Error)
+	if assert.Len(t, versions, 1) {
+		assert.Equal(t, 1, versions[0].Version)
+		assert.Equal(t, id, versions[0].ContractBytecodeID)
+	}
+}
+
+// Test refusing the duplicate keys of the older versions, then merging them
+func TestDedup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ABIs.db")
+	legacy, err := Open(path)
+	assert.NoError(t, err)
+	for _, table := range []string{"schema_version", "contract_deployments", "search_etherscans"} {
+		assert.NoError(t, legacy.Exec("DROP TABLE "+table).Error)
+	}
+	assert.NoError(t, legacy.Exec("CREATE TABLE contract_deployments (chain_id int, contract_address blob, contract_bytecode_id uuid)").Error)
+	assert.NoError(t, legacy.Exec("CREATE TABLE search_etherscans (chain_id int, contract_address blob, time int, should_search boolean)").Error)
+	withABI, withoutABI := uuid.New(), uuid.New()
+	assert.NoError(t, legacy.Create(&ContractBytecode{ID: withABI, ContractABI: "[]"}).Error)
+	assert.NoError(t, legacy.Create(&ContractBytecode{ID: withoutABI}).Error)
+	address := []byte{0xda, 0xc1, 0x7f, 0x95, 0x8d, 0x2e, 0xe5, 0x23, 0xa2, 0x20, 0x62, 0x06, 0x99, 0x45, 0x97, 0xc1, 0x3d, 0x83, 0x1e, 0xc7}
+	other := []byte{0xa0, 0xb8, 0x69, 0x91, 0xc6, 0x21, 0x8b, 0x36, 0xc1, 0xd1, 0x9d, 0x4a, 0x2e, 0x9e, 0xb0, 0xce, 0x36, 0x06, 0xeb, 0x48}
+	assert.NoError(t, legacy.Exec("INSERT INTO contract_deployments VALUES (1, ?, ?), (1, ?, ?), (1, ?, ?), (56, ?, ?)",
+		address, withoutABI, address, withABI, address, withoutABI, address, withoutABI).Error)
+	assert.NoError(t, legacy.Exec("INSERT INTO search_etherscans VALUES (1, ?, 1700000100, true), (1, ?, 1700000000, false), (1, ?, 1700000000, true)",
+		address, address, other).Error)
+	sqlDB, _ := legacy.DB()
+	assert.NoError(t, sqlDB.Close())
+
+	// the migrations before the keys are applied
+	_, err = Open(path)
+	assert.ErrorIs(t, err, ErrDuplicates)
+	db, err := Open(path, WithoutSchemaCheck())
+	assert.NoError(t, err)
+	version, err := CurrentVersion(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, version)
+
+	report, err := Dedup(db, true)
+	assert.NoError(t, err)
+	assert.Equal(t, DedupReport{Deployments: 1, DeploymentsRows: 2, Searches: 1, SearchesRows: 1}, report)
+	var count int64
+	assert.NoError(t, db.Model(&ContractDeployment{}).Count(&count).Error)
+	assert.Equal(t, int64(4), count)
+
+	report, err = Dedup(db, false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), report.DeploymentsRows)
+	_, err = Migrate(db)
+	assert.NoError(t, err)
+	assert.NoError(t, CheckVersion(db))
+
+	var deployments []ContractDeployment
+	assert.NoError(t, db.Order("chain_id ASC").Find(&deployments).Error)
+	if assert.Len(t, deployments, 2) {
+		assert.Equal(t, withABI, deployments[0].ContractBytecodeID)
+		assert.Equal(t, int64(0), deployments[0].FromBlock)
+	}
+	var searches []SearchEtherscan
+	assert.NoError(t, db.Where("contract_address = ?", address).Find(&searches).Error)
+	if assert.Len(t, searches, 1) {
+		assert.False(t, searches[0].ShouldSearch)
+		assert.Equal(t, 1700000000, searches[0].Time)
+	}
+	assert.Error(t, db.Create(&SearchEtherscan{ChainID: 1, ContractAddress: other}).Error)
+}
+
+// Test moving the function_abi of FunctionSignature into ABIEntry
+func TestMigrateABIEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ABIs.db")
+	legacy, err := Open(path)
+	assert.NoError(t, err)
+	// the schema of version 6
+	assert.NoError(t, legacy.Exec("DELETE FROM schema_version WHERE version >= 7").Error)
+	for _, table := range []string{"abi_entries", "bytecode_abi_entries", "function_signatures"} {
+		assert.NoError(t, legacy.Exec("DROP TABLE "+table).Error)
+	}
+	assert.NoError(t, legacy.Exec("CREATE TABLE function_signatures (chain_id int, contract_address blob, signature blob, contract_bytecode_id uuid, function_abi text, PRIMARY KEY (chain_id, contract_address, signature))").Error)
+	id := uuid.New()
+	address := []byte{0xda, 0xc1, 0x7f, 0x95, 0x8d, 0x2e, 0xe5, 0x23, 0xa2, 0x20, 0x62, 0x06, 0x99, 0x45, 0x97, 0xc1, 0x3d, 0x83, 0x1e, 0xc7}
+	functionABI := `{"inputs":[],"name":"name","outputs":[{"name":"","type":"string"}],"stateMutability":"view","type":"function"}`
+	assert.NoError(t, legacy.Create(&ContractBytecode{ID: id, ContractABI: `[` + functionABI + `,{"type":"event","name":"Paused","inputs":[]}]`}).Error)
+	assert.NoError(t, legacy.Exec("INSERT INTO function_signatures VALUES (1, ?, ?, ?, ?)", address, []byte{0x06, 0xfd, 0xde, 0x03}, id, "["+functionABI+"]").Error)
+	sqlDB, _ := legacy.DB()
+	assert.NoError(t, sqlDB.Close())
+
+	db, err := Open(path)
+	assert.NoError(t, err)
+	assert.False(t, db.Migrator().HasColumn(&FunctionSignature{}, "function_abi"))
+	assert.True(t, db.Migrator().HasIndex(&FunctionSignature{}, "idx_function_signatures_abi_entry_id"))
+	var links int64
+	assert.NoError(t, db.Model(&BytecodeABIEntry{}).Where("contract_bytecode_id = ?", id).Count(&links).Error)
+	assert.Equal(t, int64(2), links)
+
+	var functionSignature FunctionSignature
+	assert.NoError(t, db.Where("chain_id = ? AND contract_address = ?", 1, address).First(&functionSignature).Error)
+	var entry ABIEntry
+	assert.NoError(t, db.Where("id = ?", functionSignature.ABIEntryID).First(&entry).Error)
+	assert.Equal(t, "name()", entry.Signature)
+	assert.JSONEq(t, functionABI, entry.Fragment)
+	assert.Error(t, db.Create(&FunctionSignature{ChainID: 1, ContractAddress: address, Signature: []byte{0x06, 0xfd, 0xde, 0x03}, ContractBytecodeID: id}).Error)
+}
+
+// Test keying FunctionSignature by the bytecode too, the functions of another bytecode at the address are kept apart
+func TestKeySignaturesByBytecode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ABIs.db")
+	legacy, err := Open(path)
+	assert.NoError(t, err)
+	// the schema of version 9
+	assert.NoError(t, legacy.Exec("DELETE FROM schema_version WHERE version >= 10").Error)
+	assert.NoError(t, legacy.Exec("DROP TABLE function_signatures").Error)
+	for _, statement := range []string{
+		"CREATE TABLE function_signatures (chain_id int, contract_address blob, signature blob, contract_bytecode_id uuid, abi_entry_id uuid, PRIMARY KEY (chain_id, contract_address, signature))",
+		"CREATE INDEX idx_function_signatures_contract_bytecode_id ON function_signatures (contract_bytecode_id)",
+		"CREATE INDEX idx_function_signatures_abi_entry_id ON function_signatures (abi_entry_id)",
+	} {
+		assert.NoError(t, legacy.Exec(statement).Error)
+	}
+	address := []byte{0xda, 0xc1, 0x7f, 0x95, 0x8d, 0x2e, 0xe5, 0x23, 0xa2, 0x20, 0x62, 0x06, 0x99, 0x45, 0x97, 0xc1, 0x3d, 0x83, 0x1e, 0xc7}
+	signature := []byte{0x06, 0xfd, 0xde, 0x03}
+	id, entryID := uuid.New(), uuid.New()
+	assert.NoError(t, legacy.Create(&FunctionSignature{ChainID: 1, ContractAddress: address, Signature: signature, ContractBytecodeID: id, ABIEntryID: entryID}).Error)
+	sqlDB, _ := legacy.DB()
+	assert.NoError(t, sqlDB.Close())
+
+	db, err := Open(path)
+	assert.NoError(t, err)
+	isPrimaryKey, err := hasPrimaryKey(db, &FunctionSignature{}, "contract_bytecode_id")
+	assert.NoError(t, err)
+	assert.True(t, isPrimaryKey)
+	assert.True(t, db.Migrator().HasIndex(&FunctionSignature{}, "idx_function_signatures_abi_entry_id"))
+	var functionSignatures []FunctionSignature
+	assert.NoError(t, db.Find(&functionSignatures).Error)
+	if assert.Len(t, functionSignatures, 1) {
+		assert.Equal(t, id, functionSignatures[0].ContractBytecodeID)
+		assert.Equal(t, entryID, functionSignatures[0].ABIEntryID)
+	}
+	assert.Error(t, db.Create(&FunctionSignature{ChainID: 1, ContractAddress: address, Signature: signature, ContractBytecodeID: id}).Error)
+	assert.NoError(t, db.Create(&FunctionSignature{ChainID: 1, ContractAddress: address, Signature: signature, ContractBytecodeID: uuid.New()}).Error)
+}
@@ -0,0 +1,23 @@
+//go:build postgres
+
+package db
+
+import (
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Register the Postgres backend, build with -tags postgres
+func init() {
+	backends["postgres"] = &backend{
+		open: func(dsn string) gorm.Dialector {
+			return postgres.Open(dsn)
+		},
+		config: config{
+			maxOpenConns:    20,
+			maxIdleConns:    10,
+			connMaxLifetime: 30 * time.Minute,
+		},
+	}
+}
@@ -0,0 +1,72 @@
+//go:build postgres
+
+package db
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Test the storage suite on Postgres: TEST_POSTGRES_DSN, or a server started in a temporary directory
+// E.g. go test -tags postgres ./src/db, initdb and pg_ctl have to be in the PATH without the DSN
+func TestStoragePostgres(t *testing.T) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		dsn = startPostgres(t)
+	}
+	db, err := Open(dsn)
+	if err != nil {
+		t.Fatal("Fail to open Postgres. Err:", err)
+	}
+	// start from empty tables, every table of the models
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal("Fail to parse the model. Err:", err)
+		}
+		db.Exec("TRUNCATE " + stmt.Schema.Table)
+	}
+	storageSuite(t, db)
+
+	// The ABI columns are jsonb
+	var dataType string
+	db.Raw("SELECT data_type FROM information_schema.columns WHERE table_name = 'abi_entries' AND column_name = 'fragment'").Scan(&dataType)
+	if dataType != "jsonb" {
+		t.Error("abi_entries.fragment is not jsonb:", dataType)
+	}
+}
+
+// @dev Start a Postgres server for the test on a free port, it is stopped when the test ends
+func startPostgres(t *testing.T) string {
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		t.Skip("Neither TEST_POSTGRES_DSN nor initdb")
+	}
+	pgCtl := filepath.Join(filepath.Dir(initdb), "pg_ctl")
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	if output, err := exec.Command(initdb, "-D", data, "-U", "abi", "--auth=trust").CombinedOutput(); err != nil {
+		t.Fatal("Fail to initdb. Err:", err, string(output))
+	}
+	options := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1", port, dir)
+	if output, err := exec.Command(pgCtl, "-D", data, "-o", options, "-l", filepath.Join(dir, "log"), "-w", "start").CombinedOutput(); err != nil {
+		t.Fatal("Fail to start Postgres. Err:", err, string(output))
+	}
+	t.Cleanup(func() {
+		_ = exec.Command(pgCtl, "-D", data, "-m", "immediate", "stop").Run()
+	})
+	return fmt.Sprintf("postgres://abi@127.0.0.1:%d/postgres?sslmode=disable", port)
+}
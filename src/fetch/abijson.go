@@ -0,0 +1,129 @@
+package fetch
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"sort"
+)
+
+// abiItemJSON
+// @dev An item of the Solidity JSON ABI
+type abiItemJSON struct {
+	Type            string         `json:"type"`
+	Name            string         `json:"name,omitempty"`
+	Inputs          []argumentJSON `json:"inputs"`
+	Outputs         []argumentJSON `json:"outputs,omitempty"`
+	StateMutability string         `json:"stateMutability,omitempty"`
+	Anonymous       bool           `json:"anonymous,omitempty"`
+}
+
+// argumentJSON
+// @dev An input or output of an ABI item
+type argumentJSON struct {
+	Name       string         `json:"name"`
+	Type       string         `json:"type"`
+	Indexed    bool           `json:"indexed,omitempty"`
+	Components []argumentJSON `json:"components,omitempty"`
+}
+
+// MarshalABI
+// @dev *abi.ABI => the Solidity JSON ABI, go-ethereum can only unmarshal it
+// Notice: the items are sorted by type and name
+func MarshalABI(contractABI *abi.ABI) ([]byte, error) {
+	var items []abiItemJSON
+	// Notice: abi.Constructor is the zero value of the type, only a declared constructor has the string form
+	if contractABI.Constructor.String() != "" {
+		items = append(items, methodJSON(&contractABI.Constructor))
+	}
+	if contractABI.HasFallback() {
+		items = append(items, methodJSON(&contractABI.Fallback))
+	}
+	if contractABI.HasReceive() {
+		items = append(items, methodJSON(&contractABI.Receive))
+	}
+	for name := range contractABI.Methods {
+		method := contractABI.Methods[name]
+		items = append(items, methodJSON(&method))
+	}
+	for name := range contractABI.Events {
+		event := contractABI.Events[name]
+		items = append(items, abiItemJSON{Type: "event", Name: event.RawName, Inputs: argumentsJSON(event.Inputs), Anonymous: event.Anonymous})
+	}
+	for name := range contractABI.Errors {
+		abiError := contractABI.Errors[name]
+		items = append(items, abiItemJSON{Type: "error", Name: abiError.Name, Inputs: argumentsJSON(abiError.Inputs)})
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Type != items[j].Type {
+			return items[i].Type < items[j].Type
+		}
+		return items[i].Name < items[j].Name
+	})
+	return json.Marshal(items)
+}
+
+// MarshalMethod
+// @dev *abi.Method => the item of the Solidity JSON ABI
+func MarshalMethod(method *abi.Method) ([]byte, error) {
+	return json.Marshal(methodJSON(method))
+}
+
+// @dev abi.Method => abiItemJSON
+func methodJSON(method *abi.Method) abiItemJSON {
+	item := abiItemJSON{
+		Name:            method.RawName,
+		Inputs:          argumentsJSON(method.Inputs),
+		StateMutability: method.StateMutability,
+	}
+	switch method.Type {
+	case abi.Constructor:
+		item.Type = "constructor"
+	case abi.Fallback:
+		item.Type = "fallback"
+	case abi.Receive:
+		item.Type = "receive"
+	default:
+		item.Type = "function"
+		item.Outputs = argumentsJSON(method.Outputs)
+		if item.Outputs == nil {
+			item.Outputs = []argumentJSON{}
+		}
+	}
+	return item
+}
+
+// @dev abi.Arguments => []argumentJSON
+func argumentsJSON(arguments abi.Arguments) []argumentJSON {
+	result := []argumentJSON{}
+	for _, argument := range arguments {
+		item := typeJSON(argument.Name, argument.Type)
+		item.Indexed = argument.Indexed
+		result = append(result, item)
+	}
+	return result
+}
+
+// @dev abi.Type => argumentJSON, tuples are expanded into components
+func typeJSON(name string, t abi.Type) argumentJSON {
+	item := argumentJSON{Name: name, Type: t.String()}
+	switch t.T {
+	case abi.TupleTy:
+		item.Type = "tuple"
+		for i, elem := range t.TupleElems {
+			item.Components = append(item.Components, typeJSON(t.TupleRawNames[i], *elem))
+		}
+	case abi.SliceTy, abi.ArrayTy:
+		elem := typeJSON(name, *t.Elem)
+		if elem.Components != nil {
+			item.Components = elem.Components
+			if t.T == abi.SliceTy {
+				item.Type = elem.Type + "[]"
+			} else {
+				item.Type = fmt.Sprintf("%s[%d]", elem.Type, t.Size)
+			}
+		}
+	}
+	return item
+}
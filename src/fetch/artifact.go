@@ -0,0 +1,115 @@
+package fetch
+
+import (
+	myArtifact "code/src/artifact"
+	myDB "code/src/db"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ImportArtifacts
+// @dev ImportArtifacts of the default Fetcher
+func ImportArtifacts(dir string, bind bool) (int, error) {
+	return Default().ImportArtifacts(dir, bind)
+}
+
+// ImportArtifacts
+// @dev Register the ABIs and deployed bytecodes of a local Foundry/Hardhat/Truffle project
+// @param bind: also bind the artifacts to the addresses from Foundry broadcast logs, Hardhat-deploy deployments and Truffle networks
+// @return the number of artifacts registered
+// Notice: the artifacts which are not bound can still be found by metadata hash when searchInEtherscan() meets them on chain
+func (f *Fetcher) ImportArtifacts(dir string, bind bool) (int, error) {
+	artifacts, err := myArtifact.Load(dir)
+	if err != nil {
+		f.log.Error("Fail to load the artifacts in ", dir)
+		return 0, errors.Wrap(err, "Load fail")
+	}
+
+	for _, artifact := range artifacts {
+		contractBytecodeID, err := f.registerArtifact(artifact)
+		if err != nil {
+			return 0, err
+		}
+		if !bind {
+			continue
+		}
+
+		for _, deployment := range artifact.Deployments {
+			var contractDeployment myDB.ContractDeployment
+			if f.db.Where("chain_id = ? AND contract_address = ?", deployment.ChainID, deployment.Address.Bytes()).First(&contractDeployment).Error == nil {
+				f.log.Warning("The contract deployment already exists, skip it. ChainID:", deployment.ChainID, " contractAddress:", deployment.Address)
+				continue
+			}
+			err = f.storeDeployment(deployment.ChainID, deployment.Address, myDB.ContractBytecode{ID: contractBytecodeID, ContractABI: string(artifact.ABI)}, 0, 0)
+			if err != nil {
+				return 0, err
+			}
+			f.log.Info("Bind the artifact ", artifact.Name, " to ChainID:", deployment.ChainID, " contractAddress:", deployment.Address)
+		}
+	}
+
+	return len(artifacts), nil
+}
+
+// @dev Store an artifact into [ContractBytecode] with its [ABIEntry] items, reuse the item with the same metadata hash or
+// bytecode. A new item is keyed by its content, so importing the project again or concurrently stores it once
+func (f *Fetcher) registerArtifact(artifact *myArtifact.Artifact) (uuid.UUID, error) {
+	entries, err := myDB.NewABIEntries(string(artifact.ABI))
+	if err != nil {
+		f.log.Error("Fail to parse the ABI of ", artifact.Name)
+		return uuid.Nil, newError(ErrCorruptABI, 0, common.Address{}, err)
+	}
+
+	var contractBytecode myDB.ContractBytecode
+	metadata, err := ParseMetadata(artifact.DeployedBytecode)
+	if err == nil {
+		err = f.db.Where("metadata_hash = ?", metadata.Hash).First(&contractBytecode).Error
+	} else {
+		err = f.db.Where("bytecode = ?", artifact.DeployedBytecode).First(&contractBytecode).Error
+	}
+	switch {
+	case err == nil && contractBytecode.ContractABI != "":
+		return contractBytecode.ID, nil
+	case err == nil:
+		// stored without ABI, E.g. crawled before it is verified
+		contractBytecode.ContractABI = string(artifact.ABI)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		contractBytecode = myDB.ContractBytecode{
+			ID:          myDB.NewContractBytecodeID(artifact.DeployedBytecode, string(artifact.ABI)),
+			Bytecode:    artifact.DeployedBytecode,
+			ContractABI: string(artifact.ABI),
+		}
+		if metadata != nil {
+			contractBytecode.CompilerVersion = metadata.CompilerVersion
+			contractBytecode.MetadataHash = metadata.Hash
+		}
+	default:
+		f.log.Error("Fail to read the ContractBytecode of ", artifact.Name)
+		return uuid.Nil, newError(ErrStorage, 0, common.Address{}, err)
+	}
+
+	err = f.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"contract_abi"}),
+		}).Create(&contractBytecode).Error
+		if err != nil {
+			f.log.Error("Fail to create the ContractBytecode of ", artifact.Name)
+			return err
+		}
+		if err = myDB.StoreABIEntries(tx, contractBytecode.ID, entries); err != nil {
+			f.log.Error("Fail to create the ABIEntry items of ", artifact.Name)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return uuid.Nil, newError(ErrStorage, 0, common.Address{}, err)
+	}
+	f.log.Info("Register the artifact ", artifact.Name, " from ", artifact.Path)
+
+	return contractBytecode.ID, nil
+}
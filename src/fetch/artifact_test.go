@@ -0,0 +1,57 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test ImportArtifacts: register a Foundry project and bind it by the broadcast log
+func TestImportArtifacts(t *testing.T) {
+	id := uuid.New()
+	address := common.BytesToAddress(id[:])
+	// runtime code + {"ipfs": h'1220<random>'}
+	hash := append([]byte{0x12, 0x20}, append(id[:], id[:]...)...)
+	metadata := append(append([]byte{0xa1, 0x64, 'i', 'p', 'f', 's', 0x58, 0x22}, hash...), 0x00, 0x2a)
+	bytecode := common.Bytes2Hex(append([]byte{0x60, 0x80, 0x60, 0x40, 0x52}, metadata...))
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"out/Token.sol/Token.json":                     `{"abi":[{"inputs":[],"name":"name","outputs":[{"name":"","type":"string"}],"stateMutability":"view","type":"function"}],"deployedBytecode":{"object":"0x` + bytecode + `"}}`,
+		"broadcast/Deploy.s.sol/31337/run-latest.json": `{"transactions":[{"transactionType":"CREATE","contractName":"Token","contractAddress":"` + address.Hex() + `"}]}`,
+	}
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	fetcher := useFakeUpstream(t)
+	count, err := fetcher.ImportArtifacts(dir, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	contractABI, err := fetcher.GetContractABIAtBlock(31337, address, blockHeight)
+	assert.NoError(t, err)
+	assert.Contains(t, contractABI.Methods, "name")
+
+	// keyed by its content, with the items of its ABI
+	var contractBytecode myDB.ContractBytecode
+	assert.NoError(t, fetcher.db.Where("metadata_hash = ?", hash).First(&contractBytecode).Error)
+	assert.Equal(t, myDB.NewContractBytecodeID(contractBytecode.Bytecode, contractBytecode.ContractABI), contractBytecode.ID)
+	var entries int64
+	fetcher.db.Model(&myDB.BytecodeABIEntry{}).Where("contract_bytecode_id = ?", contractBytecode.ID).Count(&entries)
+	assert.Equal(t, int64(1), entries)
+
+	// import again: reuse the same bytecode, skip the existing deployment
+	count, err = fetcher.ImportArtifacts(dir, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	var total int64
+	fetcher.db.Model(&myDB.ContractBytecode{}).Where("metadata_hash = ?", hash).Count(&total)
+	assert.Equal(t, int64(1), total)
+}
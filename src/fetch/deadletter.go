@@ -0,0 +1,235 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"time"
+)
+
+// The outcomes of a crawl attempt in [CrawlAttempt], besides the status of an address without ABI, E.g. StatusUnverified
+const (
+	OutcomeFound  = "found"
+	OutcomeFailed = "failed"
+)
+
+// defaultRetryPolicy
+// @dev The failed searches of an address in a row, E.g. the node is down: searched again after 1 minute, 2 minutes...
+// at most every hour, and dead-lettered after the 8th, about 2 hours later
+var defaultRetryPolicy = RecheckPolicy{Initial: time.Minute, Factor: 2, Max: time.Hour, GiveUpAfter: 8}
+
+// maxAttemptsPerAddress
+// @dev The crawl attempts kept for each address, the older ones are deleted
+const maxAttemptsPerAddress = 20
+
+// kind => the class recorded in CrawlAttempt.ErrorClass
+var errorClasses = map[error]string{
+	ErrNoCode:              "no-code",
+	ErrSelfDestructed:      "self-destructed",
+	ErrNotVerified:         "not-verified",
+	ErrUnsupportedChain:    "unsupported-chain",
+	ErrUpstreamRateLimited: "rate-limited",
+	ErrExplorer:            "explorer",
+	ErrNode:                "node",
+	ErrCorruptABI:          "corrupt-abi",
+	ErrStorage:             "storage",
+}
+
+// DeadLetters
+// @dev The dead-lettered addresses with the default Fetcher
+func DeadLetters(chainID int, limit int) ([]myDB.SearchEtherscan, error) {
+	return Default().DeadLetters(chainID, limit)
+}
+
+// CrawlAttempts
+// @dev The searches of an address with the default Fetcher
+func CrawlAttempts(chainID int, contractAddress common.Address, limit int) ([]myDB.CrawlAttempt, error) {
+	return Default().CrawlAttempts(chainID, contractAddress, limit)
+}
+
+// RequeueDeadLetter
+// @dev Queue a dead-lettered address again with the default Fetcher
+func RequeueDeadLetter(chainID int, contractAddress common.Address) (bool, error) {
+	return Default().RequeueDeadLetter(chainID, contractAddress)
+}
+
+// DiscardDeadLetter
+// @dev Remove a dead-lettered address from the queue with the default Fetcher
+func DiscardDeadLetter(chainID int, contractAddress common.Address) (bool, error) {
+	return Default().DiscardDeadLetter(chainID, contractAddress)
+}
+
+// DeadLetters
+// @dev The addresses the robot stops searching after their retry budget, the last dead-lettered first
+// @param chainID 0: every chain
+// @param limit 0: no limit
+func (f *Fetcher) DeadLetters(chainID int, limit int) ([]myDB.SearchEtherscan, error) {
+	query := f.db.Where("dead_lettered_at > ?", 0)
+	if chainID != 0 {
+		query = query.Where("chain_id = ?", chainID)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	var deadLetters []myDB.SearchEtherscan
+	if err := query.Order("dead_lettered_at DESC").Find(&deadLetters).Error; err != nil {
+		f.log.Error("Fail to read the dead-lettered addresses")
+		return nil, newError(ErrStorage, chainID, common.Address{}, err)
+	}
+	return deadLetters, nil
+}
+
+// CrawlAttempts
+// @dev The searches of an address by the robot and the inline searches, the last first. [CrawlAttempt]
+// @param limit 0: all the kept ones, see maxAttemptsPerAddress
+func (f *Fetcher) CrawlAttempts(chainID int, contractAddress common.Address, limit int) ([]myDB.CrawlAttempt, error) {
+	query := f.db.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes())
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	var attempts []myDB.CrawlAttempt
+	if err := query.Order("id DESC").Find(&attempts).Error; err != nil {
+		f.log.Error("Fail to read the CrawlAttempt items")
+		return nil, newError(ErrStorage, chainID, contractAddress, err)
+	}
+	return attempts, nil
+}
+
+// RequeueDeadLetter
+// @dev Search a dead-lettered address again in the next run of the robot, with a new retry budget
+// @return false if the address is not dead-lettered
+func (f *Fetcher) RequeueDeadLetter(chainID int, contractAddress common.Address) (bool, error) {
+	result := f.db.Model(&myDB.SearchEtherscan{}).
+		Where("chain_id = ? AND contract_address = ? AND dead_lettered_at > ?", chainID, contractAddress.Bytes(), 0).
+		Updates(map[string]interface{}{
+			"should_search":    true,
+			"not_before":       0,
+			"failures":         0,
+			"last_error":       "",
+			"dead_lettered_at": 0,
+		})
+	if result.Error != nil {
+		f.log.Error("Fail to requeue the searchEtherscan item in db")
+		return false, newError(ErrStorage, chainID, contractAddress, result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// DiscardDeadLetter
+// @dev Remove a dead-lettered address from the queue with its crawl attempts
+// @return false if the address is not dead-lettered
+// Notice: a later lookup queues it again
+func (f *Fetcher) DiscardDeadLetter(chainID int, contractAddress common.Address) (bool, error) {
+	var isDiscarded bool
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("chain_id = ? AND contract_address = ? AND dead_lettered_at > ?", chainID, contractAddress.Bytes(), 0).
+			Delete(&myDB.SearchEtherscan{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		isDiscarded = true
+		return tx.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes()).Delete(&myDB.CrawlAttempt{}).Error
+	})
+	if err != nil {
+		f.log.Error("Fail to discard the searchEtherscan item in db")
+		return false, newError(ErrStorage, chainID, contractAddress, err)
+	}
+	return isDiscarded, nil
+}
+
+// @dev searchAddress, and record the attempt: its outcome and duration. A failed search is tried again after the
+// backoff of the retry policy, the address is dead-lettered after its budget, so it never holds up the queue
+func (f *Fetcher) crawl(ctx context.Context, sources []ABISource, nodes map[int]CodeReader, chainID int, contractAddress common.Address) error {
+	attemptedAt, started := f.now(), time.Now()
+	err := f.searchAddress(ctx, sources, nodes, chainID, contractAddress)
+	attempt := myDB.CrawlAttempt{
+		ChainID:         chainID,
+		ContractAddress: contractAddress.Bytes(),
+		AttemptedAt:     int(attemptedAt.Unix()),
+		Outcome:         OutcomeFound,
+		DurationMs:      time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		attempt.Outcome, attempt.ErrorClass, attempt.Message = OutcomeFailed, errorClass(err), upstreamMessage(err)
+	} else {
+		// the address without ABI is classified by this search
+		var status myDB.AddressStatus
+		result := f.db.Where("chain_id = ? AND contract_address = ? AND checked_at >= ?", chainID, contractAddress.Bytes(), attemptedAt.Unix()).
+			Limit(1).Find(&status)
+		if result.Error == nil && result.RowsAffected > 0 {
+			attempt.Outcome, attempt.ErrorClass, attempt.Message = status.Status, errorClass(statusErrors[status.Status]), status.Message
+			if status.Status == StatusExplorerError { // E.g. invalid API key, timeout: counted toward the retry budget
+				attempt.Outcome = OutcomeFailed
+			}
+		}
+	}
+
+	if recordErr := f.recordAttempt(attempt); recordErr != nil {
+		f.log.Error("Fail to record the crawl attempt. ChainID:", chainID, " contractAddress:", contractAddress, " Err:", recordErr)
+	}
+	return err
+}
+
+// @dev Persist the crawl attempt, keep the last maxAttemptsPerAddress of the address, and count its failures in the queue
+func (f *Fetcher) recordAttempt(attempt myDB.CrawlAttempt) error {
+	if err := f.db.Create(&attempt).Error; err != nil {
+		return errors.Wrap(err, "Fail to create the CrawlAttempt item")
+	}
+	err := f.db.Where("chain_id = ? AND contract_address = ? AND id NOT IN (?)", attempt.ChainID, attempt.ContractAddress,
+		f.db.Model(&myDB.CrawlAttempt{}).Select("id").
+			Where("chain_id = ? AND contract_address = ?", attempt.ChainID, attempt.ContractAddress).
+			Order("id DESC").Limit(maxAttemptsPerAddress)).
+		Delete(&myDB.CrawlAttempt{}).Error
+	if err != nil {
+		return errors.Wrap(err, "Fail to delete the old CrawlAttempt items")
+	}
+
+	queued := func() *gorm.DB {
+		return f.db.Model(&myDB.SearchEtherscan{}).Where("chain_id = ? AND contract_address = ?", attempt.ChainID, attempt.ContractAddress)
+	}
+	if attempt.Outcome != OutcomeFailed {
+		err = queued().Where("failures > ?", 0).Updates(map[string]interface{}{"failures": 0, "last_error": ""}).Error
+		return errors.Wrap(err, "Fail to reset the failures of the searchEtherscan item")
+	}
+
+	var searchEtherscan myDB.SearchEtherscan
+	result := queued().Limit(1).Find(&searchEtherscan)
+	if result.Error != nil || result.RowsAffected == 0 { // E.g. an inline search of an address not queued
+		return errors.Wrap(result.Error, "Fail to read the searchEtherscan item")
+	}
+	failures := searchEtherscan.Failures + 1
+	updates := map[string]interface{}{"failures": failures, "last_error": attempt.Message}
+	if wait, retry := f.retries.wait(failures); retry {
+		updates["not_before"] = attempt.AttemptedAt + int(wait/time.Second)
+	} else {
+		f.log.Warning("Dead-letter the address after its retry budget. ChainID:", attempt.ChainID,
+			" contractAddress:", common.BytesToAddress(attempt.ContractAddress), " failures:", failures)
+		updates["should_search"] = false
+		updates["dead_lettered_at"] = attempt.AttemptedAt
+	}
+	return errors.Wrap(queued().Updates(updates).Error, "Fail to count the failures of the searchEtherscan item")
+}
+
+// @dev The class of the error, E.g. node, "unknown" if it is not an *Error
+func errorClass(err error) string {
+	var fetchErr *Error
+	if errors.As(err, &fetchErr) {
+		if class, isFound := errorClasses[fetchErr.Kind]; isFound {
+			return class
+		}
+	} else if class, isFound := errorClasses[err]; isFound {
+		return class
+	}
+	return "unknown"
+}
+
+// @dev The message of the upstream behind the error, E.g. the one of the node
+func upstreamMessage(err error) string {
+	var fetchErr *Error
+	if errors.As(err, &fetchErr) && fetchErr.Err != nil {
+		return fetchErr.Err.Error()
+	}
+	return err.Error()
+}
@@ -0,0 +1,153 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// failingNode
+// @dev A node whose calls fail for some addresses, E.g. a pruned or overloaded one
+type failingNode struct {
+	CodeReader
+	failing map[common.Address]bool
+}
+
+func (n *failingNode) CodeAt(ctx context.Context, contractAddress common.Address, blockNumber *big.Int) ([]byte, error) {
+	if n.failing[contractAddress] {
+		return nil, errors.New("connection refused")
+	}
+	return n.CodeReader.CodeAt(ctx, contractAddress, blockNumber)
+}
+
+// Test the crawl attempts, the backoff of the failed searches, and the dead-letter queue
+func TestDeadLetters(t *testing.T) {
+	now := time.Now()
+	broken := common.HexToAddress("0x00000000000000000000000000000000000dead1")
+	discarded := common.HexToAddress("0x00000000000000000000000000000000000dead2")
+	node := &failingNode{CodeReader: &fakeChainNode{}, failing: map[common.Address]bool{broken: true, discarded: true}}
+	fetcher := useFakeUpstream(t, WithClock(func() time.Time { return now }), WithNode(0, node),
+		WithRetryPolicy(RecheckPolicy{Initial: time.Minute, Factor: 2, Max: time.Hour, GiveUpAfter: 3}),
+		WithRecheckPolicy(0, StatusExplorerError, RecheckPolicy{Initial: time.Minute, Factor: 2, Max: time.Hour}))
+	user := WithRequester(context.Background(), Requester{Tag: "api", Interactive: true})
+
+	// the failing addresses go first, they never hold up the others
+	for _, address := range []common.Address{broken, discarded} {
+		_, err := fetcher.GetContractABIAtBlockContext(user, 1, address, nil, PolicyCacheAndDB)
+		assert.ErrorIs(t, err, ErrQueued)
+	}
+	for _, address := range []common.Address{verifiedAddress, unverifiedAddress, explorerErrorAddress} {
+		_, err := fetcher.GetContractABIAtBlock(1, address, blockHeight)
+		assert.ErrorIs(t, err, ErrQueued)
+	}
+	assert.ErrorIs(t, fetcher.SearchInEtherscan(), ErrNode)
+	_, err := fetcher.GetContractABIAtBlock(1, verifiedAddress, blockHeight)
+	assert.NoError(t, err)
+
+	attempts, err := fetcher.CrawlAttempts(1, broken, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, attempts, 1) {
+		assert.Equal(t, OutcomeFailed, attempts[0].Outcome)
+		assert.Equal(t, "node", attempts[0].ErrorClass)
+		assert.Contains(t, attempts[0].Message, "connection refused")
+		assert.Equal(t, int(now.Unix()), attempts[0].AttemptedAt)
+	}
+	attempts, err = fetcher.CrawlAttempts(1, verifiedAddress, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, attempts, 1) {
+		assert.Equal(t, OutcomeFound, attempts[0].Outcome)
+		assert.Empty(t, attempts[0].ErrorClass)
+	}
+	attempts, err = fetcher.CrawlAttempts(1, unverifiedAddress, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, attempts, 1) {
+		assert.Equal(t, StatusUnverified, attempts[0].Outcome)
+		assert.Equal(t, "not-verified", attempts[0].ErrorClass)
+	}
+	attempts, err = fetcher.CrawlAttempts(1, explorerErrorAddress, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, attempts, 1) {
+		assert.Equal(t, OutcomeFailed, attempts[0].Outcome)
+		assert.Equal(t, "explorer", attempts[0].ErrorClass)
+		assert.Contains(t, attempts[0].Message, "Invalid API Key")
+	}
+
+	// backed off: 1 minute, then 2 minutes, then dead-lettered after the 3rd failure
+	readQueued := func(address common.Address) myDB.SearchEtherscan {
+		var searchEtherscan myDB.SearchEtherscan
+		assert.NoError(t, fetcher.db.Where("chain_id = ? AND contract_address = ?", 1, address.Bytes()).First(&searchEtherscan).Error)
+		return searchEtherscan
+	}
+	queued := readQueued(explorerErrorAddress)
+	assert.Equal(t, 1, queued.Failures)
+	assert.Contains(t, queued.LastError, "Invalid API Key")
+	queued = readQueued(broken)
+	assert.Equal(t, 1, queued.Failures)
+	assert.Equal(t, int(now.Add(time.Minute).Unix()), queued.NotBefore)
+	assert.Contains(t, queued.LastError, "connection refused")
+	assert.NoError(t, fetcher.SearchInEtherscan())
+	attempts, _ = fetcher.CrawlAttempts(1, broken, 0)
+	assert.Len(t, attempts, 1)
+	for _, wait := range []time.Duration{time.Minute, 2 * time.Minute} {
+		now = now.Add(wait)
+		assert.ErrorIs(t, fetcher.SearchInEtherscan(), ErrNode)
+	}
+	queued = readQueued(broken)
+	assert.Equal(t, 3, queued.Failures)
+	assert.False(t, queued.ShouldSearch)
+	assert.Equal(t, int(now.Unix()), queued.DeadLetteredAt)
+	_, err = fetcher.GetContractABIAtBlock(1, broken, blockHeight)
+	assert.ErrorIs(t, err, ErrDeadLettered)
+	queued = readQueued(explorerErrorAddress)
+	assert.Equal(t, 3, queued.Failures)
+	assert.Equal(t, int(now.Unix()), queued.DeadLetteredAt)
+
+	deadLetters, err := fetcher.DeadLetters(1, 0)
+	assert.NoError(t, err)
+	assert.Len(t, deadLetters, 3)
+	queuedAddresses, err := fetcher.QueuedAddresses(1, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, queuedAddresses)
+	attempts, err = fetcher.CrawlAttempts(1, broken, 2)
+	assert.NoError(t, err)
+	assert.Len(t, attempts, 2)
+
+	// requeued with a new budget after the node is fixed: an EOA
+	delete(node.failing, broken)
+	isRequeued, err := fetcher.RequeueDeadLetter(1, broken)
+	assert.NoError(t, err)
+	assert.True(t, isRequeued)
+	isRequeued, err = fetcher.RequeueDeadLetter(1, broken)
+	assert.NoError(t, err)
+	assert.False(t, isRequeued)
+	assert.NoError(t, fetcher.SearchInEtherscan())
+	queued = readQueued(broken)
+	assert.Equal(t, 0, queued.Failures)
+	assert.Equal(t, 0, queued.DeadLetteredAt)
+	attempts, _ = fetcher.CrawlAttempts(1, broken, 1)
+	assert.Equal(t, StatusEOA, attempts[0].Outcome)
+
+	// discarded with its attempts
+	isDiscarded, err := fetcher.DiscardDeadLetter(1, discarded)
+	assert.NoError(t, err)
+	assert.True(t, isDiscarded)
+	isDiscarded, err = fetcher.DiscardDeadLetter(1, discarded)
+	assert.NoError(t, err)
+	assert.False(t, isDiscarded)
+	attempts, _ = fetcher.CrawlAttempts(1, discarded, 0)
+	assert.Empty(t, attempts)
+	deadLetters, _ = fetcher.DeadLetters(0, 0)
+	assert.Len(t, deadLetters, 1)
+
+	// only the last attempts are kept
+	for i := 0; i < maxAttemptsPerAddress+5; i++ {
+		assert.NoError(t, fetcher.recordAttempt(myDB.CrawlAttempt{ChainID: 1, ContractAddress: verifiedAddress.Bytes(), Outcome: OutcomeFound}))
+	}
+	attempts, _ = fetcher.CrawlAttempts(1, verifiedAddress, 0)
+	assert.Len(t, attempts, maxAttemptsPerAddress)
+}
@@ -0,0 +1,82 @@
+package fetch
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// The kinds of the errors returned by the fetch package, match them with errors.Is
+var (
+	ErrQueued              = errors.New("The address is queued, waiting robot to search the ABI from Etherscan")
+	ErrNotCached           = errors.New("Not found the ABI in memory")
+	ErrUnknownSelector     = errors.New("The function is not in the contract ABI")
+	ErrNoCode              = errors.New("No code at the address, it is an EOA")
+	ErrSelfDestructed      = errors.New("The contract is self-destructed and not verified")
+	ErrNotVerified         = errors.New("The contract source code is not verified")
+	ErrUnsupportedChain    = errors.New("The chain is not supported")
+	ErrUpstreamRateLimited = errors.New("The explorer rate limit is reached")
+	ErrExplorer            = errors.New("The explorer returns an error")
+	ErrNode                = errors.New("Fail to query the blockchain node")
+	ErrCorruptABI          = errors.New("The stored ABI is corrupt")
+	ErrStorage             = errors.New("Fail to access the database")
+	ErrUnknownVersion      = errors.New("The ABI version is not recorded")
+	ErrNotProxy            = errors.New("The address is not an EIP-1967 proxy")
+	ErrDeadLettered        = errors.New("The searches of the address keep failing, it waits for an operator")
+)
+
+// queuedRetryAfter
+// @dev How long the callers should wait before asking again for a queued address
+const queuedRetryAfter = 30 * time.Second
+
+// Error
+// @dev The error returned by the fetch package, carrying the chain, the address and when to retry
+type Error struct {
+	Kind       error          // one of the Err* above
+	ChainID    int            // chainID(int)
+	Address    common.Address // contract address
+	RetryAfter time.Duration  // when it makes sense to try again, 0: unknown or never
+	Err        error          // the underlying error, may be nil
+}
+
+// Error
+// @dev E.g. The contract source code is not verified. ChainID: 1, contractAddress: 0x...: Contract source code not verified
+func (e *Error) Error() string {
+	message := e.Kind.Error()
+	if e.ChainID != 0 || e.Address != (common.Address{}) {
+		message = fmt.Sprintf("%s. ChainID: %d, contractAddress: %s", e.Kind, e.ChainID, e.Address.Hex())
+	}
+	if e.Err != nil {
+		message += ": " + e.Err.Error()
+	}
+	return message
+}
+
+// Unwrap
+// @dev The underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is
+// @dev errors.Is(err, ErrQueued) matches the kind
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// RetryAfter
+// @dev How long to wait before trying again
+// @return the duration, false if err is not an *Error or it should not be retried soon
+func RetryAfter(err error) (time.Duration, bool) {
+	var fetchErr *Error
+	if errors.As(err, &fetchErr) && fetchErr.RetryAfter > 0 {
+		return fetchErr.RetryAfter, true
+	}
+	return 0, false
+}
+
+// @dev Build an *Error
+func newError(kind error, chainID int, contractAddress common.Address, err error) *Error {
+	return &Error{Kind: kind, ChainID: chainID, Address: contractAddress, Err: err}
+}
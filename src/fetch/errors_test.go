@@ -0,0 +1,91 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	address := common.HexToAddress("0x00000000000000000000000000000000000e4401")
+	err := errors.Wrap(newError(ErrNotVerified, 1, address, errors.New("Contract source code not verified")), "Lookup fail")
+	assert.ErrorIs(t, err, ErrNotVerified)
+	assert.NotErrorIs(t, err, ErrNoCode)
+	assert.Contains(t, err.Error(), address.Hex())
+	assert.Contains(t, err.Error(), "Contract source code not verified")
+	_, ok := RetryAfter(err)
+	assert.False(t, ok)
+
+	err = &Error{Kind: ErrQueued, ChainID: 1, Address: address, RetryAfter: queuedRetryAfter}
+	retryAfter, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, queuedRetryAfter, retryAfter)
+	_, ok = RetryAfter(errors.New("Not a fetch error"))
+	assert.False(t, ok)
+
+	assert.ErrorIs(t, explorerError(1, address, "Max rate limit reached"), ErrUpstreamRateLimited)
+	assert.ErrorIs(t, explorerError(1, address, "Contract source code not verified"), ErrNotVerified)
+	assert.ErrorIs(t, explorerError(1, address, "Invalid API Key"), ErrExplorer)
+}
+
+func TestLookupErrors(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	address := common.HexToAddress("0x00000000000000000000000000000000000e4402")
+
+	_, err := fetcher.GetContractABIAtBlock(1, address, blockHeight)
+	assert.ErrorIs(t, err, ErrQueued)
+	retryAfter, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, queuedRetryAfter, retryAfter)
+
+	_, err = fetcher.GetContractABIAtBlock(5, address, blockHeight)
+	assert.ErrorIs(t, err, ErrUnsupportedChain)
+	_, err = fetcher.GetFunctionABIAtBlock(5, address, signature1, nil)
+	assert.ErrorIs(t, err, ErrUnsupportedChain)
+}
+
+// Test the DB failures: ErrStorage rather than not found
+func TestStorageErrors(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	address := common.HexToAddress("0x00000000000000000000000000000000000e4403")
+
+	// the deployment is found, its functions can not be read
+	assert.NoError(t, fetcher.db.Create(&myDB.ContractDeployment{ChainID: 1, ContractAddress: address.Bytes()}).Error)
+	assert.NoError(t, fetcher.db.Migrator().DropTable(&myDB.ABIEntry{}))
+	_, err := fetcher.GetFunctionABIAtBlock(1, address, signature1, nil)
+	assert.ErrorIs(t, err, ErrStorage)
+
+	// the classification of an unknown address can not be read
+	assert.NoError(t, fetcher.db.Migrator().DropTable(&myDB.AddressStatus{}))
+	_, err = fetcher.GetContractABIAtBlock(1, common.HexToAddress("0x00000000000000000000000000000000000e4404"), nil)
+	assert.ErrorIs(t, err, ErrStorage)
+}
+
+func TestMarshalABI(t *testing.T) {
+	source := `[
+		{"type":"constructor","inputs":[{"name":"owner","type":"address"}],"stateMutability":"nonpayable"},
+		{"type":"function","name":"swap","inputs":[{"name":"orders","type":"tuple[]","components":[{"name":"token","type":"address"},{"name":"amount","type":"uint256"}]}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"payable"},
+		{"type":"event","name":"Swapped","inputs":[{"name":"sender","type":"address","indexed":true},{"name":"amount","type":"uint256","indexed":false}],"anonymous":false},
+		{"type":"error","name":"Expired","inputs":[{"name":"deadline","type":"uint256"}]}
+	]`
+	contractABI, err := abi.JSON(strings.NewReader(source))
+	assert.NoError(t, err)
+
+	data, err := MarshalABI(&contractABI)
+	assert.NoError(t, err)
+	parsedABI, err := abi.JSON(strings.NewReader(string(data)))
+	assert.NoError(t, err)
+	assert.Equal(t, contractABI.Methods["swap"].ID, parsedABI.Methods["swap"].ID)
+	assert.Equal(t, contractABI.Events["Swapped"].ID, parsedABI.Events["Swapped"].ID)
+	assert.Equal(t, contractABI.Errors["Expired"].ID, parsedABI.Errors["Expired"].ID)
+	assert.Len(t, parsedABI.Constructor.Inputs, 1)
+
+	method := contractABI.Methods["swap"]
+	data, err = MarshalMethod(&method)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type":"function","name":"swap","inputs":[{"name":"orders","type":"tuple[]","components":[{"name":"token","type":"address"},{"name":"amount","type":"uint256"}]}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"payable"}`, string(data))
+}
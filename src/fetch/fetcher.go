@@ -8,268 +8,647 @@ import (
 	"fmt"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/google/uuid"
 	"github.com/petermattis/goid"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"io"
+	"golang.org/x/sync/singleflight"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"math/big"
-	"net/http"
-	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// ApiResponse
-// @dev For parse the data from Etherscan
-type ApiResponse struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
-	Result  string `json:"result"`
+// Fetcher
+// @dev Fetch the ABIs: override => memory => shared cache => DB => the ABI sources
+// Notice: every Fetcher has its own DB, cache and upstreams, so several configurations can run in one process
+type Fetcher struct {
+	db        *gorm.DB
+	cache     Cache
+	shared    SharedCache        // nil: no second tier
+	sources   []ABISource        // tried in order
+	nodes     map[int]CodeReader // chainID => node, 0: the node of the other chains
+	log       *logrus.Logger
+	now       func() time.Time
+	overrides overrideIndex
+	delays    map[int]time.Duration            // chainID => how long the block follower waits before searching a new contract, 0: the other chains
+	rechecks  map[int]map[string]RecheckPolicy // chainID => status => when to search an address without ABI again, 0: the other chains
+	retries   RecheckPolicy                    // when to search an address again after a failed search, and when to dead-letter it
+	proxyTTL  time.Duration                    // how long the ABIs of a watched proxy are kept in memory, 0: the TTL of the cache
+	// Request coalescing: only one call per key is in flight at each tier, the waiters share its result
+	dbFlights   singleflight.Group // E.g. "db-function-chainID-contractAddress-selector", "db-contract-chainID-contractAddress" => the DB read
+	missFlights singleflight.Group // chainID-contractAddress => queue the address for the robot
+	flights     singleflight.Group // chainID-contractAddress => the inline search of PolicyFetchThrough
+	mu          sync.Mutex         // serialize the writers of the searched ABIs: the robot and the inline searches, never the lookups
 }
 
-// FetcherCli
-// @dev Config for fetching the data from Etherscan
-type FetcherCli struct {
-	ApiKey string // Etherscan
-	RpcUrl string // Blockchain node RPC
-	mu     sync.RWMutex
+var log = logrus.New()
+
+// the Fetcher of the package functions, see Default()
+var (
+	defaultFetcher atomic.Pointer[Fetcher]
+	defaultMu      sync.Mutex
+)
+
+// NewFetcher
+// @dev Create a Fetcher, WithDB is required
+// E.g. NewFetcher(WithDB(db), WithSources(NewEtherscanSource(apiKey)), WithRPCURL(0, rpcUrl))
+func NewFetcher(options ...Option) (*Fetcher, error) {
+	f := &Fetcher{
+		nodes:     make(map[int]CodeReader),
+		log:       log,
+		now:       time.Now,
+		overrides: overrideIndex{overrides: make(map[string][]*parsedOverride)},
+		delays:    map[int]time.Duration{0: defaultDiscoveryDelay},
+		rechecks:  make(map[int]map[string]RecheckPolicy),
+		retries:   defaultRetryPolicy,
+		proxyTTL:  defaultProxyTTL,
+	}
+	for _, option := range options {
+		option(f)
+	}
+	if f.db == nil {
+		return nil, errors.New("The DB is required, use WithDB")
+	}
+	if f.cache == nil {
+		f.cache = myCache.NewABICache()
+	}
+	return f, nil
 }
 
-var cache = *myCache.NewABICache()
-var log = logrus.New()
-var f = FetcherCli{ApiKey: os.Getenv("API_KEY"), RpcUrl: os.Getenv("RPC_URL")}
+// Default
+// @dev The Fetcher behind the package functions, configured by the env: API_KEY, RPC_URL, DB_PATH(default: ABIs.db),
+// DB_MAX_OPEN_CONNS, DB_AUTO_MIGRATE(default: true), REDIS_ADDR, REDIS_PASSWORD for the shared cache(default: none),
+// and CACHE_MAX_BYTES, CACHE_TTL, CACHE_PROXY_TTL for the memory(default: 64 MiB, until evicted, 5m)
+// Notice: DB_PATH is a SQLite3 file or a Postgres DSN, see db.Open
+// Notice: it is created at the first use rather than at import time, so the env can be loaded before
+func Default() *Fetcher {
+	if f := defaultFetcher.Load(); f != nil {
+		return f
+	}
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if f := defaultFetcher.Load(); f != nil {
+		return f
+	}
 
-var db = myDB.InitDatabase()
+	path := os.Getenv("DB_PATH")
+	if path == "" {
+		path = "ABIs.db"
+	}
+	var dbOptions []myDB.Option
+	if maxOpenConns, err := strconv.Atoi(os.Getenv("DB_MAX_OPEN_CONNS")); err == nil {
+		dbOptions = append(dbOptions, myDB.WithMaxOpenConns(maxOpenConns))
+	}
+	if os.Getenv("DB_AUTO_MIGRATE") == "false" {
+		dbOptions = append(dbOptions, myDB.WithAutoMigrate(false))
+	}
+	var cacheOptions []myCache.Option
+	if maxBytes, err := strconv.ParseInt(os.Getenv("CACHE_MAX_BYTES"), 10, 64); err == nil {
+		cacheOptions = append(cacheOptions, myCache.WithMaxBytes(maxBytes))
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("CACHE_TTL")); err == nil {
+		cacheOptions = append(cacheOptions, myCache.WithTTL(ttl))
+	}
+	options := []Option{
+		WithDB(myDB.OpenDatabase(path, dbOptions...)),
+		WithCache(myCache.NewABICache(cacheOptions...)),
+		WithSources(NewEtherscanSource(os.Getenv("API_KEY"))),
+		WithRPCURL(0, os.Getenv("RPC_URL")),
+	}
+	if proxyTTL, err := time.ParseDuration(os.Getenv("CACHE_PROXY_TTL")); err == nil {
+		options = append(options, WithProxyTTL(proxyTTL))
+	}
+	if policies, err := ParseRecheckPolicies(os.Getenv("RECHECK_POLICIES")); err != nil {
+		log.Error("Invalid RECHECK_POLICIES, the default ones are used. Err:", err)
+	} else {
+		for chainID, statuses := range policies {
+			for status, policy := range statuses {
+				options = append(options, WithRecheckPolicy(chainID, status, policy))
+			}
+		}
+	}
+	if redisAddr := os.Getenv("REDIS_ADDR"); redisAddr != "" {
+		options = append(options, WithSharedCache(myCache.NewRedisCache(redisAddr, myCache.WithRedisPassword(os.Getenv("REDIS_PASSWORD")))))
+	}
+	f, _ := NewFetcher(options...)
+	defaultFetcher.Store(f)
+	return f
+}
+
+// SetDefault
+// @dev Replace the Fetcher behind the package functions
+func SetDefault(f *Fetcher) {
+	defaultFetcher.Store(f)
+}
+
+// CacheStats
+// @dev The counters and the usage of the in-memory cache, false if the cache does not report them
+func (f *Fetcher) CacheStats() (myCache.Stats, bool) {
+	if reporter, ok := f.cache.(interface{ Stats() myCache.Stats }); ok {
+		return reporter.Stats(), true
+	}
+	return myCache.Stats{}, false
+}
 
 // GetFunctionABIAtBlock
-// @dev try to get the function ABI
+// @dev try to get the function ABI with the default Fetcher
 func GetFunctionABIAtBlock(chainID int, contractAddress common.Address, sig [4]byte, block *big.Int) (*abi.Method, error) {
-	// [1. In memory]
-	functionABI, _, isFound := cache.Get(chainID, contractAddress, string(sig[:]))
-	if isFound {
-		log.Info("[Thread ", goid.Get(), "] Found functionABI in cache, data:", functionABI)
-		return functionABI, nil
+	return Default().GetFunctionABIAtBlock(chainID, contractAddress, sig, block)
+}
+
+// GetContractABIAtBlock
+// @dev try to get the contractABI with the default Fetcher
+func GetContractABIAtBlock(chainID int, contractAddress common.Address, block *big.Int) (*abi.ABI, error) {
+	return Default().GetContractABIAtBlock(chainID, contractAddress, block)
+}
+
+// GetFunctionABIAtBlockContext
+// @dev try to get the function ABI with the default Fetcher and the policy
+func GetFunctionABIAtBlockContext(ctx context.Context, chainID int, contractAddress common.Address, sig [4]byte, block *big.Int, policy Policy) (*abi.Method, error) {
+	return Default().GetFunctionABIAtBlockContext(ctx, chainID, contractAddress, sig, block, policy)
+}
+
+// GetContractABIAtBlockContext
+// @dev try to get the contractABI with the default Fetcher and the policy
+func GetContractABIAtBlockContext(ctx context.Context, chainID int, contractAddress common.Address, block *big.Int, policy Policy) (*abi.ABI, error) {
+	return Default().GetContractABIAtBlockContext(ctx, chainID, contractAddress, block, policy)
+}
+
+// @dev Set up some robot threads to run this function, search ABI from Etherscan
+func searchInEtherscan(apiKey string, rpcUrl string) error {
+	return Default().search([]ABISource{NewEtherscanSource(apiKey)}, map[int]CodeReader{0: rpcNode(rpcUrl)})
+}
+
+// GetFunctionABIAtBlock
+// @dev try to get the function ABI: override => memory => DB, queue the address for the robot if not found
+func (f *Fetcher) GetFunctionABIAtBlock(chainID int, contractAddress common.Address, sig [4]byte, block *big.Int) (*abi.Method, error) {
+	return f.GetFunctionABIAtBlockContext(context.Background(), chainID, contractAddress, sig, block, PolicyCacheAndDB)
+}
+
+// GetFunctionABIAtBlockContext
+// @dev try to get the function ABI, how far to search depends on the policy
+// Notice: PolicyFetchThrough searches the ABI sources inline and waits until the context is done
+func (f *Fetcher) GetFunctionABIAtBlockContext(ctx context.Context, chainID int, contractAddress common.Address, sig [4]byte, block *big.Int, policy Policy) (*abi.Method, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	// [2. In DB] Check if the functionABI exists in the database for the given chainID, contract address and sig
-	ID := myCache.CacheKey(chainID, contractAddress, string(sig[:]))
-	var functionSignature myDB.FunctionSignature
-	if err := db.Where("id = ?", ID).First(&functionSignature).Error; err != nil { // Not found ABI in DB
-		log.Error("Not found the functionABI in DB")
+	// [0. Override] A curated ABI takes precedence over the crawled data
+	if overrideABI, isFound := f.findOverride(chainID, contractAddress, block); isFound {
+		if method, err := overrideABI.MethodById(sig[:]); err == nil {
+			f.log.Info("[Thread ", goid.Get(), "] Found functionABI in override, data:", method)
+			return method, nil
+		}
+	}
 
-		f.mu.Lock()
-		defer f.mu.Unlock()
-		// logic: Not found the ABI in DB => if there is a shouldEtherscan item in DB?
-		//           1. no: create a new shouldEtherscan item for the given chainID and contractAddress
-		//           2. yes: check that whether now passes 2 days since the last time or not?
-		//                1. no: do nothing
-		//                2. yes: set searchEtherscan to true, then other thread of searchInEtherscan() will search from Etherscan
-
-		var searchEtherscan myDB.SearchEtherscan
-		now := time.Now().Unix()
-
-		// search in DB
-		result := db.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress).First(&searchEtherscan)
-		if result.Error != nil { // not found the searchEtherscan item by chainID nad contractAddress in DB
-			// create a new item
-			newRecord := myDB.SearchEtherscan{
-				ChainID:         chainID,
-				ContractAddress: contractAddress.Bytes(),
-				Time:            int(now),
-				ShouldSearch:    true, // should search in Etherscan
-			}
-			err = db.Create(&newRecord).Error
-			if err != nil {
-				log.Error("Fail to create a searchEtherscan item in db")
-				return nil, errors.Wrap(errors.New("Fail to create an item in db"), "Create fail")
-			}
-		} else { // the record exists
-			if now-int64(searchEtherscan.Time) >= 48*time.Hour.Microseconds() { // has pass 2 days?
-				// pass 2 days, update shouldSearch to true. so the robot will search ABi from Etherscan by searchInEtherscan()
-				err = db.Model(&searchEtherscan).Update("should_search", true).Error
-				if err != nil {
-					log.Error("Fail to update the searchEtherscan item to true in db")
-					return nil, errors.Wrap(errors.New("Fail to update the item in db"), "Update fail")
-				}
-			}
+	// [1. In memory]
+	if fromBlock, isFound := f.cachedDeployment(chainID, contractAddress, block); isFound {
+		if functionABI, _, isFound := f.cache.GetAt(myCache.SelectorKey(chainID, contractAddress, sig).At(fromBlock)); isFound {
+			f.log.Info("[Thread ", goid.Get(), "] Found functionABI in cache, data:", functionABI)
+			return functionABI, nil
 		}
-		log.Warning("Waiting robot to search the functionABI from Etherscan")
-		return nil, errors.Wrap(errors.New("Waiting robot to search the functionABI from Etherscan"), "Not Found")
-	} else { // found in db
-		log.Info("Found functionABI in DB")
+	}
+	if policy == PolicyCacheOnly {
+		return nil, f.cacheMiss(chainID, contractAddress)
+	}
 
-		///////////////////////////// update the cache /////////////////////////////////////////
-		f.mu.Lock()
-		defer f.mu.Unlock()
+	// [2. In DB]
+	functionABI, isFound, err := f.functionABIFromDB("db", chainID, contractAddress, sig, block)
+	if err != nil || isFound {
+		return functionABI, err
+	}
+	if policy != PolicyFetchThrough {
+		return nil, f.handleMiss(ctx, chainID, contractAddress)
+	}
 
-		// Second check
-		functionABISecondCheck, _, isFoundSecondCheck := cache.Get(chainID, contractAddress, string(sig[:]))
-		if isFoundSecondCheck { // If found functionABI in cache
-			log.Info("[Thread ", goid.Get(), "] Second check found functionABI in cache")
-			return functionABISecondCheck, nil
-		} else { // not found in cache, set the cache
-
-			// define the data to search in DB
-			var resultContractABIID = functionSignature.ContractBytecodeID
-			var contractBytecode myDB.ContractBytecode
-			_ = db.Where("id = ?", resultContractABIID).First(&contractBytecode)
-			// unmarshal the functionABI
-			myABI, err := abi.JSON(strings.NewReader(functionSignature.FunctionABI))
-			if err != nil {
-				log.Info("Fail to unmarshal the ABI")
-				return nil, errors.Wrap(errors.New("Fail to unmarshal the ABI"), "Unmarshal fail")
-			}
-			// get the Method's key, then we can use the key to find the functionABI(type: abi.Method)
-			//////////////////////////////////////////////////////////////////////
-			var resultFunctonABI abi.Method
-			for key := range myABI.Methods {
-				// get the functionABI(type: abi.Method) by key
-				resultFunctonABI = myABI.Methods[key] // ensure the variable to be marshaled is abi.Method
-			}
+	// [3. Upstream]
+	if err = f.fetchThrough(ctx, chainID, contractAddress); err != nil {
+		return nil, err
+	}
+	functionABI, isFound, err = f.functionABIFromDB("searched", chainID, contractAddress, sig, block)
+	if err == nil && !isFound {
+		err = newError(ErrUnknownSelector, chainID, contractAddress, errors.Errorf("Selector: 0x%x", sig))
+	}
+	return functionABI, err
+}
 
-			var resultContractABI *abi.ABI
+// @dev Check if the functionABI exists in the database for the given chainID, contract address, sig and block, then set the cache
+// @param flight: "db", or "searched" after the inline search, so the callers never share a read started before the search stored the ABI
+// Notice: the concurrent callers for the same selector and block share one DB read
+func (f *Fetcher) functionABIFromDB(flight string, chainID int, contractAddress common.Address, sig [4]byte, block *big.Int) (*abi.Method, bool, error) {
+	key := fmt.Sprintf("%s-function-%s-%x-%s", flight, addressKey(chainID, contractAddress), sig, blockKey(block))
+	value, err, shared := f.dbFlights.Do(key, func() (interface{}, error) {
+		return f.loadFunctionABI(chainID, contractAddress, sig, block)
+	})
+	if shared {
+		f.log.Info("[Thread ", goid.Get(), "] Shared the DB read of functionABI")
+	}
+	functionABI, _ := value.(*abi.Method)
+	return functionABI, functionABI != nil, err
+}
 
-			err = json.Unmarshal([]byte(contractBytecode.ContractABI), &resultContractABI)
-			if err != nil {
-				log.Error("Fail to unmarshal ContractABI. Err:", err)
-				return nil, errors.Wrap(errors.New("Fail to unmarshal ContractABI"), "Fail unmarshal")
-			}
+// @dev Read the functionABI at the block from DB and set the cache, nil if not found
+// Notice: the function of the latest deployment which has the selector, so a proxy bound to its implementation still
+// decodes its own functions, E.g. upgradeTo(address)
+func (f *Fetcher) loadFunctionABI(chainID int, contractAddress common.Address, sig [4]byte, block *big.Int) (*abi.Method, error) {
+	fromBlock, isFound, err := f.deploymentAt(chainID, contractAddress, block)
+	if err != nil || !isFound {
+		return nil, err
+	}
+	// Second check: the previous flight may have just set the cache
+	functionABISecondCheck, _, isFoundSecondCheck := f.cache.GetAt(myCache.SelectorKey(chainID, contractAddress, sig).At(fromBlock))
+	if isFoundSecondCheck { // If found functionABI in cache
+		f.log.Info("[Thread ", goid.Get(), "] Second check found functionABI in cache")
+		return functionABISecondCheck, nil
+	}
+	if functionABI, isFound := f.functionABIFromShared(chainID, contractAddress, fromBlock, sig); isFound {
+		return functionABI, nil
+	}
 
-			// set the data to cache
-			cache.Set(
-				chainID,
-				contractAddress,
-				&resultFunctonABI,
-				resultContractABI,
-				string(functionSignature.Signature),
-			)
-			///////////////////////////// update the cache /////////////////////////////////////////
+	// chainID + contractAddress + signature + the deployments up to the block => the function in [ABIEntry]
+	var functionSignature struct {
+		ContractBytecodeID uuid.UUID
+		Fragment           string
+	}
+	err = f.db.Model(&myDB.FunctionSignature{}).
+		Select("function_signatures.contract_bytecode_id, abi_entries.fragment").
+		Joins("JOIN contract_deployments ON contract_deployments.chain_id = function_signatures.chain_id AND "+
+			"contract_deployments.contract_address = function_signatures.contract_address AND contract_deployments.contract_bytecode_id = function_signatures.contract_bytecode_id").
+		Joins("JOIN abi_entries ON abi_entries.id = function_signatures.abi_entry_id").
+		Where("function_signatures.chain_id = ? AND function_signatures.contract_address = ? AND function_signatures.signature = ? AND contract_deployments.from_block <= ?",
+			chainID, contractAddress.Bytes(), sig[:], fromBlock).
+		Order("contract_deployments.from_block DESC").
+		Take(&functionSignature).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { // Not found ABI in DB
+		f.log.Error("Not found the functionABI in DB")
+		return nil, nil
+	}
+	if err != nil {
+		f.log.Error("Fail to read the FunctionSignature items. Err:", err)
+		return nil, newError(ErrStorage, chainID, contractAddress, err)
+	}
+	f.log.Info("Found functionABI in DB")
+	f.sharedSet(myCache.SelectorKey(chainID, contractAddress, sig).At(fromBlock), functionSignature.Fragment)
+
+	///////////////////////////// update the cache /////////////////////////////////////////
+	// define the data to search in DB
+	var resultContractABIID = functionSignature.ContractBytecodeID
+	var contractBytecode myDB.ContractBytecode
+	if err = f.db.Where("id = ?", resultContractABIID).First(&contractBytecode).Error; err != nil {
+		f.log.Error("Fail to read the ContractBytecode item. Err:", err)
+		return nil, newError(ErrStorage, chainID, contractAddress, err)
+	}
+	// unmarshal the functionABI
+	resultFunctonABI, err := parseFunctionABI(functionSignature.Fragment, sig)
+	if err != nil {
+		f.log.Info("Fail to unmarshal the ABI")
+		return nil, newError(ErrCorruptABI, chainID, contractAddress, err)
+	}
 
-			return &resultFunctonABI, nil // return the functionABI from DB
-		}
+	var resultContractABI *abi.ABI
 
+	err = json.Unmarshal([]byte(contractBytecode.ContractABI), &resultContractABI)
+	if err != nil {
+		f.log.Error("Fail to unmarshal ContractABI. Err:", err)
+		return nil, newError(ErrCorruptABI, chainID, contractAddress, err)
 	}
 
+	// set the data to cache
+	f.cacheSet(
+		myCache.SelectorKey(chainID, contractAddress, sig).At(fromBlock),
+		resultFunctonABI,
+		resultContractABI,
+	)
+	///////////////////////////// update the cache /////////////////////////////////////////
+
+	return resultFunctonABI, nil // return the functionABI from DB
+}
+
+// @dev Add the item of the key to the memory, for the proxy TTL if the address is a watched proxy: its ABI changes with
+// its upgrades, which the watcher only sees at its next poll
+func (f *Fetcher) cacheSet(key myCache.Key, functionABI *abi.Method, contractABI *abi.ABI) {
+	if f.proxyTTL > 0 && f.isWatchedProxy(key.ChainID, key.ContractAddress) {
+		f.cache.SetAtWithTTL(key, functionABI, contractABI, f.proxyTTL)
+		return
+	}
+	f.cache.SetAt(key, functionABI, contractABI)
 }
 
 // GetContractABIAtBlock
-// @dev try to get the contractABI
-func GetContractABIAtBlock(chainID int, contractAddress common.Address, block *big.Int) (*abi.ABI, error) {
+// @dev try to get the contractABI: override => memory => DB, queue the address for the robot if not found
+func (f *Fetcher) GetContractABIAtBlock(chainID int, contractAddress common.Address, block *big.Int) (*abi.ABI, error) {
+	return f.GetContractABIAtBlockContext(context.Background(), chainID, contractAddress, block, PolicyCacheAndDB)
+}
+
+// GetContractABIAtBlockContext
+// @dev try to get the contractABI, how far to search depends on the policy
+// Notice: PolicyFetchThrough searches the ABI sources inline and waits until the context is done
+func (f *Fetcher) GetContractABIAtBlockContext(ctx context.Context, chainID int, contractAddress common.Address, block *big.Int, policy Policy) (*abi.ABI, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// [0. Override] A curated ABI takes precedence over the crawled data
+	if overrideABI, isFound := f.findOverride(chainID, contractAddress, block); isFound {
+		f.log.Info("[Thread ", goid.Get(), "] Found contractABI in override")
+		return overrideABI, nil
+	}
+
 	// [1. In memory]
-	_, contractABI, isFound := cache.Get(chainID, contractAddress, "")
-	if isFound {
-		log.Info("[Thread ", goid.Get(), "] Found contractABI in cache, data:", contractABI)
+	if fromBlock, isFound := f.cachedDeployment(chainID, contractAddress, block); isFound {
+		if _, contractABI, isFound := f.cache.GetAt(myCache.ContractKey(chainID, contractAddress).At(fromBlock)); isFound {
+			f.log.Info("[Thread ", goid.Get(), "] Found contractABI in cache, data:", contractABI)
+			return contractABI, nil
+		}
+	}
+	if policy == PolicyCacheOnly {
+		return nil, f.cacheMiss(chainID, contractAddress)
+	}
+
+	// [2. In DB]
+	contractABI, isFound, err := f.contractABIFromDB("db", chainID, contractAddress, block)
+	if err != nil || isFound {
+		return contractABI, err
+	}
+	if policy != PolicyFetchThrough {
+		return nil, f.handleMiss(ctx, chainID, contractAddress)
+	}
+
+	// [3. Upstream]
+	if err = f.fetchThrough(ctx, chainID, contractAddress); err != nil {
+		return nil, err
+	}
+	contractABI, isFound, err = f.contractABIFromDB("searched", chainID, contractAddress, block)
+	if err == nil && !isFound {
+		return nil, f.handleMiss(ctx, chainID, contractAddress)
+	}
+	return contractABI, err
+}
+
+// @dev Check if the contractABI exists in the database for the given chainID, contract address and block, then set the cache
+// @param flight: "db", or "searched" after the inline search, see functionABIFromDB
+// Notice: the concurrent callers for the same address and block share one DB read
+func (f *Fetcher) contractABIFromDB(flight string, chainID int, contractAddress common.Address, block *big.Int) (*abi.ABI, bool, error) {
+	value, err, shared := f.dbFlights.Do(flight+"-contract-"+addressKey(chainID, contractAddress)+"-"+blockKey(block), func() (interface{}, error) {
+		return f.loadContractABI(chainID, contractAddress, block)
+	})
+	if shared {
+		f.log.Info("[Thread ", goid.Get(), "] Shared the DB read of contractABI")
+	}
+	contractABI, _ := value.(*abi.ABI)
+	return contractABI, contractABI != nil, err
+}
+
+// @dev Read the contractABI of the deployment at the block from DB and set the cache, nil if not found
+func (f *Fetcher) loadContractABI(chainID int, contractAddress common.Address, block *big.Int) (*abi.ABI, error) {
+	fromBlock, isFound, err := f.deploymentAt(chainID, contractAddress, block)
+	if err != nil || !isFound {
+		return nil, err
+	}
+	// Second check: the previous flight may have just set the cache
+	_, contractABISeccondCheck, isFoundSecondCheck := f.cache.GetAt(myCache.ContractKey(chainID, contractAddress).At(fromBlock))
+	if isFoundSecondCheck { // If found contractABI in cache
+		f.log.Info("[Thread ", goid.Get(), "] Second check found contractABI in cache")
+		return contractABISeccondCheck, nil
+	}
+	if contractABI, isFound := f.contractABIFromShared(chainID, contractAddress, fromBlock); isFound {
 		return contractABI, nil
 	}
 
-	// [2. In DB] Check if the contractABI exists in the database for the given chainID and contract address
 	var contractDeployment myDB.ContractDeployment
-	if err := db.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress).First(&contractDeployment).Error; err != nil { // Not found ABI in DB
-		log.Error("Not found the contractDeploy in DB")
-		//////////////////////////////////////////////////////////////// 加入到shouldSearch计划
-		f.mu.Lock()
-		defer f.mu.Unlock()
-		// logic: Not found the ABI in DB => if there is a shouldEtherscan item in DB?
-		//           1. no: create a new shouldEtherscan item for the given chainID and contractAddress
-		//           2. yes: check that whether now passes 2 days since the last time or not?
-		//                1. no: do nothing
-		//                2. yes: set searchEtherscan to true, then other thread of searchInEtherscan() will search from Etherscan
-
-		var searchEtherscan myDB.SearchEtherscan
-		now := time.Now().Unix()
-
-		// search in DB
-		result := db.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress).First(&searchEtherscan)
-		if result.Error != nil { // not found the searchEtherscan item by chainID nad contractAddress in DB
-			// create a new item
-			newRecord := myDB.SearchEtherscan{
-				ChainID:         chainID,
-				ContractAddress: contractAddress.Bytes(),
-				Time:            int(now),
-				ShouldSearch:    true, // should search in Etherscan
-			}
-			err = db.Create(&newRecord).Error
-			if err != nil {
-				log.Error("Fail to create a searchEtherscan item in db")
-				return nil, errors.Wrap(errors.New("Fail to create an item in db"), "Create fail")
-			}
-		} else { // the record exists
-			if now-int64(searchEtherscan.Time) >= 48*time.Hour.Microseconds() { // has pass 2 days?
-				// pass 2 days, update shouldSearch to true. so the robot will search ABi from Etherscan by searchInEtherscan()
-				err = db.Model(&searchEtherscan).Update("should_search", true).Error
-				if err != nil {
-					log.Error("Fail to update the searchEtherscan item to true in db")
-					return nil, errors.Wrap(errors.New("Fail to update the item in db"), "Update fail")
-				}
-			}
+	if err := f.db.Where("chain_id = ? AND contract_address = ? AND from_block <= ?", chainID, contractAddress.Bytes(), fromBlock).Order("from_block DESC").First(&contractDeployment).Error; err != nil { // Not found ABI in DB
+		f.log.Error("Not found the contractDeploy in DB")
+		return nil, nil
+	}
+	f.log.Info("Found contractABI in DB")
+
+	///////////////////////////// update the cache /////////////////////////////////////////
+	var contractBytecode myDB.ContractBytecode
+	if err := f.db.Where("id = ?", contractDeployment.ContractBytecodeID).First(&contractBytecode).Error; err != nil { // Not found contractABI in DB
+		f.log.Error("Not found the bytecode of the contractDeploy in DB")
+		return nil, newError(ErrCorruptABI, chainID, contractAddress, errors.Wrap(err, "Not found the bytecode in DB"))
+	}
+	// unmarshal the contractABI
+	myABI, err := abi.JSON(strings.NewReader(contractBytecode.ContractABI))
+	if err != nil {
+		f.log.Error("Fail to parse the contractABI")
+		return nil, newError(ErrCorruptABI, chainID, contractAddress, err)
+	}
+	f.sharedSet(myCache.ContractKey(chainID, contractAddress).At(fromBlock), contractBytecode.ContractABI)
+
+	// set the data to cache
+	f.cacheSet(
+		myCache.ContractKey(chainID, contractAddress).At(fromBlock),
+		nil,
+		&myABI,
+	)
+	///////////////////////////// update the cache /////////////////////////////////////////
+	return &myABI, nil // return the contractABI from DB
+}
+
+// @dev The first block of the deployment of chainID+contractAddress at the block, from memory only, see deploymentAt
+func (f *Fetcher) cachedDeployment(chainID int, contractAddress common.Address, block *big.Int) (int64, bool) {
+	fromBlocks, isFound := f.cache.GetDeployments(chainID, contractAddress)
+	if !isFound {
+		return 0, false
+	}
+	return pickDeployment(fromBlocks, block)
+}
+
+// @dev The first block of the deployment of chainID+contractAddress at the block: memory => shared cache => DB. [ContractDeployment]
+// @param block: nil, the latest deployment
+// @return false if no deployment starts at or before the block, E.g. an address not crawled yet
+func (f *Fetcher) deploymentAt(chainID int, contractAddress common.Address, block *big.Int) (int64, bool, error) {
+	fromBlocks, isFound := f.cache.GetDeployments(chainID, contractAddress)
+	if !isFound {
+		fromBlocks, isFound = f.deploymentsFromShared(chainID, contractAddress)
+	}
+	if !isFound {
+		err := f.db.Model(&myDB.ContractDeployment{}).Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes()).
+			Order("from_block ASC").Pluck("from_block", &fromBlocks).Error
+		if err != nil {
+			f.log.Error("Fail to read the ContractDeployment items")
+			return 0, false, newError(ErrStorage, chainID, contractAddress, err)
+		}
+		if len(fromBlocks) == 0 {
+			return 0, false, nil
+		}
+		if value, err := json.Marshal(fromBlocks); err == nil {
+			f.sharedSet(myCache.DeploymentsKey(chainID, contractAddress), string(value))
+		}
+		f.cache.SetDeployments(chainID, contractAddress, fromBlocks)
+	}
+	fromBlock, isFound := pickDeployment(fromBlocks, block)
+	return fromBlock, isFound, nil
+}
+
+// @dev The last of the first blocks in ascending order which is not after the block, the last one if the block is nil
+func pickDeployment(fromBlocks []int64, block *big.Int) (int64, bool) {
+	for i := len(fromBlocks) - 1; i >= 0; i-- {
+		if block == nil || block.Cmp(big.NewInt(fromBlocks[i])) >= 0 {
+			return fromBlocks[i], true
 		}
-		log.Warning("Waiting robot to search the functionABI from Etherscan")
+	}
+	return 0, false
+}
+
+// @dev The block in the keys of the flights, "latest" if it is nil
+func blockKey(block *big.Int) string {
+	if block == nil {
+		return "latest"
+	}
+	return block.String()
+}
 
-		return nil, errors.Wrap(errors.New("Not found the contractABI in DB"), "Not Found")
-	} else { // found in db
-		log.Info("Found contractABI in DB")
+// @dev Not found in memory with PolicyCacheOnly => the negative entry in memory, or ErrNotCached
+func (f *Fetcher) cacheMiss(chainID int, contractAddress common.Address) error {
+	if reason, expireAt, isFound := f.cache.GetNegative(chainID, contractAddress); isFound && expireAt.After(f.now()) {
+		return f.withRetryAfter(reason, expireAt)
+	}
+	return newError(ErrNotCached, chainID, contractAddress, nil)
+}
 
-		///////////////////////////// update the cache /////////////////////////////////////////
+// @dev Not found the ABI in DB with PolicyFetchThrough => search it with the sources now
+// Notice: the concurrent callers for the same address share one search, which goes on in the background if the context is done first
+func (f *Fetcher) fetchThrough(ctx context.Context, chainID int, contractAddress common.Address) error {
+	reason := f.checkNegative(chainID, contractAddress)
+	// An EOA, self-destructed or unverified contract: do not ask the sources again until the re-check time
+	if reason != nil {
+		return reason
+	}
+	if !supports(f.sources, chainID) {
+		f.log.Warning("Not found the ABI of an unsupported chain. ChainID:", chainID, " contractAddress:", contractAddress)
+		return newError(ErrUnsupportedChain, chainID, contractAddress, nil)
+	}
+
+	result := f.flights.DoChan(addressKey(chainID, contractAddress), func() (interface{}, error) {
 		f.mu.Lock()
 		defer f.mu.Unlock()
 
-		// Second check
-		_, contractABISeccondCheck, isFoundSecondCheck := cache.Get(chainID, contractAddress, "")
-		if isFoundSecondCheck { // If found contractABI in cache
-			log.Info("[Thread ", goid.Get(), "] Second check found contractABI in cache")
-			return contractABISeccondCheck, nil
-		} else { // not found in cache, set the cache
-			var contractBytecode myDB.ContractBytecode
-			if err := db.Where("id = ?", contractDeployment.ContractBytecodeID).First(&contractBytecode).Error; err != nil { // Not found contractABI in DB
-				log.Error("Not found the contractABI in cache")
-				return nil, errors.Wrap(errors.New("Not found the bytecode in DB"), "Not Found")
-			} else {
-				// unmarshal the contractABI
-				myABI, err := abi.JSON(strings.NewReader(contractBytecode.ContractABI))
-				if err != nil {
-					log.Error("Fail to parse the contractABI")
-					return nil, errors.Wrap(errors.New("Fail to parse the contractABI"), "Fail to parse")
-				}
-
-				// set the data to cache
-				cache.Set(
-					chainID,
-					contractAddress,
-					nil,
-					&myABI,
-					"",
-				)
-				///////////////////////////// update the cache /////////////////////////////////////////
-				return &myABI, nil // return the contractABI from DB
-			}
+		// The contract is already stored, E.g. only the selector is unknown
+		var count int64
+		err := f.db.Model(&myDB.ContractDeployment{}).Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes()).Count(&count).Error
+		if err != nil {
+			return nil, newError(ErrStorage, chainID, contractAddress, err)
+		}
+		if count > 0 {
+			return nil, nil
+		}
+		return nil, f.crawl(context.Background(), f.sources, f.nodes, chainID, contractAddress)
+	})
+
+	select {
+	case <-ctx.Done():
+		f.log.Warning("The context is done before the search finishes. ChainID:", chainID, " contractAddress:", contractAddress)
+		return &Error{Kind: ErrQueued, ChainID: chainID, Address: contractAddress, RetryAfter: queuedRetryAfter, Err: ctx.Err()}
+	case searched := <-result:
+		if searched.Err != nil {
+			return searched.Err
 		}
+	}
+
+	// Searched but not found: the classification of the address
+	return f.checkNegative(chainID, contractAddress)
+}
+
+// @dev Not found the ABI in DB => return the known negative result, or let searchInEtherscan() search it
+// Notice: the concurrent callers for the same address share one check, so the address is queued once and the
+// request of the first one is recorded
+func (f *Fetcher) handleMiss(ctx context.Context, chainID int, contractAddress common.Address) error {
+	_, err, _ := f.missFlights.Do(addressKey(chainID, contractAddress), func() (interface{}, error) {
+		return nil, f.queueAddress(ctx, chainID, contractAddress)
+	})
+	return err
+}
+
+// @dev Return the known negative result, or queue chainID+contractAddress for the robot with the request of the Requester of the context
+func (f *Fetcher) queueAddress(ctx context.Context, chainID int, contractAddress common.Address) error {
+	// An EOA, self-destructed or unverified contract: return the classified error until the re-check time
+	if reason := f.checkNegative(chainID, contractAddress); reason != nil {
+		f.log.Warning("No ABI for the address. ChainID:", chainID, " contractAddress:", contractAddress, " reason:", reason)
+		return reason
+	}
 
+	// The chains without an explorer can only be found in DB, E.g. the artifacts of a local chain
+	if !supports(f.sources, chainID) {
+		f.log.Warning("Not found the ABI of an unsupported chain. ChainID:", chainID, " contractAddress:", contractAddress)
+		return newError(ErrUnsupportedChain, chainID, contractAddress, nil)
 	}
+
+	// logic: Not found the ABI in DB => if there is a shouldEtherscan item in DB?
+	//           1. no: create a new shouldEtherscan item for the given chainID and contractAddress
+	//           2. yes: check that whether now passes 2 days since the last time or not?
+	//                1. no: do nothing
+	//                2. yes: set searchEtherscan to true, then other thread of searchInEtherscan() will search from Etherscan
+
+	var searchEtherscan myDB.SearchEtherscan
+	now := f.now().Unix()
+	requester := requesterFrom(ctx)
+
+	// search in DB
+	result := f.db.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress).First(&searchEtherscan)
+	if result.Error != nil { // not found the searchEtherscan item by chainID nad contractAddress in DB
+		// create a new item, another thread may have queued it meanwhile
+		newRecord := myDB.SearchEtherscan{
+			ChainID:          chainID,
+			ContractAddress:  contractAddress.Bytes(),
+			Time:             int(now),
+			ShouldSearch:     true, // should search in Etherscan
+			Priority:         requestPriority(1, requester.Interactive),
+			Requests:         1,
+			FirstRequestedAt: int(now),
+			LastRequestedAt:  int(now),
+			Tags:             requester.Tag,
+		}
+		err := f.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&newRecord).Error
+		if err != nil {
+			f.log.Error("Fail to create a searchEtherscan item in db")
+			return newError(ErrStorage, chainID, contractAddress, err)
+		}
+	} else { // the record exists, the robot searches it again when its re-check time is due
+		if err := f.recordRequest(requester, searchEtherscan, int(now)); err != nil {
+			f.log.Error("Fail to update the searchEtherscan item in db")
+			return newError(ErrStorage, chainID, contractAddress, err)
+		}
+		if searchEtherscan.DeadLetteredAt > 0 {
+			f.log.Warning("The address is dead-lettered. ChainID:", chainID, " contractAddress:", contractAddress)
+			return newError(ErrDeadLettered, chainID, contractAddress, errors.New(searchEtherscan.LastError))
+		}
+	}
+	f.log.Warning("Waiting robot to search the ABI from Etherscan")
+	return &Error{Kind: ErrQueued, ChainID: chainID, Address: contractAddress, RetryAfter: queuedRetryAfter}
 }
 
-// @dev Set up some robot threads to run this function, search ABI from Etherscan
-func searchInEtherscan(apiKey string, rpcUrl string) error {
+// SearchInEtherscan
+// @dev Set up some robot threads to run this function, search the queued addresses from the ABI sources
+func (f *Fetcher) SearchInEtherscan() error {
+	return f.search(f.sources, f.nodes)
+}
+
+// @dev Search the queued addresses with the sources, read the runtime code from the nodes
+func (f *Fetcher) search(sources []ABISource, nodes map[int]CodeReader) error {
 
 	// 1.Update the shouldSearch field
-	var resultsFalse []myDB.SearchEtherscan
-	// If the item pass 2 days, we set the shouldSearch field to true, so that it will try to get the ABi from Etherscan
-	err := db.Where("should_search = ?", false).Find(&resultsFalse).Error
+	// The classified addresses(EOA, unverified...) are searched again by their own re-check policy, unless given up
+	var dueStatuses []myDB.AddressStatus
+	err := f.db.Where("recheck_at <= ? AND gave_up = ?", f.now().Unix(), false).Find(&dueStatuses).Error
 	if err != nil {
-		log.Error("Fail to search item in DB")
-		return errors.Wrap(errors.New("Fail to search item in DB"), "Search fail")
+		f.log.Error("Fail to search AddressStatus items in DB")
+		return newError(ErrStorage, 0, common.Address{}, err)
 	}
-	for _, item := range resultsFalse {
-		// has pass 2 days => update the shouldSearch to true
-		if time.Now().Unix()-int64(item.Time) >= 48*time.Hour.Microseconds() {
-			err = db.Model(&item).Update("should_search", true).Error
-			if err != nil {
-				log.Error("Fail to update the searchEtherscan item in db")
-				return errors.Wrap(errors.New("Fail to update the item in db"), "Update fail")
-			}
+	for _, status := range dueStatuses {
+		err = f.db.Model(&myDB.SearchEtherscan{}).
+			Where("chain_id = ? AND contract_address = ? AND dead_lettered_at = ?", status.ChainID, status.ContractAddress, 0).
+			Update("should_search", true).Error
+		if err != nil {
+			f.log.Error("Fail to update the searchEtherscan item in db")
+			return newError(ErrStorage, status.ChainID, common.BytesToAddress(status.ContractAddress), err)
 		}
 	}
 
@@ -278,216 +657,249 @@ func searchInEtherscan(apiKey string, rpcUrl string) error {
 	defer f.mu.Unlock()
 
 	var results []myDB.SearchEtherscan
-	// query the records: shouldSearch = true
-	err = db.Where("should_search = ?", true).Find(&results).Error
+	// query the records: shouldSearch = true, unless their search is delayed. The higher priorities first, then the older ones
+	err = f.db.Where("should_search = ? AND not_before <= ?", true, f.now().Unix()).Order(queueOrder).Find(&results).Error
 	if err != nil {
-		log.Error("Fail to search item in db")
-		return errors.Wrap(errors.New("Fail to search item in db"), "Search fail")
+		f.log.Error("Fail to search item in db")
+		return newError(ErrStorage, 0, common.Address{}, err)
 	}
 
-	// 3.The all items whose shouldSearch field are true
+	// 3.The all items whose shouldSearch field are true, a failed one is retried later and never holds up the others
+	var firstErr error
 	for _, item := range results {
-		log.Info("Begin search ABI from Etherscan. ChinaID:", item.ChainID, " contractAddress:", item.ContractAddress)
-
 		var contractAddress common.Address
 		copy(contractAddress[:], item.ContractAddress[:])
 
-		// Begin search ABI in Etherscan
-		data, err := queryABIFromEtherscan(apiKey, item.ChainID, contractAddress)
-		if err != nil {
-			log.Error("Fail to search item in Etherscan")
-			return errors.Wrap(errors.New("Fail to search item in Etherscan"), "Search fail")
+		if err = f.crawl(context.Background(), sources, nodes, item.ChainID, contractAddress); err != nil && firstErr == nil {
+			firstErr = err
 		}
+	}
 
-		// Begin search Bytecode in blockchain node
-		bytecode, err := queryRuntimeCode(rpcUrl, contractAddress)
-		if err != nil {
-			log.Error("Fail to search bytecode")
-			return errors.Wrap(errors.New("Fail to search bytecode"), "Search fail")
-		}
+	return firstErr
+}
 
-		// store the contract's info into DB. [ContractBytecode]
-		contractbytecodId := uuid.New()
-		ContractBytecode := myDB.ContractBytecode{
-			ID:                contractbytecodId,
-			Bytecode:          bytecode,     // the contract's bytecode
-			SourceCode:        "",           // TODO
-			CompileTimeParams: "",           // TODO
-			ContractABI:       string(data), // the contract's ABI
-		}
-		err = db.Create(&ContractBytecode).Error
-		if err != nil {
-			log.Error("Fail to create an item")
-			return errors.Wrap(errors.New("Fail to create an item"), "Create fail")
-		}
-		// store the contract's info into DB. [ContractDeployment]
-		ContractDeployment := myDB.ContractDeployment{
-			ChainID:            item.ChainID,
-			ContractAddress:    item.ContractAddress,
-			ContractBytecodeID: contractbytecodId,
-		}
-		err = db.Create(&ContractDeployment).Error
-		if err != nil {
-			log.Error("Fail to create an item")
-			return errors.Wrap(errors.New("Fail to create an item"), "Create fail")
-		}
+// @dev Search the ABI of chainID+contractAddress with the sources, store it or the classification of the address
+// Notice: only the errors of the node and DB are returned, the address without ABI is recorded by recordNegative()
+func (f *Fetcher) searchAddress(ctx context.Context, sources []ABISource, nodes map[int]CodeReader, chainID int, contractAddress common.Address) error {
+	f.log.Info("Begin search ABI from Etherscan. ChinaID:", chainID, " contractAddress:", contractAddress)
 
-		// Using JSON RawMessage to maintain the original JSON format
-		var rawMessages []json.RawMessage
-		_ = json.Unmarshal(data, &rawMessages)
-		// Create a new string array to store each object
-		var functionStrings []string
-		for _, raw := range rawMessages {
-			functionStrings = append(functionStrings, string(raw))
-		}
+	// Begin search Bytecode in blockchain node
+	bytecode, blockNumber, err := f.codeAt(ctx, nodes, chainID, contractAddress)
+	if err != nil {
+		f.log.Error("Fail to search bytecode")
+		return err
+	}
 
-		for _, funcStr := range functionStrings {
-			theABI, err := abi.JSON(strings.NewReader("[" + funcStr + "]"))
-			if err != nil {
-				log.Error("Fail to parse the abi")
-				return errors.Wrap(errors.New("Fail to parse the abi"), "Parse fail")
-			} else {
-
-				// get the Method's key, then we can use the key to find the functionABI(type: abi.Method)
-				for key := range theABI.Methods {
-					// get the functionABI(type: abi.Method) by key
-					function := theABI.Methods[key] // ensure the variable to be marshaled is abi.Method
-					// functionABI(type: abi.Method) => signature => 4bytes signature
-					sig4bytes := myCache.Get4bytesSig(function.Sig)
-
-					// set the functionABI to DB
-					ID := myCache.CacheKey(item.ChainID, contractAddress, string(sig4bytes[:]))
-					// TODO: marshal the functionABI, later it fails to unmarshal
-					functionSig := myDB.FunctionSignature{
-						ID:                 ID,
-						ContractBytecodeID: contractbytecodId,
-						Signature:          sig4bytes[:],
-						FunctionABI:        "[" + funcStr + "]",
-					}
-					err = db.Create(&functionSig).Error
-					if err != nil {
-						log.Error("Fail to create a FunctionSignature item")
-						return errors.Wrap(errors.New("Fail to create a FunctionSignature item"), "Create fail")
-					}
-				}
-				// After get the ABI from Etherscan, set the shouldSearch to false
-				result := db.Model(&myDB.SearchEtherscan{}).
-					Where("chain_id = ? AND contract_address = ?", item.ChainID, item.ContractAddress).
-					Update("should_search", false)
-				if result.Error != nil {
-					log.Error("Fail to create a FunctionSignature item")
-					return errors.Wrap(errors.New("Fail to update the shouldSearch field"), "Update fail")
-				}
+	// No code: an EOA, or a self-destructed contract whose ABI may still be verified
+	if len(bytecode) == 0 {
+		created, err := contractCreated(sources, chainID, contractAddress)
+		if err != nil || !created {
+			status, message := StatusEOA, "No code at the address"
+			if errors.Is(err, ErrUpstreamRateLimited) {
+				status, message = StatusRateLimited, err.Error()
+			} else if err != nil {
+				status, message = StatusExplorerError, err.Error()
 			}
+			return f.recordNegative(chainID, contractAddress, status, message)
 		}
 	}
 
-	return nil
-}
-
-// @dev Check ChainID and get the format the request url
-// @notice Only support Ethereum network now
-// @notice Sometimes we could fetch data in Etherscan without an API KEY
-func checkChainIDAndGetReqURL(apiKey string, chainID int, contractAddress common.Address) (string, error) {
-	var requestURL string
+	// The metadata hash is the same on every chain, so the ABI verified on another chain can be reused
+	metadata, err := ParseMetadata(bytecode)
+	if err != nil {
+		f.log.Warning("Not found the metadata in bytecode. contractAddress:", contractAddress, " Err:", err)
+	} else {
+		var knownBytecode myDB.ContractBytecode
+		if f.db.Where("metadata_hash = ? AND contract_abi <> ''", metadata.Hash).First(&knownBytecode).Error == nil {
+			f.log.Info("Reuse the ABI of the same metadata hash. contractAddress:", contractAddress, " contractBytecodeID:", knownBytecode.ID)
+			return f.storeDeployment(chainID, contractAddress, knownBytecode, 0, blockNumber)
+		}
+	}
 
-	if apiKey == "" {
-		log.Warning("The request may be fail without an API KEY")
+	// Begin search ABI in Etherscan
+	data, err := fetchABI(sources, chainID, contractAddress)
+	if err != nil {
+		f.log.Error("Fail to search item in Etherscan")
+		status := StatusExplorerError
+		if errors.Is(err, ErrUpstreamRateLimited) {
+			status = StatusRateLimited
+		} else if errors.Is(err, ErrNotVerified) {
+			status = StatusUnverified
+			if len(bytecode) == 0 {
+				status = StatusSelfDestructed
+			}
+		}
+		return f.recordNegative(chainID, contractAddress, status, err.Error())
 	}
 
-	if chainID == 1 { // Ethereum
-		requestURL = fmt.Sprintf("https://api.etherscan.io/api?module=contract&action=getabi&address=%s&apikey=%s", contractAddress, apiKey)
-	} else if chainID == 56 { // BSC
-		requestURL = fmt.Sprintf("https://api.bscscan.com/api?module=contract&action=getabi&address=%s&apikey=%s", contractAddress, apiKey)
-	} else if chainID == 42161 { // Arbitrum
-		requestURL = fmt.Sprintf("https://api.arbiscan.io/api?module=contract&action=getabi&address=%s&apikey=%s", contractAddress, apiKey)
-	} else if chainID == 137 { // Polygon
-		requestURL = fmt.Sprintf("https://api.polygonscan.com/api?module=contract&action=getabi&address=%s&apikey=%s", contractAddress, apiKey)
-	} else {
-		log.Error("Invalid chainID or API KEY. chainID:", chainID, "API KEY:", apiKey, "contractAddress", contractAddress)
-		return "", errors.Wrap(errors.New("Check the input"), "Fail to checkChainIDAndGetReqURL")
+	// the contract's info. [ContractBytecode]
+	ContractBytecode := myDB.ContractBytecode{
+		ID:                myDB.NewContractBytecodeID(bytecode, string(data)),
+		Bytecode:          bytecode,     // the contract's bytecode
+		SourceCode:        "",           // TODO
+		CompileTimeParams: "",           // TODO
+		ContractABI:       string(data), // the contract's ABI
+	}
+	if metadata != nil {
+		ContractBytecode.CompilerVersion = metadata.CompilerVersion
+		ContractBytecode.MetadataHash = metadata.Hash
 	}
 
-	return requestURL, nil
+	return f.storeDeployment(chainID, contractAddress, ContractBytecode, 0, blockNumber)
 }
 
-// @dev Query a contract's ABI from Etherscan
-func queryABIFromEtherscan(apiKey string, chainID int, contractAddress common.Address) ([]byte, error) {
-	requestURL, err := checkChainIDAndGetReqURL(apiKey, chainID, contractAddress)
-	if err != nil {
-		log.Error("Invalid requestURL:", requestURL)
-		return []byte{}, errors.Wrap(errors.New("Please check the requestURL"), "Invalid requestURL")
+// @dev Whether any of the sources has an API for the chain
+func supports(sources []ABISource, chainID int) bool {
+	for _, source := range sources {
+		if source.Supports(chainID) {
+			return true
+		}
 	}
+	return false
+}
 
-	//////////////////////////////////////// Proxy ////////////////////////////////////////////////////////////////
-	// Notice: You should use proxy mode if you are in China, or you can not reach out Etherscan because of China Great Firewall.
-	// If you don't need a proxy, you can delete it.
-	// Note that I am using the default proxy port for Clash for Windows here: 127.0.0.1:7890
-	proxyURL, _ := url.Parse("http://127.0.0.1:7890")
-
-	// Create an HTTP client with a proxy
-	transport := &http.Transport{
-		Proxy: http.ProxyURL(proxyURL),
+// @dev Ask the sources in order, return the first ABI found
+// Notice: the error of the last source if none finds it
+func fetchABI(sources []ABISource, chainID int, contractAddress common.Address) ([]byte, error) {
+	var err error = newError(ErrUnsupportedChain, chainID, contractAddress, nil)
+	for _, source := range sources {
+		if !source.Supports(chainID) {
+			continue
+		}
+		var data []byte
+		if data, err = source.FetchABI(chainID, contractAddress); err == nil {
+			return data, nil
+		}
 	}
-	client := &http.Client{
-		Transport: transport,
+	return nil, err
+}
+
+// @dev Ask the first source which knows the contract creations
+// Notice: true if none of them knows, so the sources are still asked for the ABI
+func contractCreated(sources []ABISource, chainID int, contractAddress common.Address) (bool, error) {
+	for _, source := range sources {
+		if checker, ok := source.(CreationChecker); ok && source.Supports(chainID) {
+			return checker.ContractCreated(chainID, contractAddress)
+		}
 	}
+	return true, nil
+}
 
-	// NOTICE: If you don't need a proxy client, you should use this code:
-	// response, err := http.Get(requestURL)
+// @dev Read the runtime code of chainID+contractAddress at the newest block from its node
+// @return the code and the number of the block, 0 if the node does not tell it
+func (f *Fetcher) codeAt(ctx context.Context, nodes map[int]CodeReader, chainID int, contractAddress common.Address) ([]byte, int64, error) {
+	node, found := nodes[chainID]
+	if !found {
+		if node, found = nodes[0]; !found {
+			f.log.Error("No node for the chain. ChainID:", chainID)
+			return nil, 0, newError(ErrNode, chainID, contractAddress, errors.New("No node for the chain"))
+		}
+	}
 
-	// Wait and retry if fail to get data from Etherscan
-	var response *http.Response
-	maxRetries := 5 // maximum number of retries
-	for i := 0; i < maxRetries; i++ {
-		// Sending GET requests using clients with proxies
-		response, err = client.Get(requestURL)
-		if err == nil {
-			break // Success, exit loop
+	var block *big.Int // nil: the newest block
+	if reader, ok := node.(BlockNumberReader); ok {
+		if number, err := reader.BlockNumber(ctx); err == nil {
+			block = new(big.Int).SetUint64(number)
+		} else {
+			f.log.Warning("Fail to get the newest block, read the code without it. ChainID:", chainID, " Err:", err)
 		}
-		time.Sleep(1 * time.Second) // Wait for 1 second before retrying
 	}
-	defer response.Body.Close()
+	bytecode, err := node.CodeAt(ctx, contractAddress, block)
 	if err != nil {
-		log.Error("Timeout: Fail to fetch ABI from Etherscan. ChainID:", chainID, "contractAddress:", contractAddress)
-		return nil, errors.Wrap(errors.New("Fail to fetch ABI from Etherscan"), "Timeout")
+		f.log.Error("Fail to get the RuntimeCode. ChainID:", chainID, " ContractAddress:", contractAddress)
+		return nil, 0, newError(ErrNode, chainID, contractAddress, errors.Wrap(err, "Get fail"))
 	}
-	//////////////////////////////////////// Proxy ////////////////////////////////////////////////////////////////
-
-	// Read response content
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		log.Error("Fail to Read response content. ChainID:", chainID, "contractAddress:", contractAddress)
-		return []byte{}, errors.Wrap(errors.New("Fail to Read response content"), "Read response fail")
+	if block == nil {
+		return bytecode, 0, nil
 	}
+	return bytecode, block.Int64(), nil
+}
 
-	// Parsing JSON data
-	var apiResponse ApiResponse
-	err = json.Unmarshal(body, &apiResponse)
+// @dev Bind a contract bytecode to chainID+contractAddress in one transaction: [ContractBytecode] unless it exists,
+// [ContractDeployment], [FunctionSignature] and [ABIVersion] if the bytecode is new to the address, then set the
+// shouldSearch to false and remove the classification
+// @param fromBlock: the first block of the bytecode at the address, 0: since the creation, E.g. the block of a proxy upgrade
+// @param blockNumber: the block the bytecode is seen at, 0: unknown
+// Notice: every write is an upsert, so a retried job converges to the same rows, and a failure leaves none of them
+func (f *Fetcher) storeDeployment(chainID int, contractAddress common.Address, contractBytecode myDB.ContractBytecode, fromBlock int64, blockNumber int64) error {
+	// the items of the ABI, and chainID + contractAddress + 4bytes signature => the function
+	entries, err := myDB.NewABIEntries(contractBytecode.ContractABI)
 	if err != nil {
-		log.Error("Fail to parsing JSON data. ChainID:", chainID, "contractAddress:", contractAddress)
-		return []byte{}, errors.Wrap(errors.New("Fail to parsing JSON data"), "Parse fail")
+		f.log.Error("Fail to parse the abi")
+		return newError(ErrCorruptABI, chainID, contractAddress, err)
 	}
+	functionSignatures := myDB.NewFunctionSignatures(chainID, contractAddress.Bytes(), contractBytecode.ID, entries)
 
-	return []byte(apiResponse.Result), nil
-}
-func queryRuntimeCode(rpcUrl string, contractAddress common.Address) ([]byte, error) {
-	client, err := ethclient.Dial(rpcUrl)
-	if err != nil {
-		log.Error("Fail to connect to the node. RPC URL:", rpcUrl, "ContractAddress:", contractAddress)
-		return nil, errors.Wrap(errors.New("Fail to connect to the node"), "Connect fail")
-	}
+	err = f.db.Transaction(func(tx *gorm.DB) error {
+		// the bytecode may be stored already: the same metadata hash, an artifact, or a retry. [ContractBytecode]
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&contractBytecode).Error
+		if err != nil {
+			f.log.Error("Fail to create the ContractBytecode item")
+			return err
+		}
+		// the items shared with the other bytecodes. [ABIEntry]
+		if err = myDB.StoreABIEntries(tx, contractBytecode.ID, entries); err != nil {
+			f.log.Error("Fail to create the ABIEntry items")
+			return err
+		}
+
+		// rebind the address if it exists. [ContractDeployment]
+		ContractDeployment := myDB.ContractDeployment{
+			ChainID:            chainID,
+			ContractAddress:    contractAddress.Bytes(),
+			FromBlock:          fromBlock,
+			ContractBytecodeID: contractBytecode.ID,
+		}
+		err = tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "chain_id"}, {Name: "contract_address"}, {Name: "from_block"}},
+			DoUpdates: clause.AssignmentColumns([]string{"contract_bytecode_id"}),
+		}).Create(&ContractDeployment).Error
+		if err != nil {
+			f.log.Error("Fail to create the ContractDeployment item")
+			return err
+		}
 
-	// bytecode, err := client.CodeAt(context.Background(), contractAddress, nil) // nil: the newest block
-	// if err != nil {
-	// 	log.Error("Fail to get the RuntimeCode. RPC URL:", rpcUrl, "ContractAddress:", contractAddress)
-	// 	return nil, errors.Wrap(errors.New("Fail to get the RuntimeCode"), "Get fail")
-	// }
+		// the functions of the bytecode, the ones of the earlier deployments stay for the lookups at their blocks. [FunctionSignature]
+		if len(functionSignatures) > 0 {
+			err = tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "chain_id"}, {Name: "contract_address"}, {Name: "signature"}, {Name: "contract_bytecode_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"abi_entry_id"}),
+			}).Create(&functionSignatures).Error
+			if err != nil {
+				f.log.Error("Fail to create the FunctionSignature items")
+				return err
+			}
+		}
+		// remove the functions of a bytecode no deployment is bound to any more, E.g. the rebound one
+		err = tx.Where("chain_id = ? AND contract_address = ? AND contract_bytecode_id NOT IN (?)", chainID, contractAddress.Bytes(),
+			tx.Model(&myDB.ContractDeployment{}).Select("contract_bytecode_id").Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes())).
+			Delete(&myDB.FunctionSignature{}).Error
+		if err != nil {
+			f.log.Error("Fail to delete the stale FunctionSignature items")
+			return err
+		}
 
-	if len(bytecode) == 0 {
-		return []byte{}, nil
-	} else {
-		return bytecode, nil
+		// a new version unless the bytecode is the latest one. [ABIVersion]
+		if err = f.recordVersion(tx, chainID, contractAddress, contractBytecode.ID, blockNumber); err != nil {
+			f.log.Error("Fail to record the ABIVersion item")
+			return err
+		}
+
+		// After get the ABI, set the shouldSearch to false
+		err = tx.Model(&myDB.SearchEtherscan{}).
+			Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes()).
+			Update("should_search", false).Error
+		if err != nil {
+			f.log.Error("Fail to update the shouldSearch field")
+			return err
+		}
+		return clearNegative(tx, chainID, contractAddress)
+	})
+	if err != nil {
+		return newError(ErrStorage, chainID, contractAddress, err)
 	}
 
+	f.invalidate(chainID, contractAddress)
+	f.cache.DeleteNegative(chainID, contractAddress)
+	return nil
 }
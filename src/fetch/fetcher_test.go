@@ -1,15 +1,19 @@
 package fetch
 
 import (
+	myDB "code/src/db"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
 	"math/big"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -17,9 +21,9 @@ import (
 var contractAddress1 = common.HexToAddress("0xdAC17F958D2ee523a2206206994597C13D831ec7") // USDT
 var contractAddress2 = common.HexToAddress("0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2") // WETH
 var contractAddress3 = common.HexToAddress("0x6B175474E89094C44Da98b954EedeAC495271d0F") // DAI
-var signature1 = [4]byte{142, 88, 167, 150}
-var signature2 = [4]byte{220, 163, 100, 249}
-var signature3 = [4]byte{193, 190, 199, 214}
+var signature1 = [4]byte{0x06, 0xfd, 0xde, 0x03} // name()
+var signature2 = [4]byte{0x31, 0x3c, 0xe5, 0x67} // decimals()
+var signature3 = [4]byte{0xf2, 0xd5, 0xd5, 0x6b} // pull(address,uint256)
 var blockHeight = big.NewInt(10000)
 
 func TestUnmarshal(t *testing.T) {
@@ -220,3 +224,223 @@ func TestQueryRuntimeCode(t *testing.T) {
 
 
 }
+
+// Test two Fetchers with their own DB and clock in one process
+func TestFetcherInstances(t *testing.T) {
+	now := time.Now()
+	fetcher1 := useFakeUpstream(t, WithClock(func() time.Time { return now }))
+	fetcher2 := useFakeUpstream(t)
+
+	_, err := fetcher1.GetContractABIAtBlock(1, verifiedAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrQueued)
+	assert.NoError(t, fetcher1.SearchInEtherscan())
+	contractABI, err := fetcher1.GetContractABIAtBlock(1, verifiedAddress, blockHeight)
+	assert.NoError(t, err)
+	assert.Contains(t, contractABI.Methods, "name")
+
+	// the other Fetcher has its own DB
+	_, err = fetcher2.GetContractABIAtBlock(1, verifiedAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrQueued)
+
+	// the clock drives the re-check policy
+	_, _ = fetcher1.GetContractABIAtBlock(1, unverifiedAddress, blockHeight)
+	assert.NoError(t, fetcher1.SearchInEtherscan())
+	_, err = fetcher1.GetContractABIAtBlock(1, unverifiedAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrNotVerified)
+	now = now.Add(defaultRecheckPolicies[StatusUnverified].Initial + time.Second)
+	_, err = fetcher1.GetContractABIAtBlock(1, unverifiedAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrQueued)
+
+	_, err = NewFetcher()
+	assert.Error(t, err)
+}
+
+// Test the lookup policies: cache only, cache+DB, fetch through
+func TestLookupPolicy(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	ctx := context.Background()
+	address := common.HexToAddress("0x00000000000000000000000000000000000f7701")
+	addressesWithCode[address], addressesEverDeployed[address], addressesVerified[address] = true, true, true
+	defer func() {
+		delete(addressesWithCode, address)
+		delete(addressesEverDeployed, address)
+		delete(addressesVerified, address)
+	}()
+
+	_, err := fetcher.GetContractABIAtBlockContext(ctx, 1, address, nil, PolicyCacheOnly)
+	assert.ErrorIs(t, err, ErrNotCached)
+
+	// the concurrent callers share one search
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			method, err := fetcher.GetFunctionABIAtBlockContext(ctx, 1, address, signature1, nil, PolicyFetchThrough)
+			if assert.NoError(t, err) && assert.NotNil(t, method) {
+				assert.Equal(t, "name", method.Name)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, abiRequestCount(address))
+
+	method, err := fetcher.GetFunctionABIAtBlockContext(ctx, 1, address, signature1, nil, PolicyCacheOnly)
+	assert.NoError(t, err)
+	assert.Equal(t, "name", method.Name)
+	contractABI, err := fetcher.GetContractABIAtBlockContext(ctx, 1, address, nil, PolicyCacheAndDB)
+	assert.NoError(t, err)
+	assert.Contains(t, contractABI.Methods, "name")
+	_, err = fetcher.GetFunctionABIAtBlockContext(ctx, 1, address, [4]byte{1, 2, 3, 4}, nil, PolicyFetchThrough)
+	assert.ErrorIs(t, err, ErrUnknownSelector)
+
+	// the classification is returned inline, then from memory
+	_, err = fetcher.GetContractABIAtBlockContext(ctx, 1, unverifiedAddress, nil, PolicyFetchThrough)
+	assert.ErrorIs(t, err, ErrNotVerified)
+	_, err = fetcher.GetContractABIAtBlockContext(ctx, 1, unverifiedAddress, nil, PolicyCacheOnly)
+	assert.ErrorIs(t, err, ErrNotVerified)
+	_, err = fetcher.GetContractABIAtBlockContext(ctx, 5, address, nil, PolicyFetchThrough)
+	assert.ErrorIs(t, err, ErrUnsupportedChain)
+
+	// the deadline: the search goes on in the background
+	slowAddress := common.HexToAddress("0x00000000000000000000000000000000000f7702")
+	addressesWithCode[slowAddress], addressesEverDeployed[slowAddress], addressesVerified[slowAddress] = true, true, true
+	abiRequestsMu.Lock()
+	addressesSlow[slowAddress] = 200 * time.Millisecond
+	abiRequestsMu.Unlock()
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = fetcher.GetContractABIAtBlockContext(timeout, 1, slowAddress, nil, PolicyFetchThrough)
+	assert.ErrorIs(t, err, ErrQueued)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	contractABI, err = fetcher.GetContractABIAtBlockContext(ctx, 1, slowAddress, nil, PolicyFetchThrough)
+	assert.NoError(t, err)
+	assert.Contains(t, contractABI.Methods, "name")
+	assert.Equal(t, 1, abiRequestCount(slowAddress))
+}
+
+// Test the concurrent lookups of a new contract: one DB read per key, the address is queued once
+func TestRequestCoalescing(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	address := common.HexToAddress("0x00000000000000000000000000000000000f7703")
+	addressesWithCode[address], addressesEverDeployed[address], addressesVerified[address] = true, true, true
+	defer func() {
+		delete(addressesWithCode, address)
+		delete(addressesEverDeployed, address)
+		delete(addressesVerified, address)
+	}()
+
+	// count the DB reads of each table
+	var readsMu sync.Mutex
+	reads := make(map[string]int)
+	err := fetcher.db.Callback().Query().After("gorm:query").Register("test:count_reads", func(db *gorm.DB) {
+		readsMu.Lock()
+		reads[db.Statement.Table]++
+		readsMu.Unlock()
+	})
+	assert.NoError(t, err)
+	defer func() { _ = fetcher.db.Callback().Query().Remove("test:count_reads") }()
+
+	// 500 decoders miss the DB, the address is queued once
+	lookupAll := func(lookup func() error) []error {
+		errs := make([]error, 500)
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				errs[i] = lookup()
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+		return errs
+	}
+	errs := lookupAll(func() error {
+		_, err := fetcher.GetFunctionABIAtBlock(1, address, signature1, blockHeight)
+		return err
+	})
+	for _, err := range errs {
+		assert.ErrorIs(t, err, ErrQueued)
+	}
+	var count int64
+	fetcher.db.Model(&myDB.SearchEtherscan{}).Where("chain_id = ? AND contract_address = ?", 1, address).Count(&count)
+	assert.Equal(t, int64(1), count)
+	assert.NoError(t, fetcher.SearchInEtherscan())
+
+	// 500 decoders of the new contract share one DB read per key
+	readsMu.Lock()
+	reads = make(map[string]int)
+	readsMu.Unlock()
+	errs = lookupAll(func() error {
+		method, err := fetcher.GetFunctionABIAtBlock(1, address, signature1, blockHeight)
+		if err == nil {
+			assert.Equal(t, "name", method.Name)
+		}
+		return err
+	})
+	errs = append(errs, lookupAll(func() error {
+		_, err := fetcher.GetContractABIAtBlock(1, address, blockHeight)
+		return err
+	})...)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	readsMu.Lock()
+	defer readsMu.Unlock()
+	assert.Equal(t, 1, reads["function_signatures"])
+	// the deployments of the address, then the one of the contractABI
+	assert.Equal(t, 2, reads["contract_deployments"])
+}
+
+// Test storing a crawl result: a retry converges to the same rows, and a failure leaves none of them
+func TestStoreDeployment(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	countRows := func(address common.Address) (int64, int64, int64) {
+		var bytecodes, deployments, functionSignatures int64
+		fetcher.db.Model(&myDB.ContractBytecode{}).Count(&bytecodes)
+		fetcher.db.Model(&myDB.ContractDeployment{}).Where("contract_address = ?", address.Bytes()).Count(&deployments)
+		fetcher.db.Model(&myDB.FunctionSignature{}).Where("contract_address = ?", address.Bytes()).Count(&functionSignatures)
+		return bytecodes, deployments, functionSignatures
+	}
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, fetcher.searchAddress(context.Background(), fetcher.sources, fetcher.nodes, 1, verifiedAddress))
+		bytecodes, deployments, functionSignatures := countRows(verifiedAddress)
+		assert.Equal(t, int64(1), bytecodes)
+		assert.Equal(t, int64(1), deployments)
+		assert.Equal(t, int64(1), functionSignatures)
+	}
+
+	// rebind to another bytecode: the functions of the previous one are removed
+	decimalsABI := `[{"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"stateMutability":"view","type":"function"}]`
+	rebound := myDB.ContractBytecode{ID: myDB.NewContractBytecodeID(nil, decimalsABI), ContractABI: decimalsABI}
+	assert.NoError(t, fetcher.storeDeployment(1, verifiedAddress, rebound, 0, 0))
+	bytecodes, deployments, functionSignatures := countRows(verifiedAddress)
+	assert.Equal(t, int64(2), bytecodes)
+	assert.Equal(t, int64(1), deployments)
+	assert.Equal(t, int64(1), functionSignatures)
+	method, err := fetcher.GetFunctionABIAtBlock(1, verifiedAddress, signature2, blockHeight)
+	assert.NoError(t, err)
+	assert.Equal(t, "decimals", method.Name)
+
+	// the items are shared by the bytecodes
+	var entries int64
+	fetcher.db.Model(&myDB.ABIEntry{}).Count(&entries)
+	assert.Equal(t, int64(2), entries)
+	assert.NoError(t, fetcher.storeDeployment(1, contractAddress1, myDB.ContractBytecode{ID: myDB.NewContractBytecodeID([]byte{0x60}, decimalsABI), Bytecode: []byte{0x60}, ContractABI: decimalsABI}, 0, 0))
+	fetcher.db.Model(&myDB.ABIEntry{}).Count(&entries)
+	assert.Equal(t, int64(2), entries)
+
+	// fail in the middle: rolled back
+	address := common.HexToAddress("0x00000000000000000000000000000000000a6e02")
+	assert.NoError(t, fetcher.db.Migrator().DropTable(&myDB.SearchEtherscan{}))
+	failed := myDB.ContractBytecode{ID: myDB.NewContractBytecodeID([]byte{0x60, 0x80}, verifiedContractABI), Bytecode: []byte{0x60, 0x80}, ContractABI: verifiedContractABI}
+	assert.ErrorIs(t, fetcher.storeDeployment(1, address, failed, 0, 0), ErrStorage)
+	bytecodes, deployments, functionSignatures = countRows(address)
+	assert.Equal(t, int64(3), bytecodes)
+	assert.Equal(t, int64(0), deployments)
+	assert.Equal(t, int64(0), functionSignatures)
+}
@@ -0,0 +1,209 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
+	"gorm.io/gorm/clause"
+	"math/big"
+	"time"
+)
+
+// defaultDiscoveryDelay
+// @dev Most contracts are verified within minutes of their deployment, E.g. by the deploy scripts
+const defaultDiscoveryDelay = 15 * time.Minute
+
+// methodNotFound
+// @dev The JSON-RPC error code of a method the node does not serve, E.g. debug_traceBlockByNumber without the debug API
+const methodNotFound = -32601
+
+// maxBlocksPerRound
+// @dev The most blocks one round of the block follower reads, it catches up over several rounds
+const maxBlocksPerRound = 100
+
+// FollowBlocks
+// @dev Read the new blocks of the chain every interval until the context is done, and queue the contracts they create
+// Notice: run it in the background, E.g. go fetcher.FollowBlocks(ctx, 1, 12*time.Second)
+func (f *Fetcher) FollowBlocks(ctx context.Context, chainID int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := f.DiscoverContracts(ctx, chainID); err != nil {
+				f.log.Error("Fail to follow the blocks. ChainID:", chainID, " Err:", err)
+			}
+		}
+	}
+}
+
+// DiscoverContracts
+// @dev Read the blocks of the chain after its cursor up to the newest one, at most maxBlocksPerRound, and queue the
+// contracts they create for the robot. [ChainCursor] The robot searches them after the block time + the discovery delay,
+// unless a lookup asks for one first
+// @return the number of the contracts queued
+// Notice: the first round only sets the cursor to the newest block, SetChainCursor reads from an older one.
+// The contracts created by the other contracts are found if the node has the debug API, see TraceReader
+func (f *Fetcher) DiscoverContracts(ctx context.Context, chainID int) (int, error) {
+	if !supports(f.sources, chainID) {
+		return 0, newError(ErrUnsupportedChain, chainID, common.Address{}, nil)
+	}
+	node, err := f.blockReader(chainID)
+	if err != nil {
+		return 0, err
+	}
+	head, err := node.BlockNumber(ctx)
+	if err != nil {
+		f.log.Error("Fail to get the newest block. ChainID:", chainID)
+		return 0, newError(ErrNode, chainID, common.Address{}, err)
+	}
+
+	var cursor myDB.ChainCursor
+	result := f.db.Where("chain_id = ?", chainID).Limit(1).Find(&cursor)
+	if result.Error != nil {
+		f.log.Error("Fail to read the ChainCursor item")
+		return 0, newError(ErrStorage, chainID, common.Address{}, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return 0, f.SetChainCursor(chainID, int64(head))
+	}
+
+	fromBlock, toBlock := cursor.LastBlock+1, int64(head)
+	if toBlock-fromBlock+1 > maxBlocksPerRound {
+		toBlock = fromBlock + maxBlocksPerRound - 1
+	}
+	queued := 0
+	for number := fromBlock; number <= toBlock; number++ {
+		created, blockTime, err := f.createdContracts(ctx, node, chainID, big.NewInt(number))
+		if err == nil {
+			notBefore := int64(blockTime) + int64(f.discoveryDelay(chainID)/time.Second)
+			for _, contractAddress := range created {
+				isQueued, queueErr := f.queueDiscovered(chainID, contractAddress, notBefore)
+				if queueErr != nil {
+					err = queueErr
+					break
+				}
+				if isQueued {
+					queued++
+				}
+			}
+		}
+		if err != nil {
+			// read the block again in the next round
+			if number > fromBlock {
+				_ = f.SetChainCursor(chainID, number-1)
+			}
+			return queued, err
+		}
+	}
+	f.log.Info("Follow the blocks. ChainID:", chainID, " fromBlock:", fromBlock, " toBlock:", toBlock, " queued:", queued)
+	return queued, f.SetChainCursor(chainID, toBlock)
+}
+
+// SetChainCursor
+// @dev The block follower reads the chain after this block
+func (f *Fetcher) SetChainCursor(chainID int, lastBlock int64) error {
+	cursor := myDB.ChainCursor{ChainID: chainID, LastBlock: lastBlock, UpdatedAt: int(f.now().Unix())}
+	if err := f.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&cursor).Error; err != nil {
+		f.log.Error("Fail to update the ChainCursor item")
+		return newError(ErrStorage, chainID, common.Address{}, err)
+	}
+	return nil
+}
+
+// @dev The contracts created in the block: by its transactions, and by the other contracts if the node traces them
+// @return the contracts and the time of the block
+// Notice: a failed trace fails the block, so it is read again, unless the node has no debug API
+func (f *Fetcher) createdContracts(ctx context.Context, node BlockReader, chainID int, number *big.Int) ([]common.Address, uint64, error) {
+	block, err := node.BlockByNumber(ctx, number)
+	if err != nil {
+		f.log.Error("Fail to get the block. ChainID:", chainID, " number:", number)
+		return nil, 0, newError(ErrNode, chainID, common.Address{}, err)
+	}
+
+	var created []common.Address
+	isFound := make(map[common.Address]bool)
+	add := func(contractAddress common.Address) {
+		if contractAddress != (common.Address{}) && !isFound[contractAddress] {
+			isFound[contractAddress] = true
+			created = append(created, contractAddress)
+		}
+	}
+	for _, tx := range block.Transactions() {
+		if tx.To() != nil {
+			continue
+		}
+		receipt, err := node.TransactionReceipt(ctx, tx.Hash())
+		if err != nil {
+			f.log.Error("Fail to get the receipt. ChainID:", chainID, " tx:", tx.Hash())
+			return nil, 0, newError(ErrNode, chainID, common.Address{}, err)
+		}
+		if receipt.Status == types.ReceiptStatusSuccessful {
+			add(receipt.ContractAddress)
+		}
+	}
+	if tracer, ok := node.(TraceReader); ok {
+		contracts, err := tracer.CreatedContracts(ctx, number)
+		var rpcErr rpc.Error
+		if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == methodNotFound {
+			f.log.Debug("No debug API, the contracts created by the factories are missed. ChainID:", chainID, " number:", number, " Err:", err)
+		} else if err != nil {
+			f.log.Error("Fail to trace the block. ChainID:", chainID, " number:", number)
+			return nil, 0, newError(ErrNode, chainID, common.Address{}, err)
+		}
+		for _, contractAddress := range contracts {
+			add(contractAddress)
+		}
+	}
+	return created, block.Time(), nil
+}
+
+// @dev Queue a new contract for the robot, searched from notBefore, unless it is stored or queued
+// @return whether it is queued
+func (f *Fetcher) queueDiscovered(chainID int, contractAddress common.Address, notBefore int64) (bool, error) {
+	var count int64
+	err := f.db.Model(&myDB.ContractDeployment{}).Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes()).Count(&count).Error
+	if err != nil || count > 0 {
+		return false, err
+	}
+	result := f.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&myDB.SearchEtherscan{
+		ChainID:         chainID,
+		ContractAddress: contractAddress.Bytes(),
+		Time:            int(f.now().Unix()),
+		ShouldSearch:    true,
+		NotBefore:       int(notBefore),
+		Tags:            TagFollower,
+	})
+	if result.Error != nil {
+		f.log.Error("Fail to create a searchEtherscan item in db")
+		return false, newError(ErrStorage, chainID, contractAddress, result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// @dev How long the robot waits after the block of a new contract of the chain
+func (f *Fetcher) discoveryDelay(chainID int) time.Duration {
+	if delay, isFound := f.delays[chainID]; isFound {
+		return delay
+	}
+	return f.delays[0]
+}
+
+// @dev The node of the chain which reads the blocks, the node of the other chains if it has none
+func (f *Fetcher) blockReader(chainID int) (BlockReader, error) {
+	node, found := f.nodes[chainID]
+	if !found {
+		node, found = f.nodes[0]
+	}
+	reader, ok := node.(BlockReader)
+	if !found || !ok {
+		f.log.Error("No node reading the blocks of the chain. ChainID:", chainID)
+		return nil, newError(ErrNode, chainID, common.Address{}, errors.New("No node reading the blocks of the chain"))
+	}
+	return reader, nil
+}
@@ -0,0 +1,167 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// fakeChainNode
+// @dev A chain in memory: the blocks, the receipts of their transactions and the contracts created by the factories
+type fakeChainNode struct {
+	blocks      map[uint64]*types.Block
+	receipts    map[common.Hash]*types.Receipt
+	traces      map[uint64][]common.Address
+	traceErrors map[uint64]error // the blocks whose trace fails
+	head        uint64
+}
+
+// noDebugAPIError
+// @dev The error of a node without the debug API
+type noDebugAPIError struct{}
+
+func (noDebugAPIError) Error() string {
+	return "the method debug_traceBlockByNumber does not exist/is not available"
+}
+
+func (noDebugAPIError) ErrorCode() int {
+	return methodNotFound
+}
+
+func (n *fakeChainNode) CodeAt(ctx context.Context, contractAddress common.Address, blockNumber *big.Int) ([]byte, error) {
+	if addressesWithCode[contractAddress] {
+		return []byte{0x60, 0x80, 0x60, 0x40, 0x52}, nil
+	}
+	return nil, nil
+}
+
+func (n *fakeChainNode) BlockNumber(ctx context.Context) (uint64, error) {
+	return n.head, nil
+}
+
+func (n *fakeChainNode) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	if block, found := n.blocks[number.Uint64()]; found {
+		return block, nil
+	}
+	return types.NewBlockWithHeader(&types.Header{Number: number}), nil
+}
+
+func (n *fakeChainNode) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	return n.receipts[txHash], nil
+}
+
+func (n *fakeChainNode) CreatedContracts(ctx context.Context, number *big.Int) ([]common.Address, error) {
+	if err := n.traceErrors[number.Uint64()]; err != nil {
+		return nil, err
+	}
+	return n.traces[number.Uint64()], nil
+}
+
+// @dev Add a block of the transactions creating the contracts, an empty address: a failed creation
+func (n *fakeChainNode) addBlock(number uint64, blockTime time.Time, created ...common.Address) {
+	var txs []*types.Transaction
+	for i, contractAddress := range created {
+		tx := types.NewTx(&types.LegacyTx{Nonce: number*100 + uint64(i), Data: []byte{0x60, 0x80}})
+		receipt := &types.Receipt{TxHash: tx.Hash(), ContractAddress: contractAddress, Status: types.ReceiptStatusSuccessful}
+		if contractAddress == (common.Address{}) {
+			receipt.Status = types.ReceiptStatusFailed
+		}
+		n.receipts[tx.Hash()] = receipt
+		txs = append(txs, tx)
+	}
+	// a call is not a creation
+	to := verifiedAddress
+	txs = append(txs, types.NewTx(&types.LegacyTx{Nonce: number*100 + 99, To: &to}))
+	header := &types.Header{Number: new(big.Int).SetUint64(number), Time: uint64(blockTime.Unix())}
+	n.blocks[number] = types.NewBlockWithHeader(header).WithBody(txs, nil)
+}
+
+// Test the block follower: the cursor, the created contracts and the discovery delay
+func TestDiscoverContracts(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	node := &fakeChainNode{blocks: map[uint64]*types.Block{}, receipts: map[common.Hash]*types.Receipt{}, traces: map[uint64][]common.Address{}, head: 10}
+	fetcher := useFakeUpstream(t, WithNode(0, node), WithClock(func() time.Time { return now }))
+
+	_, err := fetcher.DiscoverContracts(ctx, 999)
+	assert.ErrorIs(t, err, ErrUnsupportedChain)
+
+	// the first round starts at the newest block
+	queued, err := fetcher.DiscoverContracts(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, queued)
+	var cursor myDB.ChainCursor
+	assert.NoError(t, fetcher.db.Where("chain_id = ?", 1).First(&cursor).Error)
+	assert.Equal(t, int64(10), cursor.LastBlock)
+
+	// a deployment, a failed deployment and a contract created by a factory
+	node.addBlock(11, now, verifiedAddress, common.Address{})
+	node.traces[11] = []common.Address{verifiedAddress, unverifiedAddress}
+	node.head = 12
+	queued, err = fetcher.DiscoverContracts(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, queued)
+	var searches []myDB.SearchEtherscan
+	assert.NoError(t, fetcher.db.Order("contract_address ASC").Find(&searches).Error)
+	if assert.Len(t, searches, 2) {
+		assert.True(t, searches[0].ShouldSearch)
+		assert.Equal(t, int(now.Add(defaultDiscoveryDelay).Unix()), searches[0].NotBefore)
+	}
+
+	// not searched before the delay, unless a lookup asks for it
+	assert.NoError(t, fetcher.SearchInEtherscan())
+	_, err = fetcher.GetContractABIAtBlock(1, verifiedAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrQueued)
+	var search myDB.SearchEtherscan
+	assert.NoError(t, fetcher.db.Where("chain_id = ? AND contract_address = ?", 1, unverifiedAddress.Bytes()).First(&search).Error)
+	assert.True(t, search.ShouldSearch)
+	assert.Equal(t, int(now.Add(defaultDiscoveryDelay).Unix()), search.NotBefore)
+	assert.NoError(t, fetcher.SearchInEtherscan())
+	contractABI, err := fetcher.GetContractABIAtBlock(1, verifiedAddress, blockHeight)
+	assert.NoError(t, err)
+	assert.Contains(t, contractABI.Methods, "name")
+	var waiting myDB.SearchEtherscan
+	assert.NoError(t, fetcher.db.Where("chain_id = ? AND contract_address = ?", 1, unverifiedAddress.Bytes()).First(&waiting).Error)
+	assert.True(t, waiting.ShouldSearch)
+
+	now = now.Add(defaultDiscoveryDelay + time.Second)
+	assert.NoError(t, fetcher.SearchInEtherscan())
+	var searched myDB.SearchEtherscan
+	assert.NoError(t, fetcher.db.Where("chain_id = ? AND contract_address = ?", 1, unverifiedAddress.Bytes()).First(&searched).Error)
+	assert.False(t, searched.ShouldSearch)
+
+	// a stored contract is not queued again, the long ranges are read over several rounds
+	node.addBlock(13, now, verifiedAddress)
+	node.head = 12 + 2*maxBlocksPerRound
+	queued, err = fetcher.DiscoverContracts(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, queued)
+	var next myDB.ChainCursor
+	assert.NoError(t, fetcher.db.Where("chain_id = ?", 1).First(&next).Error)
+	assert.Equal(t, int64(12+maxBlocksPerRound), next.LastBlock)
+
+	// a failed trace: the block is read again in the next round, skipped without the debug API
+	node.traceErrors = map[uint64]error{14 + maxBlocksPerRound: errors.New("timeout"), 13 + maxBlocksPerRound: noDebugAPIError{}}
+	_, err = fetcher.DiscoverContracts(ctx, 1)
+	assert.ErrorIs(t, err, ErrNode)
+	assert.NoError(t, fetcher.db.Where("chain_id = ?", 1).First(&next).Error)
+	assert.Equal(t, int64(13+maxBlocksPerRound), next.LastBlock)
+	delete(node.traceErrors, 14+maxBlocksPerRound)
+	_, err = fetcher.DiscoverContracts(ctx, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, fetcher.db.Where("chain_id = ?", 1).First(&next).Error)
+	assert.Equal(t, int64(12+2*maxBlocksPerRound), next.LastBlock)
+}
+
+// Test the discovery delay of each chain
+func TestDiscoveryDelay(t *testing.T) {
+	fetcher := useFakeUpstream(t, WithDiscoveryDelay(1, time.Hour), WithDiscoveryDelay(0, time.Minute))
+	assert.Equal(t, time.Hour, fetcher.discoveryDelay(1))
+	assert.Equal(t, time.Minute, fetcher.discoveryDelay(56))
+}
@@ -0,0 +1,309 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// The changes of an ABIChange
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// ABIChange
+// @dev An item of the ABI which differs between two versions
+type ABIChange struct {
+	Kind      string   `json:"kind"`               // function, event, error, constructor, fallback or receive
+	Change    string   `json:"change"`             // added, removed or modified
+	Signature string   `json:"signature"`          // in the newer version, in the older one if removed
+	Previous  string   `json:"previous,omitempty"` // the signature in the older version if it is modified
+	Details   []string `json:"details,omitempty"`  // what is modified, E.g. input 0 name: to => recipient
+}
+
+// ABIDiff
+// @dev The changes of the ABI of an address between two versions
+type ABIDiff struct {
+	ChainID int         `json:"chainId"`
+	Address string      `json:"address"`
+	From    int         `json:"from"` // the older version
+	To      int         `json:"to"`   // the newer version
+	Changes []ABIChange `json:"changes"`
+}
+
+// ABIHistory
+// @dev ABIHistory of the default Fetcher
+func ABIHistory(chainID int, contractAddress common.Address) ([]myDB.ABIVersion, error) {
+	return Default().ABIHistory(chainID, contractAddress)
+}
+
+// DiffABIVersions
+// @dev DiffABIVersions of the default Fetcher
+func DiffABIVersions(chainID int, contractAddress common.Address, from int, to int) (*ABIDiff, error) {
+	return Default().DiffABIVersions(chainID, contractAddress, from, to)
+}
+
+// DiffABIAtBlocks
+// @dev DiffABIAtBlocks of the default Fetcher
+func DiffABIAtBlocks(chainID int, contractAddress common.Address, fromBlock *big.Int, toBlock *big.Int) (*ABIDiff, error) {
+	return Default().DiffABIAtBlocks(chainID, contractAddress, fromBlock, toBlock)
+}
+
+// ABIHistory
+// @dev The ABIs seen at chainID+contractAddress, the oldest first
+func (f *Fetcher) ABIHistory(chainID int, contractAddress common.Address) ([]myDB.ABIVersion, error) {
+	var versions []myDB.ABIVersion
+	err := f.db.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes()).Order("version ASC").Find(&versions).Error
+	if err != nil {
+		f.log.Error("Fail to read the ABIVersion items")
+		return nil, newError(ErrStorage, chainID, contractAddress, err)
+	}
+	return versions, nil
+}
+
+// DiffABIVersions
+// @dev The changes of the ABI of chainID+contractAddress between two versions
+// @param from, to: the versions, to <= 0: the latest one, from <= 0: the one before to
+func (f *Fetcher) DiffABIVersions(chainID int, contractAddress common.Address, from int, to int) (*ABIDiff, error) {
+	var newer myDB.ABIVersion
+	query := f.db.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes())
+	if to > 0 {
+		query = query.Where("version = ?", to)
+	}
+	if err := query.Order("version DESC").Limit(1).Find(&newer).Error; err != nil {
+		return nil, newError(ErrStorage, chainID, contractAddress, err)
+	}
+	if newer.Version == 0 {
+		return nil, newError(ErrUnknownVersion, chainID, contractAddress, fmt.Errorf("version %d", to))
+	}
+	if from <= 0 {
+		from = newer.Version - 1
+	}
+
+	var older myDB.ABIVersion
+	err := f.db.Where("chain_id = ? AND contract_address = ? AND version = ?", chainID, contractAddress.Bytes(), from).Limit(1).Find(&older).Error
+	if err != nil {
+		return nil, newError(ErrStorage, chainID, contractAddress, err)
+	}
+	if older.Version == 0 {
+		return nil, newError(ErrUnknownVersion, chainID, contractAddress, fmt.Errorf("version %d", from))
+	}
+	return f.diffVersions(chainID, contractAddress, older, newer)
+}
+
+// DiffABIAtBlocks
+// @dev The changes of the ABI of chainID+contractAddress between the versions seen at two blocks
+// @param fromBlock, toBlock: nil: the latest version
+// Notice: a version is seen at a block after its upgrade, the one of a block is the latest version seen up to it
+func (f *Fetcher) DiffABIAtBlocks(chainID int, contractAddress common.Address, fromBlock *big.Int, toBlock *big.Int) (*ABIDiff, error) {
+	older, err := f.versionAt(chainID, contractAddress, fromBlock)
+	if err != nil {
+		return nil, err
+	}
+	newer, err := f.versionAt(chainID, contractAddress, toBlock)
+	if err != nil {
+		return nil, err
+	}
+	return f.diffVersions(chainID, contractAddress, older, newer)
+}
+
+// @dev The latest version of chainID+contractAddress seen up to the block, nil: the latest one
+func (f *Fetcher) versionAt(chainID int, contractAddress common.Address, block *big.Int) (myDB.ABIVersion, error) {
+	var version myDB.ABIVersion
+	query := f.db.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes())
+	if block != nil {
+		query = query.Where("block_number <= ?", block.Int64())
+	}
+	if err := query.Order("version DESC").Limit(1).Find(&version).Error; err != nil {
+		return version, newError(ErrStorage, chainID, contractAddress, err)
+	}
+	if version.Version == 0 {
+		return version, newError(ErrUnknownVersion, chainID, contractAddress, fmt.Errorf("block %v", block))
+	}
+	return version, nil
+}
+
+// @dev Record the bytecode as a new version of chainID+contractAddress, unless it is the latest one. [ABIVersion]
+// Notice: in the transaction of storeDeployment()
+func (f *Fetcher) recordVersion(tx *gorm.DB, chainID int, contractAddress common.Address, contractBytecodeID uuid.UUID, blockNumber int64) error {
+	var latest myDB.ABIVersion
+	err := tx.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes()).Order("version DESC").Limit(1).Find(&latest).Error
+	if err != nil || latest.ContractBytecodeID == contractBytecodeID {
+		return err
+	}
+	// another robot may have recorded it meanwhile
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&myDB.ABIVersion{
+		ChainID:            chainID,
+		ContractAddress:    contractAddress.Bytes(),
+		Version:            latest.Version + 1,
+		ContractBytecodeID: contractBytecodeID,
+		BlockNumber:        blockNumber,
+		SeenAt:             int(f.now().Unix()),
+	}).Error
+}
+
+// @dev Compare the [ABIEntry] items of two versions
+func (f *Fetcher) diffVersions(chainID int, contractAddress common.Address, older myDB.ABIVersion, newer myDB.ABIVersion) (*ABIDiff, error) {
+	olderEntries, err := f.abiEntries(older.ContractBytecodeID)
+	if err != nil {
+		return nil, newError(ErrStorage, chainID, contractAddress, err)
+	}
+	newerEntries, err := f.abiEntries(newer.ContractBytecodeID)
+	if err != nil {
+		return nil, newError(ErrStorage, chainID, contractAddress, err)
+	}
+	return &ABIDiff{
+		ChainID: chainID,
+		Address: contractAddress.Hex(),
+		From:    older.Version,
+		To:      newer.Version,
+		Changes: diffABIEntries(olderEntries, newerEntries),
+	}, nil
+}
+
+// @dev The [ABIEntry] items of a bytecode
+func (f *Fetcher) abiEntries(contractBytecodeID uuid.UUID) ([]myDB.ABIEntry, error) {
+	var entries []myDB.ABIEntry
+	err := f.db.Model(&myDB.ABIEntry{}).
+		Joins("JOIN bytecode_abi_entries ON bytecode_abi_entries.abi_entry_id = abi_entries.id").
+		Where("bytecode_abi_entries.contract_bytecode_id = ?", contractBytecodeID).
+		Find(&entries).Error
+	return entries, err
+}
+
+// @dev The changes from the older items to the newer ones. The items with the same signature are modified if their JSON
+// differs, then the one older and one newer item left with the same kind and name are modified, E.g. the types changed
+func diffABIEntries(olderEntries []myDB.ABIEntry, newerEntries []myDB.ABIEntry) []ABIChange {
+	var changes []ABIChange
+	newerBySignature := make(map[string]myDB.ABIEntry)
+	for _, entry := range newerEntries {
+		newerBySignature[entry.Kind+" "+entry.Signature] = entry
+	}
+	olderLeft, newerLeft := make(map[string][]myDB.ABIEntry), make(map[string][]myDB.ABIEntry)
+	isMatched := make(map[string]bool)
+	for _, older := range olderEntries {
+		newer, isFound := newerBySignature[older.Kind+" "+older.Signature]
+		if !isFound {
+			olderLeft[nameKey(older)] = append(olderLeft[nameKey(older)], older)
+			continue
+		}
+		isMatched[older.Kind+" "+older.Signature] = true
+		if older.ID != newer.ID {
+			changes = append(changes, ABIChange{Kind: newer.Kind, Change: ChangeModified, Signature: newer.Signature, Details: diffEntry(older, newer)})
+		}
+	}
+	for _, newer := range newerEntries {
+		if !isMatched[newer.Kind+" "+newer.Signature] {
+			newerLeft[nameKey(newer)] = append(newerLeft[nameKey(newer)], newer)
+		}
+	}
+
+	for key, olders := range olderLeft {
+		newers := newerLeft[key]
+		if len(olders) == 1 && len(newers) == 1 {
+			changes = append(changes, ABIChange{Kind: newers[0].Kind, Change: ChangeModified, Signature: newers[0].Signature, Previous: olders[0].Signature, Details: diffEntry(olders[0], newers[0])})
+			delete(newerLeft, key)
+			continue
+		}
+		for _, older := range olders {
+			changes = append(changes, ABIChange{Kind: older.Kind, Change: ChangeRemoved, Signature: older.Signature})
+		}
+	}
+	for _, newers := range newerLeft {
+		for _, newer := range newers {
+			changes = append(changes, ABIChange{Kind: newer.Kind, Change: ChangeAdded, Signature: newer.Signature})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Kind != changes[j].Kind {
+			return changes[i].Kind < changes[j].Kind
+		}
+		return changes[i].Signature < changes[j].Signature
+	})
+	return changes
+}
+
+// @dev The kind and the name, the kind only for constructor, fallback and receive
+func nameKey(entry myDB.ABIEntry) string {
+	return entry.Kind + " " + entry.Name
+}
+
+// abiParam
+// @dev An input or output in the fragment of [ABIEntry]
+type abiParam struct {
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Indexed    bool       `json:"indexed"`
+	Components []abiParam `json:"components"`
+}
+
+// abiItem
+// @dev The fragment of [ABIEntry]
+type abiItem struct {
+	Inputs    []abiParam `json:"inputs"`
+	Outputs   []abiParam `json:"outputs"`
+	Anonymous bool       `json:"anonymous"`
+}
+
+// @dev What differs between two items of the same kind, E.g. stateMutability: view => nonpayable
+func diffEntry(older myDB.ABIEntry, newer myDB.ABIEntry) []string {
+	var olderItem, newerItem abiItem
+	_ = json.Unmarshal([]byte(older.Fragment), &olderItem)
+	_ = json.Unmarshal([]byte(newer.Fragment), &newerItem)
+
+	var details []string
+	if older.StateMutability != newer.StateMutability {
+		details = append(details, fmt.Sprintf("stateMutability: %s => %s", older.StateMutability, newer.StateMutability))
+	}
+	if olderItem.Anonymous != newerItem.Anonymous {
+		details = append(details, fmt.Sprintf("anonymous: %t => %t", olderItem.Anonymous, newerItem.Anonymous))
+	}
+	details = append(details, diffParams("input", olderItem.Inputs, newerItem.Inputs)...)
+	details = append(details, diffParams("output", olderItem.Outputs, newerItem.Outputs)...)
+	if len(details) == 0 {
+		details = append(details, "the other attributes, E.g. internalType")
+	}
+	return details
+}
+
+// @dev What differs between the inputs or the outputs, E.g. input 0 name: to => recipient
+func diffParams(label string, olders []abiParam, newers []abiParam) []string {
+	var details []string
+	if len(olders) != len(newers) {
+		details = append(details, fmt.Sprintf("%ss: %d => %d", label, len(olders), len(newers)))
+	}
+	for i := 0; i < len(olders) && i < len(newers); i++ {
+		if olders[i].Name != newers[i].Name {
+			details = append(details, fmt.Sprintf("%s %d name: %s => %s", label, i, olders[i].Name, newers[i].Name))
+		}
+		if olderType, newerType := canonicalType(olders[i]), canonicalType(newers[i]); olderType != newerType {
+			details = append(details, fmt.Sprintf("%s %d type: %s => %s", label, i, olderType, newerType))
+		}
+		if olders[i].Indexed != newers[i].Indexed {
+			details = append(details, fmt.Sprintf("%s %d indexed: %t => %t", label, i, olders[i].Indexed, newers[i].Indexed))
+		}
+	}
+	return details
+}
+
+// @dev The type with the components of a tuple, E.g. (address,uint256)[]
+func canonicalType(param abiParam) string {
+	if !strings.HasPrefix(param.Type, "tuple") {
+		return param.Type
+	}
+	types := make([]string, 0, len(param.Components))
+	for _, component := range param.Components {
+		types = append(types, canonicalType(component))
+	}
+	return "(" + strings.Join(types, ",") + ")" + strings.TrimPrefix(param.Type, "tuple")
+}
@@ -0,0 +1,75 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+)
+
+// Test recording the ABIs seen at an address and the changes between them
+func TestABIHistory(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	address := common.HexToAddress("0x00000000000000000000000000000000000a6e44")
+	olderABI := `[
+		{"type":"function","name":"transfer","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable"},
+		{"type":"function","name":"mint","inputs":[{"name":"amount","type":"uint256"}],"outputs":[],"stateMutability":"nonpayable"},
+		{"type":"function","name":"paused","inputs":[],"outputs":[{"name":"","type":"bool"}],"stateMutability":"view"},
+		{"type":"event","name":"Transfer","inputs":[{"name":"from","type":"address","indexed":true},{"name":"to","type":"address","indexed":false}],"anonymous":false}
+	]`
+	newerABI := `[
+		{"type":"function","name":"transfer","inputs":[{"name":"recipient","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable"},
+		{"type":"function","name":"mint","inputs":[{"name":"amount","type":"uint128"}],"outputs":[],"stateMutability":"payable"},
+		{"type":"event","name":"Transfer","inputs":[{"name":"from","type":"address","indexed":true},{"name":"to","type":"address","indexed":true}],"anonymous":false},
+		{"type":"error","name":"Paused","inputs":[]}
+	]`
+	store := func(contractABI string, blockNumber int64) {
+		bytecode := []byte(contractABI)
+		contractBytecode := myDB.ContractBytecode{ID: myDB.NewContractBytecodeID(bytecode, contractABI), Bytecode: bytecode, ContractABI: contractABI}
+		assert.NoError(t, fetcher.storeDeployment(1, address, contractBytecode, 0, blockNumber))
+	}
+
+	// the same bytecode again is not a new version
+	store(olderABI, 100)
+	store(olderABI, 150)
+	store(newerABI, 200)
+	versions, err := fetcher.ABIHistory(1, address)
+	assert.NoError(t, err)
+	if assert.Len(t, versions, 2) {
+		assert.Equal(t, 1, versions[0].Version)
+		assert.Equal(t, int64(100), versions[0].BlockNumber)
+		assert.Equal(t, 2, versions[1].Version)
+		assert.Equal(t, int64(200), versions[1].BlockNumber)
+		assert.NotZero(t, versions[1].SeenAt)
+	}
+
+	// default: the last upgrade
+	diff, err := fetcher.DiffABIVersions(1, address, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, diff.From)
+	assert.Equal(t, 2, diff.To)
+	assert.Equal(t, []ABIChange{
+		{Kind: myDB.KindError, Change: ChangeAdded, Signature: "Paused()"},
+		{Kind: myDB.KindEvent, Change: ChangeModified, Signature: "Transfer(address,address)", Details: []string{"input 1 indexed: false => true"}},
+		{Kind: myDB.KindFunction, Change: ChangeModified, Signature: "mint(uint128)", Previous: "mint(uint256)", Details: []string{"stateMutability: nonpayable => payable", "input 0 type: uint256 => uint128"}},
+		{Kind: myDB.KindFunction, Change: ChangeRemoved, Signature: "paused()"},
+		{Kind: myDB.KindFunction, Change: ChangeModified, Signature: "transfer(address,uint256)", Details: []string{"input 0 name: to => recipient"}},
+	}, diff.Changes)
+
+	// by blocks: before the upgrade and the latest one
+	diff, err = fetcher.DiffABIAtBlocks(1, address, big.NewInt(199), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, diff.From)
+	assert.Len(t, diff.Changes, 5)
+	diff, err = fetcher.DiffABIAtBlocks(1, address, big.NewInt(200), big.NewInt(300))
+	assert.NoError(t, err)
+	assert.Empty(t, diff.Changes)
+
+	_, err = fetcher.DiffABIAtBlocks(1, address, big.NewInt(99), nil)
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+	_, err = fetcher.DiffABIVersions(1, address, 1, 3)
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+	_, err = fetcher.DiffABIVersions(1, address, 0, 1)
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+}
@@ -0,0 +1,153 @@
+package fetch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+// Metadata
+// @dev The CBOR encoded data solc appends to the end of the runtime bytecode
+// Notice: the metadata hash is the same on every chain if the contract is compiled from the same source and settings
+type Metadata struct {
+	HashType        string // "ipfs", "bzzr0" or "bzzr1"
+	Hash            []byte // the hash of metadata.json
+	CompilerVersion string // E.g. 0.8.19, empty if the compiler did not record it (solc < 0.5.9)
+	Experimental    bool   // compiled with experimental features
+}
+
+// CBOR major types used by the solc metadata
+const (
+	cborUint   = 0
+	cborBytes  = 2
+	cborText   = 3
+	cborMap    = 5
+	cborSimple = 7
+)
+
+// ParseMetadata
+// @dev runtime bytecode => solc metadata
+// The last 2 bytes of the runtime bytecode are the big-endian length of the CBOR data in front of them:
+// 0xa2 0x64 'i' 'p' 'f' 's' 0x58 0x22 <34 bytes> 0x64 's' 'o' 'l' 'c' 0x43 <3 bytes> 0x00 0x33
+func ParseMetadata(bytecode []byte) (*Metadata, error) {
+	if len(bytecode) < 2 {
+		return nil, errors.Wrap(errors.New("The bytecode is too short"), "No metadata")
+	}
+
+	length := int(binary.BigEndian.Uint16(bytecode[len(bytecode)-2:]))
+	if length == 0 || length > len(bytecode)-2 {
+		return nil, errors.Wrap(errors.New("The metadata length is out of range"), "No metadata")
+	}
+	data := bytecode[len(bytecode)-2-length : len(bytecode)-2]
+
+	major, size, pos, err := readCBORHead(data, 0)
+	if err != nil || major != cborMap {
+		return nil, errors.Wrap(errors.New("The metadata is not a CBOR map"), "No metadata")
+	}
+
+	metadata := &Metadata{}
+	for i := uint64(0); i < size; i++ {
+		var key, value interface{}
+		key, pos, err = readCBORItem(data, pos)
+		if err != nil {
+			return nil, errors.Wrap(err, "Parse fail")
+		}
+		value, pos, err = readCBORItem(data, pos)
+		if err != nil {
+			return nil, errors.Wrap(err, "Parse fail")
+		}
+
+		switch key {
+		case "ipfs", "bzzr0", "bzzr1":
+			hash, ok := value.([]byte)
+			if !ok {
+				return nil, errors.Wrap(errors.New("The metadata hash is not a byte string"), "Parse fail")
+			}
+			metadata.HashType = key.(string)
+			metadata.Hash = hash
+		case "solc":
+			// release builds store 3 bytes: major, minor, patch. Nightly builds store the full version string
+			switch version := value.(type) {
+			case []byte:
+				if len(version) == 3 {
+					metadata.CompilerVersion = fmt.Sprintf("%d.%d.%d", version[0], version[1], version[2])
+				}
+			case string:
+				metadata.CompilerVersion = version
+			}
+		case "experimental":
+			metadata.Experimental, _ = value.(bool)
+		}
+	}
+	if pos != len(data) {
+		return nil, errors.Wrap(errors.New("Unexpected data after the metadata map"), "Parse fail")
+	}
+	if metadata.Hash == nil {
+		return nil, errors.Wrap(errors.New("Not found the metadata hash"), "No metadata")
+	}
+
+	return metadata, nil
+}
+
+// @dev Read the type and the argument of a CBOR data item
+func readCBORHead(data []byte, pos int) (major byte, argument uint64, next int, err error) {
+	if pos >= len(data) {
+		return 0, 0, pos, errors.New("Unexpected end of the CBOR data")
+	}
+	major = data[pos] >> 5
+	info := data[pos] & 0x1f
+	pos++
+
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), pos, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default: // indefinite length is never used by solc
+		return 0, 0, pos, errors.New("Unsupported CBOR length")
+	}
+	if pos+size > len(data) {
+		return 0, 0, pos, errors.New("Unexpected end of the CBOR data")
+	}
+	for _, b := range data[pos : pos+size] {
+		argument = argument<<8 | uint64(b)
+	}
+	return major, argument, pos + size, nil
+}
+
+// @dev Read a single CBOR data item, only the types used by the solc metadata are supported
+func readCBORItem(data []byte, pos int) (interface{}, int, error) {
+	major, argument, pos, err := readCBORHead(data, pos)
+	if err != nil {
+		return nil, pos, err
+	}
+
+	switch major {
+	case cborUint:
+		return argument, pos, nil
+	case cborBytes, cborText:
+		if argument > uint64(len(data)-pos) {
+			return nil, pos, errors.New("Unexpected end of the CBOR data")
+		}
+		end := pos + int(argument)
+		if major == cborText {
+			return string(data[pos:end]), end, nil
+		}
+		return data[pos:end], end, nil
+	case cborSimple:
+		switch argument {
+		case 20:
+			return false, pos, nil
+		case 21:
+			return true, pos, nil
+		}
+	}
+	return nil, pos, errors.New("Unsupported CBOR type")
+}
@@ -0,0 +1,60 @@
+package fetch
+
+import (
+	"bytes"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Prepare some data that may be used
+var (
+	metadataIPFSHash = common.FromHex("0x1220b3a1c6f2d2e4b0b9e7f05c11d6a5f5a3f37c2a9d4f8a1d0e2c3b4a5968778695")
+	// {"ipfs": h'1220...', "solc": h'000813'}
+	metadataIPFS = append(append(common.FromHex("0xa264697066735822"), metadataIPFSHash...), common.FromHex("0x64736f6c6343000813")...)
+	// {"bzzr0": h'...'}, solc < 0.5.9 did not record the compiler version
+	metadataBzzr0 = append(common.FromHex("0xa165627a7a72305820"), bytes.Repeat([]byte{0xab}, 32)...)
+)
+
+func TestParseMetadata(t *testing.T) {
+	runtimeCode := append(common.FromHex("0x6080604052"), metadataIPFS...)
+	runtimeCode = append(runtimeCode, 0x00, byte(len(metadataIPFS)))
+
+	metadata, err := ParseMetadata(runtimeCode)
+	assert.NoError(t, err)
+	assert.Equal(t, "ipfs", metadata.HashType)
+	assert.Equal(t, metadataIPFSHash, metadata.Hash)
+	assert.Equal(t, "0.8.19", metadata.CompilerVersion)
+	assert.False(t, metadata.Experimental)
+}
+
+func TestParseMetadataWithoutCompilerVersion(t *testing.T) {
+	runtimeCode := append(common.FromHex("0x6080604052"), metadataBzzr0...)
+	runtimeCode = append(runtimeCode, 0x00, byte(len(metadataBzzr0)))
+
+	metadata, err := ParseMetadata(runtimeCode)
+	assert.NoError(t, err)
+	assert.Equal(t, "bzzr0", metadata.HashType)
+	assert.Equal(t, bytes.Repeat([]byte{0xab}, 32), metadata.Hash)
+	assert.Equal(t, "", metadata.CompilerVersion)
+}
+
+func TestParseMetadataInvalid(t *testing.T) {
+	// empty bytecode: EOA
+	_, err := ParseMetadata(nil)
+	assert.Error(t, err)
+
+	// the length is longer than the bytecode
+	_, err = ParseMetadata(common.FromHex("0x60806040ffff"))
+	assert.Error(t, err)
+
+	// the tail is not a CBOR map
+	_, err = ParseMetadata(common.FromHex("0x6080604052600436106100"))
+	assert.Error(t, err)
+
+	// truncated hash
+	truncated := append(common.FromHex("0x6080604052"), metadataIPFS[:20]...)
+	truncated = append(truncated, 0x00, 20)
+	_, err = ParseMetadata(truncated)
+	assert.Error(t, err)
+}
@@ -0,0 +1,250 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The classification of the addresses without ABI in [AddressStatus]
+const (
+	StatusEOA            = "eoa"
+	StatusSelfDestructed = "self-destructed"
+	StatusUnverified     = "unverified"
+	StatusRateLimited    = "rate-limited"
+	StatusExplorerError  = "explorer-error"
+)
+
+// status => the error returned to the callers
+var statusErrors = map[string]error{
+	StatusEOA:            ErrNoCode,
+	StatusSelfDestructed: ErrSelfDestructed,
+	StatusUnverified:     ErrNotVerified,
+	StatusRateLimited:    ErrUpstreamRateLimited,
+	StatusExplorerError:  ErrExplorer,
+}
+
+// RecheckPolicy
+// @dev When the robot searches an address without ABI again, by the number of the searches in a row with the same outcome:
+// Initial after the first one, multiplied by Factor after each next one, at most Max.
+// E.g. {10m, 2, 48h, 30}: 10m, 20m, 40m... 48h, and no more search after the 30th
+type RecheckPolicy struct {
+	Initial     time.Duration // the wait after the first search
+	Factor      float64       // the backoff, <= 1: the same wait every time
+	Max         time.Duration // the longest wait
+	GiveUpAfter int           // the robot gives up the address after these searches, 0: never. See Reschedule
+}
+
+// status => the default re-check policy
+var defaultRecheckPolicies = map[string]RecheckPolicy{
+	StatusEOA:            {Initial: 30 * 24 * time.Hour, Factor: 1, Max: 30 * 24 * time.Hour},          // CREATE2 can still deploy a contract to it
+	StatusSelfDestructed: {Initial: 30 * 24 * time.Hour, Factor: 1, Max: 30 * 24 * time.Hour},          // CREATE2 can still redeploy the contract
+	StatusUnverified:     {Initial: 10 * time.Minute, Factor: 2, Max: 48 * time.Hour, GiveUpAfter: 30}, // most are verified soon after the deployment, a few days later
+	StatusRateLimited:    {Initial: time.Minute, Factor: 2, Max: time.Hour},                            // the explorer limits the calls per second and per day
+	StatusExplorerError:  {Initial: 10 * time.Minute, Factor: 2, Max: 24 * time.Hour},                  // E.g. invalid API key, timeout
+}
+
+// @dev The wait after the number of the searches in a row with the same outcome
+// @return false if the robot gives up the address
+func (p RecheckPolicy) wait(checks int) (time.Duration, bool) {
+	if p.GiveUpAfter > 0 && checks >= p.GiveUpAfter {
+		return 0, false
+	}
+	wait := p.Initial
+	for i := 1; i < checks && wait < p.Max && p.Factor > 1; i++ {
+		wait = time.Duration(float64(wait) * p.Factor)
+	}
+	if p.Max > 0 && wait > p.Max {
+		wait = p.Max
+	}
+	return wait, true
+}
+
+// @dev The re-check policy of the status on the chain: its own => the one of the other chains => the default
+func (f *Fetcher) recheckPolicy(chainID int, status string) RecheckPolicy {
+	if policy, isFound := f.rechecks[chainID][status]; isFound {
+		return policy
+	}
+	if policy, isFound := f.rechecks[0][status]; isFound {
+		return policy
+	}
+	return defaultRecheckPolicies[status]
+}
+
+// ParseRecheckPolicies
+// @dev Read the re-check policies of the env RECHECK_POLICIES: [chainID:]status=initial,factor,max[,giveUpAfter] separated by ";".
+// The durations are the ones of time.ParseDuration, or days, E.g. "unverified=10m,2,7d,40;137:unverified=5m,2,2d"
+// @return chainID => status => policy, 0: the other chains
+func ParseRecheckPolicies(spec string) (map[int]map[string]RecheckPolicy, error) {
+	policies := make(map[int]map[string]RecheckPolicy)
+	for _, item := range strings.Split(spec, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, value, isFound := strings.Cut(item, "=")
+		if !isFound {
+			return nil, errors.New("Invalid re-check policy: " + item)
+		}
+		chainID, status := 0, key
+		if chain, name, hasChain := strings.Cut(key, ":"); hasChain {
+			var err error
+			if chainID, err = strconv.Atoi(chain); err != nil {
+				return nil, errors.Wrap(err, "Invalid chainID of the re-check policy: "+item)
+			}
+			status = name
+		}
+		if _, isKnown := statusErrors[status]; !isKnown {
+			return nil, errors.New("Unknown status of the re-check policy: " + item)
+		}
+
+		fields := strings.Split(value, ",")
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, errors.New("Invalid re-check policy, want initial,factor,max[,giveUpAfter]: " + item)
+		}
+		var policy RecheckPolicy
+		var err error
+		if policy.Initial, err = parseDays(fields[0]); err != nil {
+			return nil, errors.Wrap(err, "Invalid initial wait of the re-check policy: "+item)
+		}
+		if policy.Factor, err = strconv.ParseFloat(strings.TrimSpace(fields[1]), 64); err != nil {
+			return nil, errors.Wrap(err, "Invalid factor of the re-check policy: "+item)
+		}
+		if policy.Max, err = parseDays(fields[2]); err != nil {
+			return nil, errors.Wrap(err, "Invalid max wait of the re-check policy: "+item)
+		}
+		if len(fields) == 4 {
+			if policy.GiveUpAfter, err = strconv.Atoi(strings.TrimSpace(fields[3])); err != nil {
+				return nil, errors.Wrap(err, "Invalid give-up threshold of the re-check policy: "+item)
+			}
+		}
+		if policies[chainID] == nil {
+			policies[chainID] = make(map[string]RecheckPolicy)
+		}
+		policies[chainID][status] = policy
+	}
+	return policies, nil
+}
+
+// @dev time.ParseDuration, and the whole days, E.g. "7d"
+func parseDays(text string) (time.Duration, error) {
+	text = strings.TrimSpace(text)
+	if strings.HasSuffix(text, "d") {
+		count, err := strconv.Atoi(strings.TrimSuffix(text, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(text)
+}
+
+// @dev Persist the classification of chainID+contractAddress, and cache it as a negative entry until the re-check time.
+// The searches in a row with the same status back off by its RecheckPolicy, until the robot gives up the address
+func (f *Fetcher) recordNegative(chainID int, contractAddress common.Address, status string, message string) error {
+	now := f.now()
+
+	var previous myDB.AddressStatus
+	result := f.db.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes()).Limit(1).Find(&previous)
+	if result.Error != nil {
+		f.log.Error("Fail to read the AddressStatus item")
+		return newError(ErrStorage, chainID, contractAddress, result.Error)
+	}
+	checks := 1
+	if result.RowsAffected > 0 && previous.Status == status {
+		checks = previous.Checks + 1
+	}
+	policy := f.recheckPolicy(chainID, status)
+	wait, retry := policy.wait(checks)
+	recheckAt := now.Add(wait)
+	if !retry {
+		recheckAt = now.Add(policy.Max) // only the memory entry expires
+	}
+
+	err := f.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&myDB.AddressStatus{
+		ChainID:         chainID,
+		ContractAddress: contractAddress.Bytes(),
+		Status:          status,
+		Message:         message,
+		CheckedAt:       int(now.Unix()),
+		RecheckAt:       int(recheckAt.Unix()),
+		Checks:          checks,
+		GaveUp:          !retry,
+	}).Error
+	if err != nil {
+		f.log.Error("Fail to create an AddressStatus item in db")
+		return newError(ErrStorage, chainID, contractAddress, err)
+	}
+
+	// Searched, the robot will search it again after the re-check time
+	err = f.db.Model(&myDB.SearchEtherscan{}).
+		Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes()).
+		Updates(map[string]interface{}{"should_search": false, "time": int(now.Unix())}).Error
+	if err != nil {
+		f.log.Error("Fail to update the shouldSearch field")
+		return newError(ErrStorage, chainID, contractAddress, err)
+	}
+
+	if !retry {
+		f.log.Warning("Give up the address. ChainID:", chainID, " contractAddress:", contractAddress, " status:", status, " checks:", checks)
+	}
+	f.log.Warning("No ABI for the address. ChainID:", chainID, " contractAddress:", contractAddress, " status:", status, " message:", message)
+	f.cache.SetNegative(chainID, contractAddress, newError(statusErrors[status], chainID, contractAddress, errors.New(message)), recheckAt)
+	return nil
+}
+
+// @dev Remove the classification of chainID+contractAddress after its ABI is found, in the transaction of storeDeployment()
+// Notice: the caller removes it from the memory after the commit
+func clearNegative(tx *gorm.DB, chainID int, contractAddress common.Address) error {
+	err := tx.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes()).Delete(&myDB.AddressStatus{}).Error
+	if err != nil {
+		return errors.Wrap(err, "Fail to delete the AddressStatus item")
+	}
+	return nil
+}
+
+// @dev Check whether chainID+contractAddress is known to have no ABI: memory => DB
+// @return the classified *Error with RetryAfter until the re-check time, nil if it is unknown or should be searched again.
+// The given up addresses are never due. ErrStorage if the DB fails
+func (f *Fetcher) checkNegative(chainID int, contractAddress common.Address) error {
+	if reason, expireAt, isFound := f.cache.GetNegative(chainID, contractAddress); isFound && expireAt.After(f.now()) {
+		return f.withRetryAfter(reason, expireAt)
+	}
+
+	var status myDB.AddressStatus
+	err := f.db.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes()).First(&status).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		f.log.Error("Fail to read the AddressStatus item. Err:", err)
+		return newError(ErrStorage, chainID, contractAddress, err)
+	}
+	if !status.GaveUp && int64(status.RecheckAt) <= f.now().Unix() {
+		return nil
+	}
+	reason := newError(statusErrors[status.Status], chainID, contractAddress, errors.New(status.Message))
+	recheckAt := time.Unix(int64(status.RecheckAt), 0)
+	if status.GaveUp {
+		// never searched again unless it is rescheduled, keep it in memory for a while
+		recheckAt = f.now().Add(f.recheckPolicy(chainID, status.Status).Max)
+	}
+	f.cache.SetNegative(chainID, contractAddress, reason, recheckAt)
+	return f.withRetryAfter(reason, recheckAt)
+}
+
+// @dev Copy the *Error with RetryAfter until the re-check time
+func (f *Fetcher) withRetryAfter(reason error, recheckAt time.Time) error {
+	fetchErr, ok := reason.(*Error)
+	if !ok {
+		return reason
+	}
+	copied := *fetchErr
+	copied.RetryAfter = recheckAt.Sub(f.now()).Round(time.Second)
+	return &copied
+}
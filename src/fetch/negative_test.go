@@ -0,0 +1,229 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Prepare some addresses for the fake explorer and node
+var (
+	eoaAddress            = common.HexToAddress("0x00000000000000000000000000000000000e0a01")
+	destroyedAddress      = common.HexToAddress("0x00000000000000000000000000000000000de501")
+	unverifiedAddress     = common.HexToAddress("0x000000000000000000000000000000000000a401")
+	rateLimitedAddress    = common.HexToAddress("0x00000000000000000000000000000000000a7e01")
+	verifiedAddress       = common.HexToAddress("0x00000000000000000000000000000000000a6e01")
+	explorerErrorAddress  = common.HexToAddress("0x00000000000000000000000000000000000e4401")
+	verifiedContractABI   = `[{"inputs":[],"name":"name","outputs":[{"name":"","type":"string"}],"stateMutability":"view","type":"function"}]`
+	addressesWithCode     = map[common.Address]bool{unverifiedAddress: true, rateLimitedAddress: true, verifiedAddress: true, explorerErrorAddress: true}
+	addressesEverDeployed = map[common.Address]bool{destroyedAddress: true, unverifiedAddress: true, rateLimitedAddress: true, verifiedAddress: true, explorerErrorAddress: true}
+	addressesRateLimited  = map[common.Address]bool{rateLimitedAddress: true}
+	addressesVerified     = map[common.Address]bool{verifiedAddress: true}
+	addressesFailing      = map[common.Address]bool{explorerErrorAddress: true}
+	addressesSlow         = map[common.Address]time.Duration{}
+	abiRequests           = map[common.Address]int{} // the getabi requests of each address
+	abiRequestsMu         sync.Mutex
+)
+
+// @dev A Fetcher with a temporary DB, a fake explorer for chainID 1 and a fake node
+func useFakeUpstream(t *testing.T, options ...Option) *Fetcher {
+	explorer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch query.Get("action") {
+		case "getcontractcreation":
+			address := common.HexToAddress(query.Get("contractaddresses"))
+			if addressesEverDeployed[address] {
+				fmt.Fprintf(w, `{"status":"1","message":"OK","result":[{"contractAddress":"%s"}]}`, address.Hex())
+			} else {
+				fmt.Fprint(w, `{"status":"0","message":"No data found","result":[]}`)
+			}
+		case "getabi":
+			address := common.HexToAddress(query.Get("address"))
+			abiRequestsMu.Lock()
+			abiRequests[address]++
+			delay := addressesSlow[address]
+			abiRequestsMu.Unlock()
+			time.Sleep(delay)
+			switch {
+			case addressesRateLimited[address]:
+				fmt.Fprint(w, `{"status":"0","message":"NOTOK","result":"Max rate limit reached"}`)
+			case addressesFailing[address]:
+				fmt.Fprint(w, `{"status":"0","message":"NOTOK","result":"Invalid API Key"}`)
+			case addressesVerified[address]:
+				result, _ := json.Marshal(verifiedContractABI)
+				fmt.Fprintf(w, `{"status":"1","message":"OK","result":%s}`, result)
+			default:
+				fmt.Fprint(w, `{"status":"0","message":"NOTOK","result":"Contract source code not verified"}`)
+			}
+		}
+	}))
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		result := `"0x"`
+		var address common.Address
+		if len(request.Params) > 0 && json.Unmarshal(request.Params[0], &address) == nil && addressesWithCode[address] {
+			result = `"0x6080604052"`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":%s}`, request.ID, result)
+	}))
+
+	t.Cleanup(func() {
+		explorer.Close()
+		node.Close()
+	})
+
+	source := NewEtherscanSource("")
+	source.APIs, source.Client = map[int]string{1: explorer.URL}, explorer.Client()
+	options = append([]Option{
+		WithDB(myDB.OpenDatabase(filepath.Join(t.TempDir(), "ABIs.db"))),
+		WithSources(source),
+		WithRPCURL(0, node.URL),
+	}, options...)
+	fetcher, err := NewFetcher(options...)
+	assert.NoError(t, err)
+	return fetcher
+}
+
+// @dev The getabi requests of the address received by the fake explorer
+func abiRequestCount(address common.Address) int {
+	abiRequestsMu.Lock()
+	defer abiRequestsMu.Unlock()
+	return abiRequests[address]
+}
+
+// Test the negative results: EOA, self-destructed, unverified and explorer errors
+func TestNegativeResults(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	addresses := []common.Address{eoaAddress, destroyedAddress, unverifiedAddress, rateLimitedAddress, verifiedAddress}
+
+	// Not found in DB: waiting the robot
+	for _, address := range addresses {
+		_, err := fetcher.GetContractABIAtBlock(1, address, blockHeight)
+		assert.Error(t, err)
+	}
+	assert.NoError(t, fetcher.SearchInEtherscan())
+
+	_, err := fetcher.GetContractABIAtBlock(1, eoaAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrNoCode)
+	_, err = fetcher.GetContractABIAtBlock(1, destroyedAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrSelfDestructed)
+	_, err = fetcher.GetFunctionABIAtBlock(1, unverifiedAddress, signature1, blockHeight)
+	assert.ErrorIs(t, err, ErrNotVerified)
+	_, err = fetcher.GetContractABIAtBlock(1, rateLimitedAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrUpstreamRateLimited)
+	retryAfter, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.True(t, retryAfter > 0 && retryAfter <= defaultRecheckPolicies[StatusRateLimited].Initial)
+	contractABI, err := fetcher.GetContractABIAtBlock(1, verifiedAddress, blockHeight)
+	assert.NoError(t, err)
+	assert.Contains(t, contractABI.Methods, "name")
+
+	// The classification is persisted: still found after the negative entry is removed from memory
+	fetcher.cache.DeleteNegative(1, eoaAddress)
+	_, err = fetcher.GetContractABIAtBlock(1, eoaAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrNoCode)
+
+	var status myDB.AddressStatus
+	assert.NoError(t, fetcher.db.Where("chain_id = ? AND contract_address = ?", 1, unverifiedAddress.Bytes()).First(&status).Error)
+	assert.Equal(t, StatusUnverified, status.Status)
+	assert.True(t, strings.Contains(status.Message, "not verified"))
+	assert.InDelta(t, time.Now().Add(defaultRecheckPolicies[StatusUnverified].Initial).Unix(), int64(status.RecheckAt), 5)
+
+	// The re-check time passes: the robot searches it again, and the classification is removed after the ABI is found
+	delete(addressesRateLimited, rateLimitedAddress)
+	addressesVerified[rateLimitedAddress] = true
+	fetcher.db.Model(&myDB.AddressStatus{}).Where("contract_address = ?", rateLimitedAddress.Bytes()).Update("recheck_at", 0)
+	fetcher.cache.DeleteNegative(1, rateLimitedAddress)
+
+	assert.NoError(t, fetcher.SearchInEtherscan())
+	_, err = fetcher.GetContractABIAtBlock(1, rateLimitedAddress, blockHeight)
+	assert.NoError(t, err)
+	var count int64
+	fetcher.db.Model(&myDB.AddressStatus{}).Where("contract_address = ?", rateLimitedAddress.Bytes()).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+// Test the re-check policies: the backoff of the searches in a row, the give-up threshold, and the reschedule
+func TestRecheckPolicy(t *testing.T) {
+	policy := RecheckPolicy{Initial: time.Minute, Factor: 2, Max: 3 * time.Minute, GiveUpAfter: 4}
+	for checks, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 3: 3 * time.Minute} {
+		wait, retry := policy.wait(checks)
+		assert.True(t, retry)
+		assert.Equal(t, want, wait)
+	}
+	_, retry := policy.wait(4)
+	assert.False(t, retry)
+	wait, _ := RecheckPolicy{Initial: time.Hour, Factor: 1, Max: time.Hour}.wait(10)
+	assert.Equal(t, time.Hour, wait)
+
+	policies, err := ParseRecheckPolicies("unverified=10m,2,7d,40; 137:unverified=5m,1.5,2d;137:eoa=1d,1,1d")
+	assert.NoError(t, err)
+	assert.Equal(t, RecheckPolicy{Initial: 10 * time.Minute, Factor: 2, Max: 7 * 24 * time.Hour, GiveUpAfter: 40}, policies[0][StatusUnverified])
+	assert.Equal(t, RecheckPolicy{Initial: 5 * time.Minute, Factor: 1.5, Max: 48 * time.Hour}, policies[137][StatusUnverified])
+	assert.Len(t, policies[137], 2)
+	for _, spec := range []string{"unverified", "unknown=1m,2,1h", "x:unverified=1m,2,1h", "unverified=1m,2", "unverified=1m,two,1h", "eoa=1w,1,1d"} {
+		_, err = ParseRecheckPolicies(spec)
+		assert.Error(t, err, spec)
+	}
+
+	// the searches of the unverified address back off on chain 1, then the robot gives up
+	now := time.Now()
+	fetcher := useFakeUpstream(t, WithClock(func() time.Time { return now }),
+		WithRecheckPolicy(1, StatusUnverified, RecheckPolicy{Initial: time.Minute, Factor: 2, Max: time.Hour, GiveUpAfter: 3}))
+	assert.Equal(t, defaultRecheckPolicies[StatusEOA], fetcher.recheckPolicy(1, StatusEOA))
+	_, err = fetcher.GetContractABIAtBlock(1, unverifiedAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrQueued)
+	readStatus := func() myDB.AddressStatus {
+		var status myDB.AddressStatus
+		assert.NoError(t, fetcher.db.Where("chain_id = ? AND contract_address = ?", 1, unverifiedAddress.Bytes()).First(&status).Error)
+		return status
+	}
+	for checks, wait := range []time.Duration{time.Minute, 2 * time.Minute} {
+		assert.NoError(t, fetcher.SearchInEtherscan())
+		status := readStatus()
+		assert.Equal(t, checks+1, status.Checks)
+		assert.Equal(t, now.Add(wait).Unix(), int64(status.RecheckAt))
+		_, err = fetcher.GetContractABIAtBlock(1, unverifiedAddress, blockHeight)
+		assert.ErrorIs(t, err, ErrNotVerified)
+		now = now.Add(wait + time.Second)
+	}
+	assert.NoError(t, fetcher.SearchInEtherscan())
+	assert.True(t, readStatus().GaveUp)
+	requests := abiRequestCount(unverifiedAddress)
+
+	// given up: never due again
+	now = now.Add(30 * 24 * time.Hour)
+	fetcher.cache.DeleteNegative(1, unverifiedAddress)
+	_, err = fetcher.GetContractABIAtBlock(1, unverifiedAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrNotVerified)
+	assert.NoError(t, fetcher.SearchInEtherscan())
+	assert.Equal(t, requests, abiRequestCount(unverifiedAddress))
+
+	// rescheduled: searched in the next run
+	rescheduled, err := fetcher.Reschedule(1, common.Address{}, StatusEOA)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, rescheduled)
+	rescheduled, err = fetcher.Reschedule(0, unverifiedAddress, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rescheduled)
+	assert.False(t, readStatus().GaveUp)
+	_, err = fetcher.GetContractABIAtBlock(1, unverifiedAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrQueued)
+	assert.NoError(t, fetcher.SearchInEtherscan())
+	assert.Greater(t, abiRequestCount(unverifiedAddress), requests)
+}
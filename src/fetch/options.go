@@ -0,0 +1,164 @@
+package fetch
+
+import (
+	myCache "code/src/cache"
+	"context"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Cache
+// @dev The in-memory tier of a Fetcher, *cache.ABICache implements it
+// The ABIs are keyed by the deployment, the first block of the bytecode at the address, see [ContractDeployment]
+type Cache interface {
+	GetAt(key myCache.Key) (functionABI *abi.Method, contractABI *abi.ABI, isFound bool)
+	SetAt(key myCache.Key, functionABI *abi.Method, contractABI *abi.ABI)
+	SetAtWithTTL(key myCache.Key, functionABI *abi.Method, contractABI *abi.ABI, ttl time.Duration)
+	GetDeployments(chainID int, contractAddress common.Address) (fromBlocks []int64, isFound bool)
+	SetDeployments(chainID int, contractAddress common.Address, fromBlocks []int64)
+	SetNegative(chainID int, contractAddress common.Address, reason error, expireAt time.Time)
+	GetNegative(chainID int, contractAddress common.Address) (reason error, expireAt time.Time, isFound bool)
+	DeleteNegative(chainID int, contractAddress common.Address)
+}
+
+// SharedCache
+// @dev The second tier between the memory and the DB, shared by the replicas. *cache.RedisCache implements it
+// The values are the serialized ABIs: the Fragment of the function in [ABIEntry] or the ContractABI of [ContractBytecode]
+type SharedCache interface {
+	Get(ctx context.Context, key myCache.Key) (value []byte, isFound bool, err error)
+	Set(ctx context.Context, key myCache.Key, value []byte, ttl time.Duration) error
+	Invalidate(ctx context.Context, chainID int, contractAddress common.Address) error
+	Subscribe(ctx context.Context, handler func(chainID int, contractAddress common.Address)) error
+}
+
+// Policy
+// @dev How far a lookup searches the ABI
+type Policy int
+
+const (
+	PolicyCacheAndDB   Policy = iota // memory => DB, queue the address for the robot if not found. The default
+	PolicyCacheOnly                  // memory only, ErrNotCached if not found
+	PolicyFetchThrough               // memory => DB => the ABI sources inline, E.g. the interactive tools
+)
+
+// ParsePolicy
+// @dev "cache" | "db" | "fetch" => Policy
+func ParsePolicy(name string) (Policy, error) {
+	switch name {
+	case "cache":
+		return PolicyCacheOnly, nil
+	case "db", "":
+		return PolicyCacheAndDB, nil
+	case "fetch":
+		return PolicyFetchThrough, nil
+	}
+	return 0, errors.New("Invalid policy: " + name + ", should be cache, db or fetch")
+}
+
+// Option
+// @dev Configure a Fetcher, see NewFetcher
+type Option func(*Fetcher)
+
+// WithDB
+// @dev The database storing the ABIs, required
+func WithDB(db *gorm.DB) Option {
+	return func(f *Fetcher) {
+		f.db = db
+	}
+}
+
+// WithCache
+// @dev The in-memory cache, default: a new cache.ABICache
+func WithCache(cache Cache) Option {
+	return func(f *Fetcher) {
+		f.cache = cache
+	}
+}
+
+// WithSharedCache
+// @dev The second tier shared by the replicas, default: none, the memory misses go to the DB
+func WithSharedCache(shared SharedCache) Option {
+	return func(f *Fetcher) {
+		f.shared = shared
+	}
+}
+
+// WithSources
+// @dev Where the robot searches the ABIs, tried in order. Default: none, the Fetcher only serves the DB
+func WithSources(sources ...ABISource) Option {
+	return func(f *Fetcher) {
+		f.sources = append(f.sources, sources...)
+	}
+}
+
+// WithNode
+// @dev The node to read the runtime code of chainID, 0: the node of the chains without their own
+func WithNode(chainID int, node CodeReader) Option {
+	return func(f *Fetcher) {
+		f.nodes[chainID] = node
+	}
+}
+
+// WithRPCURL
+// @dev Like WithNode, dial the RPC URL for every call
+func WithRPCURL(chainID int, rpcUrl string) Option {
+	return WithNode(chainID, rpcNode(rpcUrl))
+}
+
+// WithDiscoveryDelay
+// @dev How long the block follower waits after the block of a new contract before searching it, the explorers take a
+// while to verify it. chainID 0: the chains without their own, default: 15 minutes
+func WithDiscoveryDelay(chainID int, delay time.Duration) Option {
+	return func(f *Fetcher) {
+		f.delays[chainID] = delay
+	}
+}
+
+// WithRecheckPolicy
+// @dev When the robot searches the addresses of the chain without ABI of the status again, E.g. StatusUnverified.
+// chainID 0: the chains without their own, default: see defaultRecheckPolicies
+func WithRecheckPolicy(chainID int, status string, policy RecheckPolicy) Option {
+	return func(f *Fetcher) {
+		if f.rechecks[chainID] == nil {
+			f.rechecks[chainID] = make(map[string]RecheckPolicy)
+		}
+		f.rechecks[chainID][status] = policy
+	}
+}
+
+// WithRetryPolicy
+// @dev When the robot searches an address again after a failed search, E.g. the node is down, and after how many
+// failures in a row it dead-letters the address, default: see defaultRetryPolicy
+func WithRetryPolicy(policy RecheckPolicy) Option {
+	return func(f *Fetcher) {
+		f.retries = policy
+	}
+}
+
+// WithProxyTTL
+// @dev How long the ABIs of the watched proxies are kept in memory, 0: the TTL of the cache. Default: 5 minutes
+func WithProxyTTL(ttl time.Duration) Option {
+	return func(f *Fetcher) {
+		f.proxyTTL = ttl
+	}
+}
+
+// WithLogger
+// @dev default: the logger of the package
+func WithLogger(logger *logrus.Logger) Option {
+	return func(f *Fetcher) {
+		f.log = logger
+	}
+}
+
+// WithClock
+// @dev The current time for the re-check policy and the records, default: time.Now
+func WithClock(now func() time.Time) Option {
+	return func(f *Fetcher) {
+		f.now = now
+	}
+}
@@ -0,0 +1,235 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// overrideIndex
+// @dev The active overrides in memory, so that GetContractABIAtBlock does not query the DB for every call
+type overrideIndex struct {
+	loaded    atomic.Bool // the active overrides are loaded from DB
+	loadMu    sync.Mutex  // one load at a time, it is tried again after a failure
+	mu        sync.RWMutex
+	overrides map[string][]*parsedOverride // chainID-contractAddress => active overrides, the latest is the last
+}
+
+// parsedOverride
+// @dev An active override with its parsed ABI
+type parsedOverride struct {
+	record      myDB.ABIOverride
+	contractABI *abi.ABI
+}
+
+// SetABIOverride
+// @dev SetABIOverride of the default Fetcher
+func SetABIOverride(chainID int, contractAddress common.Address, contractABI string, fromBlock *big.Int, toBlock *big.Int, setBy string) (*myDB.ABIOverride, error) {
+	return Default().SetABIOverride(chainID, contractAddress, contractABI, fromBlock, toBlock, setBy)
+}
+
+// RevertABIOverride
+// @dev RevertABIOverride of the default Fetcher
+func RevertABIOverride(chainID int, contractAddress common.Address, revertedBy string) (int64, error) {
+	return Default().RevertABIOverride(chainID, contractAddress, revertedBy)
+}
+
+// ListABIOverrides
+// @dev ListABIOverrides of the default Fetcher
+func ListABIOverrides(chainID int, contractAddress common.Address) ([]myDB.ABIOverride, error) {
+	return Default().ListABIOverrides(chainID, contractAddress)
+}
+
+// SetABIOverride
+// @dev Upload a curated ABI for chainID+contractAddress, it takes precedence over the crawled data
+// @param fromBlock, toBlock: the block range it applies to, nil: no limit
+// @param setBy: who set the override
+func (f *Fetcher) SetABIOverride(chainID int, contractAddress common.Address, contractABI string, fromBlock *big.Int, toBlock *big.Int, setBy string) (*myDB.ABIOverride, error) {
+	parsedABI, err := abi.JSON(strings.NewReader(contractABI))
+	if err != nil {
+		f.log.Error("Fail to parse the override ABI. ChainID:", chainID, " contractAddress:", contractAddress)
+		return nil, errors.Wrap(err, "Invalid ABI")
+	}
+	if fromBlock != nil && toBlock != nil && fromBlock.Cmp(toBlock) > 0 {
+		return nil, errors.Wrap(errors.New("fromBlock is larger than toBlock"), "Invalid block range")
+	}
+	if err = f.loadOverrides(); err != nil {
+		return nil, newError(ErrStorage, chainID, contractAddress, err)
+	}
+
+	record := myDB.ABIOverride{
+		ChainID:         chainID,
+		ContractAddress: contractAddress.Bytes(),
+		ContractABI:     contractABI,
+		SetBy:           setBy,
+		SetAt:           int(f.now().Unix()),
+		Active:          true,
+	}
+	if fromBlock != nil {
+		record.FromBlock = fromBlock.Int64()
+	}
+	if toBlock != nil {
+		record.ToBlock = toBlock.Int64()
+	}
+	if err = f.db.Create(&record).Error; err != nil {
+		f.log.Error("Fail to create an ABIOverride item in db")
+		return nil, newError(ErrStorage, chainID, contractAddress, err)
+	}
+	f.log.Info("Set the ABI override. ChainID:", chainID, " contractAddress:", contractAddress, " setBy:", setBy)
+
+	f.overrides.mu.Lock()
+	key := addressKey(chainID, contractAddress)
+	f.overrides.overrides[key] = append(f.overrides.overrides[key], &parsedOverride{record: record, contractABI: &parsedABI})
+	f.overrides.mu.Unlock()
+
+	f.invalidate(chainID, contractAddress)
+	return &record, nil
+}
+
+// RevertABIOverride
+// @dev Deactivate all overrides of chainID+contractAddress, so the crawled ABI is used again
+// @return the number of overrides reverted
+func (f *Fetcher) RevertABIOverride(chainID int, contractAddress common.Address, revertedBy string) (int64, error) {
+	if err := f.loadOverrides(); err != nil {
+		return 0, newError(ErrStorage, chainID, contractAddress, err)
+	}
+
+	result := f.db.Model(&myDB.ABIOverride{}).
+		Where("chain_id = ? AND contract_address = ? AND active = ?", chainID, contractAddress.Bytes(), true).
+		Updates(map[string]interface{}{"active": false, "reverted_by": revertedBy, "reverted_at": int(f.now().Unix())})
+	if result.Error != nil {
+		f.log.Error("Fail to revert the ABIOverride items in db")
+		return 0, newError(ErrStorage, chainID, contractAddress, result.Error)
+	}
+	f.log.Info("Revert the ABI override. ChainID:", chainID, " contractAddress:", contractAddress, " revertedBy:", revertedBy)
+
+	f.overrides.mu.Lock()
+	delete(f.overrides.overrides, addressKey(chainID, contractAddress))
+	f.overrides.mu.Unlock()
+
+	f.invalidate(chainID, contractAddress)
+	return result.RowsAffected, nil
+}
+
+// ListABIOverrides
+// @dev All overrides of chainID+contractAddress including the reverted ones, the latest is the first
+func (f *Fetcher) ListABIOverrides(chainID int, contractAddress common.Address) ([]myDB.ABIOverride, error) {
+	var records []myDB.ABIOverride
+	err := f.db.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress.Bytes()).
+		Order("id DESC").Find(&records).Error
+	if err != nil {
+		f.log.Error("Fail to search ABIOverride items in db")
+		return nil, newError(ErrStorage, chainID, contractAddress, err)
+	}
+	return records, nil
+}
+
+// @dev Find the latest active override which covers the block
+// Notice: block nil means the latest block, only the overrides without toBlock cover it
+func (f *Fetcher) findOverride(chainID int, contractAddress common.Address, block *big.Int) (*abi.ABI, bool) {
+	if err := f.loadOverrides(); err != nil {
+		return nil, false
+	}
+	o := &f.overrides
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	items := o.overrides[addressKey(chainID, contractAddress)]
+	for i := len(items) - 1; i >= 0; i-- {
+		record := items[i].record
+		if block == nil {
+			if record.ToBlock == 0 {
+				return items[i].contractABI, true
+			}
+			continue
+		}
+		if block.Cmp(big.NewInt(record.FromBlock)) >= 0 && (record.ToBlock == 0 || block.Cmp(big.NewInt(record.ToBlock)) <= 0) {
+			return items[i].contractABI, true
+		}
+	}
+	return nil, false
+}
+
+// @dev Load the active overrides from DB at the first use, and again at the next use if it fails
+// Notice: the loaded overrides replace the ones in memory, the DB has all of them
+func (f *Fetcher) loadOverrides() error {
+	o := &f.overrides
+	if o.loaded.Load() {
+		return nil
+	}
+	o.loadMu.Lock()
+	defer o.loadMu.Unlock()
+	if o.loaded.Load() {
+		return nil
+	}
+
+	var records []myDB.ABIOverride
+	if err := f.db.Where("active = ?", true).Order("id ASC").Find(&records).Error; err != nil {
+		f.log.Error("Fail to load the ABIOverride items from db, try again at the next use. Err:", err)
+		return errors.Wrap(err, "Fail to load the ABIOverride items")
+	}
+	overrides := make(map[string][]*parsedOverride)
+	for _, record := range records {
+		parsedABI, err := abi.JSON(strings.NewReader(record.ContractABI))
+		if err != nil {
+			f.log.Error("Fail to parse the override ABI, skip it. ID:", record.ID)
+			continue
+		}
+		var contractAddress common.Address
+		copy(contractAddress[:], record.ContractAddress)
+		key := addressKey(record.ChainID, contractAddress)
+		overrides[key] = append(overrides[key], &parsedOverride{record: record, contractABI: &parsedABI})
+	}
+
+	o.mu.Lock()
+	o.overrides = overrides
+	o.mu.Unlock()
+	o.loaded.Store(true)
+	return nil
+}
+
+// @dev Replace the overrides of chainID+contractAddress in memory with the active ones in DB, E.g. set by another replica
+func (f *Fetcher) reloadOverrides(chainID int, contractAddress common.Address) {
+	if err := f.loadOverrides(); err != nil {
+		return
+	}
+
+	var records []myDB.ABIOverride
+	err := f.db.Where("chain_id = ? AND contract_address = ? AND active = ?", chainID, contractAddress.Bytes(), true).
+		Order("id ASC").Find(&records).Error
+	if err != nil {
+		f.log.Error("Fail to reload the ABIOverride items from db. Err:", err)
+		return
+	}
+	var items []*parsedOverride
+	for _, record := range records {
+		parsedABI, err := abi.JSON(strings.NewReader(record.ContractABI))
+		if err != nil {
+			f.log.Error("Fail to parse the override ABI, skip it. ID:", record.ID)
+			continue
+		}
+		items = append(items, &parsedOverride{record: record, contractABI: &parsedABI})
+	}
+
+	o := &f.overrides
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key := addressKey(chainID, contractAddress)
+	if len(items) == 0 {
+		delete(o.overrides, key)
+		return
+	}
+	o.overrides[key] = items
+}
+
+// @dev Generate key for the override mapping and the inline searches
+func addressKey(chainID int, contractAddress common.Address) string {
+	return fmt.Sprintf("%d-%s", chainID, contractAddress.Hex())
+}
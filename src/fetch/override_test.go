@@ -0,0 +1,85 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+)
+
+var overrideABI = `[{"inputs":[],"name":"implementation","outputs":[{"name":"","type":"address"}],"stateMutability":"view","type":"function"}]`
+
+// Test SetABIOverride: the override takes precedence in its block range, and can be reverted
+func TestABIOverride(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	id := uuid.New()
+	address := common.BytesToAddress(id[:])
+
+	_, err := fetcher.SetABIOverride(1, address, "not an ABI", nil, nil, "alice")
+	assert.Error(t, err)
+
+	_, err = fetcher.SetABIOverride(1, address, overrideABI, big.NewInt(100), big.NewInt(200), "alice")
+	assert.NoError(t, err)
+
+	// in the block range
+	contractABI, err := fetcher.GetContractABIAtBlock(1, address, big.NewInt(150))
+	assert.NoError(t, err)
+	assert.Contains(t, contractABI.Methods, "implementation")
+
+	var sig [4]byte
+	copy(sig[:], contractABI.Methods["implementation"].ID)
+	method, err := fetcher.GetFunctionABIAtBlock(1, address, sig, big.NewInt(150))
+	assert.NoError(t, err)
+	assert.Equal(t, "implementation", method.Name)
+
+	// out of the block range: fall back to the crawled data
+	_, err = fetcher.GetContractABIAtBlock(1, address, big.NewInt(201))
+	assert.Error(t, err)
+	_, err = fetcher.GetContractABIAtBlock(1, address, nil)
+	assert.Error(t, err)
+
+	records, err := fetcher.ListABIOverrides(1, address)
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "alice", records[0].SetBy)
+
+	count, err := fetcher.RevertABIOverride(1, address, "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	_, err = fetcher.GetContractABIAtBlock(1, address, big.NewInt(150))
+	assert.Error(t, err)
+
+	records, err = fetcher.ListABIOverrides(1, address)
+	assert.NoError(t, err)
+	assert.False(t, records[0].Active)
+	assert.Equal(t, "bob", records[0].RevertedBy)
+}
+
+// Test loading the overrides again after the first load fails
+func TestLoadOverridesRetry(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	address := common.HexToAddress("0x00000000000000000000000000000000000f0a01")
+
+	// the first load fails: no override, and nothing is marked loaded
+	assert.NoError(t, fetcher.db.Migrator().DropTable(&myDB.ABIOverride{}))
+	_, isFound := fetcher.findOverride(1, address, nil)
+	assert.False(t, isFound)
+	_, err := fetcher.SetABIOverride(1, address, overrideABI, nil, nil, "alice")
+	assert.ErrorIs(t, err, ErrStorage)
+
+	// the DB is back: the override set meanwhile by another replica is loaded at the next use
+	assert.NoError(t, fetcher.db.Migrator().CreateTable(&myDB.ABIOverride{}))
+	assert.NoError(t, fetcher.db.Create(&myDB.ABIOverride{ChainID: 1, ContractAddress: address.Bytes(), ContractABI: overrideABI, SetBy: "bob", Active: true}).Error)
+	contractABI, isFound := fetcher.findOverride(1, address, nil)
+	assert.True(t, isFound)
+	assert.Contains(t, contractABI.Methods, "implementation")
+
+	_, err = fetcher.SetABIOverride(1, address, overrideABI, big.NewInt(100), nil, "alice")
+	assert.NoError(t, err)
+	fetcher.overrides.mu.RLock()
+	assert.Len(t, fetcher.overrides.overrides[addressKey(1, address)], 2)
+	fetcher.overrides.mu.RUnlock()
+}
@@ -0,0 +1,295 @@
+package fetch
+
+import (
+	"bytes"
+	myDB "code/src/db"
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+	"gorm.io/gorm/clause"
+	"io"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// maxFrequencyPriority
+// @dev The priority of the addresses seen the most often in a stream
+const maxFrequencyPriority = 20
+
+// prefetchBatchSize
+// @dev The addresses looked up and queued in one query
+const prefetchBatchSize = 500
+
+// AddressCounts
+// @dev address => how often it is seen in a stream
+type AddressCounts map[common.Address]int
+
+// PrefetchResult
+// @dev What Prefetch did with the addresses of a stream
+type PrefetchResult struct {
+	Seen   int // the distinct addresses
+	Known  int // stored or queued already
+	Queued int // queued for the robot
+}
+
+// streamItem
+// @dev The fields of a transaction, a log, a receipt or a block the addresses are read from
+type streamItem struct {
+	To              *common.Address   `json:"to"`              // the called contract of a transaction or a receipt
+	Address         *common.Address   `json:"address"`         // the emitter of a log
+	ContractAddress *common.Address   `json:"contractAddress"` // the contract created by a receipt
+	Logs            []json.RawMessage `json:"logs"`            // the logs of a receipt
+	Transactions    []json.RawMessage `json:"transactions"`    // the transactions of a block
+}
+
+// logFilterer
+// @dev A node the logs of a block are read from
+type logFilterer interface {
+	FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error)
+}
+
+// CountAddresses
+// @dev Count the `to` addresses and the log emitters of a stream of JSON values: the transactions, logs, receipts and
+// blocks as the JSON-RPC API returns them, the arrays of them, or the address strings. E.g. JSON lines, or the output of eth_getLogs
+// @return the number of JSON values read
+// Notice: the transaction hashes of the blocks without their full transactions are skipped
+func CountAddresses(r io.Reader, counts AddressCounts) (int, error) {
+	decoder := json.NewDecoder(r)
+	items := 0
+	for {
+		var value json.RawMessage
+		err := decoder.Decode(&value)
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return items, errors.Wrap(err, "Fail to decode the stream")
+		}
+		items++
+		if err = counts.add(value); err != nil {
+			return items, err
+		}
+	}
+}
+
+// @dev Count the addresses of one JSON value
+func (counts AddressCounts) add(value json.RawMessage) error {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 {
+		return nil
+	}
+	switch value[0] {
+	case '[':
+		var values []json.RawMessage
+		if err := json.Unmarshal(value, &values); err != nil {
+			return errors.Wrap(err, "Fail to decode the array")
+		}
+		for _, item := range values {
+			if err := counts.add(item); err != nil {
+				return err
+			}
+		}
+	case '{':
+		var item streamItem
+		if err := json.Unmarshal(value, &item); err != nil {
+			return errors.Wrap(err, "Fail to decode the item")
+		}
+		for _, address := range []*common.Address{item.To, item.Address, item.ContractAddress} {
+			if address != nil && *address != (common.Address{}) {
+				counts[*address]++
+			}
+		}
+		for _, items := range [][]json.RawMessage{item.Logs, item.Transactions} {
+			for _, child := range items {
+				if err := counts.add(child); err != nil {
+					return err
+				}
+			}
+		}
+	case '"':
+		var text string
+		if err := json.Unmarshal(value, &text); err != nil {
+			return errors.Wrap(err, "Fail to decode the string")
+		}
+		if common.IsHexAddress(text) {
+			counts[common.HexToAddress(text)]++
+		}
+	}
+	return nil
+}
+
+// Prefetch
+// @dev Queue the addresses the DB does not know for the robot, the ones seen more often with a higher priority.
+// The stored and the queued addresses are skipped
+// Notice: E.g. count the addresses of a protocol with CountAddresses before running a historical backfill
+func (f *Fetcher) Prefetch(chainID int, counts AddressCounts) (PrefetchResult, error) {
+	if !supports(f.sources, chainID) {
+		return PrefetchResult{}, newError(ErrUnsupportedChain, chainID, common.Address{}, nil)
+	}
+
+	// the most frequent ones first
+	addresses := make([]common.Address, 0, len(counts))
+	for address := range counts {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		if counts[addresses[i]] != counts[addresses[j]] {
+			return counts[addresses[i]] > counts[addresses[j]]
+		}
+		return bytes.Compare(addresses[i].Bytes(), addresses[j].Bytes()) < 0
+	})
+
+	result := PrefetchResult{Seen: len(addresses)}
+	now := int(f.now().Unix())
+	for start := 0; start < len(addresses); start += prefetchBatchSize {
+		end := start + prefetchBatchSize
+		if end > len(addresses) {
+			end = len(addresses)
+		}
+		batch := addresses[start:end]
+		keys := make([][]byte, len(batch))
+		for i, address := range batch {
+			keys[i] = address.Bytes()
+		}
+
+		isKnown := make(map[common.Address]bool)
+		for _, model := range []interface{}{&myDB.ContractDeployment{}, &myDB.SearchEtherscan{}} {
+			var known [][]byte
+			err := f.db.Model(model).Where("chain_id = ? AND contract_address IN ?", chainID, keys).Pluck("contract_address", &known).Error
+			if err != nil {
+				f.log.Error("Fail to look up the prefetched addresses in db")
+				return result, newError(ErrStorage, chainID, common.Address{}, err)
+			}
+			for _, address := range known {
+				isKnown[common.BytesToAddress(address)] = true
+			}
+		}
+
+		var records []myDB.SearchEtherscan
+		for _, address := range batch {
+			if isKnown[address] {
+				result.Known++
+				continue
+			}
+			records = append(records, myDB.SearchEtherscan{
+				ChainID:         chainID,
+				ContractAddress: address.Bytes(),
+				Time:            now,
+				ShouldSearch:    true,
+				Priority:        frequencyPriority(counts[address]),
+				Tags:            TagPrefetch,
+			})
+		}
+		if len(records) == 0 {
+			continue
+		}
+		// another thread may have queued some meanwhile
+		queued := f.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&records)
+		if queued.Error != nil {
+			f.log.Error("Fail to create the searchEtherscan items in db")
+			return result, newError(ErrStorage, chainID, common.Address{}, queued.Error)
+		}
+		result.Queued += int(queued.RowsAffected)
+		result.Known += len(records) - int(queued.RowsAffected)
+	}
+	f.log.Info("Prefetch the addresses. ChainID:", chainID, " seen:", result.Seen, " known:", result.Known, " queued:", result.Queued)
+	return result, nil
+}
+
+// PrefetchFromNode
+// @dev Subscribe to the new blocks of the node, count the `to` addresses of their transactions and their log emitters,
+// and Prefetch them every flushEvery until the context is done
+// Notice: the node needs a websocket or IPC endpoint, see HeadSubscriber. A block failing to be read is skipped
+func (f *Fetcher) PrefetchFromNode(ctx context.Context, chainID int, flushEvery time.Duration) error {
+	if !supports(f.sources, chainID) {
+		return newError(ErrUnsupportedChain, chainID, common.Address{}, nil)
+	}
+	reader, err := f.blockReader(chainID)
+	if err != nil {
+		return err
+	}
+	subscriber, ok := reader.(HeadSubscriber)
+	if !ok {
+		f.log.Error("The node does not push the new blocks. ChainID:", chainID)
+		return newError(ErrNode, chainID, common.Address{}, errors.New("The node does not push the new blocks"))
+	}
+
+	headers := make(chan *types.Header, 16)
+	sub, err := subscriber.SubscribeNewHead(ctx, headers)
+	if err != nil {
+		f.log.Error("Fail to subscribe to the new blocks. ChainID:", chainID)
+		return newError(ErrNode, chainID, common.Address{}, err)
+	}
+	defer sub.Unsubscribe()
+
+	ticker := time.NewTicker(flushEvery)
+	defer ticker.Stop()
+	counts := AddressCounts{}
+	flush := func() error {
+		if len(counts) == 0 {
+			return nil
+		}
+		_, err := f.Prefetch(chainID, counts)
+		counts = AddressCounts{}
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return flush()
+		case err := <-sub.Err():
+			if flushErr := flush(); flushErr != nil {
+				return flushErr
+			}
+			f.log.Error("The subscription to the new blocks ends. ChainID:", chainID)
+			return newError(ErrNode, chainID, common.Address{}, err)
+		case header := <-headers:
+			if err := f.countBlock(ctx, reader, header, counts); err != nil {
+				f.log.Warning("Fail to read the block, it is skipped. ChainID:", chainID, " number:", header.Number, " Err:", err)
+			}
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// @dev Count the `to` addresses of the transactions of the block, and the emitters of its logs if the node reads them
+func (f *Fetcher) countBlock(ctx context.Context, reader BlockReader, header *types.Header, counts AddressCounts) error {
+	block, err := reader.BlockByNumber(ctx, header.Number)
+	if err != nil {
+		return err
+	}
+	for _, tx := range block.Transactions() {
+		if tx.To() != nil {
+			counts[*tx.To()]++
+		}
+	}
+	filterer, ok := reader.(logFilterer)
+	if !ok {
+		return nil
+	}
+	blockHash := block.Hash()
+	logs, err := filterer.FilterLogs(ctx, ethereum.FilterQuery{BlockHash: &blockHash})
+	if err != nil {
+		return err
+	}
+	for _, entry := range logs {
+		counts[entry.Address]++
+	}
+	return nil
+}
+
+// @dev The priority of an address seen count times: 1, 2, 3... for 1, 2-3, 4-7... times, at most maxFrequencyPriority
+func frequencyPriority(count int) int {
+	priority := bits.Len(uint(count))
+	if priority > maxFrequencyPriority {
+		return maxFrequencyPriority
+	}
+	return priority
+}
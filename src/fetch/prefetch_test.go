@@ -0,0 +1,138 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"context"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStreamNode
+// @dev A chain in memory which pushes its blocks and serves their logs
+type fakeStreamNode struct {
+	*fakeChainNode
+	logs    map[common.Hash][]types.Log // block hash => logs
+	headers []*types.Header
+}
+
+func (n *fakeStreamNode) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		for _, header := range n.headers {
+			select {
+			case ch <- header:
+			case <-quit:
+				return nil
+			}
+		}
+		<-quit
+		return nil
+	}), nil
+}
+
+func (n *fakeStreamNode) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	return n.logs[*query.BlockHash], nil
+}
+
+// Test counting the addresses of the streams of transactions, logs, receipts and blocks
+func TestCountAddresses(t *testing.T) {
+	token := "0x00000000000000000000000000000000000f0001"
+	router := "0x00000000000000000000000000000000000f0002"
+	stream := `{"hash":"0x01","from":"0x00000000000000000000000000000000000e0a01","to":"` + router + `"}
+[{"address":"` + token + `","topics":[]},{"address":"` + token + `","topics":[]}]
+{"to":null,"contractAddress":"` + token + `","logs":[{"address":"` + router + `"}]}
+{"number":"0x1","transactions":["0x3f4a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a",{"to":"` + router + `"}]}
+"` + token + `"`
+	counts := AddressCounts{}
+	items, err := CountAddresses(strings.NewReader(stream), counts)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, items)
+	assert.Len(t, counts, 2)
+	assert.Equal(t, 4, counts[common.HexToAddress(token)])
+	assert.Equal(t, 3, counts[common.HexToAddress(router)])
+
+	_, err = CountAddresses(strings.NewReader(`{"to":"0x12"}`), counts)
+	assert.Error(t, err)
+	_, err = CountAddresses(strings.NewReader(`{"to":`), counts)
+	assert.Error(t, err)
+
+	assert.Equal(t, 1, frequencyPriority(1))
+	assert.Equal(t, 2, frequencyPriority(3))
+	assert.Equal(t, 3, frequencyPriority(4))
+	assert.Equal(t, maxFrequencyPriority, frequencyPriority(1<<30))
+}
+
+// Test queueing the addresses of a stream: the known ones are skipped, the frequent ones go first
+func TestPrefetch(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	queued := common.HexToAddress("0x00000000000000000000000000000000000f0003")
+	rare := common.HexToAddress("0x00000000000000000000000000000000000f0004")
+	frequent := common.HexToAddress("0x00000000000000000000000000000000000f0005")
+
+	_, err := fetcher.Prefetch(999, AddressCounts{rare: 1})
+	assert.ErrorIs(t, err, ErrUnsupportedChain)
+
+	// verifiedAddress is stored, queued is waiting for the robot
+	_, err = fetcher.GetContractABIAtBlock(1, verifiedAddress, blockHeight)
+	assert.ErrorIs(t, err, ErrQueued)
+	assert.NoError(t, fetcher.SearchInEtherscan())
+	_, err = fetcher.GetContractABIAtBlock(1, queued, blockHeight)
+	assert.ErrorIs(t, err, ErrQueued)
+
+	result, err := fetcher.Prefetch(1, AddressCounts{verifiedAddress: 9, queued: 5, rare: 1, frequent: 40})
+	assert.NoError(t, err)
+	assert.Equal(t, PrefetchResult{Seen: 4, Known: 2, Queued: 2}, result)
+	var searches []myDB.SearchEtherscan
+	assert.NoError(t, fetcher.db.Where("tags = ?", TagPrefetch).Order("priority DESC").Find(&searches).Error)
+	if assert.Len(t, searches, 2) {
+		assert.Equal(t, frequent.Bytes(), searches[0].ContractAddress)
+		assert.Equal(t, 6, searches[0].Priority)
+		assert.Equal(t, rare.Bytes(), searches[1].ContractAddress)
+		assert.Equal(t, 1, searches[1].Priority)
+		assert.True(t, searches[1].ShouldSearch)
+	}
+
+	// prefetched again: all known
+	result, err = fetcher.Prefetch(1, AddressCounts{rare: 3, frequent: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, PrefetchResult{Seen: 2, Known: 2}, result)
+}
+
+// Test prefetching the addresses of the blocks pushed by the node
+func TestPrefetchFromNode(t *testing.T) {
+	router := common.HexToAddress("0x00000000000000000000000000000000000f0006")
+	token := common.HexToAddress("0x00000000000000000000000000000000000f0007")
+	chain := &fakeChainNode{blocks: map[uint64]*types.Block{}, receipts: map[common.Hash]*types.Receipt{}, traces: map[uint64][]common.Address{}}
+	node := &fakeStreamNode{fakeChainNode: chain, logs: map[common.Hash][]types.Log{}}
+	for number := uint64(1); number <= 3; number++ {
+		to := router
+		tx := types.NewTx(&types.LegacyTx{Nonce: number, To: &to})
+		header := &types.Header{Number: new(big.Int).SetUint64(number)}
+		block := types.NewBlockWithHeader(header).WithBody([]*types.Transaction{tx}, nil)
+		chain.blocks[number] = block
+		node.logs[block.Hash()] = []types.Log{{Address: token}}
+		node.headers = append(node.headers, header)
+	}
+	fetcher := useFakeUpstream(t, WithNode(0, node))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, fetcher.PrefetchFromNode(ctx, 1, 50*time.Millisecond))
+	var searches []myDB.SearchEtherscan
+	assert.NoError(t, fetcher.db.Find(&searches).Error)
+	assert.Len(t, searches, 2)
+	for _, search := range searches {
+		assert.True(t, search.ShouldSearch)
+		assert.Greater(t, search.Priority, 0)
+	}
+
+	// the node without subscriptions
+	fetcher = useFakeUpstream(t, WithNode(0, chain))
+	assert.ErrorIs(t, fetcher.PrefetchFromNode(ctx, 1, time.Second), ErrNode)
+}
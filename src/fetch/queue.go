@@ -0,0 +1,204 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"gorm.io/gorm"
+	"sort"
+	"strings"
+)
+
+// PriorityInteractive
+// @dev The priority of the addresses someone is waiting for, above the ones of the batch jobs and the streams
+const PriorityInteractive = 100
+
+// queueOrder
+// @dev The order the robot searches the queued addresses in: by priority, then the oldest first
+const queueOrder = "priority DESC, time ASC"
+
+// The tags of the background jobs which queue the addresses
+const (
+	TagFollower       = "follower"        // the block follower
+	TagPrefetch       = "prefetch"        // the prefetch of a stream
+	TagUpgradeWatcher = "upgrade-watcher" // the new implementations of the watched proxies
+)
+
+// Requester
+// @dev Who asks for an ABI, carried by the context of the lookups, see WithRequester
+type Requester struct {
+	Tag         string // E.g. api, cli or the name of a batch job, recorded in the tags of the queued address
+	Interactive bool   // someone is waiting for the answer, the queued address is boosted to PriorityInteractive
+}
+
+// requesterKey
+// @dev The key of the Requester in the context
+type requesterKey struct{}
+
+// WithRequester
+// @dev The context of the lookups of the requester
+// Notice: the lookups without a requester are the ones of a batch job without a tag
+func WithRequester(ctx context.Context, requester Requester) context.Context {
+	return context.WithValue(ctx, requesterKey{}, requester)
+}
+
+// @dev The Requester of the context, the zero one if it has none
+func requesterFrom(ctx context.Context) Requester {
+	requester, _ := ctx.Value(requesterKey{}).(Requester)
+	return requester
+}
+
+// QueuedAddresses
+// @dev The addresses waiting for the robot with the default Fetcher
+func QueuedAddresses(chainID int, limit int) ([]myDB.SearchEtherscan, error) {
+	return Default().QueuedAddresses(chainID, limit)
+}
+
+// BoostAddress
+// @dev Raise the priority of a queued address with the default Fetcher
+func BoostAddress(chainID int, contractAddress common.Address, priority int) (bool, error) {
+	return Default().BoostAddress(chainID, contractAddress, priority)
+}
+
+// Reschedule
+// @dev Search the addresses without ABI again with the default Fetcher
+func Reschedule(chainID int, contractAddress common.Address, status string) (int, error) {
+	return Default().Reschedule(chainID, contractAddress, status)
+}
+
+// QueuedAddresses
+// @dev The addresses waiting for the robot, in the order it searches them: by priority, then the oldest first
+// @param chainID 0: every chain
+// @param limit 0: no limit
+func (f *Fetcher) QueuedAddresses(chainID int, limit int) ([]myDB.SearchEtherscan, error) {
+	query := f.db.Where("should_search = ?", true)
+	if chainID != 0 {
+		query = query.Where("chain_id = ?", chainID)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	var queued []myDB.SearchEtherscan
+	if err := query.Order(queueOrder).Find(&queued).Error; err != nil {
+		f.log.Error("Fail to read the queued addresses")
+		return nil, newError(ErrStorage, chainID, common.Address{}, err)
+	}
+	return queued, nil
+}
+
+// BoostAddress
+// @dev Raise the priority of a queued address, and search it without the discovery delay
+// @return false if the address is not queued
+// Notice: the priority is never lowered, E.g. an address boosted by a lookup stays boosted
+func (f *Fetcher) BoostAddress(chainID int, contractAddress common.Address, priority int) (bool, error) {
+	result := f.db.Model(&myDB.SearchEtherscan{}).
+		Where("chain_id = ? AND contract_address = ? AND should_search = ?", chainID, contractAddress.Bytes(), true).
+		Updates(map[string]interface{}{
+			"priority":   gorm.Expr("CASE WHEN priority < ? THEN ? ELSE priority END", priority, priority),
+			"not_before": 0,
+		})
+	if result.Error != nil {
+		f.log.Error("Fail to boost the searchEtherscan item in db")
+		return false, newError(ErrStorage, chainID, contractAddress, result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// Reschedule
+// @dev Search the addresses without ABI again in the next run of the robot, the given up ones too. [AddressStatus]
+// E.g. after the API key is fixed, or the contracts are verified
+// @param chainID 0: every chain
+// @param contractAddress the zero address: every address
+// @param status E.g. StatusUnverified, empty: every status
+// @return the number of the addresses rescheduled
+// Notice: the count of the searches in a row is kept, the next failure backs off from it.
+// The dead-lettered addresses stay, see RequeueDeadLetter
+func (f *Fetcher) Reschedule(chainID int, contractAddress common.Address, status string) (int, error) {
+	query := f.db.Model(&myDB.AddressStatus{})
+	if chainID != 0 {
+		query = query.Where("chain_id = ?", chainID)
+	}
+	if contractAddress != (common.Address{}) {
+		query = query.Where("contract_address = ?", contractAddress.Bytes())
+	}
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var statuses []myDB.AddressStatus
+	if err := query.Find(&statuses).Error; err != nil {
+		f.log.Error("Fail to read the AddressStatus items")
+		return 0, newError(ErrStorage, chainID, contractAddress, err)
+	}
+
+	now := int(f.now().Unix())
+	for i, item := range statuses {
+		itemAddress := common.BytesToAddress(item.ContractAddress)
+		err := f.db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&myDB.AddressStatus{}).
+				Where("chain_id = ? AND contract_address = ?", item.ChainID, item.ContractAddress).
+				Updates(map[string]interface{}{"recheck_at": now, "gave_up": false}).Error
+			if err != nil {
+				return err
+			}
+			return tx.Model(&myDB.SearchEtherscan{}).
+				Where("chain_id = ? AND contract_address = ? AND dead_lettered_at = ?", item.ChainID, item.ContractAddress, 0).
+				Updates(map[string]interface{}{"should_search": true, "not_before": 0}).Error
+		})
+		if err != nil {
+			f.log.Error("Fail to reschedule the address. ChainID:", item.ChainID, " contractAddress:", itemAddress)
+			return i, newError(ErrStorage, item.ChainID, itemAddress, err)
+		}
+		f.cache.DeleteNegative(item.ChainID, itemAddress)
+	}
+	f.log.Info("Reschedule the addresses without ABI. ChainID:", chainID, " status:", status, " rescheduled:", len(statuses))
+	return len(statuses), nil
+}
+
+// @dev Record a request for a queued address: its count, time and tag, and boost its priority
+func (f *Fetcher) recordRequest(requester Requester, searchEtherscan myDB.SearchEtherscan, now int) error {
+	updates := map[string]interface{}{
+		"requests":          gorm.Expr("requests + 1"),
+		"last_requested_at": now,
+		"tags":              addTag(searchEtherscan.Tags, requester.Tag),
+	}
+	if searchEtherscan.FirstRequestedAt == 0 {
+		updates["first_requested_at"] = now
+	}
+	if priority := requestPriority(searchEtherscan.Requests+1, requester.Interactive); priority > searchEtherscan.Priority {
+		updates["priority"] = priority
+	}
+	if searchEtherscan.NotBefore > now { // found by the block follower, someone is waiting for it now
+		updates["not_before"] = 0
+	}
+	return f.db.Model(&myDB.SearchEtherscan{}).
+		Where("chain_id = ? AND contract_address = ?", searchEtherscan.ChainID, searchEtherscan.ContractAddress).
+		Updates(updates).Error
+}
+
+// @dev The priority of an address requested the number of times: by frequency, boosted if someone is waiting for it
+func requestPriority(requests int64, interactive bool) int {
+	priority := frequencyPriority(int(requests))
+	if interactive {
+		priority += PriorityInteractive
+	}
+	return priority
+}
+
+// @dev Add the tag to the comma separated tags, sorted and once each
+func addTag(tags string, tag string) string {
+	if tag == "" {
+		return tags
+	}
+	var list []string
+	if tags != "" {
+		list = strings.Split(tags, ",")
+	}
+	for _, item := range list {
+		if item == tag {
+			return tags
+		}
+	}
+	list = append(list, tag)
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
@@ -0,0 +1,80 @@
+package fetch
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test the crawl queue: the requests, the tags, the boosts and the order of the robot
+func TestCrawlQueue(t *testing.T) {
+	now := time.Now()
+	fetcher := useFakeUpstream(t, WithClock(func() time.Time { return now }))
+	batch := common.HexToAddress("0x00000000000000000000000000000000000c0001")
+	waited := common.HexToAddress("0x00000000000000000000000000000000000c0002")
+	older := common.HexToAddress("0x00000000000000000000000000000000000c0003")
+	streamed := common.HexToAddress("0x00000000000000000000000000000000000c0004")
+	backfill := WithRequester(context.Background(), Requester{Tag: "backfill"})
+	user := WithRequester(context.Background(), Requester{Tag: "api", Interactive: true})
+
+	// a batch job queues them, then a user waits for one
+	_, err := fetcher.GetContractABIAtBlockContext(backfill, 1, older, nil, PolicyCacheAndDB)
+	assert.ErrorIs(t, err, ErrQueued)
+	now = now.Add(time.Second)
+	for _, address := range []common.Address{batch, waited} {
+		_, err = fetcher.GetContractABIAtBlockContext(backfill, 1, address, nil, PolicyCacheAndDB)
+		assert.ErrorIs(t, err, ErrQueued)
+	}
+	now = now.Add(time.Minute)
+	_, err = fetcher.GetContractABIAtBlockContext(user, 1, waited, nil, PolicyCacheAndDB)
+	assert.ErrorIs(t, err, ErrQueued)
+	_, err = fetcher.Prefetch(1, AddressCounts{streamed: 40})
+	assert.NoError(t, err)
+
+	queued, err := fetcher.QueuedAddresses(1, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, queued, 4) {
+		assert.Equal(t, waited.Bytes(), queued[0].ContractAddress)
+		assert.Equal(t, PriorityInteractive+2, queued[0].Priority)
+		assert.Equal(t, int64(2), queued[0].Requests)
+		assert.Equal(t, "api,backfill", queued[0].Tags)
+		assert.Equal(t, int(now.Add(-time.Minute).Unix()), queued[0].FirstRequestedAt)
+		assert.Equal(t, int(now.Unix()), queued[0].LastRequestedAt)
+		assert.Equal(t, streamed.Bytes(), queued[1].ContractAddress)
+		assert.Equal(t, TagPrefetch, queued[1].Tags)
+		assert.Equal(t, int64(0), queued[1].Requests)
+		// the same priority: the oldest first
+		assert.Equal(t, older.Bytes(), queued[2].ContractAddress)
+		assert.Equal(t, batch.Bytes(), queued[3].ContractAddress)
+		assert.Equal(t, 1, queued[3].Priority)
+	}
+
+	// boosted by hand, never lowered
+	isQueued, err := fetcher.BoostAddress(1, batch, 500)
+	assert.NoError(t, err)
+	assert.True(t, isQueued)
+	isQueued, err = fetcher.BoostAddress(1, batch, 2)
+	assert.NoError(t, err)
+	assert.True(t, isQueued)
+	isQueued, err = fetcher.BoostAddress(1, verifiedAddress, 500)
+	assert.NoError(t, err)
+	assert.False(t, isQueued)
+	queued, err = fetcher.QueuedAddresses(0, 1)
+	assert.NoError(t, err)
+	if assert.Len(t, queued, 1) {
+		assert.Equal(t, batch.Bytes(), queued[0].ContractAddress)
+		assert.Equal(t, 500, queued[0].Priority)
+	}
+
+	// searched: out of the queue
+	assert.NoError(t, fetcher.SearchInEtherscan())
+	queued, err = fetcher.QueuedAddresses(1, 0)
+	assert.NoError(t, err)
+	assert.Len(t, queued, 0)
+
+	assert.Equal(t, "a,b", addTag("b", "a"))
+	assert.Equal(t, "a,b", addTag("a,b", "b"))
+	assert.Equal(t, "a", addTag("a", ""))
+}
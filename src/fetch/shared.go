@@ -0,0 +1,137 @@
+package fetch
+
+import (
+	myCache "code/src/cache"
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/petermattis/goid"
+	"strings"
+)
+
+// addressDeleter
+// @dev A Cache which can drop all the ABIs of an address, *cache.ABICache implements it
+type addressDeleter interface {
+	DeleteAddress(chainID int, contractAddress common.Address) int
+}
+
+// RunInvalidations
+// @dev Drop the ABIs of an address from memory and reload its overrides whenever a replica invalidates it, until the context is done
+// Notice: returns at once without a shared cache. Run it in the background, E.g. go fetcher.RunInvalidations(ctx)
+func (f *Fetcher) RunInvalidations(ctx context.Context) {
+	if f.shared == nil {
+		return
+	}
+	err := f.shared.Subscribe(ctx, func(chainID int, contractAddress common.Address) {
+		f.log.Info("Invalidated by the shared cache. ChainID:", chainID, " contractAddress:", contractAddress)
+		f.dropAddress(chainID, contractAddress)
+		f.reloadOverrides(chainID, contractAddress)
+	})
+	if err != nil {
+		f.log.Error("Fail to subscribe the invalidations. Err:", err)
+	}
+}
+
+// @dev The ABIs of chainID+contractAddress change, E.g. an override or a new crawl result:
+// drop them from memory and the shared cache, and tell the other replicas
+func (f *Fetcher) invalidate(chainID int, contractAddress common.Address) {
+	f.dropAddress(chainID, contractAddress)
+	if f.shared == nil {
+		return
+	}
+	if err := f.shared.Invalidate(context.Background(), chainID, contractAddress); err != nil {
+		f.log.Error("Fail to invalidate the shared cache. ChainID:", chainID, " contractAddress:", contractAddress, " Err:", err)
+	}
+}
+
+// @dev Drop the ABIs of chainID+contractAddress from memory, if the cache supports it
+func (f *Fetcher) dropAddress(chainID int, contractAddress common.Address) {
+	if deleter, ok := f.cache.(addressDeleter); ok {
+		deleter.DeleteAddress(chainID, contractAddress)
+	}
+}
+
+// @dev Read the serialized ABI of the key from the shared cache
+// Notice: the errors are only logged, the lookup goes on to the DB
+func (f *Fetcher) sharedGet(key myCache.Key) ([]byte, bool) {
+	if f.shared == nil {
+		return nil, false
+	}
+	value, isFound, err := f.shared.Get(context.Background(), key)
+	if err != nil {
+		f.log.Warning("Fail to read the shared cache. Err:", err)
+		return nil, false
+	}
+	return value, isFound
+}
+
+// @dev Write the serialized ABI of the key to the shared cache, with its default TTL
+func (f *Fetcher) sharedSet(key myCache.Key, value string) {
+	if f.shared == nil {
+		return
+	}
+	if err := f.shared.Set(context.Background(), key, []byte(value), 0); err != nil {
+		f.log.Warning("Fail to write the shared cache. Err:", err)
+	}
+}
+
+// @dev Find the functionABI of the deployment from fromBlock in the shared cache and set the memory cache
+func (f *Fetcher) functionABIFromShared(chainID int, contractAddress common.Address, fromBlock int64, sig [4]byte) (*abi.Method, bool) {
+	value, isFound := f.sharedGet(myCache.SelectorKey(chainID, contractAddress, sig).At(fromBlock))
+	if !isFound {
+		return nil, false
+	}
+	functionABI, err := parseFunctionABI(string(value), sig)
+	if err != nil {
+		f.log.Warning("Fail to parse the functionABI of the shared cache. Err:", err)
+		return nil, false
+	}
+	f.log.Info("[Thread ", goid.Get(), "] Found functionABI in the shared cache")
+	f.cacheSet(myCache.SelectorKey(chainID, contractAddress, sig).At(fromBlock), functionABI, nil)
+	return functionABI, true
+}
+
+// @dev Find the contractABI of the deployment from fromBlock in the shared cache and set the memory cache
+func (f *Fetcher) contractABIFromShared(chainID int, contractAddress common.Address, fromBlock int64) (*abi.ABI, bool) {
+	value, isFound := f.sharedGet(myCache.ContractKey(chainID, contractAddress).At(fromBlock))
+	if !isFound {
+		return nil, false
+	}
+	contractABI, err := abi.JSON(strings.NewReader(string(value)))
+	if err != nil {
+		f.log.Warning("Fail to parse the contractABI of the shared cache. Err:", err)
+		return nil, false
+	}
+	f.log.Info("[Thread ", goid.Get(), "] Found contractABI in the shared cache")
+	f.cacheSet(myCache.ContractKey(chainID, contractAddress).At(fromBlock), nil, &contractABI)
+	return &contractABI, true
+}
+
+// @dev Find the first blocks of the deployments of chainID+contractAddress in the shared cache and set the memory cache
+func (f *Fetcher) deploymentsFromShared(chainID int, contractAddress common.Address) ([]int64, bool) {
+	value, isFound := f.sharedGet(myCache.DeploymentsKey(chainID, contractAddress))
+	if !isFound {
+		return nil, false
+	}
+	var fromBlocks []int64
+	if err := json.Unmarshal(value, &fromBlocks); err != nil || len(fromBlocks) == 0 {
+		f.log.Warning("Fail to parse the deployments of the shared cache. Err:", err)
+		return nil, false
+	}
+	f.cache.SetDeployments(chainID, contractAddress, fromBlocks)
+	return fromBlocks, true
+}
+
+// @dev The fragment of [ABIEntry], E.g. {"type":"function","name":"name",...} => the method of the selector
+// Notice: also accepts the JSON ABI of a single function, E.g. the values set by the older versions
+func parseFunctionABI(fragment string, sig [4]byte) (*abi.Method, error) {
+	if !strings.HasPrefix(strings.TrimSpace(fragment), "[") {
+		fragment = "[" + fragment + "]"
+	}
+	myABI, err := abi.JSON(strings.NewReader(fragment))
+	if err != nil {
+		return nil, err
+	}
+	return myABI.MethodById(sig[:])
+}
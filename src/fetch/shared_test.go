@@ -0,0 +1,76 @@
+package fetch
+
+import (
+	myCache "code/src/cache"
+	"code/src/cache/redistest"
+	myDB "code/src/db"
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test two replicas with their own DB and memory sharing the second tier
+func TestSharedCache(t *testing.T) {
+	server := redistest.NewServer()
+	defer server.Close()
+	cacheA, cacheB := myCache.NewABICache(), myCache.NewABICache()
+	replicaA := useFakeUpstream(t, WithCache(cacheA), WithSharedCache(myCache.NewRedisCache(server.Addr)))
+	replicaB := useFakeUpstream(t, WithCache(cacheB), WithSharedCache(myCache.NewRedisCache(server.Addr)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	address := common.HexToAddress("0x00000000000000000000000000000000000f7705")
+	addressesWithCode[address], addressesEverDeployed[address], addressesVerified[address] = true, true, true
+	defer func() {
+		delete(addressesWithCode, address)
+		delete(addressesEverDeployed, address)
+		delete(addressesVerified, address)
+	}()
+
+	// A crawls the ABI, then fills the shared cache from its DB
+	_, err := replicaA.GetContractABIAtBlockContext(ctx, 1, address, nil, PolicyFetchThrough)
+	assert.NoError(t, err)
+	_, err = replicaA.GetFunctionABIAtBlockContext(ctx, 1, address, signature1, nil, PolicyCacheAndDB)
+	assert.NoError(t, err)
+	requests := abiRequestCount(address)
+
+	// B finds them in the shared cache without its DB or the explorer
+	contractABI, err := replicaB.GetContractABIAtBlock(1, address, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, contractABI.Methods, "name")
+	functionABI, err := replicaB.GetFunctionABIAtBlock(1, address, signature1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "name", functionABI.Name)
+	_, _, isFound := cacheB.Get(1, address, "")
+	assert.True(t, isFound)
+	var deployments int64
+	replicaB.db.Model(&myDB.ContractDeployment{}).Count(&deployments)
+	assert.Equal(t, int64(0), deployments)
+	assert.Equal(t, requests, abiRequestCount(address))
+
+	// An override on A drops the ABIs from the shared cache and the memory of B
+	go replicaB.RunInvalidations(ctx)
+	assert.Eventually(t, func() bool { return server.Subscribers(myCache.DefaultRedisChannel) == 1 }, time.Second, 10*time.Millisecond)
+	_, err = replicaA.SetABIOverride(1, address, verifiedContractABI, nil, nil, "test")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, _, isFound := cacheB.Get(1, address, "")
+		return !isFound
+	}, time.Second, 10*time.Millisecond)
+	_, _, isFound = cacheB.Get(1, address, string(signature1[:]))
+	assert.False(t, isFound)
+	_, _, isFound = cacheA.Get(1, address, "")
+	assert.False(t, isFound)
+	_, err = replicaB.GetContractABIAtBlockContext(ctx, 1, address, nil, PolicyCacheOnly)
+	assert.ErrorIs(t, err, ErrNotCached)
+
+	// The shared cache is only a tier: unreachable => the DB
+	replicaC := useFakeUpstream(t, WithSharedCache(myCache.NewRedisCache("127.0.0.1:1", myCache.WithRedisTimeout(100*time.Millisecond))))
+	_, err = replicaC.GetContractABIAtBlockContext(ctx, 1, address, nil, PolicyFetchThrough)
+	assert.NoError(t, err)
+	replicaC.cache = myCache.NewABICache()
+	functionABI, err = replicaC.GetFunctionABIAtBlock(1, address, signature1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "name", functionABI.Name)
+}
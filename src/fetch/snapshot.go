@@ -0,0 +1,218 @@
+package fetch
+
+import (
+	myCache "code/src/cache"
+	myDB "code/src/db"
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshotter
+// @dev A Cache which can list its hot set, *cache.ABICache implements it
+type Snapshotter interface {
+	Snapshot() []myCache.SnapshotEntry
+}
+
+// snapshotFile
+// @dev The JSON file of SaveSnapshot
+type snapshotFile struct {
+	SavedAt time.Time               `json:"savedAt"`
+	Entries []myCache.SnapshotEntry `json:"entries"` // the most recently used first
+}
+
+// SaveSnapshot
+// @dev Write the keys of the cached ABIs and their recency to path, and add their requests to [LookupStat]
+// @return the number of keys
+// Notice: the file is replaced atomically, so a crash never leaves half a snapshot
+func (f *Fetcher) SaveSnapshot(path string) (int, error) {
+	snapshotter, ok := f.cache.(Snapshotter)
+	if !ok {
+		return 0, errors.New("The cache can not be snapshotted")
+	}
+	entries := snapshotter.Snapshot()
+
+	if err := f.recordRequests(entries); err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(snapshotFile{SavedAt: f.now(), Entries: entries})
+	if err != nil {
+		return 0, errors.Wrap(err, "Fail to marshal the snapshot")
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, errors.Wrap(err, "Fail to create the snapshot")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "Fail to write the snapshot")
+	}
+
+	f.log.Info("Save the cache snapshot. Path:", path, " keys:", len(entries))
+	return len(entries), nil
+}
+
+// Prewarm
+// @dev Load the ABIs of the snapshot at path into the cache, then the most requested ones of [LookupStat] until limit
+// @return the number of ABIs loaded
+// Notice: run it in the background, the lookups are served meanwhile. A missing or broken snapshot only leaves the DB statistics
+func (f *Fetcher) Prewarm(ctx context.Context, path string, limit int) (int, error) {
+	var keys []myCache.Key
+	seen := make(map[myCache.Key]bool)
+	add := func(key myCache.Key) {
+		if len(keys) < limit && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	if path != "" {
+		snapshot, err := readSnapshot(path)
+		if err != nil {
+			f.log.Warning("Fail to read the cache snapshot, prewarm from the DB statistics. Err:", err)
+		}
+		for _, entry := range snapshot.Entries {
+			add(entry.Key)
+		}
+	}
+
+	if len(keys) < limit {
+		var stats []myDB.LookupStat
+		err := f.db.Order("requests DESC").Limit(limit).Find(&stats).Error
+		if err != nil {
+			f.log.Error("Fail to read the LookupStat items")
+			return 0, newError(ErrStorage, 0, common.Address{}, err)
+		}
+		for _, stat := range stats {
+			contractAddress := common.BytesToAddress(stat.ContractAddress)
+			key := myCache.ContractKey(stat.ChainID, contractAddress)
+			if len(stat.Signature) == 4 {
+				var selector [4]byte
+				copy(selector[:], stat.Signature)
+				key = myCache.SelectorKey(stat.ChainID, contractAddress, selector)
+			}
+			add(key)
+		}
+	}
+
+	// The least recently used first, so the hottest ABIs end up at the front of the LRU
+	loaded := 0
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			f.log.Warning("Stop prewarming the cache. Loaded:", loaded)
+			return loaded, err
+		}
+		key := keys[i]
+		// The deployment of the snapshot key, the latest one for the statistics
+		var block *big.Int
+		if key.FromBlock != 0 {
+			block = big.NewInt(key.FromBlock)
+		}
+		var isFound bool
+		var err error
+		if key.Kind == myCache.KindFunction {
+			_, isFound, err = f.functionABIFromDB("db", key.ChainID, key.ContractAddress, key.Selector, block)
+		} else {
+			_, isFound, err = f.contractABIFromDB("db", key.ChainID, key.ContractAddress, block)
+		}
+		if err != nil {
+			f.log.Warning("Fail to prewarm the key. ChainID:", key.ChainID, " contractAddress:", key.ContractAddress, " Err:", err)
+			continue
+		}
+		if isFound {
+			loaded++
+		}
+	}
+
+	f.log.Info("Prewarm the cache. Loaded:", loaded, " keys:", len(keys))
+	return loaded, nil
+}
+
+// RunSnapshots
+// @dev Save the snapshot every interval, and once more when the context is done, E.g. on shutdown
+func (f *Fetcher) RunSnapshots(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if _, err := f.SaveSnapshot(path); err != nil {
+				f.log.Error("Fail to save the cache snapshot on shutdown. Err:", err)
+			}
+			return
+		case <-ticker.C:
+			if _, err := f.SaveSnapshot(path); err != nil {
+				f.log.Error("Fail to save the cache snapshot. Err:", err)
+			}
+		}
+	}
+}
+
+// @dev Add the requests since the previous snapshot to [LookupStat]
+func (f *Fetcher) recordRequests(entries []myCache.SnapshotEntry) error {
+	var stats []myDB.LookupStat
+	for _, entry := range entries {
+		if entry.Requests == 0 {
+			continue
+		}
+		stat := myDB.LookupStat{
+			ChainID:         entry.Key.ChainID,
+			ContractAddress: entry.Key.ContractAddress.Bytes(),
+			Signature:       []byte{},
+			Requests:        int64(entry.Requests),
+			RequestedAt:     int(entry.AccessedAt.Unix()),
+		}
+		if entry.Key.Kind == myCache.KindFunction {
+			stat.Signature = append([]byte{}, entry.Key.Selector[:]...)
+		}
+		stats = append(stats, stat)
+	}
+	if len(stats) == 0 {
+		return nil
+	}
+
+	err := f.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "chain_id"}, {Name: "contract_address"}, {Name: "signature"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"requests":     gorm.Expr("lookup_stats.requests + excluded.requests"),
+			"requested_at": gorm.Expr("excluded.requested_at"),
+		}),
+	}).CreateInBatches(&stats, 100).Error
+	if err != nil {
+		f.log.Error("Fail to update the LookupStat items")
+		return newError(ErrStorage, 0, common.Address{}, err)
+	}
+	return nil
+}
+
+// @dev Read the snapshot file, an empty snapshot if it does not exist
+func readSnapshot(path string) (snapshotFile, error) {
+	var snapshot snapshotFile
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, errors.Wrap(err, "Fail to read the snapshot")
+	}
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return snapshotFile{}, errors.Wrap(err, "Broken snapshot")
+	}
+	return snapshot, nil
+}
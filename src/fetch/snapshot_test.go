@@ -0,0 +1,102 @@
+package fetch
+
+import (
+	myDB "code/src/db"
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test saving the hot set of the cache, then prewarming another cache from it
+func TestSnapshotAndPrewarm(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.snapshot.json")
+	address := common.HexToAddress("0x00000000000000000000000000000000000f7704")
+	addressesWithCode[address], addressesEverDeployed[address], addressesVerified[address] = true, true, true
+	defer func() {
+		delete(addressesWithCode, address)
+		delete(addressesEverDeployed, address)
+		delete(addressesVerified, address)
+	}()
+
+	_, err := fetcher.GetContractABIAtBlockContext(ctx, 1, address, nil, PolicyFetchThrough)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = fetcher.GetFunctionABIAtBlockContext(ctx, 1, address, signature1, nil, PolicyFetchThrough)
+		assert.NoError(t, err)
+	}
+	count, err := fetcher.SaveSnapshot(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// the requests are added to the DB statistics
+	var stat myDB.LookupStat
+	assert.NoError(t, fetcher.db.Where("chain_id = ? AND contract_address = ? AND signature = ?", 1, address.Bytes(), signature1[:]).First(&stat).Error)
+	assert.Equal(t, int64(2), stat.Requests) // the first lookup reads the DB
+	_, err = fetcher.GetFunctionABIAtBlockContext(ctx, 1, address, signature1, nil, PolicyCacheOnly)
+	assert.NoError(t, err)
+	_, err = fetcher.SaveSnapshot(path)
+	assert.NoError(t, err)
+	assert.NoError(t, fetcher.db.Where("chain_id = ? AND contract_address = ? AND signature = ?", 1, address.Bytes(), signature1[:]).First(&stat).Error)
+	assert.Equal(t, int64(3), stat.Requests)
+
+	// a new process: prewarm from the snapshot
+	restarted, err := NewFetcher(WithDB(fetcher.db))
+	assert.NoError(t, err)
+	_, err = restarted.GetContractABIAtBlockContext(ctx, 1, address, nil, PolicyCacheOnly)
+	assert.ErrorIs(t, err, ErrNotCached)
+	loaded, err := restarted.Prewarm(ctx, path, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, loaded)
+	contractABI, err := restarted.GetContractABIAtBlockContext(ctx, 1, address, nil, PolicyCacheOnly)
+	assert.NoError(t, err)
+	assert.Contains(t, contractABI.Methods, "name")
+	method, err := restarted.GetFunctionABIAtBlockContext(ctx, 1, address, signature1, nil, PolicyCacheOnly)
+	assert.NoError(t, err)
+	assert.Equal(t, "name", method.Name)
+
+	// no snapshot, or a broken one: prewarm from the most requested ABIs in DB
+	assert.NoError(t, os.WriteFile(path, []byte("{broken"), 0o644))
+	for _, snapshot := range []string{path, filepath.Join(t.TempDir(), "missing.json"), ""} {
+		restarted, _ = NewFetcher(WithDB(fetcher.db))
+		loaded, err = restarted.Prewarm(ctx, snapshot, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, loaded)
+		method, err = restarted.GetFunctionABIAtBlockContext(ctx, 1, address, signature1, nil, PolicyCacheOnly)
+		assert.NoError(t, err)
+	}
+
+	// cancelled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	loaded, err = restarted.Prewarm(cancelled, "", 10)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, loaded)
+}
+
+// Test saving the snapshot on a timer and on shutdown
+func TestRunSnapshots(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	path := filepath.Join(t.TempDir(), "cache.snapshot.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		fetcher.RunSnapshots(ctx, path, 10*time.Millisecond)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+	assert.NoError(t, os.Remove(path))
+	cancel()
+	<-done
+	_, err := os.Stat(path)
+	assert.NoError(t, err) // saved on shutdown
+}
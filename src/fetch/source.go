@@ -0,0 +1,481 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ABISource
+// @dev Where the robot searches the verified ABIs, E.g. Etherscan
+type ABISource interface {
+	// Supports tells whether the source has an API for the chain
+	Supports(chainID int) bool
+	// FetchABI returns the JSON ABI of the verified contract
+	// Notice: ErrNotVerified if the contract is not verified, ErrUpstreamRateLimited or ErrExplorer for the other failures
+	FetchABI(chainID int, contractAddress common.Address) ([]byte, error)
+}
+
+// CreationChecker
+// @dev An ABISource which also knows whether an address has been created as a contract
+type CreationChecker interface {
+	ContractCreated(chainID int, contractAddress common.Address) (bool, error)
+}
+
+// CodeReader
+// @dev Read the runtime code from a blockchain node, *ethclient.Client implements it
+type CodeReader interface {
+	CodeAt(ctx context.Context, contractAddress common.Address, blockNumber *big.Int) ([]byte, error)
+}
+
+// BlockNumberReader
+// @dev A CodeReader which also tells the newest block, so the ABI history records where an ABI is seen.
+// *ethclient.Client implements it
+type BlockNumberReader interface {
+	BlockNumber(ctx context.Context) (uint64, error)
+}
+
+// LogReader
+// @dev A node the upgrade watcher reads the EIP-1967 events, slots and beacons from, *ethclient.Client implements it
+type LogReader interface {
+	BlockNumberReader
+	FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error)
+	StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error)
+	CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+}
+
+// BlockReader
+// @dev A node the block follower reads the new blocks and the receipts of the contract creations from,
+// *ethclient.Client and the simulated backend of go-ethereum implement it
+type BlockReader interface {
+	BlockNumberReader
+	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+// TraceReader
+// @dev A node with the debug API, which also tells the contracts created by the other contracts, E.g. by a factory
+type TraceReader interface {
+	CreatedContracts(ctx context.Context, number *big.Int) ([]common.Address, error)
+}
+
+// HeadSubscriber
+// @dev A node which pushes the new blocks, E.g. over a websocket. *ethclient.Client implements it
+type HeadSubscriber interface {
+	SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error)
+}
+
+// ApiResponse
+// @dev For parse the data from Etherscan
+type ApiResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Result  string `json:"result"`
+}
+
+// explorerAPIs
+// @dev chainID => the API of the blockchain explorer
+var explorerAPIs = map[int]string{
+	1:     "https://api.etherscan.io/api",    // Ethereum
+	56:    "https://api.bscscan.com/api",     // BSC
+	42161: "https://api.arbiscan.io/api",     // Arbitrum
+	137:   "https://api.polygonscan.com/api", // Polygon
+}
+
+// EtherscanSource
+// @dev Search the ABIs from Etherscan and the explorers with the same API
+type EtherscanSource struct {
+	ApiKey string         // Etherscan
+	APIs   map[int]string // chainID => the API of the blockchain explorer
+	Client *http.Client   // the HTTP client to reach out Etherscan
+}
+
+// NewEtherscanSource
+// @dev Create an EtherscanSource of Ethereum, BSC, Arbitrum and Polygon
+// Notice: Sometimes we could fetch data in Etherscan without an API KEY
+func NewEtherscanSource(apiKey string) *EtherscanSource {
+	apis := make(map[int]string, len(explorerAPIs))
+	for chainID, api := range explorerAPIs {
+		apis[chainID] = api
+	}
+	return &EtherscanSource{ApiKey: apiKey, APIs: apis, Client: newHTTPClient()}
+}
+
+// Supports
+// @dev Only support the chains in APIs
+func (s *EtherscanSource) Supports(chainID int) bool {
+	_, found := s.APIs[chainID]
+	return found
+}
+
+// FetchABI
+// @dev Query a contract's ABI from Etherscan
+// Notice: ErrNotVerified if the contract is not verified, ErrExplorer for the other messages of the explorer
+func (s *EtherscanSource) FetchABI(chainID int, contractAddress common.Address) ([]byte, error) {
+	requestURL, err := s.requestURL(chainID, contractAddress)
+	if err != nil {
+		log.Error("Invalid requestURL:", requestURL)
+		return []byte{}, err
+	}
+
+	body, err := s.query(requestURL)
+	if err != nil {
+		log.Error("Fail to fetch ABI from Etherscan. ChainID:", chainID, "contractAddress:", contractAddress)
+		return []byte{}, newError(ErrExplorer, chainID, contractAddress, err)
+	}
+
+	// Parsing JSON data
+	var apiResponse ApiResponse
+	err = json.Unmarshal(body, &apiResponse)
+	if err != nil {
+		log.Error("Fail to parsing JSON data. ChainID:", chainID, "contractAddress:", contractAddress)
+		return []byte{}, newError(ErrExplorer, chainID, contractAddress, err)
+	}
+
+	// status 0: E.g. "Contract source code not verified", "Max rate limit reached", "Invalid API Key"
+	if apiResponse.Status != "1" {
+		log.Warning("Etherscan returns an error. ChainID:", chainID, "contractAddress:", contractAddress, "result:", apiResponse.Result)
+		return []byte{}, explorerError(chainID, contractAddress, apiResponse.Result)
+	}
+
+	return []byte(apiResponse.Result), nil
+}
+
+// ContractCreated
+// @dev Query whether the address has been created as a contract, so an address without code is a self-destructed contract rather than an EOA
+func (s *EtherscanSource) ContractCreated(chainID int, contractAddress common.Address) (bool, error) {
+	explorerAPI, found := s.APIs[chainID]
+	if !found {
+		log.Error("Invalid chainID. chainID:", chainID, "contractAddress", contractAddress)
+		return false, newError(ErrUnsupportedChain, chainID, contractAddress, nil)
+	}
+	requestURL := fmt.Sprintf("%s?module=contract&action=getcontractcreation&contractaddresses=%s&apikey=%s", explorerAPI, contractAddress, s.ApiKey)
+
+	body, err := s.query(requestURL)
+	if err != nil {
+		log.Error("Fail to fetch contract creation from Etherscan. ChainID:", chainID, "contractAddress:", contractAddress)
+		return false, newError(ErrExplorer, chainID, contractAddress, err)
+	}
+
+	var apiResponse struct {
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+		Result  json.RawMessage `json:"result"` // an array, or an error message
+	}
+	err = json.Unmarshal(body, &apiResponse)
+	if err != nil {
+		log.Error("Fail to parsing JSON data. ChainID:", chainID, "contractAddress:", contractAddress)
+		return false, newError(ErrExplorer, chainID, contractAddress, err)
+	}
+
+	if apiResponse.Status == "1" {
+		var creations []json.RawMessage
+		_ = json.Unmarshal(apiResponse.Result, &creations)
+		return len(creations) > 0, nil
+	}
+	if strings.Contains(strings.ToLower(apiResponse.Message), "no data found") {
+		return false, nil
+	}
+	log.Warning("Etherscan returns an error. ChainID:", chainID, "contractAddress:", contractAddress, "result:", string(apiResponse.Result))
+	var message string
+	if json.Unmarshal(apiResponse.Result, &message) != nil {
+		message = string(apiResponse.Result)
+	}
+	return false, explorerError(chainID, contractAddress, message)
+}
+
+// FilterLogs
+// @dev Get the logs matching the query, eth_getLogs
+func (rpcUrl rpcNode) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	client, err := ethclient.DialContext(ctx, string(rpcUrl))
+	if err != nil {
+		log.Error("Fail to connect to the node. RPC URL:", rpcUrl)
+		return nil, errors.Wrap(err, "Connect fail")
+	}
+
+	defer client.Close()
+
+	return client.FilterLogs(ctx, query)
+}
+
+// StorageAt
+// @dev Get a storage slot of the account
+func (rpcUrl rpcNode) StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error) {
+	client, err := ethclient.DialContext(ctx, string(rpcUrl))
+	if err != nil {
+		log.Error("Fail to connect to the node. RPC URL:", rpcUrl, "Account:", account)
+		return nil, errors.Wrap(err, "Connect fail")
+	}
+
+	defer client.Close()
+
+	return client.StorageAt(ctx, account, key, blockNumber)
+}
+
+// CallContract
+// @dev Execute a read-only call, eth_call
+func (rpcUrl rpcNode) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	client, err := ethclient.DialContext(ctx, string(rpcUrl))
+	if err != nil {
+		log.Error("Fail to connect to the node. RPC URL:", rpcUrl)
+		return nil, errors.Wrap(err, "Connect fail")
+	}
+
+	defer client.Close()
+
+	return client.CallContract(ctx, call, blockNumber)
+}
+
+// BlockByNumber
+// @dev Get the block with its transactions
+func (rpcUrl rpcNode) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	client, err := ethclient.DialContext(ctx, string(rpcUrl))
+	if err != nil {
+		log.Error("Fail to connect to the node. RPC URL:", rpcUrl)
+		return nil, errors.Wrap(err, "Connect fail")
+	}
+
+	defer client.Close()
+
+	return client.BlockByNumber(ctx, number)
+}
+
+// TransactionReceipt
+// @dev Get the receipt of the transaction, E.g. the address of the contract it creates
+func (rpcUrl rpcNode) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	client, err := ethclient.DialContext(ctx, string(rpcUrl))
+	if err != nil {
+		log.Error("Fail to connect to the node. RPC URL:", rpcUrl)
+		return nil, errors.Wrap(err, "Connect fail")
+	}
+
+	defer client.Close()
+
+	return client.TransactionReceipt(ctx, txHash)
+}
+
+// SubscribeNewHead
+// @dev Push the header of each new block to ch, the RPC URL has to be a websocket or IPC endpoint
+// Notice: the connection is closed when the subscription is
+func (rpcUrl rpcNode) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	client, err := ethclient.DialContext(ctx, string(rpcUrl))
+	if err != nil {
+		log.Error("Fail to connect to the node. RPC URL:", rpcUrl)
+		return nil, errors.Wrap(err, "Connect fail")
+	}
+
+	sub, err := client.SubscribeNewHead(ctx, ch)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &clientSubscription{Subscription: sub, client: client}, nil
+}
+
+// clientSubscription
+// @dev A subscription which owns its connection
+type clientSubscription struct {
+	ethereum.Subscription
+	client *ethclient.Client
+}
+
+// Unsubscribe
+// @dev Cancel the subscription and close its connection
+func (s *clientSubscription) Unsubscribe() {
+	s.Subscription.Unsubscribe()
+	s.client.Close()
+}
+
+// callFrame
+// @dev A call of the callTracer of debug_traceBlockByNumber
+type callFrame struct {
+	Type  string         `json:"type"` // CALL, CREATE, CREATE2...
+	To    common.Address `json:"to"`   // the created contract of CREATE and CREATE2
+	Error string         `json:"error"`
+	Calls []callFrame    `json:"calls"`
+}
+
+// CreatedContracts
+// @dev Get the contracts created in the block, including the ones created by the other contracts. debug_traceBlockByNumber
+// Notice: the reverted creations are skipped, the nodes without the debug API return an error
+func (rpcUrl rpcNode) CreatedContracts(ctx context.Context, number *big.Int) ([]common.Address, error) {
+	client, err := ethclient.DialContext(ctx, string(rpcUrl))
+	if err != nil {
+		log.Error("Fail to connect to the node. RPC URL:", rpcUrl)
+		return nil, errors.Wrap(err, "Connect fail")
+	}
+
+	defer client.Close()
+
+	var traces []struct {
+		Result callFrame `json:"result"`
+	}
+	err = client.Client().CallContext(ctx, &traces, "debug_traceBlockByNumber", hexutil.EncodeBig(number), map[string]string{"tracer": "callTracer"})
+	if err != nil {
+		return nil, err
+	}
+	var created []common.Address
+	var walk func(frame callFrame)
+	walk = func(frame callFrame) {
+		if frame.Error != "" {
+			return // reverted with its sub calls
+		}
+		if frame.Type == "CREATE" || frame.Type == "CREATE2" {
+			created = append(created, frame.To)
+		}
+		for _, call := range frame.Calls {
+			walk(call)
+		}
+	}
+	for _, trace := range traces {
+		walk(trace.Result)
+	}
+	return created, nil
+}
+
+// @dev Check ChainID and get the format the request url
+func (s *EtherscanSource) requestURL(chainID int, contractAddress common.Address) (string, error) {
+	if s.ApiKey == "" {
+		log.Warning("The request may be fail without an API KEY")
+	}
+
+	explorerAPI, found := s.APIs[chainID]
+	if !found {
+		log.Error("Invalid chainID or API KEY. chainID:", chainID, "API KEY:", s.ApiKey, "contractAddress", contractAddress)
+		return "", newError(ErrUnsupportedChain, chainID, contractAddress, nil)
+	}
+
+	return fmt.Sprintf("%s?module=contract&action=getabi&address=%s&apikey=%s", explorerAPI, contractAddress, s.ApiKey), nil
+}
+
+// @dev Send a GET request to Etherscan, wait and retry if it fails
+func (s *EtherscanSource) query(requestURL string) ([]byte, error) {
+	// Wait and retry if fail to get data from Etherscan
+	var response *http.Response
+	var err error
+	maxRetries := 5 // maximum number of retries
+	for i := 0; i < maxRetries; i++ {
+		response, err = s.Client.Get(requestURL)
+		if err == nil {
+			break // Success, exit loop
+		}
+		time.Sleep(1 * time.Second) // Wait for 1 second before retrying
+	}
+	if err != nil {
+		log.Error("Timeout: Fail to fetch data from Etherscan")
+		return nil, errors.Wrap(err, "Timeout")
+	}
+	defer response.Body.Close()
+
+	// Read response content
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		log.Error("Fail to Read response content")
+		return nil, errors.Wrap(err, "Read response fail")
+	}
+	return body, nil
+}
+
+// @dev The message of a failed explorer response => the kind of error
+// E.g. "Contract source code not verified", "Max rate limit reached", "Invalid API Key"
+func explorerError(chainID int, contractAddress common.Address, message string) *Error {
+	lower := strings.ToLower(message)
+	switch {
+	case strings.Contains(lower, "not verified"):
+		return newError(ErrNotVerified, chainID, contractAddress, errors.New(message))
+	case strings.Contains(lower, "rate limit"):
+		rateLimited := newError(ErrUpstreamRateLimited, chainID, contractAddress, errors.New(message))
+		rateLimited.RetryAfter = defaultRecheckPolicies[StatusRateLimited].Initial
+		return rateLimited
+	}
+	return newError(ErrExplorer, chainID, contractAddress, errors.New(message))
+}
+
+// @dev Create the HTTP client to reach out Etherscan
+func newHTTPClient() *http.Client {
+	//////////////////////////////////////// Proxy ////////////////////////////////////////////////////////////////
+	// Notice: You should use proxy mode if you are in China, or you can not reach out Etherscan because of China Great Firewall.
+	// If you don't need a proxy, you can delete it.
+	// Note that I am using the default proxy port for Clash for Windows here: 127.0.0.1:7890
+	proxyURL, _ := url.Parse("http://127.0.0.1:7890")
+
+	// Create an HTTP client with a proxy
+	transport := &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+	}
+	// NOTICE: If you don't need a proxy client, you should use http.DefaultClient
+	return &http.Client{
+		Transport: transport,
+	}
+	//////////////////////////////////////// Proxy ////////////////////////////////////////////////////////////////
+}
+
+// rpcNode
+// @dev A CodeReader which dials the RPC URL for every call
+type rpcNode string
+
+// CodeAt
+// @dev Get the runtime code of the contract
+func (rpcUrl rpcNode) CodeAt(ctx context.Context, contractAddress common.Address, blockNumber *big.Int) ([]byte, error) {
+	client, err := ethclient.DialContext(ctx, string(rpcUrl))
+	if err != nil {
+		log.Error("Fail to connect to the node. RPC URL:", rpcUrl, "ContractAddress:", contractAddress)
+		return nil, errors.Wrap(err, "Connect fail")
+	}
+
+	defer client.Close()
+
+	return client.CodeAt(ctx, contractAddress, blockNumber)
+}
+
+// BlockNumber
+// @dev Get the number of the newest block
+func (rpcUrl rpcNode) BlockNumber(ctx context.Context) (uint64, error) {
+	client, err := ethclient.DialContext(ctx, string(rpcUrl))
+	if err != nil {
+		log.Error("Fail to connect to the node. RPC URL:", rpcUrl)
+		return 0, errors.Wrap(err, "Connect fail")
+	}
+
+	defer client.Close()
+
+	return client.BlockNumber(ctx)
+}
+
+// @dev Check ChainID and get the format the request url
+// @notice Only support the chains in explorerAPIs now
+func checkChainIDAndGetReqURL(apiKey string, chainID int, contractAddress common.Address) (string, error) {
+	return NewEtherscanSource(apiKey).requestURL(chainID, contractAddress)
+}
+
+// @dev Query a contract's ABI from Etherscan
+func queryABIFromEtherscan(apiKey string, chainID int, contractAddress common.Address) ([]byte, error) {
+	return NewEtherscanSource(apiKey).FetchABI(chainID, contractAddress)
+}
+
+// @dev Query the runtime code from the node, nil: the newest block
+func queryRuntimeCode(rpcUrl string, contractAddress common.Address) ([]byte, error) {
+	bytecode, err := rpcNode(rpcUrl).CodeAt(context.Background(), contractAddress, nil)
+	if err != nil {
+		log.Error("Fail to get the RuntimeCode. RPC URL:", rpcUrl, "ContractAddress:", contractAddress)
+		return nil, newError(ErrNode, 0, contractAddress, errors.Wrap(err, "Get fail"))
+	}
+
+	if len(bytecode) == 0 {
+		return []byte{}, nil
+	} else {
+		return bytecode, nil
+	}
+}
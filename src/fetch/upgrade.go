@@ -0,0 +1,476 @@
+package fetch
+
+import (
+	"bytes"
+	myDB "code/src/db"
+	"context"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// The EIP-1967 slots: keccak256("eip1967.proxy.implementation|beacon|admin") - 1
+var (
+	implementationSlot = common.HexToHash("0x360894a13ba1a3210667c828492db98dca3e2076cc3735a920a3ca505d382bbc")
+	beaconSlot         = common.HexToHash("0xa3f0ad74e5423aebfd80d3ef4346578335a9a72aeaee59ff6cb3582b35133d50")
+	adminSlot          = common.HexToHash("0xb53127684a568b3173ae13b9f8a6016e243e63b6e8ee1178d6a717850b5d6103")
+)
+
+// The EIP-1967 events, and implementation() of a beacon
+var (
+	upgradedTopic          = crypto.Keccak256Hash([]byte("Upgraded(address)"))
+	beaconUpgradedTopic    = crypto.Keccak256Hash([]byte("BeaconUpgraded(address)"))
+	adminChangedTopic      = crypto.Keccak256Hash([]byte("AdminChanged(address,address)"))
+	implementationSelector = []byte{0x5c, 0x60, 0xda, 0x1b}
+)
+
+// defaultProxyTTL
+// @dev The ABIs of a proxy change with its upgrades, so they are read from the DB again after it, see WithProxyTTL
+const defaultProxyTTL = 5 * time.Minute
+
+// The events of [ProxyUpgrade]
+const (
+	EventUpgraded       = "Upgraded"
+	EventBeaconUpgraded = "BeaconUpgraded"
+	EventAdminChanged   = "AdminChanged"
+)
+
+// maxLogRange
+// @dev The most blocks one eth_getLogs asks for, the nodes refuse the larger ranges. The watcher catches up over several polls
+const maxLogRange = 5000
+
+// WatchProxy
+// @dev WatchProxy of the default Fetcher
+func WatchProxy(ctx context.Context, chainID int, proxyAddress common.Address) (*myDB.WatchedProxy, error) {
+	return Default().WatchProxy(ctx, chainID, proxyAddress)
+}
+
+// UnwatchProxy
+// @dev UnwatchProxy of the default Fetcher
+func UnwatchProxy(chainID int, proxyAddress common.Address) (bool, error) {
+	return Default().UnwatchProxy(chainID, proxyAddress)
+}
+
+// WatchedProxies
+// @dev WatchedProxies of the default Fetcher
+func WatchedProxies(chainID int) ([]myDB.WatchedProxy, error) {
+	return Default().WatchedProxies(chainID)
+}
+
+// ProxyUpgrades
+// @dev ProxyUpgrades of the default Fetcher
+func ProxyUpgrades(chainID int, proxyAddress common.Address) ([]myDB.ProxyUpgrade, error) {
+	return Default().ProxyUpgrades(chainID, proxyAddress)
+}
+
+// WatchProxy
+// @dev Follow the upgrades of an EIP-1967 proxy from the newest block. Its implementation, beacon and admin are read from
+// the slots, the implementation is queued for the robot, and its ABI serves the proxy once it is stored. [WatchedProxy]
+// Notice: watching it again reads the slots again. ErrNotProxy if neither the implementation nor the beacon slot is set
+func (f *Fetcher) WatchProxy(ctx context.Context, chainID int, proxyAddress common.Address) (*myDB.WatchedProxy, error) {
+	node, err := f.logReader(chainID, proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	head, err := node.BlockNumber(ctx)
+	if err != nil {
+		f.log.Error("Fail to get the newest block. ChainID:", chainID)
+		return nil, newError(ErrNode, chainID, proxyAddress, err)
+	}
+	block := new(big.Int).SetUint64(head)
+	var slots [3]common.Address
+	for i, slot := range []common.Hash{implementationSlot, beaconSlot, adminSlot} {
+		word, err := node.StorageAt(ctx, proxyAddress, slot, block)
+		if err != nil {
+			f.log.Error("Fail to read the EIP-1967 slot. ChainID:", chainID, " proxyAddress:", proxyAddress)
+			return nil, newError(ErrNode, chainID, proxyAddress, err)
+		}
+		slots[i] = common.BytesToAddress(word)
+	}
+	implementation, beacon, admin := slots[0], slots[1], slots[2]
+	if beacon != (common.Address{}) {
+		if implementation, err = f.beaconImplementation(ctx, node, chainID, beacon, block); err != nil {
+			return nil, err
+		}
+	}
+	if implementation == (common.Address{}) {
+		return nil, newError(ErrNotProxy, chainID, proxyAddress, nil)
+	}
+
+	proxy := myDB.WatchedProxy{
+		ChainID:             chainID,
+		ProxyAddress:        proxyAddress.Bytes(),
+		Implementation:      implementation.Bytes(),
+		ImplementationBlock: int64(head), // the block it is seen at, the slots do not tell since when
+		LastBlock:           int64(head),
+		WatchedAt:           int(f.now().Unix()),
+	}
+	if beacon != (common.Address{}) {
+		proxy.Beacon = beacon.Bytes()
+	}
+	if admin != (common.Address{}) {
+		proxy.Admin = admin.Bytes()
+	}
+	if err = f.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&proxy).Error; err != nil {
+		f.log.Error("Fail to create the WatchedProxy item")
+		return nil, newError(ErrStorage, chainID, proxyAddress, err)
+	}
+	f.log.Info("Watch the proxy. ChainID:", chainID, " proxyAddress:", proxyAddress, " implementation:", implementation)
+
+	f.invalidate(chainID, proxyAddress)
+	f.queueImplementation(chainID, implementation)
+	return &proxy, f.bindImplementations(chainID)
+}
+
+// UnwatchProxy
+// @dev Stop following the upgrades of the proxy, its recorded upgrades and ABIs stay
+// @return false if it is not watched
+func (f *Fetcher) UnwatchProxy(chainID int, proxyAddress common.Address) (bool, error) {
+	result := f.db.Where("chain_id = ? AND proxy_address = ?", chainID, proxyAddress.Bytes()).Delete(&myDB.WatchedProxy{})
+	if result.Error != nil {
+		f.log.Error("Fail to delete the WatchedProxy item")
+		return false, newError(ErrStorage, chainID, proxyAddress, result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// WatchedProxies
+// @dev The watched proxies of the chain, 0: of every chain
+func (f *Fetcher) WatchedProxies(chainID int) ([]myDB.WatchedProxy, error) {
+	query := f.db.Order("chain_id ASC, watched_at ASC, proxy_address ASC")
+	if chainID != 0 {
+		query = query.Where("chain_id = ?", chainID)
+	}
+	var proxies []myDB.WatchedProxy
+	if err := query.Find(&proxies).Error; err != nil {
+		f.log.Error("Fail to read the WatchedProxy items")
+		return nil, newError(ErrStorage, chainID, common.Address{}, err)
+	}
+	return proxies, nil
+}
+
+// ProxyUpgrades
+// @dev The upgrades of the proxy seen by the watcher, the oldest first
+func (f *Fetcher) ProxyUpgrades(chainID int, proxyAddress common.Address) ([]myDB.ProxyUpgrade, error) {
+	var upgrades []myDB.ProxyUpgrade
+	err := f.db.Where("chain_id = ? AND proxy_address = ?", chainID, proxyAddress.Bytes()).Order("block_number ASC, log_index ASC").Find(&upgrades).Error
+	if err != nil {
+		f.log.Error("Fail to read the ProxyUpgrade items")
+		return nil, newError(ErrStorage, chainID, proxyAddress, err)
+	}
+	return upgrades, nil
+}
+
+// RunUpgradeWatcher
+// @dev Poll the upgrades of the watched proxies every interval, until the context is done
+// Notice: run it in the background, E.g. go fetcher.RunUpgradeWatcher(ctx, time.Minute)
+func (f *Fetcher) RunUpgradeWatcher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.PollUpgrades(ctx); err != nil {
+				f.log.Error("Fail to poll the proxy upgrades. Err:", err)
+			}
+		}
+	}
+}
+
+// PollUpgrades
+// @dev Read the Upgraded, BeaconUpgraded and AdminChanged events of the watched proxies and their beacons since the
+// previous poll. [ProxyUpgrade] A new implementation drops the ABIs of the proxy from the caches and is queued for the
+// robot, then the proxy is bound to the ABI of its implementation from the block of the upgrade, once the ABI is stored
+// Notice: the chains are polled one by one, the failure of one does not stop the others
+func (f *Fetcher) PollUpgrades(ctx context.Context) error {
+	var proxies []myDB.WatchedProxy
+	if err := f.db.Order("chain_id ASC").Find(&proxies).Error; err != nil {
+		f.log.Error("Fail to read the WatchedProxy items")
+		return newError(ErrStorage, 0, common.Address{}, err)
+	}
+	byChain := make(map[int][]myDB.WatchedProxy)
+	var chainIDs []int
+	for _, proxy := range proxies {
+		if _, isFound := byChain[proxy.ChainID]; !isFound {
+			chainIDs = append(chainIDs, proxy.ChainID)
+		}
+		byChain[proxy.ChainID] = append(byChain[proxy.ChainID], proxy)
+	}
+
+	var firstErr error
+	for _, chainID := range chainIDs {
+		if err := f.pollChain(ctx, chainID, byChain[chainID]); err != nil {
+			f.log.Error("Fail to poll the proxy upgrades. ChainID:", chainID, " Err:", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// @dev Read the events of the proxies of a chain up to the newest block, at most maxLogRange blocks, then bind them
+func (f *Fetcher) pollChain(ctx context.Context, chainID int, proxies []myDB.WatchedProxy) error {
+	node, err := f.logReader(chainID, common.Address{})
+	if err != nil {
+		return err
+	}
+	head, err := node.BlockNumber(ctx)
+	if err != nil {
+		return newError(ErrNode, chainID, common.Address{}, err)
+	}
+
+	fromBlock := int64(head) + 1
+	watched := make(map[common.Address]*myDB.WatchedProxy)
+	byBeacon := make(map[common.Address][]*myDB.WatchedProxy)
+	var addresses []common.Address
+	for i := range proxies {
+		proxy := &proxies[i]
+		if proxy.LastBlock+1 < fromBlock {
+			fromBlock = proxy.LastBlock + 1
+		}
+		proxyAddress := common.BytesToAddress(proxy.ProxyAddress)
+		watched[proxyAddress] = proxy
+		addresses = append(addresses, proxyAddress)
+		if len(proxy.Beacon) > 0 {
+			beacon := common.BytesToAddress(proxy.Beacon)
+			if _, isFound := byBeacon[beacon]; !isFound {
+				addresses = append(addresses, beacon)
+			}
+			byBeacon[beacon] = append(byBeacon[beacon], proxy)
+		}
+	}
+	if fromBlock > int64(head) {
+		return f.bindImplementations(chainID)
+	}
+	toBlock := int64(head)
+	if toBlock-fromBlock+1 > maxLogRange {
+		toBlock = fromBlock + maxLogRange - 1
+	}
+
+	logs, err := node.FilterLogs(ctx, ethereum.FilterQuery{
+		FromBlock: big.NewInt(fromBlock),
+		ToBlock:   big.NewInt(toBlock),
+		Addresses: addresses,
+		Topics:    [][]common.Hash{{upgradedTopic, beaconUpgradedTopic, adminChangedTopic}},
+	})
+	if err != nil {
+		f.log.Error("Fail to read the logs. ChainID:", chainID, " fromBlock:", fromBlock, " toBlock:", toBlock)
+		return newError(ErrNode, chainID, common.Address{}, err)
+	}
+	sort.SliceStable(logs, func(i, j int) bool {
+		if logs[i].BlockNumber != logs[j].BlockNumber {
+			return logs[i].BlockNumber < logs[j].BlockNumber
+		}
+		return logs[i].Index < logs[j].Index
+	})
+
+	var upgrades []myDB.ProxyUpgrade
+	changed := make(map[common.Address]common.Address) // proxy => the new implementation
+	record := func(proxy *myDB.WatchedProxy, event string, address common.Address, blockNumber int64, logIndex uint) {
+		upgrades = append(upgrades, myDB.ProxyUpgrade{
+			ChainID:        chainID,
+			ProxyAddress:   proxy.ProxyAddress,
+			BlockNumber:    blockNumber,
+			LogIndex:       int(logIndex),
+			Event:          event,
+			Address:        address.Bytes(),
+			Implementation: proxy.Implementation,
+		})
+	}
+	upgrade := func(proxy *myDB.WatchedProxy, implementation common.Address, blockNumber int64) {
+		if bytes.Equal(proxy.Implementation, implementation.Bytes()) {
+			return
+		}
+		proxy.Implementation, proxy.ImplementationBlock, proxy.IsBound = implementation.Bytes(), blockNumber, false
+		changed[common.BytesToAddress(proxy.ProxyAddress)] = implementation
+	}
+
+	for _, entry := range logs {
+		blockNumber := int64(entry.BlockNumber)
+		if entry.Removed || len(entry.Topics) == 0 {
+			continue
+		}
+		switch entry.Topics[0] {
+		case upgradedTopic:
+			if len(entry.Topics) < 2 {
+				continue
+			}
+			implementation := common.BytesToAddress(entry.Topics[1].Bytes())
+			// the upgrade of a beacon upgrades its proxies
+			targets := append([]*myDB.WatchedProxy{}, byBeacon[entry.Address]...)
+			if proxy, isFound := watched[entry.Address]; isFound {
+				targets = append(targets, proxy)
+			}
+			for _, proxy := range targets {
+				if blockNumber > proxy.LastBlock {
+					upgrade(proxy, implementation, blockNumber)
+					record(proxy, EventUpgraded, implementation, blockNumber, entry.Index)
+				}
+			}
+
+		case beaconUpgradedTopic:
+			proxy, isFound := watched[entry.Address]
+			if !isFound || blockNumber <= proxy.LastBlock || len(entry.Topics) < 2 {
+				continue
+			}
+			// Notice: the events of the new beacon are read from the next poll
+			beacon := common.BytesToAddress(entry.Topics[1].Bytes())
+			implementation, err := f.beaconImplementation(ctx, node, chainID, beacon, big.NewInt(blockNumber))
+			if err != nil {
+				return err
+			}
+			proxy.Beacon = beacon.Bytes()
+			upgrade(proxy, implementation, blockNumber)
+			record(proxy, EventBeaconUpgraded, beacon, blockNumber, entry.Index)
+
+		case adminChangedTopic:
+			proxy, isFound := watched[entry.Address]
+			if !isFound || blockNumber <= proxy.LastBlock || len(entry.Data) < 64 {
+				continue
+			}
+			admin := common.BytesToAddress(entry.Data[32:64]) // previousAdmin, newAdmin
+			proxy.Admin = admin.Bytes()
+			record(proxy, EventAdminChanged, admin, blockNumber, entry.Index)
+		}
+	}
+
+	// the events and the new state in one transaction, a failed poll is read again
+	err = f.db.Transaction(func(tx *gorm.DB) error {
+		if len(upgrades) > 0 {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&upgrades).Error; err != nil {
+				f.log.Error("Fail to create the ProxyUpgrade items")
+				return err
+			}
+		}
+		for _, proxy := range proxies {
+			if proxy.LastBlock < toBlock {
+				proxy.LastBlock = toBlock
+			}
+			// update only, an unwatched proxy is not created again
+			err := tx.Model(&myDB.WatchedProxy{}).Where("chain_id = ? AND proxy_address = ?", chainID, proxy.ProxyAddress).
+				Select("*").Omit("chain_id", "proxy_address", "watched_at").Updates(&proxy).Error
+			if err != nil {
+				f.log.Error("Fail to update the WatchedProxy item")
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return newError(ErrStorage, chainID, common.Address{}, err)
+	}
+
+	for proxyAddress, implementation := range changed {
+		f.log.Info("The proxy is upgraded. ChainID:", chainID, " proxyAddress:", proxyAddress, " implementation:", implementation)
+		f.invalidate(chainID, proxyAddress)
+		f.queueImplementation(chainID, implementation)
+	}
+	return f.bindImplementations(chainID)
+}
+
+// @dev Bind the watched proxies of the chain to the ABIs of their implementations which are stored, from the block of
+// the upgrade. [ContractDeployment] [ABIVersion]
+func (f *Fetcher) bindImplementations(chainID int) error {
+	var proxies []myDB.WatchedProxy
+	if err := f.db.Where("chain_id = ? AND is_bound = ?", chainID, false).Find(&proxies).Error; err != nil {
+		f.log.Error("Fail to read the WatchedProxy items")
+		return newError(ErrStorage, chainID, common.Address{}, err)
+	}
+	for _, proxy := range proxies {
+		if len(proxy.Implementation) == 0 {
+			continue
+		}
+		proxyAddress, implementation := common.BytesToAddress(proxy.ProxyAddress), common.BytesToAddress(proxy.Implementation)
+		contractBytecode, isFound, err := f.implementationBytecode(chainID, implementation)
+		if err != nil {
+			return newError(ErrStorage, chainID, implementation, err)
+		}
+		if !isFound {
+			continue // the robot has not stored it yet
+		}
+
+		f.mu.Lock()
+		err = f.storeDeployment(chainID, proxyAddress, contractBytecode, proxy.ImplementationBlock, proxy.ImplementationBlock)
+		f.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		// unless it is upgraded meanwhile
+		err = f.db.Model(&myDB.WatchedProxy{}).
+			Where("chain_id = ? AND proxy_address = ? AND implementation = ?", chainID, proxy.ProxyAddress, proxy.Implementation).
+			Update("is_bound", true).Error
+		if err != nil {
+			return newError(ErrStorage, chainID, proxyAddress, err)
+		}
+		f.log.Info("Bind the proxy to its implementation. ChainID:", chainID, " proxyAddress:", proxyAddress, " implementation:", implementation, " fromBlock:", proxy.ImplementationBlock)
+	}
+	return nil
+}
+
+// @dev Whether chainID+contractAddress is a watched proxy, false if the DB fails
+func (f *Fetcher) isWatchedProxy(chainID int, contractAddress common.Address) bool {
+	var count int64
+	err := f.db.Model(&myDB.WatchedProxy{}).Where("chain_id = ? AND proxy_address = ?", chainID, contractAddress.Bytes()).Count(&count).Error
+	if err != nil {
+		f.log.Warning("Fail to read the WatchedProxy items. ChainID:", chainID, " contractAddress:", contractAddress, " Err:", err)
+		return false
+	}
+	return count > 0
+}
+
+// @dev Queue the implementation for the robot, unless its ABI is stored
+func (f *Fetcher) queueImplementation(chainID int, implementation common.Address) {
+	if _, isFound, err := f.implementationBytecode(chainID, implementation); err != nil || isFound {
+		return
+	}
+	if err := f.queueAddress(WithRequester(context.Background(), Requester{Tag: TagUpgradeWatcher}), chainID, implementation); err != nil && !errors.Is(err, ErrQueued) {
+		f.log.Warning("Fail to queue the implementation. ChainID:", chainID, " implementation:", implementation, " Err:", err)
+	}
+}
+
+// @dev The latest bytecode with an ABI deployed at the implementation
+func (f *Fetcher) implementationBytecode(chainID int, implementation common.Address) (myDB.ContractBytecode, bool, error) {
+	var contractBytecode myDB.ContractBytecode
+	err := f.db.Model(&myDB.ContractBytecode{}).Select("contract_bytecodes.*").
+		Joins("JOIN contract_deployments ON contract_deployments.contract_bytecode_id = contract_bytecodes.id").
+		Where("contract_deployments.chain_id = ? AND contract_deployments.contract_address = ? AND contract_bytecodes.contract_abi <> ''", chainID, implementation.Bytes()).
+		Order("contract_deployments.from_block DESC").Limit(1).Find(&contractBytecode).Error
+	return contractBytecode, contractBytecode.ID != uuid.Nil, err
+}
+
+// @dev The implementation of a beacon at the block, implementation()
+func (f *Fetcher) beaconImplementation(ctx context.Context, node LogReader, chainID int, beacon common.Address, block *big.Int) (common.Address, error) {
+	output, err := node.CallContract(ctx, ethereum.CallMsg{To: &beacon, Data: implementationSelector}, block)
+	if err == nil && len(output) < 32 {
+		err = errors.New("Invalid implementation() of the beacon")
+	}
+	if err != nil {
+		f.log.Error("Fail to read the implementation of the beacon. ChainID:", chainID, " beacon:", beacon)
+		return common.Address{}, newError(ErrNode, chainID, beacon, err)
+	}
+	return common.BytesToAddress(output[:32]), nil
+}
+
+// @dev The node of the chain which reads the logs, the node of the other chains if it has none
+func (f *Fetcher) logReader(chainID int, contractAddress common.Address) (LogReader, error) {
+	node, found := f.nodes[chainID]
+	if !found {
+		node, found = f.nodes[0]
+	}
+	reader, ok := node.(LogReader)
+	if !found || !ok {
+		f.log.Error("No node reading the logs of the chain. ChainID:", chainID)
+		return nil, newError(ErrNode, chainID, contractAddress, errors.New("No node reading the logs of the chain"))
+	}
+	return reader, nil
+}
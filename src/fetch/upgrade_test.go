@@ -0,0 +1,292 @@
+package fetch
+
+import (
+	myCache "code/src/cache"
+	myDB "code/src/db"
+	"context"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLogNode
+// @dev A node serving the code of addressesWithCode, and the logs, slots and beacons set by the test
+type fakeLogNode struct {
+	mu       sync.Mutex
+	head     uint64
+	logs     []types.Log
+	slots    map[common.Address]map[common.Hash]common.Address
+	beacons  map[common.Address]common.Address // beacon => implementation
+	queries  []ethereum.FilterQuery
+	contract map[common.Address]bool
+}
+
+func (n *fakeLogNode) CodeAt(ctx context.Context, contractAddress common.Address, blockNumber *big.Int) ([]byte, error) {
+	if addressesWithCode[contractAddress] || n.contract[contractAddress] {
+		return []byte{0x60, 0x80, 0x60, 0x40, 0x52}, nil
+	}
+	return nil, nil
+}
+
+func (n *fakeLogNode) BlockNumber(ctx context.Context) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.head, nil
+}
+
+func (n *fakeLogNode) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.queries = append(n.queries, query)
+	var logs []types.Log
+	for _, entry := range n.logs {
+		if entry.BlockNumber < query.FromBlock.Uint64() || entry.BlockNumber > query.ToBlock.Uint64() {
+			continue
+		}
+		for _, address := range query.Addresses {
+			if address == entry.Address {
+				logs = append(logs, entry)
+				break
+			}
+		}
+	}
+	return logs, nil
+}
+
+func (n *fakeLogNode) StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error) {
+	return common.BytesToHash(n.slots[account][key].Bytes()).Bytes(), nil
+}
+
+func (n *fakeLogNode) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return common.BytesToHash(n.beacons[*call.To].Bytes()).Bytes(), nil
+}
+
+// @dev Add a log of the event
+func (n *fakeLogNode) emit(address common.Address, blockNumber uint64, topics []common.Hash, data []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.logs = append(n.logs, types.Log{Address: address, BlockNumber: blockNumber, Index: uint(len(n.logs)), Topics: topics, Data: data})
+}
+
+// Test following the upgrades of the proxies: the slots, the events, the beacons and the binding of the ABIs
+func TestUpgradeWatcher(t *testing.T) {
+	ctx := context.Background()
+	proxy := common.HexToAddress("0x00000000000000000000000000000000000b4501")
+	beaconProxy := common.HexToAddress("0x00000000000000000000000000000000000b4502")
+	beacon := common.HexToAddress("0x00000000000000000000000000000000000b4503")
+	implementation2 := common.HexToAddress("0x00000000000000000000000000000000000b4504")
+	implementation3 := common.HexToAddress("0x00000000000000000000000000000000000b4505")
+	admin1, admin2 := common.HexToAddress("0x00000000000000000000000000000000000ad001"), common.HexToAddress("0x00000000000000000000000000000000000ad002")
+	node := &fakeLogNode{
+		head: 100,
+		slots: map[common.Address]map[common.Hash]common.Address{
+			proxy:       {implementationSlot: verifiedAddress, adminSlot: admin1},
+			beaconProxy: {beaconSlot: beacon},
+		},
+		beacons:  map[common.Address]common.Address{beacon: implementation2},
+		contract: map[common.Address]bool{implementation3: true},
+	}
+	fetcher := useFakeUpstream(t, WithNode(0, node))
+
+	// not a proxy
+	_, err := fetcher.WatchProxy(ctx, 1, implementation2)
+	assert.ErrorIs(t, err, ErrNotProxy)
+
+	// the implementation is queued, then bound once the robot stores it
+	watched, err := fetcher.WatchProxy(ctx, 1, proxy)
+	assert.NoError(t, err)
+	assert.Equal(t, verifiedAddress.Bytes(), watched.Implementation)
+	assert.Equal(t, admin1.Bytes(), watched.Admin)
+	assert.Equal(t, int64(100), watched.LastBlock)
+	assert.False(t, watched.IsBound)
+	var search myDB.SearchEtherscan
+	assert.NoError(t, fetcher.db.Where("chain_id = ? AND contract_address = ?", 1, verifiedAddress.Bytes()).First(&search).Error)
+	assert.True(t, search.ShouldSearch)
+	assert.NoError(t, fetcher.SearchInEtherscan())
+	assert.NoError(t, fetcher.PollUpgrades(ctx))
+	method, err := fetcher.GetFunctionABIAtBlock(1, proxy, signature1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "name", method.Name)
+
+	// upgraded to an implementation already stored: bound at the block of the upgrade
+	decimalsABI := `[{"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"stateMutability":"view","type":"function"}]`
+	decimals := myDB.ContractBytecode{ID: myDB.NewContractBytecodeID([]byte{0x60, 0x02}, decimalsABI), Bytecode: []byte{0x60, 0x02}, ContractABI: decimalsABI}
+	assert.NoError(t, fetcher.storeDeployment(1, implementation2, decimals, 0, 0))
+	node.emit(proxy, 150, []common.Hash{upgradedTopic, common.BytesToHash(implementation2.Bytes())}, nil)
+	node.emit(proxy, 160, []common.Hash{adminChangedTopic}, append(common.BytesToHash(admin1.Bytes()).Bytes(), common.BytesToHash(admin2.Bytes()).Bytes()...))
+	node.head = 200
+	assert.NoError(t, fetcher.PollUpgrades(ctx))
+	// polled again: nothing new
+	assert.NoError(t, fetcher.PollUpgrades(ctx))
+
+	upgrades, err := fetcher.ProxyUpgrades(1, proxy)
+	assert.NoError(t, err)
+	if assert.Len(t, upgrades, 2) {
+		assert.Equal(t, EventUpgraded, upgrades[0].Event)
+		assert.Equal(t, int64(150), upgrades[0].BlockNumber)
+		assert.Equal(t, implementation2.Bytes(), upgrades[0].Address)
+		assert.Equal(t, EventAdminChanged, upgrades[1].Event)
+		assert.Equal(t, admin2.Bytes(), upgrades[1].Address)
+		assert.Equal(t, implementation2.Bytes(), upgrades[1].Implementation)
+	}
+	method, err = fetcher.GetFunctionABIAtBlock(1, proxy, signature2, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "decimals", method.Name)
+	var deployments []myDB.ContractDeployment
+	assert.NoError(t, fetcher.db.Where("chain_id = ? AND contract_address = ?", 1, proxy.Bytes()).Order("from_block ASC").Find(&deployments).Error)
+	if assert.Len(t, deployments, 2) {
+		assert.Equal(t, int64(100), deployments[0].FromBlock)
+		assert.Equal(t, int64(150), deployments[1].FromBlock)
+		assert.Equal(t, decimals.ID, deployments[1].ContractBytecodeID)
+	}
+	versions, err := fetcher.ABIHistory(1, proxy)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	// a beacon proxy follows the upgrades of its beacon
+	watched, err = fetcher.WatchProxy(ctx, 1, beaconProxy)
+	assert.NoError(t, err)
+	assert.Equal(t, implementation2.Bytes(), watched.Implementation)
+	assert.Equal(t, beacon.Bytes(), watched.Beacon)
+	proxies, err := fetcher.WatchedProxies(1)
+	assert.NoError(t, err)
+	if assert.Len(t, proxies, 2) {
+		assert.True(t, proxies[1].IsBound)
+	}
+	node.emit(beacon, 250, []common.Hash{upgradedTopic, common.BytesToHash(implementation3.Bytes())}, nil)
+	node.head = 300
+	assert.NoError(t, fetcher.PollUpgrades(ctx))
+	assert.Contains(t, node.queries[len(node.queries)-1].Addresses, beacon)
+	proxies, err = fetcher.WatchedProxies(1)
+	assert.NoError(t, err)
+	if assert.Len(t, proxies, 2) {
+		assert.Equal(t, implementation3.Bytes(), proxies[1].Implementation)
+		assert.Equal(t, int64(250), proxies[1].ImplementationBlock)
+		assert.Equal(t, int64(300), proxies[1].LastBlock)
+		assert.False(t, proxies[1].IsBound)
+		assert.Equal(t, int64(300), proxies[0].LastBlock)
+	}
+	var queued myDB.SearchEtherscan
+	assert.NoError(t, fetcher.db.Where("chain_id = ? AND contract_address = ?", 1, implementation3.Bytes()).First(&queued).Error)
+	assert.True(t, queued.ShouldSearch)
+
+	// the long ranges are read over several polls
+	node.head = 300 + 2*maxLogRange
+	assert.NoError(t, fetcher.PollUpgrades(ctx))
+	query := node.queries[len(node.queries)-1]
+	assert.Equal(t, int64(301), query.FromBlock.Int64())
+	assert.Equal(t, int64(300+maxLogRange), query.ToBlock.Int64())
+
+	isWatched, err := fetcher.UnwatchProxy(1, beaconProxy)
+	assert.NoError(t, err)
+	assert.True(t, isWatched)
+	assert.NoError(t, fetcher.PollUpgrades(ctx))
+	proxies, err = fetcher.WatchedProxies(0)
+	assert.NoError(t, err)
+	assert.Len(t, proxies, 1)
+}
+
+// Test the lookups at the blocks of a proxy upgraded twice: the ABI of the deployment at the block, and the functions
+// of the proxy itself at every block
+func TestLookupAtBlock(t *testing.T) {
+	fetcher := useFakeUpstream(t)
+	proxy := common.HexToAddress("0x00000000000000000000000000000000000b4506")
+	proxyABI := `[{"inputs":[{"name":"newImplementation","type":"address"}],"name":"upgradeTo","outputs":[],"stateMutability":"nonpayable","type":"function"},` +
+		`{"inputs":[],"name":"admin","outputs":[{"name":"","type":"address"}],"stateMutability":"view","type":"function"}]`
+	decimalsABI := `[{"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"stateMutability":"view","type":"function"}]`
+	for _, deployment := range []struct {
+		fromBlock   int64
+		bytecode    []byte
+		contractABI string
+	}{
+		{0, []byte{0x60, 0x03}, proxyABI},
+		{100, []byte{0x60, 0x01}, verifiedContractABI},
+		{150, []byte{0x60, 0x02}, decimalsABI},
+	} {
+		contractBytecode := myDB.ContractBytecode{
+			ID:          myDB.NewContractBytecodeID(deployment.bytecode, deployment.contractABI),
+			Bytecode:    deployment.bytecode,
+			ContractABI: deployment.contractABI,
+		}
+		assert.NoError(t, fetcher.storeDeployment(1, proxy, contractBytecode, deployment.fromBlock, deployment.fromBlock))
+	}
+	var functionSignatures int64
+	fetcher.db.Model(&myDB.FunctionSignature{}).Where("chain_id = ? AND contract_address = ?", 1, proxy.Bytes()).Count(&functionSignatures)
+	assert.Equal(t, int64(4), functionSignatures)
+
+	// the deployment at the block, from the DB then from memory
+	for i := 0; i < 2; i++ {
+		contractABI, err := fetcher.GetContractABIAtBlock(1, proxy, big.NewInt(50))
+		assert.NoError(t, err)
+		assert.Contains(t, contractABI.Methods, "upgradeTo")
+		contractABI, err = fetcher.GetContractABIAtBlock(1, proxy, big.NewInt(120))
+		assert.NoError(t, err)
+		assert.Contains(t, contractABI.Methods, "name")
+		assert.NotContains(t, contractABI.Methods, "decimals")
+		contractABI, err = fetcher.GetContractABIAtBlock(1, proxy, nil)
+		assert.NoError(t, err)
+		assert.Contains(t, contractABI.Methods, "decimals")
+
+		method, err := fetcher.GetFunctionABIAtBlock(1, proxy, signature1, big.NewInt(149))
+		assert.NoError(t, err)
+		assert.Equal(t, "name", method.Name)
+		method, err = fetcher.GetFunctionABIAtBlock(1, proxy, signature2, big.NewInt(150))
+		assert.NoError(t, err)
+		assert.Equal(t, "decimals", method.Name)
+	}
+
+	// the functions of the proxy decode before and after the upgrades
+	parsed, err := abi.JSON(strings.NewReader(proxyABI))
+	assert.NoError(t, err)
+	for _, name := range []string{"upgradeTo", "admin"} {
+		var sig [4]byte
+		copy(sig[:], parsed.Methods[name].ID)
+		for _, block := range []*big.Int{big.NewInt(0), big.NewInt(120), nil} {
+			method, err := fetcher.GetFunctionABIAtBlock(1, proxy, sig, block)
+			if assert.NoError(t, err) {
+				assert.Equal(t, name, method.Name)
+			}
+		}
+	}
+}
+
+// Test the proxy TTL: the ABIs of a watched proxy expire from memory, the others are kept
+func TestProxyTTL(t *testing.T) {
+	now := time.Now()
+	memory := myCache.NewABICache(myCache.WithClock(func() time.Time { return now }))
+	fetcher := useFakeUpstream(t, WithCache(memory), WithProxyTTL(time.Minute))
+	proxy := common.HexToAddress("0x00000000000000000000000000000000000b4507")
+	other := common.HexToAddress("0x00000000000000000000000000000000000b4508")
+	assert.NoError(t, fetcher.db.Create(&myDB.WatchedProxy{ChainID: 1, ProxyAddress: proxy.Bytes(), IsBound: true}).Error)
+	contractBytecode := myDB.ContractBytecode{
+		ID:          myDB.NewContractBytecodeID([]byte{0x60, 0x04}, verifiedContractABI),
+		Bytecode:    []byte{0x60, 0x04},
+		ContractABI: verifiedContractABI,
+	}
+	for _, address := range []common.Address{proxy, other} {
+		assert.NoError(t, fetcher.storeDeployment(1, address, contractBytecode, 0, 0))
+		_, err := fetcher.GetContractABIAtBlock(1, address, nil)
+		assert.NoError(t, err)
+		_, err = fetcher.GetFunctionABIAtBlock(1, address, signature1, nil)
+		assert.NoError(t, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	_, _, isFound := memory.GetAt(myCache.ContractKey(1, proxy))
+	assert.False(t, isFound)
+	_, _, isFound = memory.GetAt(myCache.SelectorKey(1, proxy, signature1))
+	assert.False(t, isFound)
+	_, _, isFound = memory.GetAt(myCache.ContractKey(1, other))
+	assert.True(t, isFound)
+	_, _, isFound = memory.GetAt(myCache.SelectorKey(1, other, signature1))
+	assert.True(t, isFound)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	myDB "code/src/db"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+)
+
+// @dev db migrate|version|dedup [-dsn <DSN>] [-dry-run]
+// Notice: the DSN defaults to DB_PATH or ABIs.db, like the other commands. dedup merges the duplicate keys of the older
+// versions, which the migration of the keys refuses, then migrates
+func runDB(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: db migrate|version|dedup [-dsn <DSN>] [-dry-run]")
+	}
+
+	flags := flag.NewFlagSet("db "+args[0], flag.ExitOnError)
+	dsn := flags.String("dsn", os.Getenv("DB_PATH"), "the SQLite3 file or the Postgres DSN, default: DB_PATH or ABIs.db")
+	dryRun := flags.Bool("dry-run", false, "dedup: only count the duplicates")
+	_ = flags.Parse(args[1:])
+	if *dsn == "" {
+		*dsn = "ABIs.db"
+	}
+
+	switch args[0] {
+	case "migrate":
+		_, err := myDB.Open(*dsn, myDB.WithAutoMigrate(false))
+		if err == nil {
+			fmt.Println("Already at version", myDB.LatestVersion())
+			return nil
+		}
+		if !errors.Is(err, myDB.ErrSchemaOutdated) {
+			return err
+		}
+		if _, err = myDB.Open(*dsn); err != nil {
+			return err
+		}
+		fmt.Println("Migrated to version", myDB.LatestVersion())
+
+	case "version":
+		fmt.Println("Binary version:", myDB.LatestVersion())
+		_, err := myDB.Open(*dsn, myDB.WithAutoMigrate(false))
+		if errors.Is(err, myDB.ErrSchemaOutdated) {
+			fmt.Println(err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("Database version:", myDB.LatestVersion())
+
+	case "dedup":
+		db, err := myDB.Open(*dsn, myDB.WithoutSchemaCheck())
+		if err != nil {
+			return err
+		}
+		if !*dryRun {
+			// apply the migrations before the keys, the duplicates stop the one of the keys
+			if _, err = myDB.Migrate(db); err == nil {
+				fmt.Println("No duplicates, at version", myDB.LatestVersion())
+				return nil
+			}
+			if !errors.Is(err, myDB.ErrDuplicates) {
+				return err
+			}
+		}
+		report, err := myDB.Dedup(db, *dryRun)
+		if err != nil {
+			return err
+		}
+		fmt.Println(report)
+		if *dryRun {
+			return nil
+		}
+		if _, err = myDB.Migrate(db); err != nil {
+			return err
+		}
+		fmt.Println("Migrated to version", myDB.LatestVersion())
+
+	default:
+		return errors.New("Unknown db command: " + args[0])
+	}
+	return nil
+}
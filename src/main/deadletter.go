@@ -0,0 +1,85 @@
+package main
+
+import (
+	"code/src/fetch"
+	"flag"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// @dev deadletter list|inspect|requeue|discard [-chain <chainID>] [-address <contractAddress>] [-limit 20]
+// Notice: the robot dead-letters an address after the failed searches of its retry budget, E.g. the node is down
+func runDeadLetter(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: deadletter list|inspect|requeue|discard [-chain <chainID>] [-address <contractAddress>] [-limit 20]")
+	}
+
+	flags := flag.NewFlagSet("deadletter "+args[0], flag.ExitOnError)
+	chainID := flags.Int("chain", 0, "the chainID, list: 0 for every chain")
+	address := flags.String("address", "", "inspect, requeue, discard: the dead-lettered address")
+	limit := flags.Int("limit", 20, "list, inspect: the number of addresses or attempts, 0: all")
+	_ = flags.Parse(args[1:])
+
+	if args[0] == "list" {
+		deadLetters, err := fetch.DeadLetters(*chainID, *limit)
+		if err != nil {
+			return err
+		}
+		for _, item := range deadLetters {
+			fmt.Printf("%d\t%s\tdead-lettered %s\t%d failures\t%s\n", item.ChainID, common.BytesToAddress(item.ContractAddress).Hex(),
+				formatTime(item.DeadLetteredAt), item.Failures, item.LastError)
+		}
+		return nil
+	}
+
+	if args[0] != "inspect" && args[0] != "requeue" && args[0] != "discard" {
+		return errors.New("Unknown deadletter command: " + args[0])
+	}
+	if *chainID == 0 {
+		return errors.New(args[0] + " needs -chain")
+	}
+	if !common.IsHexAddress(*address) {
+		return errors.New("Invalid contract address: " + *address)
+	}
+	contractAddress := common.HexToAddress(*address)
+	switch args[0] {
+	case "inspect":
+		attempts, err := fetch.CrawlAttempts(*chainID, contractAddress, *limit)
+		if err != nil {
+			return err
+		}
+		for _, attempt := range attempts {
+			fmt.Printf("%s\t%s\t%s\t%dms\t%s\n", formatTime(attempt.AttemptedAt), attempt.Outcome, attempt.ErrorClass, attempt.DurationMs, attempt.Message)
+		}
+
+	case "requeue":
+		isRequeued, err := fetch.RequeueDeadLetter(*chainID, contractAddress)
+		if err != nil {
+			return err
+		}
+		if !isRequeued {
+			fmt.Println("Not dead-lettered:", contractAddress.Hex(), "on chain", *chainID)
+			return nil
+		}
+		fmt.Println("Requeued", contractAddress.Hex(), "on chain", *chainID)
+
+	case "discard":
+		isDiscarded, err := fetch.DiscardDeadLetter(*chainID, contractAddress)
+		if err != nil {
+			return err
+		}
+		if !isDiscarded {
+			fmt.Println("Not dead-lettered:", contractAddress.Hex(), "on chain", *chainID)
+			return nil
+		}
+		fmt.Println("Discarded", contractAddress.Hex(), "on chain", *chainID)
+	}
+	return nil
+}
+
+// @dev UNIX timestamp => RFC3339 in UTC
+func formatTime(timestamp int) string {
+	return time.Unix(int64(timestamp), 0).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"code/src/fetch"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// @dev follow -chain <chainID> [-from N] [-every 12s] [-once]
+// Notice: the contracts created in the new blocks are queued for the robot, searched after the discovery delay
+// Notice: without -from the first round starts at the newest block, the next runs go on from the last block read
+func runFollow(args []string) error {
+	flags := flag.NewFlagSet("follow", flag.ExitOnError)
+	chainID := flags.Int("chain", 1, "the chainID")
+	from := flags.Int64("from", -1, "the first block to read, -1: go on from the last block read")
+	every := flags.Duration("every", 12*time.Second, "how often to read the new blocks")
+	once := flags.Bool("once", false, "read the new blocks once and exit, E.g. from a cron job")
+	_ = flags.Parse(args)
+
+	fetcher := fetch.Default()
+	if *from >= 0 {
+		if err := fetcher.SetChainCursor(*chainID, *from-1); err != nil {
+			return err
+		}
+	}
+	if *once {
+		queued, err := fetcher.DiscoverContracts(context.Background(), *chainID)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Queued", queued, "new contracts on chain", *chainID)
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Println("Follow the blocks of chain", *chainID, "every", *every)
+	fetcher.FollowBlocks(ctx, *chainID, *every)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"code/src/fetch"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// @dev get -chain <chainID> -address <contractAddress> [-selector 0xa9059cbb] [-block N] [-policy cache|db|fetch] [-timeout 30s]
+// Notice: the exit code tells why it fails, see exitCodes
+func runGet(args []string) error {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	chainID := flags.Int("chain", 1, "the chainID")
+	address := flags.String("address", "", "the contract address")
+	selector := flags.String("selector", "", "the 4 bytes function selector, empty: the whole contract ABI")
+	block := flags.Int64("block", -1, "the block number, -1: the latest block")
+	policyName := flags.String("policy", "db", "cache: memory only, db: memory and DB, fetch: also search the explorer now")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long to wait for -policy fetch")
+	_ = flags.Parse(args)
+
+	policy, err := fetch.ParsePolicy(*policyName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	ctx = fetch.WithRequester(ctx, fetch.Requester{Tag: "cli", Interactive: true})
+
+	if !common.IsHexAddress(*address) {
+		return errors.New("Invalid contract address: " + *address)
+	}
+	contractAddress := common.HexToAddress(*address)
+
+	var data []byte
+	if *selector == "" {
+		contractABI, err := fetch.GetContractABIAtBlockContext(ctx, *chainID, contractAddress, optionalBlock(*block), policy)
+		if err != nil {
+			return err
+		}
+		if data, err = fetch.MarshalABI(contractABI); err != nil {
+			return err
+		}
+	} else {
+		sig, err := hexutil.Decode(*selector)
+		if err != nil || len(sig) != 4 {
+			return errors.New("Invalid selector: " + *selector)
+		}
+		var sig4bytes [4]byte
+		copy(sig4bytes[:], sig)
+		functionABI, err := fetch.GetFunctionABIAtBlockContext(ctx, *chainID, contractAddress, sig4bytes, optionalBlock(*block), policy)
+		if err != nil {
+			return err
+		}
+		if data, err = fetch.MarshalMethod(functionABI); err != nil {
+			return err
+		}
+	}
+	fmt.Println(string(data))
+	return nil
+}
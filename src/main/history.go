@@ -0,0 +1,72 @@
+package main
+
+import (
+	"code/src/fetch"
+	"flag"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// @dev history list|diff -chain <chainID> -address <contractAddress> [-from V -to V | -from-block N -to-block N]
+// Notice: diff compares the last upgrade by default, the blocks select the versions seen up to them
+func runHistory(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: history list|diff -chain <chainID> -address <contractAddress> [-from V -to V | -from-block N -to-block N]")
+	}
+
+	flags := flag.NewFlagSet("history "+args[0], flag.ExitOnError)
+	chainID := flags.Int("chain", 1, "the chainID")
+	address := flags.String("address", "", "the contract address")
+	from := flags.Int("from", 0, "diff: the older version, default: the one before -to")
+	to := flags.Int("to", 0, "diff: the newer version, default: the latest one")
+	fromBlock := flags.Int64("from-block", -1, "diff: the older version is the one seen up to this block")
+	toBlock := flags.Int64("to-block", -1, "diff: the newer version is the one seen up to this block, default: the latest one")
+	_ = flags.Parse(args[1:])
+
+	if !common.IsHexAddress(*address) {
+		return errors.New("Invalid contract address: " + *address)
+	}
+	contractAddress := common.HexToAddress(*address)
+
+	switch args[0] {
+	case "list":
+		versions, err := fetch.ABIHistory(*chainID, contractAddress)
+		if err != nil {
+			return err
+		}
+		for _, version := range versions {
+			fmt.Printf("%d\tblock %d\tbytecode %s\tseen at %s\n", version.Version, version.BlockNumber, version.ContractBytecodeID,
+				time.Unix(int64(version.SeenAt), 0).UTC().Format(time.RFC3339))
+		}
+
+	case "diff":
+		var diff *fetch.ABIDiff
+		var err error
+		if *fromBlock >= 0 || *toBlock >= 0 {
+			diff, err = fetch.DiffABIAtBlocks(*chainID, contractAddress, optionalBlock(*fromBlock), optionalBlock(*toBlock))
+		} else {
+			diff, err = fetch.DiffABIVersions(*chainID, contractAddress, *from, *to)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Version %d => %d: %d changes\n", diff.From, diff.To, len(diff.Changes))
+		for _, change := range diff.Changes {
+			signature := change.Signature
+			if change.Previous != "" {
+				signature = change.Previous + " => " + change.Signature
+			}
+			fmt.Printf("%s\t%s\t%s\n", change.Change, change.Kind, signature)
+			if len(change.Details) > 0 {
+				fmt.Println("\t" + strings.Join(change.Details, "\n\t"))
+			}
+		}
+
+	default:
+		return errors.New("Unknown history command: " + args[0])
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"code/src/fetch"
+	"flag"
+	"fmt"
+)
+
+// @dev import -dir <project> [-bind]
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dir := flags.String("dir", ".", "the project directory containing out/, artifacts/, deployments/ or build/contracts/")
+	bind := flags.Bool("bind", false, "bind the artifacts to the addresses in broadcast logs and deployments")
+	_ = flags.Parse(args)
+
+	count, err := fetch.ImportArtifacts(*dir, *bind)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Imported", count, "artifacts from", *dir)
+	return nil
+}
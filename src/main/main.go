@@ -1,7 +1,99 @@
 package main
 
-import "fmt"
+import (
+	"code/src/fetch"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command
+// @dev A sub command of the CLI
+type command struct {
+	usage string                    // shown by `help`
+	run   func(args []string) error // args: the arguments after the sub command
+}
+
+var commands = map[string]command{
+	"db":         {usage: "db migrate|version|dedup [-dsn <DSN>] [-dry-run]    apply the schema migrations, compare the versions of the database and the binary, or merge the duplicate keys", run: runDB},
+	"deadletter": {usage: "deadletter list|inspect|requeue|discard [-chain <chainID>] [-address <contractAddress>] [-limit 20]    the addresses the robot stops searching after their retry budget, and their crawl attempts", run: runDeadLetter},
+	"follow":     {usage: "follow -chain <chainID> [-from N] [-every 12s] [-once]    queue the contracts created in the new blocks", run: runFollow},
+	"get":        {usage: "get -chain <chainID> -address <contractAddress> [-selector 0xa9059cbb] [-block N] [-policy cache|db|fetch] [-timeout 30s]    print the contract or function ABI", run: runGet},
+	"history":    {usage: "history list|diff -chain <chainID> -address <contractAddress> [-from V -to V | -from-block N -to-block N]    the ABI versions of the address and the changes between two of them", run: runHistory},
+	"import":     {usage: "import -dir <project> [-bind]    register the artifacts of a Foundry/Hardhat/Truffle project", run: runImport},
+	"override":   {usage: "override set|revert|list -chain <chainID> -address <contractAddress> [-abi <file>] [-from <block>] [-to <block>] [-by <name>]", run: runOverride},
+	"prefetch":   {usage: "prefetch -chain <chainID> [-file <stream.jsonl>|-] [-subscribe] [-flush-every 1m]    queue the addresses of a stream of transactions or logs, the frequent ones first", run: runPrefetch},
+	"proxy":      {usage: "proxy watch|unwatch|list|upgrades|poll -chain <chainID> -address <proxyAddress>    follow the upgrades of an EIP-1967 proxy", run: runProxy},
+	"queue":      {usage: "queue list|boost|reschedule -chain <chainID> [-address <contractAddress>] [-priority 100] [-limit 20] [-status unverified]    the addresses waiting for the robot, by priority then age, and the re-checks of the ones without ABI", run: runQueue},
+	"serve":      {usage: "serve [-addr :8080] [-snapshot cache.snapshot.json] [-snapshot-every 5m] [-prewarm 1000] [-watch-every 1m]    run the REST API and the upgrade watcher, prewarm and snapshot the cache, the admin API requires ADMIN_TOKEN", run: runServe},
+}
 
 func main() {
-	fmt.Println("Hello, D23E:)")
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	cmd, found := commands[os.Args[1]]
+	if !found {
+		printUsage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		if retryAfter, ok := fetch.RetryAfter(err); ok {
+			fmt.Fprintln(os.Stderr, "Retry after:", retryAfter)
+		}
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCodes
+// @dev The kind of the fetch error => exit code, 1: the other errors, 2: bad usage
+var exitCodes = []struct {
+	kind error
+	code int
+}{
+	{fetch.ErrQueued, 3},              // try later
+	{fetch.ErrNotCached, 4},           // -policy cache
+	{fetch.ErrUnknownSelector, 4},     // the contract is known, the function is not
+	{fetch.ErrNoCode, 4},              // EOA
+	{fetch.ErrSelfDestructed, 4},      // self-destructed and not verified
+	{fetch.ErrNotVerified, 4},         // not verified
+	{fetch.ErrUnsupportedChain, 5},    // bad chainID
+	{fetch.ErrUpstreamRateLimited, 6}, // the explorer is rate limited
+	{fetch.ErrExplorer, 6},            // the explorer returns an error
+	{fetch.ErrNode, 6},                // the node returns an error
+	{fetch.ErrCorruptABI, 7},          // the stored ABI is broken
+	{fetch.ErrStorage, 8},             // DB is broken
+	{fetch.ErrUnknownVersion, 4},      // not in the ABI history
+	{fetch.ErrNotProxy, 4},            // no EIP-1967 slot set
+	{fetch.ErrDeadLettered, 9},        // the searches keep failing, see `deadletter`
+}
+
+// @dev error => exit code
+func exitCode(err error) int {
+	for _, item := range exitCodes {
+		if errors.Is(err, item.kind) {
+			return item.code
+		}
+	}
+	return 1
+}
+
+// @dev Print the usage of all sub commands
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Usage: abi-fetcher <command> [flags]")
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "Exit codes: 1 other errors, 2 bad usage, 3 queued(try later), 4 no ABI(EOA, not verified, unknown selector...), "+
+		"5 unsupported chain, 6 the explorer or the node fails, 7 corrupt ABI, 8 database, 9 dead-lettered")
 }
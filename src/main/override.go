@@ -0,0 +1,94 @@
+package main
+
+import (
+	"code/src/fetch"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"math/big"
+	"os"
+	"os/user"
+	"time"
+)
+
+// @dev override set|revert|list -chain <chainID> -address <contractAddress>
+func runOverride(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: override set|revert|list -chain <chainID> -address <contractAddress>")
+	}
+
+	flags := flag.NewFlagSet("override "+args[0], flag.ExitOnError)
+	chainID := flags.Int("chain", 1, "the chainID")
+	address := flags.String("address", "", "the contract address")
+	abiFile := flags.String("abi", "", "set: the ABI JSON file")
+	fromBlock := flags.Int64("from", -1, "set: the first block the override applies to")
+	toBlock := flags.Int64("to", -1, "set: the last block the override applies to")
+	by := flags.String("by", currentUser(), "who sets or reverts the override")
+	_ = flags.Parse(args[1:])
+
+	if !common.IsHexAddress(*address) {
+		return errors.New("Invalid contract address: " + *address)
+	}
+	contractAddress := common.HexToAddress(*address)
+
+	switch args[0] {
+	case "set":
+		content, err := os.ReadFile(*abiFile)
+		if err != nil {
+			return errors.Wrap(err, "Fail to read the ABI file")
+		}
+		record, err := fetch.SetABIOverride(*chainID, contractAddress, string(content), optionalBlock(*fromBlock), optionalBlock(*toBlock), *by)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Set the override", record.ID, "for", contractAddress.Hex(), "on chain", *chainID)
+
+	case "revert":
+		count, err := fetch.RevertABIOverride(*chainID, contractAddress, *by)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Reverted", count, "overrides for", contractAddress.Hex(), "on chain", *chainID)
+
+	case "list":
+		records, err := fetch.ListABIOverrides(*chainID, contractAddress)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			status := "active"
+			if !record.Active {
+				status = fmt.Sprintf("reverted by %s at %s", record.RevertedBy, time.Unix(int64(record.RevertedAt), 0).UTC().Format(time.RFC3339))
+			}
+			itemCount := 0
+			var items []json.RawMessage
+			if json.Unmarshal([]byte(record.ContractABI), &items) == nil {
+				itemCount = len(items)
+			}
+			fmt.Printf("%d\tblocks [%d, %d]\t%d items\tset by %s at %s\t%s\n", record.ID, record.FromBlock, record.ToBlock, itemCount,
+				record.SetBy, time.Unix(int64(record.SetAt), 0).UTC().Format(time.RFC3339), status)
+		}
+
+	default:
+		return errors.New("Unknown override command: " + args[0])
+	}
+	return nil
+}
+
+// @dev -1 => nil: no limit
+func optionalBlock(block int64) *big.Int {
+	if block < 0 {
+		return nil
+	}
+	return big.NewInt(block)
+}
+
+// @dev The login name of the current user
+func currentUser() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"code/src/fetch"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// @dev prefetch -chain <chainID> [-file <stream.jsonl>|-] [-subscribe] [-flush-every 1m]
+// Notice: the stream is JSON values: the transactions, logs, receipts and blocks of the JSON-RPC API, or the addresses.
+// With -subscribe the new blocks of RPC_URL(a websocket endpoint) are read until SIGINT/SIGTERM
+func runPrefetch(args []string) error {
+	flags := flag.NewFlagSet("prefetch", flag.ExitOnError)
+	chainID := flags.Int("chain", 1, "the chainID")
+	file := flags.String("file", "-", "the stream of transactions or logs, -: stdin")
+	subscribe := flags.Bool("subscribe", false, "read the new blocks of the node instead of a stream")
+	flushEvery := flags.Duration("flush-every", time.Minute, "-subscribe: how often to queue the addresses seen")
+	_ = flags.Parse(args)
+
+	if *subscribe {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		fmt.Println("Prefetch the addresses of the new blocks of chain", *chainID)
+		return fetch.Default().PrefetchFromNode(ctx, *chainID, *flushEvery)
+	}
+
+	var stream io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return errors.Wrap(err, "Fail to open the stream")
+		}
+		defer f.Close()
+		stream = f
+	}
+	counts := fetch.AddressCounts{}
+	items, err := fetch.CountAddresses(stream, counts)
+	if err != nil {
+		return err
+	}
+	result, err := fetch.Default().Prefetch(*chainID, counts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Read %d items: %d addresses, %d known, %d queued\n", items, result.Seen, result.Known, result.Queued)
+	return nil
+}
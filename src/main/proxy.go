@@ -0,0 +1,85 @@
+package main
+
+import (
+	"code/src/fetch"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+)
+
+// @dev proxy watch|unwatch|list|upgrades|poll -chain <chainID> -address <proxyAddress>
+// Notice: serve polls the upgrades in the background, poll runs one round, E.g. from a cron job
+func runProxy(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: proxy watch|unwatch|list|upgrades|poll -chain <chainID> -address <proxyAddress>")
+	}
+
+	flags := flag.NewFlagSet("proxy "+args[0], flag.ExitOnError)
+	chainID := flags.Int("chain", 1, "the chainID, list: 0 lists every chain")
+	address := flags.String("address", "", "the proxy address")
+	_ = flags.Parse(args[1:])
+
+	var proxyAddress common.Address
+	switch args[0] {
+	case "watch", "unwatch", "upgrades":
+		if !common.IsHexAddress(*address) {
+			return errors.New("Invalid proxy address: " + *address)
+		}
+		proxyAddress = common.HexToAddress(*address)
+	}
+
+	switch args[0] {
+	case "watch":
+		proxy, err := fetch.WatchProxy(context.Background(), *chainID, proxyAddress)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Watch", proxyAddress.Hex(), "on chain", *chainID, "from block", proxy.LastBlock, "implementation", common.BytesToAddress(proxy.Implementation).Hex())
+
+	case "unwatch":
+		isWatched, err := fetch.UnwatchProxy(*chainID, proxyAddress)
+		if err != nil {
+			return err
+		}
+		if !isWatched {
+			fmt.Println("Not watched:", proxyAddress.Hex(), "on chain", *chainID)
+			return nil
+		}
+		fmt.Println("Unwatched", proxyAddress.Hex(), "on chain", *chainID)
+
+	case "list":
+		proxies, err := fetch.WatchedProxies(*chainID)
+		if err != nil {
+			return err
+		}
+		for _, proxy := range proxies {
+			status := "waiting for the ABI"
+			if proxy.IsBound {
+				status = "bound"
+			}
+			fmt.Printf("%d\t%s\timplementation %s since block %d\t%s\tread up to block %d\n", proxy.ChainID, common.BytesToAddress(proxy.ProxyAddress).Hex(),
+				common.BytesToAddress(proxy.Implementation).Hex(), proxy.ImplementationBlock, status, proxy.LastBlock)
+		}
+
+	case "upgrades":
+		upgrades, err := fetch.ProxyUpgrades(*chainID, proxyAddress)
+		if err != nil {
+			return err
+		}
+		for _, upgrade := range upgrades {
+			fmt.Printf("block %d\tlog %d\t%s\t%s\n", upgrade.BlockNumber, upgrade.LogIndex, upgrade.Event, common.BytesToAddress(upgrade.Address).Hex())
+		}
+
+	case "poll":
+		if err := fetch.Default().PollUpgrades(context.Background()); err != nil {
+			return err
+		}
+		fmt.Println("Polled the upgrades")
+
+	default:
+		return errors.New("Unknown proxy command: " + args[0])
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"code/src/fetch"
+	"flag"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// @dev queue list|boost|reschedule -chain <chainID> [-address <contractAddress>] [-priority 100] [-limit 20] [-status unverified]
+// Notice: the robot searches the queued addresses by priority, then the oldest first. The lookups of the API and `get` boost them.
+// reschedule: search the addresses without ABI again in the next run of the robot, the given up ones too
+func runQueue(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: queue list|boost|reschedule -chain <chainID> [-address <contractAddress>] [-priority 100] [-limit 20] [-status unverified]")
+	}
+
+	flags := flag.NewFlagSet("queue "+args[0], flag.ExitOnError)
+	chainID := flags.Int("chain", 0, "the chainID, 0: every chain")
+	address := flags.String("address", "", "boost: the queued address, reschedule: the address, empty: all")
+	priority := flags.Int("priority", fetch.PriorityInteractive, "boost: the priority")
+	limit := flags.Int("limit", 20, "list: the number of addresses, 0: all")
+	status := flags.String("status", "", "reschedule: eoa, self-destructed, unverified, rate-limited or explorer-error, empty: all")
+	_ = flags.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		queued, err := fetch.QueuedAddresses(*chainID, *limit)
+		if err != nil {
+			return err
+		}
+		for _, item := range queued {
+			lastRequested := "never requested"
+			if item.LastRequestedAt > 0 {
+				lastRequested = "last requested " + time.Unix(int64(item.LastRequestedAt), 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%d\t%s\tpriority %d\t%d requests\t%s\t%s\n", item.ChainID, common.BytesToAddress(item.ContractAddress).Hex(),
+				item.Priority, item.Requests, lastRequested, item.Tags)
+		}
+
+	case "boost":
+		if *chainID == 0 {
+			return errors.New("boost needs -chain")
+		}
+		if !common.IsHexAddress(*address) {
+			return errors.New("Invalid contract address: " + *address)
+		}
+		contractAddress := common.HexToAddress(*address)
+		isQueued, err := fetch.BoostAddress(*chainID, contractAddress, *priority)
+		if err != nil {
+			return err
+		}
+		if !isQueued {
+			fmt.Println("Not queued:", contractAddress.Hex(), "on chain", *chainID)
+			return nil
+		}
+		fmt.Println("Boosted", contractAddress.Hex(), "on chain", *chainID, "to priority", *priority)
+
+	case "reschedule":
+		var contractAddress common.Address
+		if *address != "" {
+			if !common.IsHexAddress(*address) {
+				return errors.New("Invalid contract address: " + *address)
+			}
+			contractAddress = common.HexToAddress(*address)
+		}
+		rescheduled, err := fetch.Reschedule(*chainID, contractAddress, *status)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Rescheduled", rescheduled, "addresses, the robot searches them in its next run")
+
+	default:
+		return errors.New("Unknown queue command: " + args[0])
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"code/src/fetch"
+	"code/src/server"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// @dev serve -addr :8080 [-snapshot cache.snapshot.json] [-snapshot-every 5m] [-prewarm 1000] [-watch-every 1m]
+// Notice: the admin endpoints require the bearer token in the ADMIN_TOKEN env, they are not served without it
+// Notice: the cache is prewarmed in the background, and snapshotted on a timer and on SIGINT/SIGTERM
+// Notice: with REDIS_ADDR the replicas share the second tier, and drop the ABIs invalidated by each other
+// Notice: the upgrades of the watched proxies are polled in the background, see `proxy watch`
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "the listen address")
+	snapshot := flags.String("snapshot", "cache.snapshot.json", "the snapshot of the cache, empty: no snapshot")
+	snapshotEvery := flags.Duration("snapshot-every", 5*time.Minute, "how often to save the snapshot")
+	prewarm := flags.Int("prewarm", 1000, "the max number of ABIs to load at start, 0: no prewarm")
+	watchEvery := flags.Duration("watch-every", time.Minute, "how often to poll the upgrades of the watched proxies, 0: never")
+	_ = flags.Parse(args)
+
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		fmt.Fprintln(os.Stderr, "Warning: ADMIN_TOKEN is not set, the admin API is disabled")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fetcher := fetch.Default()
+	go fetcher.RunInvalidations(ctx)
+	if *watchEvery > 0 {
+		go fetcher.RunUpgradeWatcher(ctx, *watchEvery)
+	}
+	if *prewarm > 0 {
+		go func() {
+			if _, err := fetcher.Prewarm(ctx, *snapshot, *prewarm); err != nil {
+				fmt.Fprintln(os.Stderr, "Warning: fail to prewarm the cache:", err)
+			}
+		}()
+	}
+	snapshotted := make(chan struct{})
+	if *snapshot != "" && *snapshotEvery > 0 {
+		go func() {
+			fetcher.RunSnapshots(ctx, *snapshot, *snapshotEvery)
+			close(snapshotted)
+		}()
+	} else {
+		close(snapshotted)
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: server.NewFetcherHandler(fetcher, adminToken)}
+	served := make(chan error, 1)
+	go func() {
+		fmt.Println("Listen on", *addr)
+		served <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		stop()
+		<-snapshotted
+		return err
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	<-snapshotted // the last snapshot
+	return err
+}
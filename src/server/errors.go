@@ -0,0 +1,47 @@
+package server
+
+import (
+	"code/src/fetch"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// statusCodes
+// @dev The kind of the fetch error => HTTP status code
+var statusCodes = []struct {
+	kind   error
+	status int
+}{
+	{fetch.ErrQueued, http.StatusAccepted},                     // try later
+	{fetch.ErrNotCached, http.StatusNotFound},                  // policy=cache
+	{fetch.ErrUnknownSelector, http.StatusNotFound},            // the contract is known, the function is not
+	{fetch.ErrNoCode, http.StatusNotFound},                     // EOA
+	{fetch.ErrSelfDestructed, http.StatusNotFound},             // self-destructed and not verified
+	{fetch.ErrNotVerified, http.StatusNotFound},                // not verified
+	{fetch.ErrUnsupportedChain, http.StatusBadRequest},         // bad chainID
+	{fetch.ErrUpstreamRateLimited, http.StatusTooManyRequests}, // the explorer is rate limited
+	{fetch.ErrExplorer, http.StatusBadGateway},                 // the explorer returns an error
+	{fetch.ErrNode, http.StatusBadGateway},                     // the node returns an error
+	{fetch.ErrCorruptABI, http.StatusInternalServerError},      // the stored ABI is broken
+	{fetch.ErrStorage, http.StatusServiceUnavailable},          // DB is broken
+	{fetch.ErrUnknownVersion, http.StatusNotFound},             // not in the ABI history
+	{fetch.ErrNotProxy, http.StatusBadRequest},                 // no EIP-1967 slot set
+	{fetch.ErrDeadLettered, http.StatusBadGateway},             // the searches keep failing
+}
+
+// @dev Write the fetch error with its status code and the Retry-After header
+func writeFetchError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	for _, item := range statusCodes {
+		if errors.Is(err, item.kind) {
+			status = item.status
+			break
+		}
+	}
+	if retryAfter, ok := fetch.RetryAfter(err); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	writeError(w, status, err)
+}
@@ -0,0 +1,437 @@
+package server
+
+import (
+	"code/src/fetch"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// overrideRequest
+// @dev The body of PUT /admin/overrides/{chainID}/{contractAddress}
+type overrideRequest struct {
+	ABI       json.RawMessage `json:"abi"`       // the whole ABI of the contract
+	FromBlock *big.Int        `json:"fromBlock"` // optional
+	ToBlock   *big.Int        `json:"toBlock"`   // optional
+}
+
+// errorResponse
+// @dev The body of a failed request
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// handler
+// @dev The REST API served by a Fetcher
+type handler struct {
+	fetcher *fetch.Fetcher
+}
+
+var log = logrus.New()
+
+// NewHandler
+// @dev The REST API of the default Fetcher, see NewFetcherHandler
+func NewHandler(adminToken string) http.Handler {
+	return NewFetcherHandler(fetch.Default(), adminToken)
+}
+
+// NewFetcherHandler
+// @dev The REST API of the fetcher
+// @param adminToken: the bearer token of the /admin/ endpoints, empty: the /admin/ endpoints are not served
+//
+//	GET    /abi/{chainID}/{contractAddress}?block=N&policy=db             the contract ABI
+//	GET    /abi/{chainID}/{contractAddress}/{selector}?block=N&policy=db  the function ABI, E.g. selector: 0xa9059cbb
+//	       policy: cache, db(default) or fetch, fetch searches the explorer inline until the client gives up
+//	       requester: the tag recorded in the queue when the ABI is not found, default: api. The address is boosted
+//	GET    /history/{chainID}/{contractAddress}       the ABI versions seen at the address, the oldest first
+//	GET    /diff/{chainID}/{contractAddress}?from=V&to=V  the changes of the ABI between two versions, default: the last upgrade
+//	GET    /diff/{chainID}/{contractAddress}?fromBlock=N&toBlock=N  the same between the versions seen at two blocks
+//	PUT    /admin/overrides/{chainID}/{contractAddress}  upload an ABI override, X-Admin-User: who sets it
+//	GET    /admin/overrides/{chainID}/{contractAddress}  list the overrides, including the reverted ones
+//	DELETE /admin/overrides/{chainID}/{contractAddress}  revert to the crawled ABI, X-Admin-User: who reverts it
+//	GET    /admin/cache                                  the hits, misses and bytes of the in-memory cache
+//	GET    /admin/queue?chain=N&limit=100                the addresses waiting for the robot, in the order it searches them
+//	GET    /admin/deadletters?chain=N&limit=100          the addresses the robot stops searching after their retry budget
+//	GET    /admin/deadletters/{chainID}/{contractAddress}?limit=20  the last crawl attempts of the address, the last first
+//	POST   /admin/deadletters/{chainID}/{contractAddress}/requeue   search it again with a new retry budget
+//	DELETE /admin/deadletters/{chainID}/{contractAddress}  remove it from the queue with its crawl attempts
+func NewFetcherHandler(fetcher *fetch.Fetcher, adminToken string) http.Handler {
+	h := &handler{fetcher: fetcher}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/abi/", h.handleABI)
+	mux.HandleFunc("/history/", h.handleHistory)
+	mux.HandleFunc("/diff/", h.handleDiff)
+	if adminToken == "" { // fail closed: nobody may write the overrides or the queue
+		return mux
+	}
+	mux.HandleFunc("/admin/overrides/", requireAdmin(adminToken, h.handleOverrides))
+	mux.HandleFunc("/admin/cache", requireAdmin(adminToken, h.handleCacheStats))
+	mux.HandleFunc("/admin/queue", requireAdmin(adminToken, h.handleQueue))
+	mux.HandleFunc("/admin/deadletters", requireAdmin(adminToken, h.handleDeadLetters))
+	mux.HandleFunc("/admin/deadletters/", requireAdmin(adminToken, h.handleDeadLetter))
+	return mux
+}
+
+// @dev Check the bearer token of the admin endpoints, "Authorization: Bearer <token>", an empty token never matches
+func requireAdmin(adminToken string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if adminToken == "" || token == authorization || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("Invalid admin token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// @dev /abi/{chainID}/{contractAddress}[/{selector}]?block=N&policy=db
+func (h *handler) handleABI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/abi/"), "/")
+	var selector string
+	if parts := strings.Split(path, "/"); len(parts) == 3 {
+		path, selector = parts[0]+"/"+parts[1], parts[2]
+	}
+	chainID, contractAddress, err := parseTarget(path)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var block *big.Int
+	if value := r.URL.Query().Get("block"); value != "" {
+		var ok bool
+		if block, ok = new(big.Int).SetString(value, 10); !ok {
+			writeError(w, http.StatusBadRequest, errors.New("Invalid block: "+value))
+			return
+		}
+	}
+
+	policy, err := fetch.ParsePolicy(r.URL.Query().Get("policy"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// someone is waiting for the answer
+	requester := fetch.Requester{Tag: r.URL.Query().Get("requester"), Interactive: true}
+	if requester.Tag == "" {
+		requester.Tag = "api"
+	}
+	ctx := fetch.WithRequester(r.Context(), requester)
+
+	var data []byte
+	if selector == "" {
+		contractABI, fetchErr := h.fetcher.GetContractABIAtBlockContext(ctx, chainID, contractAddress, block, policy)
+		if fetchErr != nil {
+			writeFetchError(w, fetchErr)
+			return
+		}
+		data, err = fetch.MarshalABI(contractABI)
+	} else {
+		sig, decodeErr := hexutil.Decode(selector)
+		if decodeErr != nil || len(sig) != 4 {
+			writeError(w, http.StatusBadRequest, errors.New("Invalid selector: "+selector))
+			return
+		}
+		var sig4bytes [4]byte
+		copy(sig4bytes[:], sig)
+		functionABI, fetchErr := h.fetcher.GetFunctionABIAtBlockContext(ctx, chainID, contractAddress, sig4bytes, block, policy)
+		if fetchErr != nil {
+			writeFetchError(w, fetchErr)
+			return
+		}
+		data, err = fetch.MarshalMethod(functionABI)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, json.RawMessage(data))
+}
+
+// @dev /history/{chainID}/{contractAddress}
+func (h *handler) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+	chainID, contractAddress, err := parseTarget(strings.TrimPrefix(r.URL.Path, "/history/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	versions, err := h.fetcher.ABIHistory(chainID, contractAddress)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// @dev /diff/{chainID}/{contractAddress}?from=V&to=V or ?fromBlock=N&toBlock=N
+func (h *handler) handleDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+	chainID, contractAddress, err := parseTarget(strings.TrimPrefix(r.URL.Path, "/diff/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	query := r.URL.Query()
+	var diff *fetch.ABIDiff
+	if query.Get("fromBlock") != "" || query.Get("toBlock") != "" {
+		var blocks [2]*big.Int
+		for i, name := range []string{"fromBlock", "toBlock"} {
+			if value := query.Get(name); value != "" {
+				var ok bool
+				if blocks[i], ok = new(big.Int).SetString(value, 10); !ok {
+					writeError(w, http.StatusBadRequest, errors.New("Invalid "+name+": "+value))
+					return
+				}
+			}
+		}
+		diff, err = h.fetcher.DiffABIAtBlocks(chainID, contractAddress, blocks[0], blocks[1])
+	} else {
+		var versions [2]int
+		for i, name := range []string{"from", "to"} {
+			if value := query.Get(name); value != "" {
+				if versions[i], err = strconv.Atoi(value); err != nil {
+					writeError(w, http.StatusBadRequest, errors.New("Invalid "+name+": "+value))
+					return
+				}
+			}
+		}
+		diff, err = h.fetcher.DiffABIVersions(chainID, contractAddress, versions[0], versions[1])
+	}
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, diff)
+}
+
+// @dev /admin/overrides/{chainID}/{contractAddress}
+func (h *handler) handleOverrides(w http.ResponseWriter, r *http.Request) {
+	chainID, contractAddress, err := parseTarget(strings.TrimPrefix(r.URL.Path, "/admin/overrides/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		records, err := h.fetcher.ListABIOverrides(chainID, contractAddress)
+		if err != nil {
+			writeFetchError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, records)
+
+	case http.MethodPut, http.MethodPost:
+		setBy := r.Header.Get("X-Admin-User")
+		if setBy == "" {
+			writeError(w, http.StatusBadRequest, errors.New("X-Admin-User is required"))
+			return
+		}
+		var request overrideRequest
+		body, err := io.ReadAll(io.LimitReader(r.Body, 16<<20))
+		if err == nil {
+			err = json.Unmarshal(body, &request)
+		}
+		if err != nil || len(request.ABI) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("The body should be {\"abi\": [...], \"fromBlock\": n, \"toBlock\": n}"))
+			return
+		}
+		record, err := h.fetcher.SetABIOverride(chainID, contractAddress, string(request.ABI), request.FromBlock, request.ToBlock, setBy)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, record)
+
+	case http.MethodDelete:
+		revertedBy := r.Header.Get("X-Admin-User")
+		if revertedBy == "" {
+			writeError(w, http.StatusBadRequest, errors.New("X-Admin-User is required"))
+			return
+		}
+		count, err := h.fetcher.RevertABIOverride(chainID, contractAddress, revertedBy)
+		if err != nil {
+			writeFetchError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int64{"reverted": count})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+	}
+}
+
+// @dev /admin/cache
+func (h *handler) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+	stats, ok := h.fetcher.CacheStats()
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("The cache does not report its usage"))
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// @dev /admin/queue?chain=N&limit=100
+func (h *handler) handleQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+	chainID, limit, err := parseListParams(r, 100)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	queued, err := h.fetcher.QueuedAddresses(chainID, limit)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, queued)
+}
+
+// @dev /admin/deadletters?chain=N&limit=100
+func (h *handler) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+	chainID, limit, err := parseListParams(r, 100)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	deadLetters, err := h.fetcher.DeadLetters(chainID, limit)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, deadLetters)
+}
+
+// @dev /admin/deadletters/{chainID}/{contractAddress}[/requeue]
+func (h *handler) handleDeadLetter(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/deadletters/"), "/")
+	isRequeue := strings.HasSuffix(path, "/requeue")
+	chainID, contractAddress, err := parseTarget(strings.TrimSuffix(path, "/requeue"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && !isRequeue:
+		_, limit, err := parseListParams(r, 20)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		attempts, err := h.fetcher.CrawlAttempts(chainID, contractAddress, limit)
+		if err != nil {
+			writeFetchError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, attempts)
+
+	case r.Method == http.MethodPost && isRequeue:
+		isRequeued, err := h.fetcher.RequeueDeadLetter(chainID, contractAddress)
+		if err != nil {
+			writeFetchError(w, err)
+			return
+		}
+		if !isRequeued {
+			writeError(w, http.StatusNotFound, errors.New("The address is not dead-lettered"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"requeued": true})
+
+	case r.Method == http.MethodDelete && !isRequeue:
+		isDiscarded, err := h.fetcher.DiscardDeadLetter(chainID, contractAddress)
+		if err != nil {
+			writeFetchError(w, err)
+			return
+		}
+		if !isDiscarded {
+			writeError(w, http.StatusNotFound, errors.New("The address is not dead-lettered"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"discarded": true})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+	}
+}
+
+// @dev ?chain=N&limit=N => chainID(0: every chain), limit(default if not set)
+func parseListParams(r *http.Request, defaultLimit int) (int, int, error) {
+	params := [2]int{0, defaultLimit}
+	for i, name := range []string{"chain", "limit"} {
+		if value := r.URL.Query().Get(name); value != "" {
+			var err error
+			if params[i], err = strconv.Atoi(value); err != nil {
+				return 0, 0, errors.New("Invalid " + name + ": " + value)
+			}
+		}
+	}
+	if params[1] == 0 {
+		params[1] = defaultLimit
+	}
+	return params[0], params[1], nil
+}
+
+// @dev "{chainID}/{contractAddress}" => chainID, contractAddress
+func parseTarget(path string) (int, common.Address, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 2 {
+		return 0, common.Address{}, errors.New("The path should be /{chainID}/{contractAddress}")
+	}
+	chainID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, common.Address{}, errors.New("Invalid chainID: " + parts[0])
+	}
+	if !common.IsHexAddress(parts[1]) {
+		return 0, common.Address{}, errors.New("Invalid contractAddress: " + parts[1])
+	}
+	return chainID, common.HexToAddress(parts[1]), nil
+}
+
+// @dev Write the response as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("Fail to write the response. Err:", err)
+	}
+}
+
+// @dev Write the error message as JSON
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	myDB "code/src/db"
+	"code/src/fetch"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var overrideABI = `[{"inputs":[],"name":"implementation","outputs":[{"name":"","type":"address"}],"stateMutability":"view","type":"function"}]`
+
+// @dev Send a request to the handler
+func request(handler http.Handler, method string, path string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// @dev The handler of a Fetcher on a temporary database, and the database
+func newTestHandler(t *testing.T, adminToken string) (http.Handler, *gorm.DB) {
+	db := myDB.OpenDatabase(filepath.Join(t.TempDir(), "ABIs.db"))
+	fetcher, err := fetch.NewFetcher(fetch.WithDB(db), fetch.WithSources(fetch.NewEtherscanSource("")))
+	assert.NoError(t, err)
+	return NewFetcherHandler(fetcher, adminToken), db
+}
+
+func TestOverrideAPI(t *testing.T) {
+	handler, _ := newTestHandler(t, "secret")
+	id := uuid.New()
+	address := common.BytesToAddress(id[:])
+	path := "/admin/overrides/1/" + address.Hex()
+	admin := map[string]string{"Authorization": "Bearer secret", "X-Admin-User": "alice"}
+
+	// without the token
+	response := request(handler, http.MethodPut, path, `{"abi":`+overrideABI+`}`, nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	// the token without the Bearer scheme
+	response = request(handler, http.MethodPut, path, `{"abi":`+overrideABI+`}`, map[string]string{"Authorization": "secret"})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// invalid path and body
+	response = request(handler, http.MethodGet, "/admin/overrides/1/0x1234", "", admin)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = request(handler, http.MethodPut, path, `{"abi":"not an ABI"}`, admin)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = request(handler, http.MethodPut, path, `{"abi":`+overrideABI+`,"fromBlock":100}`, admin)
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	response = request(handler, http.MethodGet, path, "", admin)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var records []myDB.ABIOverride
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &records))
+	assert.Len(t, records, 1)
+	assert.Equal(t, "alice", records[0].SetBy)
+	assert.Equal(t, int64(100), records[0].FromBlock)
+
+	response = request(handler, http.MethodDelete, path, "", admin)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"reverted":1}`, response.Body.String())
+}
+
+func TestLookupAPI(t *testing.T) {
+	handler, _ := newTestHandler(t, "secret")
+	admin := map[string]string{"Authorization": "Bearer secret", "X-Admin-User": "alice"}
+	id := uuid.New()
+	address := common.BytesToAddress(id[:])
+
+	// unknown address: queued for the robot
+	response := request(handler, http.MethodGet, "/abi/1/"+address.Hex(), "", nil)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Equal(t, "30", response.Header().Get("Retry-After"))
+	// the lookups of the API are boosted, with the tag of the requester
+	response = request(handler, http.MethodGet, "/abi/1/"+address.Hex()+"?requester=dashboard", "", nil)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	response = request(handler, http.MethodGet, "/admin/queue?chain=1", "", admin)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var queued []myDB.SearchEtherscan
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &queued))
+	isFound := false
+	for _, item := range queued {
+		if common.BytesToAddress(item.ContractAddress) == address {
+			isFound = true
+			assert.Equal(t, int64(2), item.Requests)
+			assert.Equal(t, "api,dashboard", item.Tags)
+			assert.GreaterOrEqual(t, item.Priority, 100)
+		}
+	}
+	assert.True(t, isFound)
+	response = request(handler, http.MethodGet, "/admin/queue?limit=many", "", admin)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = request(handler, http.MethodGet, "/abi/5/"+address.Hex(), "", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = request(handler, http.MethodGet, "/abi/1/"+address.Hex()+"/0x1234", "", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = request(handler, http.MethodGet, "/abi/1/"+address.Hex()+"?block=latest", "", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = request(handler, http.MethodGet, "/abi/1/"+address.Hex()+"?policy=never", "", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = request(handler, http.MethodGet, "/abi/1/"+address.Hex()+"?policy=cache", "", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	// overridden: found
+	response = request(handler, http.MethodPut, "/admin/overrides/1/"+address.Hex(), `{"abi":`+overrideABI+`}`, admin)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	response = request(handler, http.MethodGet, "/abi/1/"+address.Hex(), "", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, overrideABI, response.Body.String())
+	response = request(handler, http.MethodGet, "/abi/1/"+address.Hex()+"/0x5c60da1b", "", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+}
+
+func TestCacheStatsAPI(t *testing.T) {
+	// no admin token: the admin endpoints are not served
+	handler, _ := newTestHandler(t, "")
+	response := request(handler, http.MethodGet, "/admin/cache", "", map[string]string{"Authorization": "Bearer "})
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	handler, _ = newTestHandler(t, "secret")
+	response = request(handler, http.MethodGet, "/admin/cache", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	response = request(handler, http.MethodGet, "/admin/cache", "", map[string]string{"Authorization": "Bearer secret"})
+	assert.Equal(t, http.StatusOK, response.Code)
+	var stats map[string]int64
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &stats))
+	assert.Equal(t, int64(1000), stats["capacity"])
+	assert.Equal(t, int64(64<<20), stats["maxBytes"])
+	assert.Contains(t, stats, "bytes")
+	assert.Contains(t, stats, "hits")
+}
+
+func TestHistoryAPI(t *testing.T) {
+	handler, db := newTestHandler(t, "")
+	id := uuid.New()
+	address := common.BytesToAddress(id[:])
+
+	// two versions, the implementation function added by the second one
+	for i, contractABI := range []string{"[]", overrideABI} {
+		entries, err := myDB.NewABIEntries(contractABI)
+		assert.NoError(t, err)
+		bytecodeID := myDB.NewContractBytecodeID(id[:], contractABI)
+		assert.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&myDB.ContractBytecode{ID: bytecodeID, ContractABI: contractABI}).Error; err != nil {
+				return err
+			}
+			if err := myDB.StoreABIEntries(tx, bytecodeID, entries); err != nil {
+				return err
+			}
+			return tx.Create(&myDB.ABIVersion{ChainID: 1, ContractAddress: address.Bytes(), Version: i + 1, ContractBytecodeID: bytecodeID, BlockNumber: int64(100 * i)}).Error
+		}))
+	}
+
+	response := request(handler, http.MethodGet, "/history/1/"+address.Hex(), "", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var versions []myDB.ABIVersion
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &versions))
+	assert.Len(t, versions, 2)
+
+	expected := `{"chainId":1,"address":"` + address.Hex() + `","from":1,"to":2,"changes":[{"kind":"function","change":"added","signature":"implementation()"}]}`
+	response = request(handler, http.MethodGet, "/diff/1/"+address.Hex(), "", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, expected, response.Body.String())
+	response = request(handler, http.MethodGet, "/diff/1/"+address.Hex()+"?fromBlock=50&toBlock=100", "", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, expected, response.Body.String())
+
+	response = request(handler, http.MethodGet, "/diff/1/"+address.Hex()+"?from=1&to=3", "", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = request(handler, http.MethodGet, "/diff/1/"+address.Hex()+"?from=first", "", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = request(handler, http.MethodGet, "/diff/1/"+address.Hex()+"?toBlock=latest", "", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+func TestDeadLetterAPI(t *testing.T) {
+	handler, db := newTestHandler(t, "secret")
+	admin := map[string]string{"Authorization": "Bearer secret"}
+	id := uuid.New()
+	address := common.BytesToAddress(id[:])
+	assert.NoError(t, db.Create(&myDB.SearchEtherscan{ChainID: 1, ContractAddress: address.Bytes(), Time: 1700000000, Failures: 8,
+		LastError: "connection refused", DeadLetteredAt: 1700000100}).Error)
+	assert.NoError(t, db.Create(&myDB.CrawlAttempt{ChainID: 1, ContractAddress: address.Bytes(), AttemptedAt: 1700000100,
+		Outcome: "failed", ErrorClass: "node", Message: "connection refused", DurationMs: 12}).Error)
+
+	response := request(handler, http.MethodGet, "/admin/deadletters?chain=1", "", admin)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var deadLetters []myDB.SearchEtherscan
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &deadLetters))
+	isFound := false
+	for _, item := range deadLetters {
+		isFound = isFound || common.BytesToAddress(item.ContractAddress) == address
+	}
+	assert.True(t, isFound)
+	response = request(handler, http.MethodGet, "/admin/deadletters?chain=one", "", admin)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = request(handler, http.MethodGet, "/admin/deadletters/1/"+address.Hex(), "", admin)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var attempts []myDB.CrawlAttempt
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &attempts))
+	if assert.Len(t, attempts, 1) {
+		assert.Equal(t, "node", attempts[0].ErrorClass)
+	}
+
+	// a lookup of the dead-lettered address
+	response = request(handler, http.MethodGet, "/abi/1/"+address.Hex(), "", nil)
+	assert.Equal(t, http.StatusBadGateway, response.Code)
+
+	response = request(handler, http.MethodPost, "/admin/deadletters/1/"+address.Hex()+"/requeue", "", admin)
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = request(handler, http.MethodPost, "/admin/deadletters/1/"+address.Hex()+"/requeue", "", admin)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = request(handler, http.MethodDelete, "/admin/deadletters/1/"+address.Hex(), "", admin)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	assert.NoError(t, db.Model(&myDB.SearchEtherscan{}).Where("contract_address = ?", address.Bytes()).Update("dead_lettered_at", 1700000200).Error)
+	response = request(handler, http.MethodDelete, "/admin/deadletters/1/"+address.Hex(), "", admin)
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = request(handler, http.MethodPut, "/admin/deadletters/1/"+address.Hex(), "", admin)
+	assert.Equal(t, http.StatusMethodNotAllowed, response.Code)
+}